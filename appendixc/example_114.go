@@ -35,37 +35,382 @@ func WithRetry(operation func() error, config RetryConfig) error {
         config.MaxAttempts, err)
 }
 
-// Circuit breaker
-type CircuitBreaker struct {
-    name     string
-    timeout  time.Duration
-    maxFails int
-    failures int
-    lastFail time.Time
-    mu       sync.RWMutex
+// State represents the state of the circuit breaker
+type State int
+
+const (
+    StateClosed   State = iota // Calls are allowed and recorded in the window
+    StateOpen                  // Calls are rejected until OpenTimeout has passed
+    StateHalfOpen              // A limited number of probe calls are allowed
+)
+
+func (s State) String() string {
+    switch s {
+    case StateClosed:
+        return "closed"
+    case StateOpen:
+        return "open"
+    case StateHalfOpen:
+        return "half-open"
+    default:
+        return fmt.Sprintf("State(%d)", int(s))
+    }
+}
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// WindowType selects how the breaker remembers recent calls
+type WindowType int
+
+const (
+    // CountWindow keeps the outcomes of the last WindowSize calls
+    CountWindow WindowType = iota
+    // TimeWindow keeps the outcomes of the calls of the last WindowDuration
+    TimeWindow
+)
+
+// BreakerConfig configures a CircuitBreaker. Rates are fractions between 0
+// and 1; a zero SlowCallDuration or SlowCallRateThreshold disables slow
+// call detection.
+type BreakerConfig[T any] struct {
+    Name           string
+    WindowType     WindowType
+    WindowSize     int
+    WindowDuration time.Duration
+    // MinimumCalls keeps a handful of failures at low traffic from
+    // tripping the breaker. It is capped at WindowSize for count windows,
+    // which never hold more calls than that.
+    MinimumCalls          int
+    FailureRateThreshold  float64
+    SlowCallDuration      time.Duration
+    SlowCallRateThreshold float64
+    // OpenTimeout is how long the breaker stays open before probing
+    OpenTimeout time.Duration
+    // HalfOpenProbes is how many calls are let through while half-open;
+    // their failure and slow call rates decide whether the breaker closes
+    HalfOpenProbes int
+    // HalfOpenMaxWait is how long the breaker waits for its probes before
+    // it opens again, so a probe that never returns cannot keep it
+    // half-open and rejecting calls forever; it defaults to OpenTimeout
+    HalfOpenMaxWait time.Duration
+    // IsFailure decides whether a call failed, such as an HTTP response
+    // with a 5xx status; by default any error is a failure
+    IsFailure func(result T, err error) bool
+    // OnStateChange is called with the breaker locked, so it must not
+    // call the breaker itself
+    OnStateChange func(name string, from, to State)
+}
+
+// CircuitBreaker stops calling an operation whose recent failure rate or
+// slow call rate crossed a threshold. It is generic over the operation's
+// result, so it wraps HTTP calls as well as plain func() error.
+type CircuitBreaker[T any] struct {
+    config BreakerConfig[T]
+
+    mu        sync.Mutex
+    state     State
+    changedAt time.Time
+    window    slidingWindow
+    // generation changes with every state change, so calls that started
+    // before it are not counted afterwards
+    generation uint64
+    probes     int
+    probeStats WindowStats
 }
 
-func (cb *CircuitBreaker) Execute(operation func() error) error {
-    if !cb.canTry() {
-        return fmt.Errorf("circuit breaker %s is open", cb.name)
+func NewCircuitBreaker[T any](config BreakerConfig[T]) *CircuitBreaker[T] {
+    if config.WindowSize <= 0 {
+        config.WindowSize = 100
     }
-    
-    err := operation()
-    cb.recordResult(err)
+    if config.WindowDuration <= 0 {
+        config.WindowDuration = time.Minute
+    }
+    if config.MinimumCalls <= 0 {
+        config.MinimumCalls = 10
+    }
+    if config.WindowType == CountWindow && config.MinimumCalls > config.WindowSize {
+        config.MinimumCalls = config.WindowSize
+    }
+    if config.FailureRateThreshold <= 0 {
+        config.FailureRateThreshold = 0.5
+    }
+    if config.OpenTimeout <= 0 {
+        config.OpenTimeout = 30 * time.Second
+    }
+    if config.HalfOpenProbes <= 0 {
+        config.HalfOpenProbes = 1
+    }
+    if config.HalfOpenMaxWait <= 0 {
+        config.HalfOpenMaxWait = config.OpenTimeout
+    }
+    if config.IsFailure == nil {
+        config.IsFailure = func(_ T, err error) bool { return err != nil }
+    }
+
+    cb := &CircuitBreaker[T]{config: config}
+    if config.WindowType == TimeWindow {
+        cb.window = newTimeWindow(config.WindowDuration)
+    } else {
+        cb.window = newCountWindow(config.WindowSize)
+    }
+    return cb
+}
+
+// Execute runs operation unless the breaker is open, and records whether
+// it failed and whether it was slow
+func (cb *CircuitBreaker[T]) Execute(operation func() (T, error)) (T, error) {
+    generation, err := cb.beforeCall()
+    if err != nil {
+        var zero T
+        return zero, err
+    }
+
+    start := time.Now()
+    completed := false
+    defer func() {
+        // A panicking operation is recorded as failed
+        if !completed {
+            cb.afterCall(generation, true, time.Since(start))
+        }
+    }()
+
+    result, err := operation()
+    completed = true
+    cb.afterCall(generation, cb.config.IsFailure(result, err), time.Since(start))
+    return result, err
+}
+
+// Run is Execute for operations without a result
+func (cb *CircuitBreaker[T]) Run(operation func() error) error {
+    _, err := cb.Execute(func() (T, error) {
+        var zero T
+        return zero, operation()
+    })
     return err
 }
 
-func (cb *CircuitBreaker) canTry() bool {
-    cb.mu.RLock()
-    defer cb.mu.RUnlock()
-    
-    if cb.failures < cb.maxFails {
-        return true
+func (cb *CircuitBreaker[T]) State() State {
+    cb.mu.Lock()
+    defer cb.mu.Unlock()
+    return cb.currentState(time.Now())
+}
+
+// Stats returns the calls currently in the window
+func (cb *CircuitBreaker[T]) Stats() WindowStats {
+    cb.mu.Lock()
+    defer cb.mu.Unlock()
+    return cb.window.stats(time.Now())
+}
+
+// currentState moves an open breaker to half-open once OpenTimeout has
+// passed, and opens a half-open breaker again when its probes are still
+// outstanding after HalfOpenMaxWait. Callers hold cb.mu.
+func (cb *CircuitBreaker[T]) currentState(now time.Time) State {
+    elapsed := now.Sub(cb.changedAt)
+    switch {
+    case cb.state == StateOpen && elapsed >= cb.config.OpenTimeout:
+        cb.setState(StateHalfOpen, now)
+    case cb.state == StateHalfOpen && elapsed >= cb.config.HalfOpenMaxWait &&
+        cb.probes > cb.probeStats.Calls:
+        cb.setState(StateOpen, now)
     }
-    
-    if time.Since(cb.lastFail) > cb.timeout {
+    return cb.state
+}
+
+func (cb *CircuitBreaker[T]) beforeCall() (uint64, error) {
+    cb.mu.Lock()
+    defer cb.mu.Unlock()
+
+    switch cb.currentState(time.Now()) {
+    case StateOpen:
+        return 0, fmt.Errorf("%s: %w", cb.config.Name, ErrCircuitOpen)
+    case StateHalfOpen:
+        if cb.probes >= cb.config.HalfOpenProbes {
+            return 0, fmt.Errorf("%s: %w", cb.config.Name, ErrCircuitOpen)
+        }
+        cb.probes++
+    }
+    return cb.generation, nil
+}
+
+func (cb *CircuitBreaker[T]) afterCall(generation uint64, failed bool, duration time.Duration) {
+    cb.mu.Lock()
+    defer cb.mu.Unlock()
+
+    if generation != cb.generation {
+        return
+    }
+    now := time.Now()
+    slow := cb.config.SlowCallDuration > 0 && duration >= cb.config.SlowCallDuration
+
+    switch cb.state {
+    case StateClosed:
+        cb.window.record(now, failed, slow)
+        if stats := cb.window.stats(now); stats.Calls >= cb.config.MinimumCalls && cb.exceeded(stats) {
+            cb.setState(StateOpen, now)
+        }
+    case StateHalfOpen:
+        cb.probeStats.add(failed, slow)
+        if cb.probeStats.Calls < cb.config.HalfOpenProbes {
+            return
+        }
+        if cb.exceeded(cb.probeStats) {
+            cb.setState(StateOpen, now)
+        } else {
+            cb.setState(StateClosed, now)
+        }
+    }
+}
+
+func (cb *CircuitBreaker[T]) exceeded(stats WindowStats) bool {
+    if stats.FailureRate() >= cb.config.FailureRateThreshold {
         return true
     }
-    
-    return false
+    return cb.config.SlowCallRateThreshold > 0 && cb.config.SlowCallDuration > 0 &&
+        stats.SlowCallRate() >= cb.config.SlowCallRateThreshold
+}
+
+// setState starts the new state with an empty window. Callers hold cb.mu.
+func (cb *CircuitBreaker[T]) setState(state State, now time.Time) {
+    from := cb.state
+    cb.state = state
+    cb.changedAt = now
+    cb.generation++
+    cb.probes = 0
+    cb.probeStats = WindowStats{}
+    cb.window.reset()
+    if cb.config.OnStateChange != nil {
+        cb.config.OnStateChange(cb.config.Name, from, state)
+    }
+}
+
+type WindowStats struct {
+    Calls     int
+    Failures  int
+    SlowCalls int
+}
+
+func (s *WindowStats) add(failed, slow bool) {
+    s.Calls++
+    if failed {
+        s.Failures++
+    }
+    if slow {
+        s.SlowCalls++
+    }
+}
+
+func (s WindowStats) FailureRate() float64 {
+    if s.Calls == 0 {
+        return 0
+    }
+    return float64(s.Failures) / float64(s.Calls)
+}
+
+func (s WindowStats) SlowCallRate() float64 {
+    if s.Calls == 0 {
+        return 0
+    }
+    return float64(s.SlowCalls) / float64(s.Calls)
+}
+
+type slidingWindow interface {
+    record(now time.Time, failed, slow bool)
+    stats(now time.Time) WindowStats
+    reset()
+}
+
+type callOutcome struct {
+    failed bool
+    slow   bool
+}
+
+// countWindow is a ring buffer of the last calls' outcomes
+type countWindow struct {
+    outcomes []callOutcome
+    next     int
+    filled   bool
+    totals   WindowStats
+}
+
+func newCountWindow(size int) *countWindow {
+    return &countWindow{outcomes: make([]callOutcome, size)}
+}
+
+func (w *countWindow) record(_ time.Time, failed, slow bool) {
+    if w.filled {
+        // Forget the outcome that drops out of the window
+        old := w.outcomes[w.next]
+        w.totals.Calls--
+        if old.failed {
+            w.totals.Failures--
+        }
+        if old.slow {
+            w.totals.SlowCalls--
+        }
+    }
+    w.outcomes[w.next] = callOutcome{failed: failed, slow: slow}
+    w.totals.add(failed, slow)
+    w.next = (w.next + 1) % len(w.outcomes)
+    if w.next == 0 {
+        w.filled = true
+    }
+}
+
+func (w *countWindow) stats(time.Time) WindowStats {
+    return w.totals
+}
+
+func (w *countWindow) reset() {
+    w.next, w.filled, w.totals = 0, false, WindowStats{}
+}
+
+// timeWindow aggregates outcomes in ten buckets spanning the window, so
+// memory stays constant at any call rate
+type timeWindow struct {
+    width   time.Duration
+    buckets []timeBucket
+}
+
+type timeBucket struct {
+    epoch int64 // start of the bucket in units of width
+    stats WindowStats
+}
+
+const timeWindowBuckets = 10
+
+func newTimeWindow(duration time.Duration) *timeWindow {
+    width := duration / timeWindowBuckets
+    if width <= 0 {
+        width = 1
+    }
+    return &timeWindow{width: width, buckets: make([]timeBucket, timeWindowBuckets)}
+}
+
+func (w *timeWindow) record(now time.Time, failed, slow bool) {
+    epoch := now.UnixNano() / int64(w.width)
+    bucket := &w.buckets[epoch%int64(len(w.buckets))]
+    if bucket.epoch != epoch {
+        *bucket = timeBucket{epoch: epoch}
+    }
+    bucket.stats.add(failed, slow)
+}
+
+func (w *timeWindow) stats(now time.Time) WindowStats {
+    epoch := now.UnixNano() / int64(w.width)
+    var total WindowStats
+    for _, bucket := range w.buckets {
+        if epoch-bucket.epoch < int64(len(w.buckets)) {
+            total.Calls += bucket.stats.Calls
+            total.Failures += bucket.stats.Failures
+            total.SlowCalls += bucket.stats.SlowCalls
+        }
+    }
+    return total
+}
+
+func (w *timeWindow) reset() {
+    for i := range w.buckets {
+        w.buckets[i] = timeBucket{}
+    }
 }
\ No newline at end of file
@@ -7,57 +7,895 @@ type RabbitMQConfig struct {
     ExchangeName      string
     QueueName         string
     RoutingKey        string
+
+    // ConfirmTimeout bounds the wait for the broker's ack or nack
+    ConfirmTimeout time.Duration
+    // BufferSize is how many messages are held while reconnecting
+    BufferSize int
+    // BufferDir keeps the buffer on disk when set, so it survives restarts
+    BufferDir string
+}
+
+var (
+    ErrPublishNacked = errors.New("message nacked by broker")
+    ErrBufferFull    = errors.New("publish buffer full")
+    // ErrDisconnected is returned once the client stopped reconnecting or
+    // was closed, so nothing it buffers would ever be sent
+    ErrDisconnected = errors.New("rabbitmq client disconnected")
+)
+
+// GaugeRecorder is implemented by metrics backends that support gauges
+type GaugeRecorder interface {
+    SetGauge(name string, value float64)
 }
 
 type RabbitMQClient struct {
+    mu      sync.RWMutex
     conn    *amqp.Connection
     channel *amqp.Channel
+    // connected is false while monitorConnection is reconnecting
+    connected bool
+    // disconnected is set for good when monitorConnection gives up
+    disconnected bool
+
     config  RabbitMQConfig
     logger  Logger
     metrics MetricsRecorder
+
+    // tracer and propagator carry W3C trace context and baggage in the
+    // message headers
+    tracer     trace.Tracer
+    propagator propagation.TextMapPropagator
+
+    buffer      PublishBuffer
+    flushMu     sync.Mutex
+    unconfirmed int64
+    done        chan struct{}
 }
 
 func NewRabbitMQClient(config RabbitMQConfig, logger Logger, metrics MetricsRecorder) (*RabbitMQClient, error) {
+    if config.ConfirmTimeout == 0 {
+        config.ConfirmTimeout = 5 * time.Second
+    }
+    if config.BufferSize == 0 {
+        config.BufferSize = 10000
+    }
+
+    var buffer PublishBuffer = NewMemoryBuffer(config.BufferSize)
+    if config.BufferDir != "" {
+        diskBuffer, err := NewDiskBuffer(config.BufferDir, config.BufferSize)
+        if err != nil {
+            return nil, fmt.Errorf("opening publish buffer: %w", err)
+        }
+        buffer = diskBuffer
+    }
+
     client := &RabbitMQClient{
         config:  config,
         logger:  logger,
         metrics: metrics,
+        tracer:  otel.Tracer("messaging/rabbitmq"),
+        propagator: propagation.NewCompositeTextMapPropagator(
+            propagation.TraceContext{},
+            propagation.Baggage{},
+        ),
+        buffer: buffer,
+        done:   make(chan struct{}),
     }
-    
+
     if err := client.connect(); err != nil {
         return nil, fmt.Errorf("connecting to RabbitMQ: %w", err)
     }
-    
+
     // Start connection monitoring
     go client.monitorConnection()
-    
+
+    // A disk buffer may hold messages from before a restart
+    go client.flushBuffer()
+
     return client, nil
 }
 
-func (c *RabbitMQClient) Publish(ctx context.Context, message []byte) error {
+// connect opens a connection and a channel in confirm mode
+func (c *RabbitMQClient) connect() error {
+    conn, err := amqp.Dial(c.config.URI)
+    if err != nil {
+        return fmt.Errorf("dialing: %w", err)
+    }
+
+    channel, err := openChannel(conn)
+    if err != nil {
+        conn.Close()
+        return err
+    }
+
+    c.mu.Lock()
+    c.conn = conn
+    c.channel = channel
+    c.connected = true
+    c.mu.Unlock()
+    return nil
+}
+
+func openChannel(conn *amqp.Connection) (*amqp.Channel, error) {
+    channel, err := conn.Channel()
+    if err != nil {
+        return nil, fmt.Errorf("opening channel: %w", err)
+    }
+    if err := channel.Confirm(false); err != nil {
+        channel.Close()
+        return nil, fmt.Errorf("enabling publisher confirms: %w", err)
+    }
+    return channel, nil
+}
+
+// monitorConnection reconnects after the connection drops and then
+// flushes the messages buffered in the meantime. The broker can also close
+// just the channel, say when a publish names a missing exchange; the
+// connection stays up then, so only the channel is reopened.
+func (c *RabbitMQClient) monitorConnection() {
+    for {
+        c.mu.RLock()
+        connClosed := c.conn.NotifyClose(make(chan *amqp.Error, 1))
+        channelClosed := c.channel.NotifyClose(make(chan *amqp.Error, 1))
+        c.mu.RUnlock()
+
+        channelOnly := false
+        select {
+        case <-c.done:
+            return
+        case err := <-channelClosed:
+            c.logger.Error("rabbitmq channel closed", "error", err)
+            channelOnly = true
+        case err := <-connClosed:
+            c.logger.Error("rabbitmq connection lost", "error", err)
+        }
+
+        c.mu.Lock()
+        c.connected = false
+        c.mu.Unlock()
+
+        if channelOnly {
+            if c.reopenChannel() {
+                c.logger.Info("reopened rabbitmq channel", "buffered", c.buffer.Len())
+                c.flushBuffer()
+                continue
+            }
+            // Don't leak the old connection when reconnecting from scratch
+            c.mu.RLock()
+            conn := c.conn
+            c.mu.RUnlock()
+            conn.Close()
+        }
+
+        if !c.reconnect() {
+            c.mu.Lock()
+            c.disconnected = true
+            c.mu.Unlock()
+            c.logger.Error("giving up reconnecting to rabbitmq",
+                "attempts", c.config.MaxReconnectTries,
+                "buffered", c.buffer.Len())
+            return
+        }
+
+        c.logger.Info("reconnected to rabbitmq", "buffered", c.buffer.Len())
+        c.flushBuffer()
+    }
+}
+
+// reopenChannel opens a new confirm mode channel on the current
+// connection. It waits ReconnectDelay first so a publish the broker keeps
+// rejecting doesn't spin through channels.
+func (c *RabbitMQClient) reopenChannel() bool {
+    select {
+    case <-c.done:
+        return false
+    case <-time.After(c.config.ReconnectDelay):
+    }
+
+    c.mu.RLock()
+    conn := c.conn
+    c.mu.RUnlock()
+    if conn.IsClosed() {
+        return false
+    }
+
+    channel, err := openChannel(conn)
+    if err != nil {
+        c.metrics.IncCounter("rabbitmq_reconnect_errors")
+        c.logger.Error("reopening rabbitmq channel", "error", err)
+        return false
+    }
+
+    c.mu.Lock()
+    c.channel = channel
+    c.connected = true
+    c.mu.Unlock()
+    return true
+}
+
+func (c *RabbitMQClient) reconnect() bool {
+    for attempt := 1; c.config.MaxReconnectTries == 0 || attempt <= c.config.MaxReconnectTries; attempt++ {
+        select {
+        case <-c.done:
+            return false
+        case <-time.After(c.config.ReconnectDelay):
+        }
+
+        if err := c.connect(); err != nil {
+            c.metrics.IncCounter("rabbitmq_reconnect_errors")
+            c.logger.Error("reconnecting to rabbitmq", "attempt", attempt, "error", err)
+            continue
+        }
+        return true
+    }
+    return false
+}
+
+// Publish returns once the broker confirmed the message, or once it is
+// buffered because the client is reconnecting. Buffered messages are sent
+// in order after the reconnect, ahead of anything published later. After
+// the client gave up reconnecting, Publish fails with ErrDisconnected.
+func (c *RabbitMQClient) Publish(ctx context.Context, message []byte) (err error) {
     start := time.Now()
+    ctx, span := c.tracer.Start(ctx, c.config.ExchangeName+" publish",
+        trace.WithSpanKind(trace.SpanKindProducer),
+        trace.WithAttributes(
+            attribute.String("messaging.system", "rabbitmq"),
+            attribute.String("messaging.destination.name", c.config.ExchangeName),
+            attribute.String("messaging.rabbitmq.destination.routing_key", c.config.RoutingKey),
+        ),
+    )
     defer func() {
+        if err != nil {
+            span.RecordError(err)
+            span.SetStatus(codes.Error, err.Error())
+        }
+        span.End()
         c.metrics.ObserveLatency("rabbitmq_publish", time.Since(start))
     }()
 
-    err := c.channel.PublishWithContext(ctx,
-        c.config.ExchangeName,
-        c.config.RoutingKey,
+    // The trace context is part of the message, so buffered messages keep
+    // the producer span they were published under
+    outgoing := BufferedMessage{Body: message, Headers: make(map[string]string)}
+    c.propagator.Inject(ctx, propagation.MapCarrier(outgoing.Headers))
+
+    // While older messages wait in the buffer, new ones queue behind them
+    if !c.isConnected() || c.buffer.Len() > 0 {
+        return c.bufferMessage(outgoing)
+    }
+
+    err = c.publishConfirmed(ctx, outgoing)
+    if errors.Is(err, amqp.ErrClosed) {
+        // The connection dropped before the broker answered; the message
+        // may arrive twice, once now and once from the buffer
+        return c.bufferMessage(outgoing)
+    }
+    if err != nil {
+        c.metrics.IncCounter("rabbitmq_publish_errors")
+        return err
+    }
+
+    c.metrics.IncCounter("rabbitmq_messages_published")
+    return nil
+}
+
+// publishConfirmed publishes and waits for the broker's ack or nack
+func (c *RabbitMQClient) publishConfirmed(ctx context.Context, message BufferedMessage) error {
+    return c.PublishConfirmed(ctx, c.config.ExchangeName, c.config.RoutingKey, amqp.Publishing{
+        Headers:      headerTable(message.Headers),
+        ContentType:  "application/json",
+        Body:         message.Body,
+        DeliveryMode: amqp.Persistent,
+        Timestamp:    time.Now(),
+    })
+}
+
+// PublishConfirmed publishes to any exchange and routing key and returns
+// once the broker acked the message. A nack is ErrPublishNacked; a channel
+// that closed before answering is amqp.ErrClosed.
+func (c *RabbitMQClient) PublishConfirmed(ctx context.Context, exchange, routingKey string, publishing amqp.Publishing) error {
+    channel := c.currentChannel()
+
+    c.trackUnconfirmed(1)
+    defer c.trackUnconfirmed(-1)
+
+    confirmation, err := channel.PublishWithDeferredConfirmWithContext(ctx,
+        exchange,
+        routingKey,
         false, // mandatory
         false, // immediate
-        amqp.Publishing{
-            ContentType:  "application/json",
-            Body:        message,
-            DeliveryMode: amqp.Persistent,
-            Timestamp:   time.Now(),
-        },
+        publishing,
     )
-    
     if err != nil {
-        c.metrics.IncCounter("rabbitmq_publish_errors")
         return fmt.Errorf("publishing message: %w", err)
     }
-    
-    c.metrics.IncCounter("rabbitmq_messages_published")
+
+    confirmCtx, cancel := context.WithTimeout(ctx, c.config.ConfirmTimeout)
+    defer cancel()
+
+    acked, err := confirmation.WaitContext(confirmCtx)
+    if err != nil {
+        return fmt.Errorf("waiting for publisher confirm: %w", err)
+    }
+    if !acked {
+        // A closing channel resolves pending confirms as nacks
+        if channel.IsClosed() {
+            return fmt.Errorf("publishing message: %w", amqp.ErrClosed)
+        }
+        c.metrics.IncCounter("rabbitmq_messages_nacked")
+        return ErrPublishNacked
+    }
+    return nil
+}
+
+func (c *RabbitMQClient) bufferMessage(message BufferedMessage) error {
+    if c.isDisconnected() {
+        c.metrics.IncCounter("rabbitmq_publish_errors")
+        return ErrDisconnected
+    }
+    if err := c.buffer.Push(message); err != nil {
+        c.metrics.IncCounter("rabbitmq_publish_errors")
+        return fmt.Errorf("buffering message: %w", err)
+    }
+    c.metrics.IncCounter("rabbitmq_messages_buffered")
+    c.setGauge("rabbitmq_buffered_messages", float64(c.buffer.Len()))
+
+    // The connection may have come back between the check and the push
+    if c.isConnected() {
+        go c.flushBuffer()
+    }
+    return nil
+}
+
+// flushBuffer publishes buffered messages oldest first and stops at the
+// first failure, leaving the rest for the next reconnect
+func (c *RabbitMQClient) flushBuffer() {
+    c.flushMu.Lock()
+    defer c.flushMu.Unlock()
+
+    for c.isConnected() {
+        message, ok, err := c.buffer.Peek()
+        if err != nil {
+            c.logger.Error("reading publish buffer", "error", err)
+            return
+        }
+        if !ok {
+            return
+        }
+
+        ctx, cancel := context.WithTimeout(context.Background(), c.config.ConfirmTimeout)
+        err = c.publishConfirmed(ctx, message)
+        cancel()
+        if errors.Is(err, ErrPublishNacked) {
+            // Retrying won't help and would block everything behind it
+            c.logger.Error("dropping buffered message nacked by broker")
+        } else if err != nil {
+            c.logger.Error("flushing publish buffer", "error", err, "buffered", c.buffer.Len())
+            return
+        } else {
+            c.metrics.IncCounter("rabbitmq_messages_published")
+        }
+
+        if err := c.buffer.Pop(); err != nil {
+            c.logger.Error("removing message from publish buffer", "error", err)
+            return
+        }
+        c.setGauge("rabbitmq_buffered_messages", float64(c.buffer.Len()))
+    }
+}
+
+// StartConsumerSpan restores the trace context and baggage a publisher put
+// in a delivery's headers and starts a consumer span for handling it. The
+// span continues the producer's trace and links to the producer span.
+// Callers end the span once the delivery is acked or rejected.
+func (c *RabbitMQClient) StartConsumerSpan(ctx context.Context, delivery amqp.Delivery) (context.Context, trace.Span) {
+    ctx = c.propagator.Extract(ctx, amqpHeaderCarrier(delivery.Headers))
+
+    opts := []trace.SpanStartOption{
+        trace.WithSpanKind(trace.SpanKindConsumer),
+        trace.WithAttributes(
+            attribute.String("messaging.system", "rabbitmq"),
+            attribute.String("messaging.destination.name", delivery.Exchange),
+            attribute.String("messaging.rabbitmq.destination.routing_key", delivery.RoutingKey),
+            attribute.String("messaging.message.id", delivery.MessageId),
+        ),
+    }
+    if producer := trace.SpanContextFromContext(ctx); producer.IsValid() {
+        opts = append(opts, trace.WithLinks(trace.Link{SpanContext: producer}))
+    }
+    return c.tracer.Start(ctx, delivery.RoutingKey+" process", opts...)
+}
+
+// amqpHeaderCarrier lets the propagators read AMQP headers
+type amqpHeaderCarrier amqp.Table
+
+func (c amqpHeaderCarrier) Get(key string) string {
+    value, _ := c[key].(string)
+    return value
+}
+
+func (c amqpHeaderCarrier) Set(key, value string) {
+    c[key] = value
+}
+
+func (c amqpHeaderCarrier) Keys() []string {
+    keys := make([]string, 0, len(c))
+    for key := range c {
+        keys = append(keys, key)
+    }
+    return keys
+}
+
+func headerTable(headers map[string]string) amqp.Table {
+    if len(headers) == 0 {
+        return nil
+    }
+    table := make(amqp.Table, len(headers))
+    for key, value := range headers {
+        table[key] = value
+    }
+    return table
+}
+
+// currentChannel returns the channel in use; it changes on every reconnect
+func (c *RabbitMQClient) currentChannel() *amqp.Channel {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return c.channel
+}
+
+func (c *RabbitMQClient) isConnected() bool {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return c.connected
+}
+
+func (c *RabbitMQClient) isDisconnected() bool {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return c.disconnected
+}
+
+func (c *RabbitMQClient) trackUnconfirmed(delta int64) {
+    n := atomic.AddInt64(&c.unconfirmed, delta)
+    c.setGauge("rabbitmq_unconfirmed_messages", float64(n))
+}
+
+func (c *RabbitMQClient) setGauge(name string, value float64) {
+    if gauges, ok := c.metrics.(GaugeRecorder); ok {
+        gauges.SetGauge(name, value)
+    }
+}
+
+// Unconfirmed returns the number of messages waiting for a broker confirm
+func (c *RabbitMQClient) Unconfirmed() int64 {
+    return atomic.LoadInt64(&c.unconfirmed)
+}
+
+// Buffered returns the number of messages waiting for a reconnect
+func (c *RabbitMQClient) Buffered() int {
+    return c.buffer.Len()
+}
+
+func (c *RabbitMQClient) Close() error {
+    close(c.done)
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.connected = false
+    c.disconnected = true
+    return c.conn.Close()
+}
+
+var (
+    ErrScheduledMessageNotFound = errors.New("scheduled message not found")
+    // ErrScheduledMessageInFlight means a dispatcher claimed the message
+    // and may be publishing it, so it can no longer be canceled
+    ErrScheduledMessageInFlight = errors.New("scheduled message is being published")
+)
+
+// ScheduledMessage is a message held back until DeliverAt
+type ScheduledMessage struct {
+    ID        string
+    Message   BufferedMessage
+    DeliverAt time.Time
+}
+
+// ScheduleStore keeps scheduled messages until a dispatcher publishes them
+type ScheduleStore interface {
+    Add(ctx context.Context, msg ScheduledMessage) error
+    // Cancel removes a message no dispatcher has claimed
+    Cancel(ctx context.Context, id string) error
+    // Claim returns due messages and hides them from other dispatchers
+    // until the claim expires
+    Claim(ctx context.Context, now time.Time, claimFor time.Duration, limit int) ([]ScheduledMessage, error)
+    // Release removes a message after it was published
+    Release(ctx context.Context, id string) error
+}
+
+// ScheduledPublisher publishes through a RabbitMQClient at a later time,
+// for reminders, payment timeouts and saga deadlines. Messages wait in the
+// store, so they survive restarts and are published at least once.
+type ScheduledPublisher struct {
+    client       *RabbitMQClient
+    store        ScheduleStore
+    pollInterval time.Duration
+    claimTimeout time.Duration
+    logger       Logger
+    metrics      MetricsRecorder
+}
+
+func NewScheduledPublisher(client *RabbitMQClient, store ScheduleStore, pollInterval time.Duration) *ScheduledPublisher {
+    return &ScheduledPublisher{
+        client:       client,
+        store:        store,
+        pollInterval: pollInterval,
+        claimTimeout: 30 * time.Second,
+        logger:       client.logger,
+        metrics:      client.metrics,
+    }
+}
+
+// PublishAt stores the message with the trace context of ctx and returns
+// the ID to cancel it with
+func (p *ScheduledPublisher) PublishAt(ctx context.Context, message []byte, at time.Time) (string, error) {
+    scheduled := ScheduledMessage{
+        ID:        uuid.New().String(),
+        Message:   BufferedMessage{Body: message, Headers: make(map[string]string)},
+        DeliverAt: at,
+    }
+    p.client.propagator.Inject(ctx, propagation.MapCarrier(scheduled.Message.Headers))
+
+    if err := p.store.Add(ctx, scheduled); err != nil {
+        return "", fmt.Errorf("scheduling message: %w", err)
+    }
+    p.metrics.IncCounter("rabbitmq_messages_scheduled")
+    return scheduled.ID, nil
+}
+
+func (p *ScheduledPublisher) PublishAfter(ctx context.Context, message []byte, delay time.Duration) (string, error) {
+    return p.PublishAt(ctx, message, time.Now().Add(delay))
+}
+
+// Cancel returns ErrScheduledMessageNotFound once the message was published
+// and ErrScheduledMessageInFlight while a dispatcher is publishing it
+func (p *ScheduledPublisher) Cancel(ctx context.Context, id string) error {
+    if err := p.store.Cancel(ctx, id); err != nil {
+        return err
+    }
+    p.metrics.IncCounter("rabbitmq_scheduled_messages_canceled")
+    return nil
+}
+
+// Run publishes due messages every poll interval until ctx is canceled
+func (p *ScheduledPublisher) Run(ctx context.Context) error {
+    ticker := time.NewTicker(p.pollInterval)
+    defer ticker.Stop()
+
+    for {
+        if err := p.dispatchDue(ctx); err != nil && ctx.Err() == nil {
+            p.logger.Error("dispatching scheduled messages", "error", err)
+        }
+
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-ticker.C:
+        }
+    }
+}
+
+// dispatchDue publishes due messages and removes them from the store only
+// after the broker confirmed them. Client.Publish is not used: it returns
+// once a message is buffered in memory, and a crash would then lose it.
+func (p *ScheduledPublisher) dispatchDue(ctx context.Context) error {
+    if !p.client.isConnected() {
+        return nil // due messages wait in the store instead
+    }
+
+    due, err := p.store.Claim(ctx, time.Now(), p.claimTimeout, 100)
+    if err != nil {
+        return err
+    }
+
+    for _, msg := range due {
+        // The stored headers carry the trace the message was scheduled in
+        if err := p.client.publishConfirmed(ctx, msg.Message); err != nil {
+            // Retried when the claim expires
+            p.logger.Error("publishing scheduled message", "id", msg.ID, "error", err)
+            continue
+        }
+        if err := p.store.Release(ctx, msg.ID); err != nil {
+            p.logger.Error("releasing scheduled message", "id", msg.ID, "error", err)
+            continue
+        }
+        p.metrics.ObserveLatency("rabbitmq_scheduled_message_delay", time.Since(msg.DeliverAt))
+    }
+    return nil
+}
+
+const scheduledMessagesSchema = `
+CREATE TABLE IF NOT EXISTS scheduled_messages (
+    id            UUID PRIMARY KEY,
+    body          BYTEA NOT NULL,
+    headers       JSONB NOT NULL,
+    deliver_at    TIMESTAMPTZ NOT NULL,
+    claimed_until TIMESTAMPTZ NOT NULL DEFAULT '-infinity'
+);
+CREATE INDEX IF NOT EXISTS scheduled_messages_deliver_at ON scheduled_messages (deliver_at);`
+
+type PostgresScheduleStore struct {
+    db *sql.DB
+}
+
+func NewPostgresScheduleStore(ctx context.Context, db *sql.DB) (*PostgresScheduleStore, error) {
+    if _, err := db.ExecContext(ctx, scheduledMessagesSchema); err != nil {
+        return nil, fmt.Errorf("creating scheduled_messages table: %w", err)
+    }
+    return &PostgresScheduleStore{db: db}, nil
+}
+
+func (s *PostgresScheduleStore) Add(ctx context.Context, msg ScheduledMessage) error {
+    headers, err := json.Marshal(msg.Message.Headers)
+    if err != nil {
+        return fmt.Errorf("encoding headers: %w", err)
+    }
+    // A nil slice would be stored as NULL
+    body := msg.Message.Body
+    if body == nil {
+        body = []byte{}
+    }
+    _, err = s.db.ExecContext(ctx,
+        `INSERT INTO scheduled_messages (id, body, headers, deliver_at) VALUES ($1, $2, $3, $4)`,
+        msg.ID, body, headers, msg.DeliverAt)
+    if err != nil {
+        return fmt.Errorf("storing scheduled message: %w", err)
+    }
+    return nil
+}
+
+func (s *PostgresScheduleStore) Cancel(ctx context.Context, id string) error {
+    result, err := s.db.ExecContext(ctx,
+        `DELETE FROM scheduled_messages WHERE id = $1 AND claimed_until <= NOW()`, id)
+    if err != nil {
+        return fmt.Errorf("canceling scheduled message: %w", err)
+    }
+    n, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("canceling scheduled message: %w", err)
+    }
+    if n > 0 {
+        return nil
+    }
+
+    var exists bool
+    err = s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM scheduled_messages WHERE id = $1)`, id).Scan(&exists)
+    if err != nil {
+        return fmt.Errorf("canceling scheduled message: %w", err)
+    }
+    if exists {
+        return fmt.Errorf("%w: %s", ErrScheduledMessageInFlight, id)
+    }
+    return fmt.Errorf("%w: %s", ErrScheduledMessageNotFound, id)
+}
+
+// Claim skips rows locked by other dispatchers instead of waiting for them
+func (s *PostgresScheduleStore) Claim(ctx context.Context, now time.Time, claimFor time.Duration, limit int) ([]ScheduledMessage, error) {
+    rows, err := s.db.QueryContext(ctx, `
+        UPDATE scheduled_messages SET claimed_until = $1
+        WHERE id IN (
+            SELECT id FROM scheduled_messages
+            WHERE deliver_at <= $2 AND claimed_until <= $2
+            ORDER BY deliver_at
+            LIMIT $3
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING id, body, headers, deliver_at`,
+        now.Add(claimFor), now, limit)
+    if err != nil {
+        return nil, fmt.Errorf("claiming due messages: %w", err)
+    }
+    defer rows.Close()
+
+    var due []ScheduledMessage
+    for rows.Next() {
+        var msg ScheduledMessage
+        var headers []byte
+        if err := rows.Scan(&msg.ID, &msg.Message.Body, &headers, &msg.DeliverAt); err != nil {
+            return nil, fmt.Errorf("scanning scheduled message: %w", err)
+        }
+        if err := json.Unmarshal(headers, &msg.Message.Headers); err != nil {
+            return nil, fmt.Errorf("decoding headers of %s: %w", msg.ID, err)
+        }
+        due = append(due, msg)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("claiming due messages: %w", err)
+    }
+
+    sort.Slice(due, func(i, j int) bool { return due[i].DeliverAt.Before(due[j].DeliverAt) })
+    return due, nil
+}
+
+func (s *PostgresScheduleStore) Release(ctx context.Context, id string) error {
+    if _, err := s.db.ExecContext(ctx, `DELETE FROM scheduled_messages WHERE id = $1`, id); err != nil {
+        return fmt.Errorf("releasing scheduled message: %w", err)
+    }
+    return nil
+}
+
+// BufferedMessage is a message waiting to be published, with the headers
+// that carry its trace context
+type BufferedMessage struct {
+    Body    []byte            `json:"body"`
+    Headers map[string]string `json:"headers,omitempty"`
+}
+
+// PublishBuffer is a bounded FIFO of messages waiting to be published
+type PublishBuffer interface {
+    Push(message BufferedMessage) error
+    // Peek returns the oldest message without removing it
+    Peek() (BufferedMessage, bool, error)
+    Pop() error
+    Len() int
+}
+
+type MemoryBuffer struct {
+    mu       sync.Mutex
+    messages []BufferedMessage
+    capacity int
+}
+
+func NewMemoryBuffer(capacity int) *MemoryBuffer {
+    return &MemoryBuffer{capacity: capacity}
+}
+
+func (b *MemoryBuffer) Push(message BufferedMessage) error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if len(b.messages) >= b.capacity {
+        return ErrBufferFull
+    }
+    b.messages = append(b.messages, message)
+    return nil
+}
+
+func (b *MemoryBuffer) Peek() (BufferedMessage, bool, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if len(b.messages) == 0 {
+        return BufferedMessage{}, false, nil
+    }
+    return b.messages[0], true, nil
+}
+
+func (b *MemoryBuffer) Pop() error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if len(b.messages) > 0 {
+        b.messages[0] = BufferedMessage{}
+        b.messages = b.messages[1:]
+    }
     return nil
+}
+
+func (b *MemoryBuffer) Len() int {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return len(b.messages)
+}
+
+// DiskBuffer stores each message as a numbered file, so messages buffered
+// before a crash are flushed after the restart
+type DiskBuffer struct {
+    mu       sync.Mutex
+    dir      string
+    capacity int
+    head     uint64 // oldest message
+    tail     uint64 // next message to write
+}
+
+func NewDiskBuffer(dir string, capacity int) (*DiskBuffer, error) {
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return nil, err
+    }
+
+    b := &DiskBuffer{dir: dir, capacity: capacity}
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    first := true
+    for _, entry := range entries {
+        name := entry.Name()
+        if strings.HasSuffix(name, ".msg.tmp") {
+            // A write that never got renamed was never acknowledged
+            if err := os.Remove(filepath.Join(dir, name)); err != nil {
+                return nil, fmt.Errorf("removing partial message %s: %w", name, err)
+            }
+            continue
+        }
+        if !strings.HasSuffix(name, ".msg") {
+            continue
+        }
+        seq, err := strconv.ParseUint(strings.TrimSuffix(name, ".msg"), 10, 64)
+        if err != nil {
+            continue
+        }
+        if first || seq < b.head {
+            b.head = seq
+        }
+        if seq >= b.tail {
+            b.tail = seq + 1
+        }
+        first = false
+    }
+    if first {
+        b.head, b.tail = 0, 0
+    }
+    return b, nil
+}
+
+func (b *DiskBuffer) path(seq uint64) string {
+    return filepath.Join(b.dir, fmt.Sprintf("%020d.msg", seq))
+}
+
+func (b *DiskBuffer) Push(message BufferedMessage) error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if int(b.tail-b.head) >= b.capacity {
+        return ErrBufferFull
+    }
+
+    data, err := json.Marshal(message)
+    if err != nil {
+        return err
+    }
+
+    // Write and rename so a crash never leaves a partial message
+    tmp := b.path(b.tail) + ".tmp"
+    if err := os.WriteFile(tmp, data, 0o644); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp, b.path(b.tail)); err != nil {
+        return err
+    }
+    b.tail++
+    return nil
+}
+
+func (b *DiskBuffer) Peek() (BufferedMessage, bool, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.head == b.tail {
+        return BufferedMessage{}, false, nil
+    }
+    data, err := os.ReadFile(b.path(b.head))
+    if err != nil {
+        return BufferedMessage{}, false, err
+    }
+    var message BufferedMessage
+    if err := json.Unmarshal(data, &message); err != nil {
+        return BufferedMessage{}, false, fmt.Errorf("decoding %s: %w", b.path(b.head), err)
+    }
+    return message, true, nil
+}
+
+func (b *DiskBuffer) Pop() error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.head == b.tail {
+        return nil
+    }
+    if err := os.Remove(b.path(b.head)); err != nil && !errors.Is(err, os.ErrNotExist) {
+        return err
+    }
+    b.head++
+    return nil
+}
+
+func (b *DiskBuffer) Len() int {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return int(b.tail - b.head)
 }
\ No newline at end of file
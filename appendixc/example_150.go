@@ -5,8 +5,19 @@ type DeadLetterConfig struct {
     DeadLetterQueue   string
     RetryCount        int
     RetryDelay        time.Duration
+
+    // RetryDelays are the retry tiers, e.g. 10s, 1m, 10m. Attempts past the
+    // last tier reuse it. Empty means a single tier of RetryDelay.
+    RetryDelays []time.Duration
 }
 
+const (
+    // attemptHeader counts failed deliveries; x-death is used when a
+    // message reached us without it
+    attemptHeader     = "x-retry-attempt"
+    parkedErrorHeader = "x-parked-error"
+)
+
 type DeadLetterHandler struct {
     client  *RabbitMQClient
     config  DeadLetterConfig
@@ -14,34 +25,499 @@ type DeadLetterHandler struct {
     metrics MetricsRecorder
 }
 
+func (h *DeadLetterHandler) retryDelays() []time.Duration {
+    if len(h.config.RetryDelays) > 0 {
+        return h.config.RetryDelays
+    }
+    return []time.Duration{h.config.RetryDelay}
+}
+
+// retryQueue names the queue of a retry tier, e.g. orders.retry.1m0s
+func (h *DeadLetterHandler) retryQueue(delay time.Duration) string {
+    return fmt.Sprintf("%s.retry.%s", h.config.MainQueue, delay)
+}
+
+// Setup declares one retry queue per tier and the parking queue. A retry
+// queue has no consumers: its TTL expires the message back to the main
+// queue through the default exchange.
 func (h *DeadLetterHandler) Setup(ctx context.Context) error {
-    // Declare dead letter exchange
-    err := h.client.channel.ExchangeDeclare(
-        "dlx",    // name
-        "direct", // type
-        true,     // durable
-        false,    // auto-deleted
-        false,    // internal
-        false,    // no-wait
-        nil,      // arguments
-    )
-    if err != nil {
-        return fmt.Errorf("declaring dead letter exchange: %w", err)
+    channel := h.client.currentChannel()
+    for _, delay := range h.retryDelays() {
+        _, err := channel.QueueDeclare(
+            h.retryQueue(delay),
+            true,  // durable
+            false, // auto-deleted
+            false, // exclusive
+            false, // no-wait
+            amqp.Table{
+                "x-dead-letter-exchange":    "",
+                "x-dead-letter-routing-key": h.config.MainQueue,
+                "x-message-ttl":            delay.Milliseconds(),
+            },
+        )
+        if err != nil {
+            return fmt.Errorf("declaring retry queue for %s: %w", delay, err)
+        }
     }
 
-    // Declare dead letter queue
-    _, err = h.client.channel.QueueDeclare(
+    // Declare parking queue, where messages wait for an operator
+    _, err := channel.QueueDeclare(
         h.config.DeadLetterQueue,
         true,  // durable
         false, // auto-deleted
         false, // exclusive
         false, // no-wait
-        amqp.Table{
-            "x-dead-letter-exchange":    "",
-            "x-dead-letter-routing-key": h.config.MainQueue,
-            "x-message-ttl":            int32(h.config.RetryDelay.Milliseconds()),
-        },
+        nil,
     )
-    
-    return err
+    if err != nil {
+        return fmt.Errorf("declaring parking queue: %w", err)
+    }
+
+    return nil
+}
+
+// attempts returns how often the message has failed so far
+func attempts(headers amqp.Table) int {
+    switch n := headers[attemptHeader].(type) {
+    case int32:
+        return int(n)
+    case int64:
+        return int(n)
+    case int:
+        return n
+    }
+
+    // Every expiry from a retry queue is one failed attempt
+    total := 0
+    deaths, _ := headers["x-death"].([]interface{})
+    for _, d := range deaths {
+        death, ok := d.(amqp.Table)
+        if !ok || death["reason"] != "expired" {
+            continue
+        }
+        if count, ok := death["count"].(int64); ok {
+            total += int(count)
+        }
+    }
+    return total
+}
+
+// HandleFailure routes a delivery whose processing failed: to the retry
+// tier for its attempt, or to the parking queue once RetryCount attempts
+// have failed. The original delivery is acked only after the broker
+// confirmed the copy, so a crash or a lost copy redelivers the original
+// instead of losing it.
+//
+// A retried message comes back behind whatever reached the main queue in
+// the meantime, so consumers that need per-key ordering should Park.
+func (h *DeadLetterHandler) HandleFailure(ctx context.Context, delivery amqp.Delivery, cause error) error {
+    failed := attempts(delivery.Headers) + 1
+    if failed >= h.config.RetryCount {
+        return h.moveTo(ctx, delivery, h.config.DeadLetterQueue, failed, cause)
+    }
+
+    delays := h.retryDelays()
+    tier := failed - 1
+    if tier >= len(delays) {
+        tier = len(delays) - 1
+    }
+    return h.moveTo(ctx, delivery, h.retryQueue(delays[tier]), failed, cause)
+}
+
+// Park moves a failed delivery straight to the parking queue, skipping the
+// retry tiers
+func (h *DeadLetterHandler) Park(ctx context.Context, delivery amqp.Delivery, cause error) error {
+    return h.moveTo(ctx, delivery, h.config.DeadLetterQueue, attempts(delivery.Headers)+1, cause)
+}
+
+func (h *DeadLetterHandler) moveTo(ctx context.Context, delivery amqp.Delivery, queue string, failed int, cause error) error {
+    headers := amqp.Table{}
+    for k, v := range delivery.Headers {
+        headers[k] = v
+    }
+    headers[attemptHeader] = int32(failed)
+    if queue == h.config.DeadLetterQueue {
+        headers[parkedErrorHeader] = cause.Error()
+    }
+
+    // The default exchange routes by queue name
+    err := h.client.PublishConfirmed(ctx, "", queue, amqp.Publishing{
+        Headers:      headers,
+        ContentType:  delivery.ContentType,
+        MessageId:    delivery.MessageId,
+        Body:         delivery.Body,
+        DeliveryMode: amqp.Persistent,
+        Timestamp:    time.Now(),
+    })
+    if err != nil {
+        h.metrics.IncCounter("dead_letter_publish_errors")
+        return fmt.Errorf("moving message to %s: %w", queue, err)
+    }
+
+    if queue == h.config.DeadLetterQueue {
+        h.metrics.IncCounter("messages_parked")
+        h.logger.Error("message parked",
+            "message_id", delivery.MessageId,
+            "attempts", failed,
+            "error", cause)
+    } else {
+        h.metrics.IncCounter("messages_retried")
+    }
+
+    return delivery.Ack(false)
+}
+
+// ParkedMessage is a message an operator has to look at. ID is assigned
+// when the message is collected; MessageID is the publisher's, which may
+// be empty or shared by several parked copies.
+type ParkedMessage struct {
+    ID          string            `json:"id"`
+    MessageID   string            `json:"message_id"`
+    Body        []byte            `json:"body"`
+    ContentType string            `json:"content_type"`
+    Headers     map[string]string `json:"headers"`
+    Error       string            `json:"error"`
+    Attempts    int               `json:"attempts"`
+    ParkedAt    time.Time         `json:"parked_at"`
+}
+
+var ErrParkedMessageNotFound = errors.New("parked message not found")
+
+// ParkedStore keeps parked messages where they can be browsed and edited,
+// which a queue does not allow
+type ParkedStore interface {
+    Save(ctx context.Context, msg ParkedMessage) error
+    List(ctx context.Context) ([]ParkedMessage, error)
+    Get(ctx context.Context, id string) (ParkedMessage, error)
+    Delete(ctx context.Context, id string) error
+}
+
+const parkedMessagesSchema = `
+CREATE TABLE IF NOT EXISTS parked_messages (
+    id           UUID PRIMARY KEY,
+    message_id   TEXT NOT NULL,
+    body         BYTEA NOT NULL,
+    content_type TEXT NOT NULL,
+    headers      JSONB NOT NULL,
+    error        TEXT NOT NULL,
+    attempts     INT NOT NULL,
+    parked_at    TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS parked_messages_parked_at ON parked_messages (parked_at);`
+
+// PostgresParkedStore keeps parked messages once they are acked off the
+// parking queue, so they survive restarts
+type PostgresParkedStore struct {
+    db *sql.DB
+}
+
+func NewPostgresParkedStore(ctx context.Context, db *sql.DB) (*PostgresParkedStore, error) {
+    if _, err := db.ExecContext(ctx, parkedMessagesSchema); err != nil {
+        return nil, fmt.Errorf("creating parked_messages table: %w", err)
+    }
+    return &PostgresParkedStore{db: db}, nil
+}
+
+// Save inserts a collected message or overwrites an edited one
+func (s *PostgresParkedStore) Save(ctx context.Context, msg ParkedMessage) error {
+    headers, err := json.Marshal(msg.Headers)
+    if err != nil {
+        return fmt.Errorf("encoding headers: %w", err)
+    }
+    // A nil slice would be stored as NULL
+    body := msg.Body
+    if body == nil {
+        body = []byte{}
+    }
+    _, err = s.db.ExecContext(ctx, `
+        INSERT INTO parked_messages
+            (id, message_id, body, content_type, headers, error, attempts, parked_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+        ON CONFLICT (id) DO UPDATE SET body = EXCLUDED.body, headers = EXCLUDED.headers`,
+        msg.ID, msg.MessageID, body, msg.ContentType, headers, msg.Error, msg.Attempts, msg.ParkedAt)
+    if err != nil {
+        return fmt.Errorf("storing parked message: %w", err)
+    }
+    return nil
+}
+
+func (s *PostgresParkedStore) List(ctx context.Context) ([]ParkedMessage, error) {
+    rows, err := s.db.QueryContext(ctx, `
+        SELECT id, message_id, body, content_type, headers, error, attempts, parked_at
+        FROM parked_messages ORDER BY parked_at`)
+    if err != nil {
+        return nil, fmt.Errorf("listing parked messages: %w", err)
+    }
+    defer rows.Close()
+
+    var messages []ParkedMessage
+    for rows.Next() {
+        msg, err := scanParkedMessage(rows)
+        if err != nil {
+            return nil, err
+        }
+        messages = append(messages, msg)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("listing parked messages: %w", err)
+    }
+    return messages, nil
+}
+
+func (s *PostgresParkedStore) Get(ctx context.Context, id string) (ParkedMessage, error) {
+    row := s.db.QueryRowContext(ctx, `
+        SELECT id, message_id, body, content_type, headers, error, attempts, parked_at
+        FROM parked_messages WHERE id = $1`, id)
+    msg, err := scanParkedMessage(row)
+    if errors.Is(err, sql.ErrNoRows) {
+        return ParkedMessage{}, ErrParkedMessageNotFound
+    }
+    return msg, err
+}
+
+func (s *PostgresParkedStore) Delete(ctx context.Context, id string) error {
+    result, err := s.db.ExecContext(ctx, `DELETE FROM parked_messages WHERE id = $1`, id)
+    if err != nil {
+        return fmt.Errorf("deleting parked message: %w", err)
+    }
+    n, err := result.RowsAffected()
+    if err != nil {
+        return fmt.Errorf("deleting parked message: %w", err)
+    }
+    if n == 0 {
+        return ErrParkedMessageNotFound
+    }
+    return nil
+}
+
+func scanParkedMessage(row interface{ Scan(dest ...interface{}) error }) (ParkedMessage, error) {
+    var msg ParkedMessage
+    var headers []byte
+    err := row.Scan(&msg.ID, &msg.MessageID, &msg.Body, &msg.ContentType,
+        &headers, &msg.Error, &msg.Attempts, &msg.ParkedAt)
+    if err != nil {
+        return ParkedMessage{}, fmt.Errorf("scanning parked message: %w", err)
+    }
+    if err := json.Unmarshal(headers, &msg.Headers); err != nil {
+        return ParkedMessage{}, fmt.Errorf("decoding headers of %s: %w", msg.ID, err)
+    }
+    return msg, nil
+}
+
+// InMemoryParkedStore loses everything Collect acked when the process
+// exits; use it in tests, not in front of a real parking queue
+type InMemoryParkedStore struct {
+    mu       sync.Mutex
+    messages map[string]ParkedMessage
+}
+
+func NewInMemoryParkedStore() *InMemoryParkedStore {
+    return &InMemoryParkedStore{messages: make(map[string]ParkedMessage)}
+}
+
+func (s *InMemoryParkedStore) Save(ctx context.Context, msg ParkedMessage) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.messages[msg.ID] = msg
+    return nil
+}
+
+func (s *InMemoryParkedStore) List(ctx context.Context) ([]ParkedMessage, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    messages := make([]ParkedMessage, 0, len(s.messages))
+    for _, msg := range s.messages {
+        messages = append(messages, msg)
+    }
+    sort.Slice(messages, func(i, j int) bool {
+        return messages[i].ParkedAt.Before(messages[j].ParkedAt)
+    })
+    return messages, nil
+}
+
+func (s *InMemoryParkedStore) Get(ctx context.Context, id string) (ParkedMessage, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    msg, ok := s.messages[id]
+    if !ok {
+        return ParkedMessage{}, ErrParkedMessageNotFound
+    }
+    return msg, nil
+}
+
+func (s *InMemoryParkedStore) Delete(ctx context.Context, id string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, ok := s.messages[id]; !ok {
+        return ErrParkedMessageNotFound
+    }
+    delete(s.messages, id)
+    return nil
+}
+
+// ParkingLot moves messages from the parking queue into a ParkedStore and
+// lets operators inspect, edit and replay them. Collect acks what it
+// stored, so the store has to be durable, e.g. PostgresParkedStore.
+type ParkingLot struct {
+    handler *DeadLetterHandler
+    store   ParkedStore
+}
+
+func NewParkingLot(handler *DeadLetterHandler, store ParkedStore) *ParkingLot {
+    return &ParkingLot{handler: handler, store: store}
+}
+
+// Collect drains the parking queue into the store. A message is acked
+// only after it is saved.
+func (p *ParkingLot) Collect(ctx context.Context) (int, error) {
+    collected := 0
+    for ctx.Err() == nil {
+        delivery, ok, err := p.handler.client.currentChannel().Get(p.handler.config.DeadLetterQueue, false)
+        if err != nil {
+            return collected, fmt.Errorf("reading parking queue: %w", err)
+        }
+        if !ok {
+            return collected, nil
+        }
+
+        msg := ParkedMessage{
+            ID:          uuid.New().String(),
+            MessageID:   delivery.MessageId,
+            Body:        delivery.Body,
+            ContentType: delivery.ContentType,
+            Headers:     make(map[string]string),
+            Attempts:    attempts(delivery.Headers),
+            ParkedAt:    delivery.Timestamp,
+        }
+        for k, v := range delivery.Headers {
+            if k == attemptHeader || k == "x-death" {
+                continue
+            }
+            if k == parkedErrorHeader {
+                msg.Error = fmt.Sprint(v)
+                continue
+            }
+            msg.Headers[k] = fmt.Sprint(v)
+        }
+
+        if err := p.store.Save(ctx, msg); err != nil {
+            delivery.Nack(false, true)
+            return collected, fmt.Errorf("saving parked message: %w", err)
+        }
+        if err := delivery.Ack(false); err != nil {
+            return collected, err
+        }
+        collected++
+    }
+    return collected, ctx.Err()
+}
+
+// Edit replaces the body and headers of a parked message, e.g. to fix the
+// payload that made it fail
+func (p *ParkingLot) Edit(ctx context.Context, id string, body []byte, headers map[string]string) (ParkedMessage, error) {
+    msg, err := p.store.Get(ctx, id)
+    if err != nil {
+        return ParkedMessage{}, err
+    }
+    if body != nil {
+        msg.Body = body
+    }
+    if headers != nil {
+        msg.Headers = headers
+    }
+    return msg, p.store.Save(ctx, msg)
+}
+
+// Replay publishes a parked message to the main queue with a fresh retry
+// budget and removes it from the store once the broker confirmed it
+func (p *ParkingLot) Replay(ctx context.Context, id string) error {
+    msg, err := p.store.Get(ctx, id)
+    if err != nil {
+        return err
+    }
+
+    headers := amqp.Table{"x-replayed-at": time.Now().Format(time.RFC3339)}
+    for k, v := range msg.Headers {
+        headers[k] = v
+    }
+
+    err = p.handler.client.PublishConfirmed(ctx, "", p.handler.config.MainQueue, amqp.Publishing{
+        Headers:      headers,
+        ContentType:  msg.ContentType,
+        MessageId:    msg.MessageID,
+        Body:         msg.Body,
+        DeliveryMode: amqp.Persistent,
+        Timestamp:    time.Now(),
+    })
+    if err != nil {
+        return fmt.Errorf("replaying message %s: %w", id, err)
+    }
+
+    p.handler.metrics.IncCounter("messages_replayed")
+    return p.store.Delete(ctx, id)
+}
+
+// AdminHandler serves the parking lot:
+//
+//    GET    /parked               list parked messages
+//    POST   /parked/collect       drain the parking queue into the store
+//    GET    /parked/{id}          inspect one message
+//    PUT    /parked/{id}          edit body and headers
+//    POST   /parked/{id}/replay   send it back to the main queue
+//    DELETE /parked/{id}          discard it
+func (p *ParkingLot) AdminHandler() http.Handler {
+    mux := http.NewServeMux()
+
+    mux.HandleFunc("GET /parked", func(w http.ResponseWriter, r *http.Request) {
+        messages, err := p.store.List(r.Context())
+        writeParkedResponse(w, messages, err)
+    })
+
+    mux.HandleFunc("POST /parked/collect", func(w http.ResponseWriter, r *http.Request) {
+        n, err := p.Collect(r.Context())
+        writeParkedResponse(w, map[string]int{"collected": n}, err)
+    })
+
+    mux.HandleFunc("GET /parked/{id}", func(w http.ResponseWriter, r *http.Request) {
+        msg, err := p.store.Get(r.Context(), r.PathValue("id"))
+        writeParkedResponse(w, msg, err)
+    })
+
+    mux.HandleFunc("PUT /parked/{id}", func(w http.ResponseWriter, r *http.Request) {
+        var edit struct {
+            Body    []byte            `json:"body"`
+            Headers map[string]string `json:"headers"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&edit); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        msg, err := p.Edit(r.Context(), r.PathValue("id"), edit.Body, edit.Headers)
+        writeParkedResponse(w, msg, err)
+    })
+
+    mux.HandleFunc("POST /parked/{id}/replay", func(w http.ResponseWriter, r *http.Request) {
+        err := p.Replay(r.Context(), r.PathValue("id"))
+        writeParkedResponse(w, map[string]string{"status": "replayed"}, err)
+    })
+
+    mux.HandleFunc("DELETE /parked/{id}", func(w http.ResponseWriter, r *http.Request) {
+        err := p.store.Delete(r.Context(), r.PathValue("id"))
+        writeParkedResponse(w, map[string]string{"status": "deleted"}, err)
+    })
+
+    return mux
+}
+
+func writeParkedResponse(w http.ResponseWriter, body interface{}, err error) {
+    w.Header().Set("Content-Type", "application/json")
+    switch {
+    case errors.Is(err, ErrParkedMessageNotFound):
+        w.WriteHeader(http.StatusNotFound)
+        body = map[string]string{"error": err.Error()}
+    case err != nil:
+        w.WriteHeader(http.StatusInternalServerError)
+        body = map[string]string{"error": err.Error()}
+    }
+    json.NewEncoder(w).Encode(body)
 }
\ No newline at end of file
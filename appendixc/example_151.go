@@ -1,17 +1,78 @@
 // Example 151
 // internal/infrastructure/messaging/stream.go
+type StreamConfig struct {
+    QueueName   string
+    ConsumerTag string
+    // Prefetch bounds the unacked messages held by the processor
+    Prefetch int
+    // MaxRedeliveries is how often a failed message is retried before it
+    // is dead-lettered instead of being requeued forever; defaults to
+    // defaultMaxRedeliveries. NoRedeliveries dead-letters it on the first
+    // failure.
+    MaxRedeliveries int
+    RetryBackoff    time.Duration
+    // DrainTimeout bounds how long in-flight messages may take after the
+    // context is canceled
+    DrainTimeout time.Duration
+    // PartitionKey returns the key that messages are ordered by; the
+    // routing key when nil
+    PartitionKey func(amqp.Delivery) string
+}
+
+// defaultMaxRedeliveries keeps a misconfigured processor from dropping a
+// message on its first failure when the queue has no dead letter exchange
+const defaultMaxRedeliveries = 5
+
+// NoRedeliveries sets StreamConfig.MaxRedeliveries to dead-letter without
+// retrying, since zero already means the default
+const NoRedeliveries = -1
+
+// StreamProcessor runs one worker per partition. Messages with the same
+// key always go to the same worker, so they are handled one at a time in
+// arrival order, while concurrency bounds the work in progress overall.
+// Failed messages are retried in place and then parked, never sent through
+// the retry tiers, which would put them behind later messages of their key.
 type StreamProcessor struct {
     client      *RabbitMQClient
     handler     MessageHandler
     concurrency int
+    config      StreamConfig
     logger      Logger
     metrics     MetricsRecorder
+    // deadLetters parks messages that ran out of redeliveries; without it
+    // they are rejected to the queue's dead letter exchange
+    deadLetters *DeadLetterHandler
+    done        chan struct{}
 }
 
 func (p *StreamProcessor) Start(ctx context.Context) error {
-    msgs, err := p.client.channel.Consume(
+    // Zero workers would leave nothing to partition over, and a zero
+    // prefetch would let the broker push without limit
+    if p.concurrency < 1 {
+        return fmt.Errorf("stream processor needs a concurrency of at least 1, got %d", p.concurrency)
+    }
+    if p.config.ConsumerTag == "" {
+        p.config.ConsumerTag = fmt.Sprintf("stream-%s", uuid.New())
+    }
+    if p.config.Prefetch == 0 {
+        p.config.Prefetch = p.concurrency * 10
+    }
+    if p.config.DrainTimeout == 0 {
+        p.config.DrainTimeout = 30 * time.Second
+    }
+    if p.config.MaxRedeliveries == 0 {
+        p.config.MaxRedeliveries = defaultMaxRedeliveries
+    }
+
+    // Cancel has to reach the channel the consumer was started on
+    channel := p.client.currentChannel()
+    if err := channel.Qos(p.config.Prefetch, 0, false); err != nil {
+        return fmt.Errorf("setting prefetch: %w", err)
+    }
+
+    msgs, err := channel.Consume(
         p.config.QueueName,
-        "",    // consumer
+        p.config.ConsumerTag,
         false, // auto-ack
         false, // exclusive
         false, // no-local
@@ -22,26 +83,163 @@ func (p *StreamProcessor) Start(ctx context.Context) error {
         return fmt.Errorf("starting consumer: %w", err)
     }
 
-    for i := 0; i < p.concurrency; i++ {
-        go p.processMessages(ctx, msgs)
+    // Handlers keep running during the drain, so they get a context that
+    // outlives ctx until the drain timeout
+    workCtx, cancelWork := context.WithCancel(context.WithoutCancel(ctx))
+
+    partitions := make([]chan amqp.Delivery, p.concurrency)
+    var workers sync.WaitGroup
+    for i := range partitions {
+        partitions[i] = make(chan amqp.Delivery, p.config.Prefetch)
+        workers.Add(1)
+        go func(partition <-chan amqp.Delivery) {
+            defer workers.Done()
+            p.processMessages(workCtx, partition)
+        }(partitions[i])
     }
 
+    p.done = make(chan struct{})
+    go func() {
+        defer close(p.done)
+        defer cancelWork()
+
+        p.dispatch(ctx, channel, msgs, partitions)
+
+        drained := make(chan struct{})
+        go func() {
+            workers.Wait()
+            close(drained)
+        }()
+
+        select {
+        case <-drained:
+            p.logger.Info("stream processor drained", "queue", p.config.QueueName)
+        case <-time.After(p.config.DrainTimeout):
+            // Handlers see a canceled context; what they leave unacked is
+            // requeued by processMessages
+            p.logger.Error("drain timed out, requeueing unfinished messages", "queue", p.config.QueueName)
+            cancelWork()
+            <-drained
+        }
+    }()
+
     return nil
 }
 
+// Wait blocks until the processor has drained after its context was canceled
+func (p *StreamProcessor) Wait() {
+    <-p.done
+}
+
+// dispatch routes deliveries to their partition until ctx is canceled,
+// then cancels the consumer and hands over what was already prefetched
+func (p *StreamProcessor) dispatch(ctx context.Context, channel *amqp.Channel, msgs <-chan amqp.Delivery, partitions []chan amqp.Delivery) {
+    defer func() {
+        for _, partition := range partitions {
+            close(partition)
+        }
+    }()
+
+    for {
+        select {
+        case msg, ok := <-msgs:
+            if !ok {
+                return
+            }
+            partitions[p.partition(msg, len(partitions))] <- msg
+        case <-ctx.Done():
+            if err := channel.Cancel(p.config.ConsumerTag, false); err != nil {
+                p.logger.Error("cancelling consumer", "error", err)
+                return
+            }
+            // The channel is closed once the broker confirmed the cancel
+            for msg := range msgs {
+                partitions[p.partition(msg, len(partitions))] <- msg
+            }
+            return
+        }
+    }
+}
+
+func (p *StreamProcessor) partition(msg amqp.Delivery, n int) int {
+    key := msg.RoutingKey
+    if p.config.PartitionKey != nil {
+        key = p.config.PartitionKey(msg)
+    }
+    h := fnv.New32a()
+    h.Write([]byte(key))
+    return int(h.Sum32() % uint32(n))
+}
+
 func (p *StreamProcessor) processMessages(ctx context.Context, msgs <-chan amqp.Delivery) {
     for msg := range msgs {
+        if ctx.Err() != nil {
+            // Drain timed out: give the message back untouched
+            msg.Nack(false, true)
+            continue
+        }
+
         start := time.Now()
-        err := p.handler.Handle(ctx, msg.Body)
-        
+        msgCtx, span := p.client.StartConsumerSpan(ctx, msg)
+        err := p.handleWithRedelivery(msgCtx, msg)
+
         if err != nil {
+            span.RecordError(err)
+            span.SetStatus(codes.Error, err.Error())
             p.metrics.IncCounter("message_processing_errors")
             p.logger.Error("failed to process message", "error", err)
-            msg.Nack(false, true) // requeue message
+            if ctx.Err() != nil {
+                msg.Nack(false, true) // requeue message
+                span.End()
+                continue
+            }
+            p.deadLetter(msgCtx, msg, err)
+            span.End()
             continue
         }
-        
+
         msg.Ack(false)
+        span.End()
         p.metrics.ObserveLatency("message_processing", time.Since(start))
     }
+}
+
+// handleWithRedelivery retries a failed message in place, which keeps it
+// ahead of later messages with the same key. Deliveries the broker already
+// counted in x-delivery-count (quorum queues) use up the same budget.
+func (p *StreamProcessor) handleWithRedelivery(ctx context.Context, msg amqp.Delivery) error {
+    redelivered := 0
+    if count, ok := msg.Headers["x-delivery-count"].(int64); ok {
+        redelivered = int(count)
+    }
+
+    for {
+        err := p.handler.Handle(ctx, msg.Body)
+        if err == nil || redelivered >= p.config.MaxRedeliveries || ctx.Err() != nil {
+            return err
+        }
+
+        redelivered++
+        p.metrics.IncCounter("message_redeliveries")
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(p.config.RetryBackoff * time.Duration(redelivered)):
+        }
+    }
+}
+
+func (p *StreamProcessor) deadLetter(ctx context.Context, msg amqp.Delivery, cause error) {
+    if p.deadLetters != nil {
+        if err := p.deadLetters.Park(ctx, msg, cause); err != nil {
+            // Requeue rather than drop a message the parking queue never got
+            p.logger.Error("parking message", "error", err)
+            msg.Nack(false, true)
+            return
+        }
+        p.metrics.IncCounter("messages_dead_lettered")
+        return
+    }
+    p.metrics.IncCounter("messages_dead_lettered")
+    msg.Nack(false, false) // to the dead letter exchange, if any
 }
\ No newline at end of file
@@ -2,7 +2,9 @@
 
 // internal/infrastructure/messaging/schema.go
 type SchemaRegistry struct {
-    schemas map[string]Schema
+    schemas map[string][]Schema // by event type, ordered by version
+    modes   map[string]CompatibilityMode
+    mode    CompatibilityMode
     mu      sync.RWMutex
 }
 
@@ -12,6 +14,128 @@ type Schema struct {
     Definition  string
     Validators  []SchemaValidator
     Migrations  []SchemaMigration
+
+    compiled *jsonSchema
+}
+
+
+// SchemaValidator adds checks a JSON Schema cannot express
+type SchemaValidator interface {
+    Validate(data []byte) error
+}
+
+
+// SchemaMigration converts a payload between two versions of a schema.
+// Registering migrations in both directions lets old consumers read new
+// messages as well as the reverse.
+type SchemaMigration struct {
+    FromVersion int
+    ToVersion   int
+    Migrate     func(data []byte) ([]byte, error)
+}
+
+
+// CompatibilityMode decides which new versions Register accepts.
+// Backward: consumers on the new version can read messages written with
+// the previous one. Forward: consumers still on the previous version can
+// read messages written with the new one. Full: both.
+type CompatibilityMode string
+
+
+const (
+    CompatibilityBackward CompatibilityMode = "backward"
+    CompatibilityForward  CompatibilityMode = "forward"
+    CompatibilityFull     CompatibilityMode = "full"
+    CompatibilityNone     CompatibilityMode = "none"
+)
+
+
+var (
+    ErrSchemaNotFound     = errors.New("schema not found")
+    ErrIncompatibleSchema = errors.New("incompatible schema")
+    ErrNoMigrationPath    = errors.New("no migration path")
+    // ErrUnsupportedKeyword is returned by Register for schema keywords
+    // the registry cannot enforce
+    ErrUnsupportedKeyword = errors.New("unsupported schema keyword")
+)
+
+
+func NewSchemaRegistry(mode CompatibilityMode) *SchemaRegistry {
+    return &SchemaRegistry{
+        schemas: make(map[string][]Schema),
+        modes:   make(map[string]CompatibilityMode),
+        mode:    mode,
+    }
+}
+
+
+// SetCompatibility overrides the registry's mode for one event type
+func (r *SchemaRegistry) SetCompatibility(eventType string, mode CompatibilityMode) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.modes[eventType] = mode
+}
+
+
+// Register adds the next version of an event type's schema. Versions must
+// be consecutive, and the new version must be compatible with the previous
+// one under the event type's compatibility mode.
+func (r *SchemaRegistry) Register(eventType string, schema Schema) error {
+    compiled, err := compileSchema(schema.Definition)
+    if err != nil {
+        return fmt.Errorf("parsing %s v%d: %w", eventType, schema.Version, err)
+    }
+    schema.compiled = compiled
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    versions := r.schemas[eventType]
+    if len(versions) == 0 {
+        if schema.Version != 1 {
+            return fmt.Errorf("registering %s: first version must be 1, got %d", eventType, schema.Version)
+        }
+        r.schemas[eventType] = []Schema{schema}
+        return nil
+    }
+
+    previous := versions[len(versions)-1]
+    if schema.Version != previous.Version+1 {
+        return fmt.Errorf("registering %s: expected version %d, got %d", eventType, previous.Version+1, schema.Version)
+    }
+
+    mode, ok := r.modes[eventType]
+    if !ok {
+        mode = r.mode
+    }
+
+    var problems []string
+    if mode == CompatibilityBackward || mode == CompatibilityFull {
+        problems = append(problems, checkReadable(compiled, previous.compiled, "")...)
+    }
+    if mode == CompatibilityForward || mode == CompatibilityFull {
+        problems = append(problems, checkReadable(previous.compiled, compiled, "")...)
+    }
+    if len(problems) > 0 {
+        return fmt.Errorf("registering %s v%d (%s): %w: %s",
+            eventType, schema.Version, mode, ErrIncompatibleSchema, strings.Join(problems, "; "))
+    }
+
+    r.schemas[eventType] = append(versions, schema)
+    return nil
+}
+
+
+func (r *SchemaRegistry) GetSchema(eventType string, version int) (Schema, error) {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+
+    for _, schema := range r.schemas[eventType] {
+        if schema.Version == version {
+            return schema, nil
+        }
+    }
+    return Schema{}, fmt.Errorf("%s v%d: %w", eventType, version, ErrSchemaNotFound)
 }
 
 
@@ -22,6 +146,15 @@ func (r *SchemaRegistry) ValidateMessage(eventType string, version int, data []b
     }
 
 
+    var value interface{}
+    if err := json.Unmarshal(data, &value); err != nil {
+        return fmt.Errorf("validating against schema: %w", err)
+    }
+    if problems := schema.compiled.validate(value, ""); len(problems) > 0 {
+        return fmt.Errorf("validating against schema: %s", strings.Join(problems, "; "))
+    }
+
+
     for _, validator := range schema.Validators {
         if err := validator.Validate(data); err != nil {
             return fmt.Errorf("validating against schema: %w", err)
@@ -31,4 +164,380 @@ func (r *SchemaRegistry) ValidateMessage(eventType string, version int, data []b
 
     return nil
 
+}
+
+
+// Migrate converts data from one version to another, following the
+// registered migrations one step at a time, and validates the result
+// against the target version
+func (r *SchemaRegistry) Migrate(eventType string, data []byte, fromVersion, toVersion int) ([]byte, error) {
+    r.mu.RLock()
+    var migrations []SchemaMigration
+    for _, schema := range r.schemas[eventType] {
+        migrations = append(migrations, schema.Migrations...)
+    }
+    r.mu.RUnlock()
+
+    for version := fromVersion; version != toVersion; {
+        step, ok := nextMigration(migrations, version, toVersion)
+        if !ok {
+            return nil, fmt.Errorf("migrating %s from v%d to v%d: %w at v%d",
+                eventType, fromVersion, toVersion, ErrNoMigrationPath, version)
+        }
+
+        migrated, err := step.Migrate(data)
+        if err != nil {
+            return nil, fmt.Errorf("migrating %s from v%d to v%d: %w", eventType, step.FromVersion, step.ToVersion, err)
+        }
+        data, version = migrated, step.ToVersion
+    }
+
+    if err := r.ValidateMessage(eventType, toVersion, data); err != nil {
+        return nil, fmt.Errorf("migrated %s payload: %w", eventType, err)
+    }
+    return data, nil
+}
+
+
+// nextMigration picks the step from version that gets closest to target
+// without passing it
+func nextMigration(migrations []SchemaMigration, version, target int) (SchemaMigration, bool) {
+    var best SchemaMigration
+    found := false
+    for _, m := range migrations {
+        if m.FromVersion != version {
+            continue
+        }
+        towards := (target > version && m.ToVersion > version && m.ToVersion <= target) ||
+            (target < version && m.ToVersion < version && m.ToVersion >= target)
+        if !towards {
+            continue
+        }
+        if !found || abs(target-m.ToVersion) < abs(target-best.ToVersion) {
+            best, found = m, true
+        }
+    }
+    return best, found
+}
+
+
+func abs(n int) int {
+    if n < 0 {
+        return -n
+    }
+    return n
+}
+
+
+// jsonSchema is the subset of JSON Schema the registry understands: type,
+// properties, required, additionalProperties, items, enum and the numeric
+// and length bounds
+type jsonSchema struct {
+    Type                 schemaTypes            `json:"type"`
+    Properties           map[string]*jsonSchema `json:"properties"`
+    Required             []string               `json:"required"`
+    AdditionalProperties *bool                  `json:"additionalProperties"`
+    Items                *jsonSchema            `json:"items"`
+    Enum                 []interface{}          `json:"enum"`
+    Minimum              *float64               `json:"minimum"`
+    Maximum              *float64               `json:"maximum"`
+    MinLength            *int                   `json:"minLength"`
+    MaxLength            *int                   `json:"maxLength"`
+}
+
+
+// schemaTypes accepts "type" as a single name or a list of names
+type schemaTypes []string
+
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+    var single string
+    if err := json.Unmarshal(data, &single); err == nil {
+        *t = schemaTypes{single}
+        return nil
+    }
+    var list []string
+    if err := json.Unmarshal(data, &list); err != nil {
+        return fmt.Errorf("type must be a string or a list of strings")
+    }
+    *t = list
+    return nil
+}
+
+
+// schemaKeywords are the keywords jsonSchema enforces, plus annotations
+// that never affect validation
+var schemaKeywords = map[string]bool{
+    "type": true, "properties": true, "required": true, "additionalProperties": true,
+    "items": true, "enum": true, "minimum": true, "maximum": true,
+    "minLength": true, "maxLength": true,
+    "$schema": true, "$id": true, "$comment": true,
+    "title": true, "description": true, "default": true, "examples": true,
+}
+
+
+func compileSchema(definition string) (*jsonSchema, error) {
+    // Anything else (pattern, format, $ref, oneOf, const, ...) would be
+    // silently ignored, making the schema look stricter than it is
+    if err := checkKeywords([]byte(definition), "$"); err != nil {
+        return nil, err
+    }
+
+    var schema jsonSchema
+    if err := json.Unmarshal([]byte(definition), &schema); err != nil {
+        return nil, err
+    }
+    return &schema, nil
+}
+
+
+// checkKeywords rejects unknown keywords in a schema and its nested
+// property and item schemas
+func checkKeywords(data []byte, path string) error {
+    var keywords map[string]json.RawMessage
+    if err := json.Unmarshal(data, &keywords); err != nil {
+        return fmt.Errorf("%s: schema must be an object: %w", path, err)
+    }
+
+    names := make([]string, 0, len(keywords))
+    for name := range keywords {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        if !schemaKeywords[name] {
+            return fmt.Errorf("%s: %w: %s", path, ErrUnsupportedKeyword, name)
+        }
+    }
+
+    if raw, ok := keywords["properties"]; ok {
+        var properties map[string]json.RawMessage
+        if err := json.Unmarshal(raw, &properties); err != nil {
+            return fmt.Errorf("%s.properties: %w", path, err)
+        }
+        for name, property := range properties {
+            if err := checkKeywords(property, path+"."+name); err != nil {
+                return err
+            }
+        }
+    }
+    if raw, ok := keywords["items"]; ok {
+        return checkKeywords(raw, path+"[]")
+    }
+    return nil
+}
+
+
+// accepts reports whether values of JSON type name are allowed; an empty
+// type list allows anything
+func (s *jsonSchema) accepts(name string) bool {
+    if len(s.Type) == 0 {
+        return true
+    }
+    for _, t := range s.Type {
+        if t == name || (t == "number" && name == "integer") {
+            return true
+        }
+    }
+    return false
+}
+
+
+func jsonType(value interface{}) string {
+    switch v := value.(type) {
+    case nil:
+        return "null"
+    case bool:
+        return "boolean"
+    case float64:
+        if v == math.Trunc(v) {
+            return "integer"
+        }
+        return "number"
+    case string:
+        return "string"
+    case []interface{}:
+        return "array"
+    default:
+        return "object"
+    }
+}
+
+
+func (s *jsonSchema) validate(value interface{}, path string) []string {
+    if path == "" {
+        path = "$"
+    }
+    if !s.accepts(jsonType(value)) {
+        return []string{fmt.Sprintf("%s: expected %s, got %s", path, strings.Join(s.Type, " or "), jsonType(value))}
+    }
+
+    var problems []string
+    if len(s.Enum) > 0 {
+        allowed := false
+        for _, e := range s.Enum {
+            if reflect.DeepEqual(e, value) {
+                allowed = true
+                break
+            }
+        }
+        if !allowed {
+            problems = append(problems, fmt.Sprintf("%s: %v is not one of %v", path, value, s.Enum))
+        }
+    }
+
+    switch v := value.(type) {
+    case float64:
+        if s.Minimum != nil && v < *s.Minimum {
+            problems = append(problems, fmt.Sprintf("%s: %v is below the minimum %v", path, v, *s.Minimum))
+        }
+        if s.Maximum != nil && v > *s.Maximum {
+            problems = append(problems, fmt.Sprintf("%s: %v is above the maximum %v", path, v, *s.Maximum))
+        }
+    case string:
+        n := utf8.RuneCountInString(v)
+        if s.MinLength != nil && n < *s.MinLength {
+            problems = append(problems, fmt.Sprintf("%s: shorter than %d characters", path, *s.MinLength))
+        }
+        if s.MaxLength != nil && n > *s.MaxLength {
+            problems = append(problems, fmt.Sprintf("%s: longer than %d characters", path, *s.MaxLength))
+        }
+    case []interface{}:
+        if s.Items != nil {
+            for i, item := range v {
+                problems = append(problems, s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i))...)
+            }
+        }
+    case map[string]interface{}:
+        for _, name := range s.Required {
+            if _, ok := v[name]; !ok {
+                problems = append(problems, fmt.Sprintf("%s: missing required property %s", path, name))
+            }
+        }
+        for name, property := range v {
+            if propertySchema, ok := s.Properties[name]; ok {
+                problems = append(problems, propertySchema.validate(property, path+"."+name)...)
+            } else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+                problems = append(problems, fmt.Sprintf("%s: unexpected property %s", path, name))
+            }
+        }
+    }
+    return problems
+}
+
+
+// checkReadable lists the ways a message valid under writer could be
+// rejected by reader
+func checkReadable(reader, writer *jsonSchema, path string) []string {
+    if path == "" {
+        path = "$"
+    }
+
+    var problems []string
+    if len(reader.Type) > 0 {
+        if len(writer.Type) == 0 {
+            problems = append(problems, fmt.Sprintf("%s: type restricted to %s", path, strings.Join(reader.Type, " or ")))
+        }
+        for _, t := range writer.Type {
+            if !reader.accepts(t) {
+                problems = append(problems, fmt.Sprintf("%s: type %s no longer accepted", path, t))
+            }
+        }
+    }
+
+    for _, name := range reader.Required {
+        if !contains(writer.Required, name) {
+            problems = append(problems, fmt.Sprintf("%s: property %s is required but may be missing", path, name))
+        }
+    }
+
+    for name, readerProperty := range reader.Properties {
+        if writerProperty, ok := writer.Properties[name]; ok {
+            problems = append(problems, checkReadable(readerProperty, writerProperty, path+"."+name)...)
+        }
+    }
+
+    if reader.AdditionalProperties != nil && !*reader.AdditionalProperties {
+        if writer.AdditionalProperties == nil || *writer.AdditionalProperties {
+            problems = append(problems, fmt.Sprintf("%s: additional properties no longer allowed", path))
+        }
+        for name := range writer.Properties {
+            if _, ok := reader.Properties[name]; !ok {
+                problems = append(problems, fmt.Sprintf("%s: property %s no longer allowed", path, name))
+            }
+        }
+    }
+
+    if len(reader.Enum) > 0 {
+        if len(writer.Enum) == 0 {
+            problems = append(problems, fmt.Sprintf("%s: values restricted to %v", path, reader.Enum))
+        }
+        for _, value := range writer.Enum {
+            found := false
+            for _, allowed := range reader.Enum {
+                if reflect.DeepEqual(value, allowed) {
+                    found = true
+                    break
+                }
+            }
+            if !found {
+                problems = append(problems, fmt.Sprintf("%s: value %v no longer allowed", path, value))
+            }
+        }
+    }
+
+    if tighterFloat(reader.Minimum, writer.Minimum, false) || tighterFloat(reader.Maximum, writer.Maximum, true) ||
+        tighterInt(reader.MinLength, writer.MinLength, false) || tighterInt(reader.MaxLength, writer.MaxLength, true) {
+        problems = append(problems, fmt.Sprintf("%s: bounds narrowed", path))
+    }
+
+    if reader.Items != nil {
+        // Without items the writer allows arrays of anything
+        writerItems := writer.Items
+        if writerItems == nil {
+            writerItems = &jsonSchema{}
+        }
+        problems = append(problems, checkReadable(reader.Items, writerItems, path+"[]")...)
+    }
+    return problems
+}
+
+
+// tighterFloat reports whether the reader's bound rejects values the
+// writer's bound allows; upper selects maximum instead of minimum
+func tighterFloat(reader, writer *float64, upper bool) bool {
+    if reader == nil {
+        return false
+    }
+    if writer == nil {
+        return true
+    }
+    if upper {
+        return *reader < *writer
+    }
+    return *reader > *writer
+}
+
+
+func tighterInt(reader, writer *int, upper bool) bool {
+    if reader == nil {
+        return false
+    }
+    if writer == nil {
+        return true
+    }
+    if upper {
+        return *reader < *writer
+    }
+    return *reader > *writer
+}
+
+
+func contains(values []string, value string) bool {
+    for _, v := range values {
+        if v == value {
+            return true
+        }
+    }
+    return false
 }
\ No newline at end of file
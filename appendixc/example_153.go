@@ -1,34 +1,604 @@
 // Example 153
 // internal/infrastructure/messaging/router.go
 type MessageRouter struct {
-    routes   map[string][]MessageHandler
+    routes   []Route
     filters  []MessageFilter
     logger   Logger
     metrics  MetricsRecorder
 }
 
-func (r *MessageRouter) Route(ctx context.Context, message Message) error {
+// Route sends messages whose type matches Pattern and that satisfy every
+// condition to Handler. Patterns are dot-separated: "*" stands for exactly
+// one segment and "#" for zero or more, so "orders.*" matches
+// "orders.created" and "orders.#" also matches "orders" and
+// "orders.item.added".
+type Route struct {
+    Name       string
+    Pattern    string
+    Conditions []Condition
+    Handler    MessageHandler
+    // MaxAttempts and Backoff retry this handler only; other handlers for
+    // the same message are not held up or affected by its failures
+    MaxAttempts int
+    Backoff     time.Duration
+}
+
+// Condition inspects a message's headers and its decoded JSON payload,
+// which is nil when the payload is not JSON
+type Condition func(headers map[string]string, payload interface{}) bool
+
+type Operator string
+
+const (
+    OpExists      Operator = "exists"
+    OpEquals      Operator = "=="
+    OpNotEquals   Operator = "!="
+    OpGreaterThan Operator = ">"
+    OpLessThan    Operator = "<"
+    OpIn          Operator = "in" // value is a slice of candidates
+)
+
+var ErrInvalidPattern = errors.New("invalid routing pattern")
+
+func NewMessageRouter(logger Logger, metrics MetricsRecorder, filters ...MessageFilter) *MessageRouter {
+    return &MessageRouter{
+        filters: filters,
+        logger:  logger,
+        metrics: metrics,
+    }
+}
+
+func (r *MessageRouter) AddRoute(route Route) error {
+    for _, segment := range strings.Split(route.Pattern, ".") {
+        if segment == "" || (strings.ContainsAny(segment, "*#") && len(segment) > 1) {
+            return fmt.Errorf("%w: %q", ErrInvalidPattern, route.Pattern)
+        }
+    }
+    if route.Name == "" {
+        route.Name = route.Pattern
+    }
+    if route.MaxAttempts < 1 {
+        route.MaxAttempts = 1
+    }
+    r.routes = append(r.routes, route)
+    return nil
+}
+
+// Header builds a condition on a header value. Values that parse as
+// numbers are compared as numbers.
+func Header(name string, op Operator, value interface{}) Condition {
+    return func(headers map[string]string, _ interface{}) bool {
+        actual, ok := headers[name]
+        return compareValue(actual, ok, op, value)
+    }
+}
+
+// Payload builds a condition on a field of the JSON payload, addressed by
+// a dot-separated path such as "customer.tier" or "items.0.sku"
+func Payload(path string, op Operator, value interface{}) Condition {
+    return func(_ map[string]string, payload interface{}) bool {
+        actual, ok := lookupPath(payload, path)
+        return compareValue(actual, ok, op, value)
+    }
+}
+
+// HandlerOutcome is what happened to one handler for one message
+type HandlerOutcome struct {
+    Route    string
+    Attempts int
+    Duration time.Duration
+    Err      error
+}
+
+type RouteReport struct {
+    MessageType string
+    Outcomes    []HandlerOutcome
+}
+
+func (rr *RouteReport) Failed() []HandlerOutcome {
+    var failed []HandlerOutcome
+    for _, outcome := range rr.Outcomes {
+        if outcome.Err != nil {
+            failed = append(failed, outcome)
+        }
+    }
+    return failed
+}
+
+// Err joins the errors of every failed handler, or is nil if all succeeded
+func (rr *RouteReport) Err() error {
+    var errs []error
+    for _, outcome := range rr.Failed() {
+        errs = append(errs, fmt.Errorf("route %s: %w", outcome.Route, outcome.Err))
+    }
+    return errors.Join(errs...)
+}
+
+// Route runs every matching handler concurrently and waits for all of them.
+// The report has one outcome per matching route; the error is
+// ErrNoHandlerFound or the joined handler failures.
+func (r *MessageRouter) Route(ctx context.Context, message Message) (*RouteReport, error) {
+    report := &RouteReport{MessageType: message.Type}
+
     // Apply filters
     for _, filter := range r.filters {
         if !filter.Accept(message) {
             r.metrics.IncCounter("messages_filtered")
-            return nil
+            return report, nil
         }
     }
 
     // Find handlers
-    handlers, exists := r.routes[message.Type]
-    if !exists {
+    matched := r.match(message)
+    if len(matched) == 0 {
         r.metrics.IncCounter("messages_unrouted")
-        return ErrNoHandlerFound
+        return report, ErrNoHandlerFound
     }
 
     // Execute handlers
-    for _, handler := range handlers {
-        if err := handler.Handle(ctx, message); err != nil {
-            return fmt.Errorf("handling message: %w", err)
+    report.Outcomes = make([]HandlerOutcome, len(matched))
+    var wg sync.WaitGroup
+    for i, route := range matched {
+        wg.Add(1)
+        go func(i int, route Route) {
+            defer wg.Done()
+            report.Outcomes[i] = r.runHandler(ctx, route, message)
+        }(i, route)
+    }
+    wg.Wait()
+
+    r.metrics.IncCounter("messages_routed")
+    return report, report.Err()
+}
+
+func (r *MessageRouter) match(message Message) []Route {
+    topic := strings.Split(message.Type, ".")
+
+    var payload interface{}
+    decoded := false
+
+    var matched []Route
+    for _, route := range r.routes {
+        if !matchTopic(strings.Split(route.Pattern, "."), topic) {
+            continue
+        }
+        if len(route.Conditions) > 0 && !decoded {
+            if err := json.Unmarshal(message.Payload, &payload); err != nil {
+                payload = nil
+            }
+            decoded = true
+        }
+        accepted := true
+        for _, condition := range route.Conditions {
+            if !condition(message.Headers, payload) {
+                accepted = false
+                break
+            }
+        }
+        if accepted {
+            matched = append(matched, route)
         }
     }
+    return matched
+}
 
-    return nil
+func matchTopic(pattern, topic []string) bool {
+    if len(pattern) == 0 {
+        return len(topic) == 0
+    }
+    switch pattern[0] {
+    case "#":
+        for skip := 0; skip <= len(topic); skip++ {
+            if matchTopic(pattern[1:], topic[skip:]) {
+                return true
+            }
+        }
+        return false
+    case "*":
+        return len(topic) > 0 && matchTopic(pattern[1:], topic[1:])
+    default:
+        return len(topic) > 0 && pattern[0] == topic[0] && matchTopic(pattern[1:], topic[1:])
+    }
+}
+
+// runHandler retries one handler with linear backoff; a panic counts as a
+// failed attempt so it cannot take down the other handlers
+func (r *MessageRouter) runHandler(ctx context.Context, route Route, message Message) (outcome HandlerOutcome) {
+    outcome.Route = route.Name
+    start := time.Now()
+    defer func() {
+        outcome.Duration = time.Since(start)
+        r.metrics.ObserveLatency("message_handler", outcome.Duration)
+    }()
+
+    for outcome.Attempts < route.MaxAttempts {
+        outcome.Attempts++
+        outcome.Err = r.safeHandle(ctx, route.Handler, message)
+        if outcome.Err == nil {
+            return outcome
+        }
+
+        r.metrics.IncCounter("message_handler_errors")
+        r.logger.Error("handler failed",
+            "route", route.Name,
+            "type", message.Type,
+            "attempt", outcome.Attempts,
+            "error", outcome.Err)
+
+        if outcome.Attempts == route.MaxAttempts {
+            break
+        }
+        select {
+        case <-ctx.Done():
+            outcome.Err = ctx.Err()
+            return outcome
+        case <-time.After(route.Backoff * time.Duration(outcome.Attempts)):
+        }
+    }
+    return outcome
+}
+
+func (r *MessageRouter) safeHandle(ctx context.Context, handler MessageHandler, message Message) (err error) {
+    defer func() {
+        if p := recover(); p != nil {
+            err = fmt.Errorf("handler panicked: %v", p)
+        }
+    }()
+    return handler.Handle(ctx, message)
+}
+
+func lookupPath(value interface{}, path string) (interface{}, bool) {
+    for _, key := range strings.Split(path, ".") {
+        switch v := value.(type) {
+        case map[string]interface{}:
+            next, ok := v[key]
+            if !ok {
+                return nil, false
+            }
+            value = next
+        case []interface{}:
+            i, err := strconv.Atoi(key)
+            if err != nil || i < 0 || i >= len(v) {
+                return nil, false
+            }
+            value = v[i]
+        default:
+            return nil, false
+        }
+    }
+    return value, true
+}
+
+func compareValue(actual interface{}, present bool, op Operator, expected interface{}) bool {
+    if op == OpExists {
+        return present
+    }
+    if !present {
+        return op == OpNotEquals
+    }
+
+    switch op {
+    case OpEquals:
+        return equalValues(actual, expected)
+    case OpNotEquals:
+        return !equalValues(actual, expected)
+    case OpGreaterThan, OpLessThan:
+        a, aok := toNumber(actual)
+        e, eok := toNumber(expected)
+        if !aok || !eok {
+            return false
+        }
+        if op == OpGreaterThan {
+            return a > e
+        }
+        return a < e
+    case OpIn:
+        candidates := reflect.ValueOf(expected)
+        if candidates.Kind() != reflect.Slice {
+            return false
+        }
+        for i := 0; i < candidates.Len(); i++ {
+            if equalValues(actual, candidates.Index(i).Interface()) {
+                return true
+            }
+        }
+        return false
+    default:
+        return false
+    }
+}
+
+func equalValues(a, b interface{}) bool {
+    if x, ok := toNumber(a); ok {
+        if y, ok := toNumber(b); ok {
+            return x == y
+        }
+    }
+    return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func toNumber(v interface{}) (float64, bool) {
+    switch n := v.(type) {
+    case float64:
+        return n, true
+    case float32:
+        return float64(n), true
+    case int:
+        return float64(n), true
+    case int64:
+        return float64(n), true
+    case string:
+        f, err := strconv.ParseFloat(n, 64)
+        return f, err == nil
+    default:
+        return 0, false
+    }
+}
+
+// internal/infrastructure/messaging/router_test.go
+type handlerFunc func(ctx context.Context, message Message) error
+
+func (f handlerFunc) Handle(ctx context.Context, message Message) error {
+    return f(ctx, message)
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Info(msg string, args ...interface{})  {}
+func (discardLogger) Error(msg string, args ...interface{}) {}
+
+type discardMetrics struct{}
+
+func (discardMetrics) IncCounter(name string, labels ...string)    {}
+func (discardMetrics) ObserveLatency(name string, d time.Duration) {}
+
+func succeed(context.Context, Message) error { return nil }
+
+func TestMatchTopic(t *testing.T) {
+    tests := []struct {
+        pattern string
+        topic   string
+        want    bool
+    }{
+        {"orders.created", "orders.created", true},
+        {"orders.created", "orders.cancelled", false},
+        {"orders.*", "orders.created", true},
+        {"orders.*", "orders", false},
+        {"orders.*", "orders.item.added", false},
+        {"*.created", "orders.created", true},
+        {"orders.#", "orders", true},
+        {"orders.#", "orders.created", true},
+        {"orders.#", "orders.item.added", true},
+        {"orders.#", "payments.created", false},
+        {"orders.#", "", false},
+        {"#", "", true},
+        {"#", "orders.item.added", true},
+        {"#.added", "added", true},
+        {"#.added", "orders.item.added", true},
+        {"orders.#.added", "orders.added", true},
+        {"orders.#.added", "orders.item.removed", false},
+        {"orders.*.#", "orders", false},
+        {"orders.*.#", "orders.item", true},
+        {"#.#", "orders", true},
+    }
+    for _, tt := range tests {
+        got := matchTopic(strings.Split(tt.pattern, "."), strings.Split(tt.topic, "."))
+        if got != tt.want {
+            t.Errorf("matchTopic(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+        }
+    }
+}
+
+func TestAddRouteRejectsInvalidPatterns(t *testing.T) {
+    router := NewMessageRouter(discardLogger{}, discardMetrics{})
+    for _, pattern := range []string{"", ".", "orders.", ".orders", "orders..created", "orders.#x", "ord*", "orders.**"} {
+        err := router.AddRoute(Route{Pattern: pattern, Handler: handlerFunc(succeed)})
+        if !errors.Is(err, ErrInvalidPattern) {
+            t.Errorf("AddRoute(%q) = %v, want ErrInvalidPattern", pattern, err)
+        }
+    }
+}
+
+func TestRouteMatchesHeadersAndPayload(t *testing.T) {
+    router := NewMessageRouter(discardLogger{}, discardMetrics{})
+    router.AddRoute(Route{
+        Name:       "priority",
+        Pattern:    "orders.*",
+        Conditions: []Condition{Header("priority", OpEquals, "high")},
+        Handler:    handlerFunc(succeed),
+    })
+    router.AddRoute(Route{
+        Name:       "large",
+        Pattern:    "orders.#",
+        Conditions: []Condition{Payload("total", OpGreaterThan, 1000)},
+        Handler:    handlerFunc(succeed),
+    })
+
+    tests := []struct {
+        name    string
+        message Message
+        want    []string
+    }{
+        {"header", Message{Type: "orders.created", Headers: map[string]string{"priority": "high"}, Payload: []byte(`{"total": 10}`)}, []string{"priority"}},
+        {"payload", Message{Type: "orders.created", Payload: []byte(`{"total": 5000}`)}, []string{"large"}},
+        {"both", Message{Type: "orders.created", Headers: map[string]string{"priority": "high"}, Payload: []byte(`{"total": 5000}`)}, []string{"priority", "large"}},
+        {"not json", Message{Type: "orders.created", Payload: []byte("total=5000")}, nil},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            report, err := router.Route(context.Background(), tt.message)
+            if tt.want == nil {
+                if !errors.Is(err, ErrNoHandlerFound) {
+                    t.Fatalf("Route() error = %v, want ErrNoHandlerFound", err)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("Route() error = %v", err)
+            }
+            var got []string
+            for _, outcome := range report.Outcomes {
+                got = append(got, outcome.Route)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("routes = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestRouteRetriesEachHandlerOnItsOwn(t *testing.T) {
+    router := NewMessageRouter(discardLogger{}, discardMetrics{})
+
+    var flakyCalls, healthyCalls int32
+    router.AddRoute(Route{
+        Name:        "flaky",
+        Pattern:     "orders.#",
+        MaxAttempts: 3,
+        Backoff:     time.Millisecond,
+        Handler: handlerFunc(func(context.Context, Message) error {
+            if atomic.AddInt32(&flakyCalls, 1) < 3 {
+                return errors.New("temporarily unavailable")
+            }
+            return nil
+        }),
+    })
+    router.AddRoute(Route{
+        Name:        "broken",
+        Pattern:     "orders.created",
+        MaxAttempts: 2,
+        Backoff:     time.Millisecond,
+        Handler: handlerFunc(func(context.Context, Message) error {
+            return errors.New("always fails")
+        }),
+    })
+    router.AddRoute(Route{
+        Name:    "healthy",
+        Pattern: "*.created",
+        Handler: handlerFunc(func(context.Context, Message) error {
+            atomic.AddInt32(&healthyCalls, 1)
+            return nil
+        }),
+    })
+
+    report, err := router.Route(context.Background(), Message{Type: "orders.created"})
+    if err == nil || !strings.Contains(err.Error(), "route broken") {
+        t.Fatalf("Route() error = %v, want the broken route's failure", err)
+    }
+
+    want := map[string]struct {
+        attempts int
+        failed   bool
+    }{
+        "flaky":   {3, false},
+        "broken":  {2, true},
+        "healthy": {1, false},
+    }
+    for _, outcome := range report.Outcomes {
+        w := want[outcome.Route]
+        if outcome.Attempts != w.attempts || (outcome.Err != nil) != w.failed {
+            t.Errorf("%s: attempts = %d, err = %v; want %d attempts, failed %v",
+                outcome.Route, outcome.Attempts, outcome.Err, w.attempts, w.failed)
+        }
+    }
+    if healthyCalls != 1 {
+        t.Errorf("healthy handler ran %d times, want once", healthyCalls)
+    }
+    if failed := report.Failed(); len(failed) != 1 || failed[0].Route != "broken" {
+        t.Errorf("Failed() = %v, want only broken", failed)
+    }
+}
+
+func TestRouteRecoversPanickingHandler(t *testing.T) {
+    router := NewMessageRouter(discardLogger{}, discardMetrics{})
+    router.AddRoute(Route{
+        Name:        "panics",
+        Pattern:     "orders.*",
+        MaxAttempts: 2,
+        Handler: handlerFunc(func(context.Context, Message) error {
+            panic("nil map")
+        }),
+    })
+    var delivered int32
+    router.AddRoute(Route{
+        Name:    "audit",
+        Pattern: "#",
+        Handler: handlerFunc(func(context.Context, Message) error {
+            atomic.AddInt32(&delivered, 1)
+            return nil
+        }),
+    })
+
+    report, err := router.Route(context.Background(), Message{Type: "orders.created"})
+    if err == nil || !strings.Contains(err.Error(), "handler panicked: nil map") {
+        t.Fatalf("Route() error = %v, want the recovered panic", err)
+    }
+    if delivered != 1 {
+        t.Errorf("audit handler ran %d times, want once", delivered)
+    }
+    failed := report.Failed()
+    if len(failed) != 1 || failed[0].Route != "panics" || failed[0].Attempts != 2 {
+        t.Errorf("Failed() = %+v, want panics after 2 attempts", failed)
+    }
+}
+
+func TestRouteRunsHandlersConcurrently(t *testing.T) {
+    router := NewMessageRouter(discardLogger{}, discardMetrics{})
+
+    // Each handler waits for all the others to start, which only works if
+    // they run at the same time
+    const handlers = 3
+    var started sync.WaitGroup
+    started.Add(handlers)
+    allStarted := make(chan struct{})
+    go func() {
+        started.Wait()
+        close(allStarted)
+    }()
+
+    for i := 0; i < handlers; i++ {
+        router.AddRoute(Route{
+            Name:    fmt.Sprintf("handler-%d", i),
+            Pattern: "orders.#",
+            Handler: handlerFunc(func(context.Context, Message) error {
+                started.Done()
+                select {
+                case <-allStarted:
+                    return nil
+                case <-time.After(time.Second):
+                    return errors.New("handlers ran one after another")
+                }
+            }),
+        })
+    }
+
+    report, err := router.Route(context.Background(), Message{Type: "orders.created"})
+    if err != nil {
+        t.Fatalf("Route() error = %v", err)
+    }
+    if len(report.Outcomes) != handlers {
+        t.Errorf("got %d outcomes, want %d", len(report.Outcomes), handlers)
+    }
+}
+
+func TestRouteStopsRetryingWhenContextIsCanceled(t *testing.T) {
+    router := NewMessageRouter(discardLogger{}, discardMetrics{})
+    router.AddRoute(Route{
+        Pattern:     "orders.created",
+        MaxAttempts: 5,
+        Backoff:     time.Hour,
+        Handler: handlerFunc(func(context.Context, Message) error {
+            return errors.New("unavailable")
+        }),
+    })
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+    defer cancel()
+    report, err := router.Route(ctx, Message{Type: "orders.created"})
+    if !errors.Is(err, context.DeadlineExceeded) {
+        t.Fatalf("Route() error = %v, want context.DeadlineExceeded", err)
+    }
+    if attempts := report.Outcomes[0].Attempts; attempts != 1 {
+        t.Errorf("attempts = %d, want 1", attempts)
+    }
 }
\ No newline at end of file
@@ -1,60 +1,44 @@
 // Example 156
 // internal/infrastructure/gateway/circuitbreaker.go
+// CircuitBreaker guards a backend with the sliding-window breaker from the
+// retry package. 5xx responses count as failures.
 type CircuitBreaker struct {
-    name           string
-    failureThreshold   float64
-    resetTimeout   time.Duration
-    halfOpenMax    int
-    metrics        MetricsRecorder
-    
-    state         State
-    failures      int64
-    successes     int64
-    lastStateChange time.Time
-    mu            sync.RWMutex
+    breaker *retry.CircuitBreaker[*http.Response]
+    client  *http.Client
+    metrics MetricsRecorder
 }
 
-type State int
+func NewCircuitBreaker(config retry.BreakerConfig[*http.Response], metrics MetricsRecorder) *CircuitBreaker {
+    if config.IsFailure == nil {
+        config.IsFailure = func(resp *http.Response, err error) bool {
+            return err != nil || resp.StatusCode >= 500
+        }
+    }
+    onStateChange := config.OnStateChange
+    config.OnStateChange = func(name string, from, to retry.State) {
+        metrics.IncCounter("circuit_breaker_" + to.String())
+        if onStateChange != nil {
+            onStateChange(name, from, to)
+        }
+    }
 
-const (
-    StateClosed State = iota
-    StateOpen
-    StateHalfOpen
-)
+    return &CircuitBreaker{
+        breaker: retry.NewCircuitBreaker(config),
+        client:  http.DefaultClient,
+        metrics: metrics,
+    }
+}
 
 func (cb *CircuitBreaker) Execute(ctx context.Context, req *http.Request) (*http.Response, error) {
-    if !cb.allowRequest() {
+    resp, err := cb.breaker.Execute(func() (*http.Response, error) {
+        return cb.client.Do(req.WithContext(ctx))
+    })
+    if errors.Is(err, retry.ErrCircuitOpen) {
         cb.metrics.IncCounter("circuit_breaker_rejected")
-        return nil, ErrCircuitOpen
     }
-
-    resp, err := http.DefaultClient.Do(req)
-    
-    if err != nil || resp.StatusCode >= 500 {
-        cb.recordFailure()
-        return resp, err
-    }
-
-    cb.recordSuccess()
-    return resp, nil
+    return resp, err
 }
 
-func (cb *CircuitBreaker) allowRequest() bool {
-    cb.mu.RLock()
-    defer cb.mu.RUnlock()
-
-    switch cb.state {
-    case StateClosed:
-        return true
-    case StateOpen:
-        if time.Since(cb.lastStateChange) > cb.resetTimeout {
-            cb.setState(StateHalfOpen)
-            return true
-        }
-        return false
-    case StateHalfOpen:
-        return atomic.LoadInt64(&cb.successes) < int64(cb.halfOpenMax)
-    default:
-        return false
-    }
+func (cb *CircuitBreaker) State() retry.State {
+    return cb.breaker.State()
 }
\ No newline at end of file
@@ -0,0 +1,1036 @@
+// Example 178
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// Event represents a domain event
+type Event struct {
+	ID          string          `json:"id"`
+	AggregateID string          `json:"aggregate_id"`
+	Type        string          `json:"type"`
+	Data        json.RawMessage `json:"data"`
+	Timestamp   time.Time       `json:"timestamp"`
+}
+
+// EventHandler reacts to published events
+type EventHandler func(ctx context.Context, event Event) error
+
+// Command is an instruction dispatched to exactly one handler
+type Command interface {
+	CommandType() string
+}
+
+// CommandHandler executes a command
+type CommandHandler interface {
+	Handle(ctx context.Context, cmd Command) error
+}
+
+// CommandHandlerFunc adapts a function to CommandHandler
+type CommandHandlerFunc func(ctx context.Context, cmd Command) error
+
+func (f CommandHandlerFunc) Handle(ctx context.Context, cmd Command) error {
+	return f(ctx, cmd)
+}
+
+// CommandDispatcher sends commands to their handlers
+type CommandDispatcher interface {
+	Dispatch(ctx context.Context, cmd Command) error
+}
+
+// Logger interface for logging
+type Logger interface {
+	Info(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// SimpleLogger implements Logger
+type SimpleLogger struct{}
+
+func (l *SimpleLogger) Info(msg string, args ...interface{}) {
+	log.Printf("INFO: "+msg, args...)
+}
+
+func (l *SimpleLogger) Error(msg string, args ...interface{}) {
+	log.Printf("ERROR: "+msg, args...)
+}
+
+// CommandBus routes commands to handlers by command type
+type CommandBus struct {
+	mu       sync.RWMutex
+	handlers map[string]CommandHandler
+}
+
+func NewCommandBus() *CommandBus {
+	return &CommandBus{handlers: make(map[string]CommandHandler)}
+}
+
+func (b *CommandBus) Register(commandType string, handler CommandHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[commandType] = handler
+}
+
+func (b *CommandBus) Dispatch(ctx context.Context, cmd Command) error {
+	b.mu.RLock()
+	handler, ok := b.handlers[cmd.CommandType()]
+	b.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("no handler registered for command %s", cmd.CommandType())
+	}
+	return handler.Handle(ctx, cmd)
+}
+
+// InMemoryEventStore stores events and hands them to subscribers once saved
+type InMemoryEventStore struct {
+	mu          sync.Mutex
+	events      []Event
+	subscribers []EventHandler
+}
+
+func NewInMemoryEventStore() *InMemoryEventStore {
+	return &InMemoryEventStore{}
+}
+
+func (s *InMemoryEventStore) Subscribe(handler EventHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers = append(s.subscribers, handler)
+}
+
+func (s *InMemoryEventStore) Save(ctx context.Context, events []Event) error {
+	s.mu.Lock()
+	s.events = append(s.events, events...)
+	subscribers := append([]EventHandler(nil), s.subscribers...)
+	s.mu.Unlock()
+
+	for _, event := range events {
+		for _, subscriber := range subscribers {
+			if err := subscriber(ctx, event); err != nil {
+				return fmt.Errorf("delivering event %s: %w", event.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Events returns a copy of every stored event
+func (s *InMemoryEventStore) Events() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Event(nil), s.events...)
+}
+
+// SagaStatus describes where a saga is in its lifecycle
+type SagaStatus string
+
+const (
+	SagaRunning      SagaStatus = "running"
+	SagaCompleted    SagaStatus = "completed"
+	SagaCompensating SagaStatus = "compensating"
+	SagaCompensated  SagaStatus = "compensated"
+)
+
+// SagaState is the durable state of one running business process
+type SagaState struct {
+	ID             string                 `json:"id"`
+	Type           string                 `json:"type"`
+	Status         SagaStatus             `json:"status"`
+	Step           int                    `json:"step"`
+	Data           map[string]interface{} `json:"data"`
+	CompletedSteps []string               `json:"completed_steps"`
+	// Compensations lists the steps still to be undone, in the order
+	// they will be undone; it shrinks as each compensation is dispatched
+	Compensations   []string        `json:"compensations,omitempty"`
+	Notified        bool            `json:"notified,omitempty"`
+	ProcessedEvents map[string]bool `json:"processed_events"`
+	FailureReason   string          `json:"failure_reason,omitempty"`
+	Deadline        time.Time       `json:"deadline"`
+	Version         int             `json:"version"`
+	UpdatedAt       time.Time       `json:"updated_at"`
+}
+
+// ErrSagaNotFound is returned by SagaStore.Load for unknown sagas
+var ErrSagaNotFound = errors.New("saga not found")
+
+// ErrSagaConflict is returned by SagaStore.Save when the saga was changed
+// by someone else since it was loaded
+var ErrSagaConflict = errors.New("saga was modified concurrently")
+
+// SagaStore persists saga state. Save only succeeds when the stored
+// version still equals state.Version, and increments it. FindExpired
+// returns running and compensating sagas whose deadline has passed.
+type SagaStore interface {
+	Load(ctx context.Context, id string) (*SagaState, error)
+	Save(ctx context.Context, state *SagaState) error
+	FindExpired(ctx context.Context, now time.Time) ([]*SagaState, error)
+}
+
+// InMemorySagaStore implements SagaStore for tests and examples
+type InMemorySagaStore struct {
+	mu     sync.Mutex
+	states map[string][]byte
+}
+
+func NewInMemorySagaStore() *InMemorySagaStore {
+	return &InMemorySagaStore{states: make(map[string][]byte)}
+}
+
+func (s *InMemorySagaStore) Load(ctx context.Context, id string) (*SagaState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.states[id]
+	if !ok {
+		return nil, ErrSagaNotFound
+	}
+
+	// Keep stored state isolated from callers, like a real database would
+	var state SagaState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("decoding saga %s: %w", id, err)
+	}
+	return &state, nil
+}
+
+func (s *InMemorySagaStore) Save(ctx context.Context, state *SagaState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := 0
+	if data, ok := s.states[state.ID]; ok {
+		var current SagaState
+		if err := json.Unmarshal(data, &current); err != nil {
+			return fmt.Errorf("decoding saga %s: %w", state.ID, err)
+		}
+		stored = current.Version
+	}
+	if stored != state.Version {
+		return ErrSagaConflict
+	}
+
+	state.Version++
+	state.UpdatedAt = time.Now()
+	data, err := json.Marshal(state)
+	if err != nil {
+		state.Version--
+		return fmt.Errorf("encoding saga %s: %w", state.ID, err)
+	}
+	s.states[state.ID] = data
+	return nil
+}
+
+func (s *InMemorySagaStore) FindExpired(ctx context.Context, now time.Time) ([]*SagaState, error) {
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.states))
+	for id := range s.states {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+
+	var expired []*SagaState
+	for _, id := range ids {
+		state, err := s.Load(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		active := state.Status == SagaRunning || state.Status == SagaCompensating
+		if active && !state.Deadline.IsZero() && now.After(state.Deadline) {
+			expired = append(expired, state)
+		}
+	}
+	return expired, nil
+}
+
+// PostgresSagaStore implements SagaStore using PostgreSQL
+type PostgresSagaStore struct {
+	db *sql.DB
+}
+
+func NewPostgresSagaStore(db *sql.DB) *PostgresSagaStore {
+	return &PostgresSagaStore{db: db}
+}
+
+func (s *PostgresSagaStore) Load(ctx context.Context, id string) (*SagaState, error) {
+	var data []byte
+	err := s.db.QueryRowContext(ctx, "SELECT state FROM sagas WHERE id = $1", id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSagaNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading saga %s: %w", id, err)
+	}
+
+	var state SagaState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("decoding saga %s: %w", id, err)
+	}
+	return &state, nil
+}
+
+func (s *PostgresSagaStore) Save(ctx context.Context, state *SagaState) error {
+	expected := state.Version
+	state.Version++
+	state.UpdatedAt = time.Now()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		state.Version = expected
+		return fmt.Errorf("encoding saga %s: %w", state.ID, err)
+	}
+
+	var result sql.Result
+	if expected == 0 {
+		result, err = s.db.ExecContext(ctx, `
+			INSERT INTO sagas (id, saga_type, status, deadline, version, state)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (id) DO NOTHING`,
+			state.ID, state.Type, state.Status, state.Deadline, state.Version, data)
+	} else {
+		result, err = s.db.ExecContext(ctx, `
+			UPDATE sagas SET status = $2, deadline = $3, version = $4, state = $5
+			WHERE id = $1 AND version = $6`,
+			state.ID, state.Status, state.Deadline, state.Version, data, expected)
+	}
+	if err != nil {
+		state.Version = expected
+		return fmt.Errorf("saving saga %s: %w", state.ID, err)
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		state.Version = expected
+		return ErrSagaConflict
+	}
+	return nil
+}
+
+func (s *PostgresSagaStore) FindExpired(ctx context.Context, now time.Time) ([]*SagaState, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT state FROM sagas WHERE status IN ($1, $2) AND deadline < $3 ORDER BY deadline",
+		SagaRunning, SagaCompensating, now)
+	if err != nil {
+		return nil, fmt.Errorf("querying expired sagas: %w", err)
+	}
+	defer rows.Close()
+
+	var expired []*SagaState
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("scanning saga: %w", err)
+		}
+		var state SagaState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, fmt.Errorf("decoding saga: %w", err)
+		}
+		expired = append(expired, &state)
+	}
+	return expired, rows.Err()
+}
+
+// SagaStep is one step of a process: the command that performs it, the
+// events that report its outcome and the command that undoes it.
+// Compensation may be dispatched more than once, and for an action that
+// timed out and never ran, so its handler must be idempotent.
+type SagaStep struct {
+	Name         string
+	Action       func(state *SagaState) Command
+	SucceededOn  string
+	FailedOn     string
+	Compensation func(state *SagaState) Command
+	Timeout      time.Duration
+}
+
+// SagaDefinition describes a business process as an ordered list of steps
+type SagaDefinition struct {
+	Name      string
+	StartedBy string
+	// Correlate returns the saga ID an event belongs to
+	Correlate func(event Event) string
+	// Start copies the data the steps need out of the starting event
+	Start         func(state *SagaState, event Event) error
+	Steps         []SagaStep
+	OnCompleted   func(state *SagaState) Command
+	OnCompensated func(state *SagaState) Command
+}
+
+// ProcessManager drives sagas: it reacts to events, dispatches the next
+// command, persists saga state, and compensates completed steps when a step
+// fails or times out.
+//
+// State is saved before commands are dispatched. If the process crashes in
+// between, the command is lost, the step times out and the saga compensates.
+// A compensating saga records which compensations are still outstanding and
+// only becomes compensated once all of them were dispatched; until then
+// CheckTimeouts keeps resuming it, so no saga is ever left hanging.
+type ProcessManager struct {
+	definitions []*SagaDefinition
+	store       SagaStore
+	commands    CommandDispatcher
+	logger      Logger
+	now         func() time.Time
+	// retryDelay is how long a compensating saga waits before
+	// CheckTimeouts resumes it
+	retryDelay time.Duration
+}
+
+func NewProcessManager(store SagaStore, commands CommandDispatcher, logger Logger) *ProcessManager {
+	return &ProcessManager{
+		store:      store,
+		commands:   commands,
+		logger:     logger,
+		now:        time.Now,
+		retryDelay: 30 * time.Second,
+	}
+}
+
+// Register adds a saga definition
+func (pm *ProcessManager) Register(definition *SagaDefinition) {
+	pm.definitions = append(pm.definitions, definition)
+}
+
+// HandleEvent routes an event to every saga it starts or advances
+func (pm *ProcessManager) HandleEvent(ctx context.Context, event Event) error {
+	for _, definition := range pm.definitions {
+		if err := pm.handle(ctx, definition, event); err != nil {
+			return fmt.Errorf("saga %s: %w", definition.Name, err)
+		}
+	}
+	return nil
+}
+
+func (pm *ProcessManager) handle(ctx context.Context, definition *SagaDefinition, event Event) error {
+	sagaID := definition.Correlate(event)
+	if sagaID == "" {
+		return nil
+	}
+
+	if event.Type == definition.StartedBy {
+		return pm.start(ctx, definition, sagaID, event)
+	}
+
+	state, err := pm.store.Load(ctx, sagaID)
+	if errors.Is(err, ErrSagaNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if state.ProcessedEvents[event.ID] {
+		return nil
+	}
+	if state.Status != SagaRunning {
+		return pm.handleLate(ctx, definition, state, event)
+	}
+
+	step := definition.Steps[state.Step]
+	switch event.Type {
+	case step.SucceededOn:
+		state.ProcessedEvents[event.ID] = true
+		state.CompletedSteps = append(state.CompletedSteps, step.Name)
+		return pm.advance(ctx, definition, state)
+	case step.FailedOn:
+		state.ProcessedEvents[event.ID] = true
+		return pm.compensate(ctx, definition, state, fmt.Sprintf("step %s failed", step.Name), false)
+	default:
+		return nil
+	}
+}
+
+// handleLate deals with a step succeeding after the saga stopped waiting
+// for it, typically after a timeout. The action did happen after all, so it
+// is undone again even if its compensation was sent when the step timed
+// out: that one may have arrived before the action it was meant to undo.
+func (pm *ProcessManager) handleLate(ctx context.Context, definition *SagaDefinition, state *SagaState, event Event) error {
+	if state.Status != SagaCompensating && state.Status != SagaCompensated {
+		return nil
+	}
+
+	for i := 0; i <= state.Step && i < len(definition.Steps); i++ {
+		step := definition.Steps[i]
+		if step.SucceededOn != event.Type || step.Compensation == nil || contains(state.CompletedSteps, step.Name) {
+			continue
+		}
+
+		pm.logger.Info("Saga %s: step %s succeeded late, compensating it", state.ID, step.Name)
+		state.ProcessedEvents[event.ID] = true
+		if !contains(state.Compensations, step.Name) {
+			state.Compensations = append(state.Compensations, step.Name)
+		}
+		state.Status = SagaCompensating
+		return pm.resumeCompensation(ctx, definition, state)
+	}
+	return nil
+}
+
+func (pm *ProcessManager) start(ctx context.Context, definition *SagaDefinition, sagaID string, event Event) error {
+	state := &SagaState{
+		ID:              sagaID,
+		Type:            definition.Name,
+		Status:          SagaRunning,
+		Data:            make(map[string]interface{}),
+		ProcessedEvents: map[string]bool{event.ID: true},
+	}
+	if err := definition.Start(state, event); err != nil {
+		return fmt.Errorf("starting saga %s: %w", sagaID, err)
+	}
+
+	// Redelivery of the starting event must not start the saga twice
+	if _, err := pm.store.Load(ctx, sagaID); err == nil {
+		return nil
+	}
+
+	pm.logger.Info("Saga %s (%s) started", sagaID, definition.Name)
+	return pm.runStep(ctx, definition, state)
+}
+
+// advance moves to the next step, or completes the saga after the last one
+func (pm *ProcessManager) advance(ctx context.Context, definition *SagaDefinition, state *SagaState) error {
+	state.Step++
+	if state.Step < len(definition.Steps) {
+		return pm.runStep(ctx, definition, state)
+	}
+
+	state.Status = SagaCompleted
+	state.Deadline = time.Time{}
+	if err := pm.store.Save(ctx, state); err != nil {
+		return err
+	}
+
+	pm.logger.Info("Saga %s completed", state.ID)
+	if definition.OnCompleted != nil {
+		return pm.commands.Dispatch(ctx, definition.OnCompleted(state))
+	}
+	return nil
+}
+
+func (pm *ProcessManager) runStep(ctx context.Context, definition *SagaDefinition, state *SagaState) error {
+	step := definition.Steps[state.Step]
+	state.Deadline = time.Time{}
+	if step.Timeout > 0 {
+		state.Deadline = pm.now().Add(step.Timeout)
+	}
+	if err := pm.store.Save(ctx, state); err != nil {
+		return err
+	}
+
+	pm.logger.Info("Saga %s running step %s", state.ID, step.Name)
+	if err := pm.commands.Dispatch(ctx, step.Action(state)); err != nil {
+		// The command never ran, so this step has nothing to undo
+		return pm.compensate(ctx, definition, state, fmt.Sprintf("dispatching %s: %v", step.Name, err), false)
+	}
+	return nil
+}
+
+// compensate switches the saga to compensating and undoes its completed
+// steps in reverse order. A step that timed out may still have run, so with
+// includeCurrent it is undone as well, before the others.
+func (pm *ProcessManager) compensate(ctx context.Context, definition *SagaDefinition, state *SagaState, reason string, includeCurrent bool) error {
+	state.Status = SagaCompensating
+	state.FailureReason = reason
+	state.Compensations = nil
+	if includeCurrent {
+		if step := definition.Steps[state.Step]; step.Compensation != nil {
+			state.Compensations = append(state.Compensations, step.Name)
+		}
+	}
+	for i := len(state.CompletedSteps) - 1; i >= 0; i-- {
+		if step := definition.step(state.CompletedSteps[i]); step != nil && step.Compensation != nil {
+			state.Compensations = append(state.Compensations, step.Name)
+		}
+	}
+
+	pm.logger.Info("Saga %s compensating: %s", state.ID, reason)
+	return pm.resumeCompensation(ctx, definition, state)
+}
+
+// resumeCompensation dispatches the outstanding compensations one at a time,
+// saving progress after each, and marks the saga compensated once they and
+// OnCompensated went through. On failure the saga stays compensating and
+// CheckTimeouts resumes it after retryDelay.
+func (pm *ProcessManager) resumeCompensation(ctx context.Context, definition *SagaDefinition, state *SagaState) error {
+	state.Deadline = pm.now().Add(pm.retryDelay)
+	if err := pm.store.Save(ctx, state); err != nil {
+		return err
+	}
+
+	for len(state.Compensations) > 0 {
+		step := definition.step(state.Compensations[0])
+		if step != nil && step.Compensation != nil {
+			if err := pm.commands.Dispatch(ctx, step.Compensation(state)); err != nil {
+				return fmt.Errorf("compensating %s: %w", step.Name, err)
+			}
+		}
+		state.Compensations = state.Compensations[1:]
+		if err := pm.store.Save(ctx, state); err != nil {
+			return err
+		}
+	}
+
+	if definition.OnCompensated != nil && !state.Notified {
+		if err := pm.commands.Dispatch(ctx, definition.OnCompensated(state)); err != nil {
+			return err
+		}
+	}
+
+	state.Notified = true
+	state.Status = SagaCompensated
+	state.Deadline = time.Time{}
+	if err := pm.store.Save(ctx, state); err != nil {
+		return err
+	}
+	pm.logger.Info("Saga %s compensated", state.ID)
+	return nil
+}
+
+// CheckTimeouts compensates every running saga whose current step passed
+// its deadline and resumes compensating sagas that are due for a retry
+func (pm *ProcessManager) CheckTimeouts(ctx context.Context, now time.Time) error {
+	expired, err := pm.store.FindExpired(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	for _, state := range expired {
+		definition := pm.definition(state.Type)
+		if definition == nil {
+			continue
+		}
+
+		switch state.Status {
+		case SagaRunning:
+			step := definition.Steps[state.Step]
+			err = pm.compensate(ctx, definition, state, fmt.Sprintf("step %s timed out", step.Name), true)
+		case SagaCompensating:
+			err = pm.resumeCompensation(ctx, definition, state)
+		default:
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrSagaConflict) {
+			pm.logger.Error("Compensating saga %s: %v", state.ID, err)
+		}
+	}
+	return nil
+}
+
+// RunTimeouts checks for expired sagas every interval until ctx is canceled
+func (pm *ProcessManager) RunTimeouts(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := pm.CheckTimeouts(ctx, now); err != nil {
+				pm.logger.Error("Checking saga timeouts: %v", err)
+			}
+		}
+	}
+}
+
+func (pm *ProcessManager) definition(name string) *SagaDefinition {
+	for _, definition := range pm.definitions {
+		if definition.Name == name {
+			return definition
+		}
+	}
+	return nil
+}
+
+func (d *SagaDefinition) step(name string) *SagaStep {
+	for i := range d.Steps {
+		if d.Steps[i].Name == name {
+			return &d.Steps[i]
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Commands of the order fulfillment process
+type ProcessPayment struct {
+	OrderID string
+	Amount  float64
+}
+
+type RefundPayment struct {
+	OrderID string
+	Amount  float64
+}
+
+type ReserveInventory struct {
+	OrderID string
+	SKU     string
+	Qty     int
+}
+
+type ReleaseInventory struct {
+	OrderID string
+	SKU     string
+	Qty     int
+}
+
+type CompleteOrder struct{ OrderID string }
+
+type CancelOrder struct {
+	OrderID string
+	Reason  string
+}
+
+func (ProcessPayment) CommandType() string   { return "ProcessPayment" }
+func (RefundPayment) CommandType() string    { return "RefundPayment" }
+func (ReserveInventory) CommandType() string { return "ReserveInventory" }
+func (ReleaseInventory) CommandType() string { return "ReleaseInventory" }
+func (CompleteOrder) CommandType() string    { return "CompleteOrder" }
+func (CancelOrder) CommandType() string      { return "CancelOrder" }
+
+// newEvent builds an event for the example services
+func newEvent(aggregateID, eventType string, data interface{}) Event {
+	payload, _ := json.Marshal(data)
+	return Event{
+		ID:          fmt.Sprintf("evt-%d", time.Now().UnixNano()),
+		AggregateID: aggregateID,
+		Type:        eventType,
+		Data:        payload,
+		Timestamp:   time.Now(),
+	}
+}
+
+// registerServices wires the payment, inventory and order handlers. Payments
+// above paymentLimit are declined and SKUs missing from stock cannot be
+// reserved; a SKU listed in silent never gets an answer.
+func registerServices(bus *CommandBus, store *InMemoryEventStore, paymentLimit float64, stock map[string]int, silent map[string]bool) {
+	save := func(ctx context.Context, event Event) error {
+		return store.Save(ctx, []Event{event})
+	}
+
+	bus.Register("ProcessPayment", CommandHandlerFunc(func(ctx context.Context, cmd Command) error {
+		c := cmd.(ProcessPayment)
+		if c.Amount > paymentLimit {
+			return save(ctx, newEvent(c.OrderID, "PaymentFailed", map[string]interface{}{"order_id": c.OrderID, "reason": "limit exceeded"}))
+		}
+		return save(ctx, newEvent(c.OrderID, "PaymentCaptured", map[string]interface{}{"order_id": c.OrderID, "amount": c.Amount}))
+	}))
+	bus.Register("RefundPayment", CommandHandlerFunc(func(ctx context.Context, cmd Command) error {
+		c := cmd.(RefundPayment)
+		return save(ctx, newEvent(c.OrderID, "PaymentRefunded", map[string]interface{}{"order_id": c.OrderID, "amount": c.Amount}))
+	}))
+	bus.Register("ReserveInventory", CommandHandlerFunc(func(ctx context.Context, cmd Command) error {
+		c := cmd.(ReserveInventory)
+		if silent[c.SKU] {
+			return nil
+		}
+		if stock[c.SKU] < c.Qty {
+			return save(ctx, newEvent(c.OrderID, "InventoryReservationFailed", map[string]interface{}{"order_id": c.OrderID, "sku": c.SKU}))
+		}
+		stock[c.SKU] -= c.Qty
+		return save(ctx, newEvent(c.OrderID, "InventoryReserved", map[string]interface{}{"order_id": c.OrderID, "sku": c.SKU}))
+	}))
+	bus.Register("ReleaseInventory", CommandHandlerFunc(func(ctx context.Context, cmd Command) error {
+		c := cmd.(ReleaseInventory)
+		stock[c.SKU] += c.Qty
+		return save(ctx, newEvent(c.OrderID, "InventoryReleased", map[string]interface{}{"order_id": c.OrderID, "sku": c.SKU}))
+	}))
+	bus.Register("CompleteOrder", CommandHandlerFunc(func(ctx context.Context, cmd Command) error {
+		c := cmd.(CompleteOrder)
+		return save(ctx, newEvent(c.OrderID, "OrderCompleted", map[string]interface{}{"order_id": c.OrderID}))
+	}))
+	bus.Register("CancelOrder", CommandHandlerFunc(func(ctx context.Context, cmd Command) error {
+		c := cmd.(CancelOrder)
+		return save(ctx, newEvent(c.OrderID, "OrderCanceled", map[string]interface{}{"order_id": c.OrderID, "reason": c.Reason}))
+	}))
+}
+
+// OrderFulfillmentSaga takes a placed order through payment and inventory
+// reservation, refunding the payment if the reservation fails
+func OrderFulfillmentSaga() *SagaDefinition {
+	orderID := func(state *SagaState) string { return state.Data["order_id"].(string) }
+	amount := func(state *SagaState) float64 { return state.Data["amount"].(float64) }
+	sku := func(state *SagaState) string { return state.Data["sku"].(string) }
+	qty := func(state *SagaState) int { return int(state.Data["qty"].(float64)) }
+
+	return &SagaDefinition{
+		Name:      "order_fulfillment",
+		StartedBy: "OrderPlaced",
+		Correlate: func(event Event) string { return "fulfillment-" + event.AggregateID },
+		Start: func(state *SagaState, event Event) error {
+			// Round-trip through JSON so numbers look the same as after a reload
+			return json.Unmarshal(event.Data, &state.Data)
+		},
+		Steps: []SagaStep{
+			{
+				Name:        "payment",
+				Action:      func(s *SagaState) Command { return ProcessPayment{OrderID: orderID(s), Amount: amount(s)} },
+				SucceededOn: "PaymentCaptured",
+				FailedOn:    "PaymentFailed",
+				Compensation: func(s *SagaState) Command {
+					return RefundPayment{OrderID: orderID(s), Amount: amount(s)}
+				},
+				Timeout: 30 * time.Second,
+			},
+			{
+				Name:        "inventory",
+				Action:      func(s *SagaState) Command { return ReserveInventory{OrderID: orderID(s), SKU: sku(s), Qty: qty(s)} },
+				SucceededOn: "InventoryReserved",
+				FailedOn:    "InventoryReservationFailed",
+				Compensation: func(s *SagaState) Command {
+					return ReleaseInventory{OrderID: orderID(s), SKU: sku(s), Qty: qty(s)}
+				},
+				Timeout: 30 * time.Second,
+			},
+		},
+		OnCompleted: func(s *SagaState) Command { return CompleteOrder{OrderID: orderID(s)} },
+		OnCompensated: func(s *SagaState) Command {
+			return CancelOrder{OrderID: orderID(s), Reason: s.FailureReason}
+		},
+	}
+}
+
+func setupDatabase(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS sagas (
+			id TEXT PRIMARY KEY,
+			saga_type TEXT NOT NULL,
+			status TEXT NOT NULL,
+			deadline TIMESTAMP,
+			version INTEGER NOT NULL,
+			state JSONB NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS sagas_deadline_idx ON sagas (deadline) WHERE status IN ('running', 'compensating')
+	`)
+	return err
+}
+
+// faultyDispatcher fails the next failures[type] dispatches of a command
+// type and silently drops every command whose type is in drop
+type faultyDispatcher struct {
+	next     CommandDispatcher
+	failures map[string]int
+	drop     map[string]bool
+}
+
+func (d *faultyDispatcher) Dispatch(ctx context.Context, cmd Command) error {
+	if d.failures[cmd.CommandType()] > 0 {
+		d.failures[cmd.CommandType()]--
+		return fmt.Errorf("%s: broker unavailable", cmd.CommandType())
+	}
+	if d.drop[cmd.CommandType()] {
+		return nil
+	}
+	return d.next.Dispatch(ctx, cmd)
+}
+
+// End-to-end tests of the order fulfillment saga against the example services
+func TestOrderFulfillmentSaga(t *testing.T) {
+	later := func(d time.Duration) time.Time { return time.Now().Add(d) }
+
+	tests := []struct {
+		name     string
+		amount   float64
+		sku      string
+		failures map[string]int
+		drop     map[string]bool
+		// run drives the saga after the order was placed
+		run        func(t *testing.T, pm *ProcessManager, store *InMemoryEventStore)
+		wantStatus SagaStatus
+		wantEvents []string
+	}{
+		{
+			name:       "completes",
+			amount:     120,
+			sku:        "book",
+			wantStatus: SagaCompleted,
+			wantEvents: []string{"OrderPlaced", "PaymentCaptured", "InventoryReserved", "OrderCompleted"},
+		},
+		{
+			name:       "payment declined",
+			amount:     900,
+			sku:        "book",
+			wantStatus: SagaCompensated,
+			wantEvents: []string{"OrderPlaced", "PaymentFailed", "OrderCanceled"},
+		},
+		{
+			name:       "out of stock refunds the payment",
+			amount:     80,
+			sku:        "lamp",
+			wantStatus: SagaCompensated,
+			wantEvents: []string{"OrderPlaced", "PaymentCaptured", "InventoryReservationFailed", "PaymentRefunded", "OrderCanceled"},
+		},
+		{
+			name:   "timed out step is compensated too",
+			amount: 60,
+			sku:    "slow-sku",
+			run: func(t *testing.T, pm *ProcessManager, store *InMemoryEventStore) {
+				if err := pm.CheckTimeouts(context.Background(), later(time.Minute)); err != nil {
+					t.Fatalf("CheckTimeouts() error = %v", err)
+				}
+			},
+			wantStatus: SagaCompensated,
+			wantEvents: []string{"OrderPlaced", "PaymentCaptured", "InventoryReleased", "PaymentRefunded", "OrderCanceled"},
+		},
+		{
+			name:     "failed refund is retried",
+			amount:   80,
+			sku:      "lamp",
+			failures: map[string]int{"RefundPayment": 1},
+			run: func(t *testing.T, pm *ProcessManager, store *InMemoryEventStore) {
+				state, err := pm.store.Load(context.Background(), "fulfillment-order")
+				if err != nil {
+					t.Fatalf("Load() error = %v", err)
+				}
+				if state.Status != SagaCompensating {
+					t.Fatalf("status after failed refund = %s, want %s", state.Status, SagaCompensating)
+				}
+				// Too early for a retry
+				if err := pm.CheckTimeouts(context.Background(), time.Now()); err != nil {
+					t.Fatalf("CheckTimeouts() error = %v", err)
+				}
+				if err := pm.CheckTimeouts(context.Background(), later(time.Minute)); err != nil {
+					t.Fatalf("CheckTimeouts() error = %v", err)
+				}
+			},
+			wantStatus: SagaCompensated,
+			wantEvents: []string{"OrderPlaced", "PaymentCaptured", "InventoryReservationFailed", "PaymentRefunded", "OrderCanceled"},
+		},
+		{
+			name:   "late payment is refunded",
+			amount: 50,
+			sku:    "book",
+			drop:   map[string]bool{"ProcessPayment": true},
+			run: func(t *testing.T, pm *ProcessManager, store *InMemoryEventStore) {
+				ctx := context.Background()
+				if err := pm.CheckTimeouts(ctx, later(time.Minute)); err != nil {
+					t.Fatalf("CheckTimeouts() error = %v", err)
+				}
+				captured := newEvent("order", "PaymentCaptured", map[string]interface{}{"order_id": "order", "amount": 50})
+				if err := store.Save(ctx, []Event{captured}); err != nil {
+					t.Fatalf("Save() error = %v", err)
+				}
+				// Redelivery must not refund a second time
+				if err := store.Save(ctx, []Event{captured}); err != nil {
+					t.Fatalf("Save() error = %v", err)
+				}
+			},
+			wantStatus: SagaCompensated,
+			wantEvents: []string{"OrderPlaced", "PaymentRefunded", "OrderCanceled", "PaymentCaptured", "PaymentRefunded", "PaymentCaptured"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := NewInMemoryEventStore()
+			sagas := NewInMemorySagaStore()
+			bus := NewCommandBus()
+			registerServices(bus, store, 500, map[string]int{"book": 5}, map[string]bool{"slow-sku": true})
+
+			commands := &faultyDispatcher{next: bus, failures: tt.failures, drop: tt.drop}
+			pm := NewProcessManager(sagas, commands, &SimpleLogger{})
+			pm.Register(OrderFulfillmentSaga())
+			store.Subscribe(pm.HandleEvent)
+
+			placed := newEvent("order", "OrderPlaced", map[string]interface{}{
+				"order_id": "order", "amount": tt.amount, "sku": tt.sku, "qty": 1,
+			})
+			// A failing compensation is reported to the publisher of the
+			// event that triggered it; the saga itself retries later
+			if err := store.Save(ctx, []Event{placed}); err != nil && len(tt.failures) == 0 {
+				t.Fatalf("placing order: %v", err)
+			}
+			if tt.run != nil {
+				tt.run(t, pm, store)
+			}
+
+			state, err := sagas.Load(ctx, "fulfillment-order")
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if state.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s (%s)", state.Status, tt.wantStatus, state.FailureReason)
+			}
+
+			var got []string
+			for _, event := range store.Events() {
+				got = append(got, event.Type)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.wantEvents) {
+				t.Errorf("events = %v, want %v", got, tt.wantEvents)
+			}
+		})
+	}
+}
+
+func main() {
+	ctx := context.Background()
+	logger := &SimpleLogger{}
+
+	// Everything runs in memory; swap in NewPostgresSagaStore(db) after
+	// setupDatabase(db) to keep saga state across restarts
+	store := NewInMemoryEventStore()
+	sagas := NewInMemorySagaStore()
+	bus := NewCommandBus()
+	registerServices(bus, store, 500, map[string]int{"book": 5}, map[string]bool{"slow-sku": true})
+
+	pm := NewProcessManager(sagas, bus, logger)
+	pm.Register(OrderFulfillmentSaga())
+	store.Subscribe(pm.HandleEvent)
+
+	orders := []struct {
+		id     string
+		amount float64
+		sku    string
+		qty    int
+	}{
+		{"order-1", 120, "book", 1},    // completes
+		{"order-2", 900, "book", 1},    // payment declined
+		{"order-3", 80, "lamp", 1},     // out of stock, payment refunded
+		{"order-4", 60, "slow-sku", 1}, // inventory never answers
+	}
+
+	for _, o := range orders {
+		placed := newEvent(o.id, "OrderPlaced", map[string]interface{}{
+			"order_id": o.id, "amount": o.amount, "sku": o.sku, "qty": o.qty,
+		})
+		if err := store.Save(ctx, []Event{placed}); err != nil {
+			log.Fatalf("Failed to place %s: %v", o.id, err)
+		}
+	}
+
+	// Pretend the step timeout has passed for order-4
+	if err := pm.CheckTimeouts(ctx, time.Now().Add(time.Minute)); err != nil {
+		log.Fatalf("Failed to check timeouts: %v", err)
+	}
+
+	for _, o := range orders {
+		state, err := sagas.Load(ctx, "fulfillment-"+o.id)
+		if err != nil {
+			log.Fatalf("Failed to load saga: %v", err)
+		}
+		fmt.Printf("%s: %s %s\n", o.id, state.Status, state.FailureReason)
+	}
+
+	fmt.Println("\nEvent log:")
+	for _, event := range store.Events() {
+		fmt.Printf("  %s %s\n", event.AggregateID, event.Type)
+	}
+}
\ No newline at end of file
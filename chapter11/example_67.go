@@ -2,8 +2,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -23,9 +27,290 @@ type EventVersioner interface {
 	Upgrade(nextVersion int) (Event, error)
 }
 
+// Upcaster transforms an event payload from one version to the next
+type Upcaster func(data json.RawMessage) (json.RawMessage, error)
+
+// ErrMissingUpcaster is returned when no upcaster covers a step in the chain
+var ErrMissingUpcaster = errors.New("missing upcaster")
+
+type upcasterKey struct {
+	eventType   string
+	fromVersion int
+}
+
+// UpcasterRegistry holds the upcasters of every event type keyed by the
+// version they upgrade from, and chains them to reach the latest version
+type UpcasterRegistry struct {
+	upcasters map[upcasterKey]Upcaster
+	latest    map[string]int
+	oldest    map[string]int
+}
+
+func NewUpcasterRegistry() *UpcasterRegistry {
+	return &UpcasterRegistry{
+		upcasters: make(map[upcasterKey]Upcaster),
+		latest:    make(map[string]int),
+		oldest:    make(map[string]int),
+	}
+}
+
+// Register adds the upcaster that turns eventType payloads of fromVersion
+// into fromVersion+1
+func (r *UpcasterRegistry) Register(eventType string, fromVersion int, upcaster Upcaster) error {
+	key := upcasterKey{eventType: eventType, fromVersion: fromVersion}
+	if _, exists := r.upcasters[key]; exists {
+		return fmt.Errorf("upcaster for %s v%d already registered", eventType, fromVersion)
+	}
+
+	r.upcasters[key] = upcaster
+	if fromVersion+1 > r.latest[eventType] {
+		r.latest[eventType] = fromVersion + 1
+	}
+	return nil
+}
+
+// SetOldestVersion declares the oldest version of eventType still found in
+// the store, for types whose earlier versions were migrated away. Validate
+// assumes version 1 otherwise.
+func (r *UpcasterRegistry) SetOldestVersion(eventType string, version int) {
+	r.oldest[eventType] = version
+}
+
+// GetLatestVersion returns the newest known version of eventType, or 0 if
+// the type has no upcasters
+func (r *UpcasterRegistry) GetLatestVersion(eventType string) int {
+	return r.latest[eventType]
+}
+
+// Validate checks that every event type has an unbroken chain from its
+// oldest stored version, 1 unless set with SetOldestVersion, up to its
+// latest one. Call it at startup so gaps fail fast rather than on the
+// first old event read.
+func (r *UpcasterRegistry) Validate() error {
+	var problems []string
+	for eventType, latest := range r.latest {
+		from, ok := r.oldest[eventType]
+		if !ok {
+			from = 1
+		}
+		for v := from; v < latest; v++ {
+			if _, ok := r.upcasters[upcasterKey{eventType: eventType, fromVersion: v}]; !ok {
+				problems = append(problems, fmt.Sprintf("%s v%d->v%d", eventType, v, v+1))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%w: %s", ErrMissingUpcaster, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// UpgradeTo runs the upcasters of event one step at a time until it
+// reaches targetVersion
+func (r *UpcasterRegistry) UpgradeTo(event Event, targetVersion int) (Event, error) {
+	if targetVersion < event.Version {
+		return event, fmt.Errorf("cannot downgrade %s from v%d to v%d", event.Type, event.Version, targetVersion)
+	}
+
+	upgraded := event
+	for upgraded.Version < targetVersion {
+		upcaster, ok := r.upcasters[upcasterKey{eventType: upgraded.Type, fromVersion: upgraded.Version}]
+		if !ok {
+			return event, fmt.Errorf("%w: %s v%d->v%d", ErrMissingUpcaster, upgraded.Type, upgraded.Version, upgraded.Version+1)
+		}
+
+		data, err := upcaster(upgraded.Data)
+		if err != nil {
+			return event, fmt.Errorf("upcasting %s v%d: %w", upgraded.Type, upgraded.Version, err)
+		}
+		upgraded.Data = data
+		upgraded.Version++
+	}
+
+	return upgraded, nil
+}
+
+// UpgradeEvent brings event to the latest version of its type. Events of
+// types without upcasters are returned unchanged.
+func (r *UpcasterRegistry) UpgradeEvent(event Event) (Event, error) {
+	latest, ok := r.latest[event.Type]
+	if !ok {
+		return event, nil
+	}
+	if event.Version > latest {
+		return event, fmt.Errorf("%s v%d is newer than latest known v%d", event.Type, event.Version, latest)
+	}
+	return r.UpgradeTo(event, latest)
+}
+
+// EventUpgrader is the shape of EventVersioner in example 68, which
+// upgrades events of a single type
+type EventUpgrader interface {
+	UpgradeEvent(event Event) (Event, error)
+	GetLatestVersion() int
+}
+
+// ForType returns an EventUpgrader for one event type backed by the
+// registry
+func (r *UpcasterRegistry) ForType(eventType string) *TypeUpcaster {
+	return &TypeUpcaster{registry: r, eventType: eventType}
+}
+
+// TypeUpcaster upgrades the events of one type through a registry
+type TypeUpcaster struct {
+	registry  *UpcasterRegistry
+	eventType string
+}
+
+var _ EventUpgrader = (*TypeUpcaster)(nil)
+
+func (u *TypeUpcaster) UpgradeEvent(event Event) (Event, error) {
+	if event.Type != u.eventType {
+		return event, fmt.Errorf("upcaster for %s cannot upgrade %s", u.eventType, event.Type)
+	}
+	return u.registry.UpgradeEvent(event)
+}
+
+func (u *TypeUpcaster) GetLatestVersion() int {
+	return u.registry.GetLatestVersion(u.eventType)
+}
+
+// Payload transforms used to build upcasters
+
+// transformFields decodes a JSON object, lets fn modify its fields and
+// encodes it again
+func transformFields(data json.RawMessage, fn func(fields map[string]json.RawMessage) error) (json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("decoding payload: %w", err)
+	}
+	if err := fn(fields); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// RenameField moves the value of field from to field to
+func RenameField(from, to string) Upcaster {
+	return func(data json.RawMessage) (json.RawMessage, error) {
+		return transformFields(data, func(fields map[string]json.RawMessage) error {
+			if value, ok := fields[from]; ok {
+				fields[to] = value
+				delete(fields, from)
+			}
+			return nil
+		})
+	}
+}
+
+// AddDefault sets field to value when the payload does not have it yet
+func AddDefault(field string, value interface{}) Upcaster {
+	return func(data json.RawMessage) (json.RawMessage, error) {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("encoding default for %s: %w", field, err)
+		}
+		return transformFields(data, func(fields map[string]json.RawMessage) error {
+			if _, ok := fields[field]; !ok {
+				fields[field] = encoded
+			}
+			return nil
+		})
+	}
+}
+
+// SplitField splits the string in field on sep into the fields named by
+// into. The last target receives whatever is left over.
+func SplitField(field, sep string, into ...string) Upcaster {
+	return func(data json.RawMessage) (json.RawMessage, error) {
+		return transformFields(data, func(fields map[string]json.RawMessage) error {
+			raw, ok := fields[field]
+			if !ok {
+				return nil
+			}
+			var value string
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return fmt.Errorf("field %s is not a string: %w", field, err)
+			}
+
+			parts := strings.SplitN(value, sep, len(into))
+			for i, target := range into {
+				part := ""
+				if i < len(parts) {
+					part = parts[i]
+				}
+				encoded, _ := json.Marshal(part)
+				fields[target] = encoded
+			}
+			delete(fields, field)
+			return nil
+		})
+	}
+}
+
+// Chain combines upcasters that together form a single version step
+func Chain(upcasters ...Upcaster) Upcaster {
+	return func(data json.RawMessage) (json.RawMessage, error) {
+		var err error
+		for _, upcaster := range upcasters {
+			if data, err = upcaster(data); err != nil {
+				return nil, err
+			}
+		}
+		return data, nil
+	}
+}
+
+// EventReader loads the stored events of an aggregate
+type EventReader interface {
+	Load(ctx context.Context, aggregateID string) ([]Event, error)
+}
+
+// InMemoryEventReader serves events from memory for the example
+type InMemoryEventReader struct {
+	events map[string][]Event
+}
+
+func (r *InMemoryEventReader) Load(ctx context.Context, aggregateID string) ([]Event, error) {
+	return r.events[aggregateID], nil
+}
+
+// UpcastingEventReader upgrades every event it reads, so the rest of the
+// application only ever sees the latest version of each event type
+type UpcastingEventReader struct {
+	reader   EventReader
+	registry *UpcasterRegistry
+}
+
+func NewUpcastingEventReader(reader EventReader, registry *UpcasterRegistry) *UpcastingEventReader {
+	return &UpcastingEventReader{reader: reader, registry: registry}
+}
+
+func (r *UpcastingEventReader) Load(ctx context.Context, aggregateID string) ([]Event, error) {
+	events, err := r.reader.Load(ctx, aggregateID)
+	if err != nil {
+		return nil, err
+	}
+
+	upgraded := make([]Event, len(events))
+	for i, event := range events {
+		if upgraded[i], err = r.registry.UpgradeEvent(event); err != nil {
+			return nil, fmt.Errorf("loading event %s: %w", event.ID, err)
+		}
+	}
+	return upgraded, nil
+}
+
 // OrderCreated is an example of a concrete event
 type OrderCreated struct {
 	Event
+	registry *UpcasterRegistry
+}
+
+func NewOrderCreated(event Event, registry *UpcasterRegistry) OrderCreated {
+	return OrderCreated{Event: event, registry: registry}
 }
 
 func (e OrderCreated) Version() int {
@@ -36,18 +321,47 @@ func (e OrderCreated) Upgrade(nextVersion int) (Event, error) {
 	if nextVersion <= e.Version() {
 		return e.Event, fmt.Errorf("cannot upgrade to same or lower version")
 	}
+	if e.registry == nil {
+		return e.Event, fmt.Errorf("upgrading %s: %w: no registry", e.Type, ErrMissingUpcaster)
+	}
 
-	// In a real scenario, here you would transform the event data
-	// according to the new schema/version
-	upgradedEvent := e.Event
-	upgradedEvent.Version = nextVersion
+	// The registry transforms the data step by step to the new schema
+	return e.registry.UpgradeTo(e.Event, nextVersion)
+}
 
-	return upgradedEvent, nil
+// newOrderUpcasters registers the schema history of order.created:
+// v1->v2 renames amount to total_amount and adds a currency,
+// v2->v3 splits customer_name into first and last name
+func newOrderUpcasters() (*UpcasterRegistry, error) {
+	registry := NewUpcasterRegistry()
+	steps := []struct {
+		from     int
+		upcaster Upcaster
+	}{
+		{1, Chain(RenameField("amount", "total_amount"), AddDefault("currency", "USD"))},
+		{2, SplitField("customer_name", " ", "first_name", "last_name")},
+	}
+	for _, step := range steps {
+		if err := registry.Register("order.created", step.from, step.upcaster); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := registry.Validate(); err != nil {
+		return nil, err
+	}
+	return registry, nil
 }
 
 func main() {
+	registry, err := newOrderUpcasters()
+	if err != nil {
+		fmt.Println("Error registering upcasters:", err)
+		return
+	}
+
 	// Create a sample event
-	orderData := json.RawMessage(`{"order_id": "12345", "customer_id": "C789", "amount": 99.99}`)
+	orderData := json.RawMessage(`{"order_id": "12345", "customer_id": "C789", "customer_name": "Jane Doe", "amount": 99.99}`)
 
 	event := Event{
 		ID:          "evt-001",
@@ -64,7 +378,7 @@ func main() {
 	}
 
 	// Create a versioned event
-	orderCreated := OrderCreated{Event: event}
+	orderCreated := NewOrderCreated(event, registry)
 
 	// Demonstrate event serialization
 	eventJSON, _ := json.MarshalIndent(event, "", "  ")
@@ -81,4 +395,32 @@ func main() {
 	upgradedJSON, _ := json.MarshalIndent(upgradedEvent, "", "  ")
 	fmt.Println("\nUpgraded Event (Version 2):")
 	fmt.Println(string(upgradedJSON))
+
+	// Events are upcast to the latest version automatically when read
+	reader := NewUpcastingEventReader(&InMemoryEventReader{
+		events: map[string][]Event{event.AggregateID: {event}},
+	}, registry)
+
+	loaded, err := reader.Load(context.Background(), event.AggregateID)
+	if err != nil {
+		fmt.Println("Error loading events:", err)
+		return
+	}
+
+	loadedJSON, _ := json.MarshalIndent(loaded[0], "", "  ")
+	fmt.Printf("\nLoaded Event (Version %d):\n", registry.GetLatestVersion(event.Type))
+	fmt.Println(string(loadedJSON))
+
+	// A gap in the chain is reported instead of handing out a stale payload
+	gapped := NewUpcasterRegistry()
+	if err := gapped.Register("order.created", 2, SplitField("customer_name", " ", "first_name", "last_name")); err != nil {
+		fmt.Println("Error registering upcaster:", err)
+		return
+	}
+	if err := gapped.Validate(); err != nil {
+		fmt.Println("\nValidation error:", err)
+	}
+	if _, err := gapped.ForType("order.created").UpgradeEvent(event); err != nil {
+		fmt.Println("\nExpected error:", err)
+	}
 }
\ No newline at end of file
@@ -4,8 +4,11 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
@@ -62,10 +65,82 @@ func (l *SimpleLogger) Error(msg string, args ...interface{}) {
 	fmt.Printf("ERROR: "+msg+"\n", args...)
 }
 
-// EventPublisher interface
+// EventPublisher interface. Publish and PublishBatch return only after the
+// broker confirmed delivery.
 type EventPublisher interface {
 	Publish(ctx context.Context, event Event) error
-	PublishBatch(ctx context.Context, events []Event) error
+	PublishBatch(ctx context.Context, events []Event, mode BatchMode) error
+}
+
+// BatchMode decides what happens to the rest of a batch when some events
+// cannot be delivered
+type BatchMode int
+
+const (
+	// BestEffort delivers as many events as possible. After a failure, the
+	// later events of the same aggregate are skipped so that a consumer
+	// never sees them without the event that failed.
+	BestEffort BatchMode = iota
+	// AllOrNothing makes the batch visible to consumers only if every
+	// event was delivered
+	AllOrNothing
+)
+
+var (
+	// ErrSkipped is reported for events not sent because an earlier event
+	// of the same aggregate failed
+	ErrSkipped = errors.New("skipped after earlier failure of the same aggregate")
+	// ErrRolledBack is reported for events discarded because another event
+	// of an all-or-nothing batch failed
+	ErrRolledBack = errors.New("rolled back with the rest of the batch")
+	// ErrTransactionsDisabled is returned for all-or-nothing batches on a
+	// publisher that was not created with transactions enabled
+	ErrTransactionsDisabled = errors.New("publisher is not transactional")
+)
+
+// EventFailure is an event that was not published and why
+type EventFailure struct {
+	Event Event
+	Err   error
+}
+
+// BatchPublishError lists the events of a batch that were not published.
+// Events not listed were delivered.
+type BatchPublishError struct {
+	Total  int
+	Failed []EventFailure
+}
+
+func (e *BatchPublishError) Error() string {
+	return fmt.Sprintf("publishing batch: %d of %d events failed, first: %s: %v",
+		len(e.Failed), e.Total, e.Failed[0].Event.ID, e.Failed[0].Err)
+}
+
+// Unwrap exposes the individual failures to errors.Is and errors.As
+func (e *BatchPublishError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, f := range e.Failed {
+		errs[i] = f.Err
+	}
+	return errs
+}
+
+// orderedWaves splits events into waves holding at most one event per
+// aggregate, keeping the batch order within each aggregate. Sending a wave
+// only after the previous one was confirmed keeps aggregates in order even
+// when a send fails and later ones succeed.
+func orderedWaves(events []Event) [][]Event {
+	var waves [][]Event
+	seen := make(map[string]int)
+	for _, event := range events {
+		n := seen[event.AggregateID]
+		seen[event.AggregateID] = n + 1
+		if n == len(waves) {
+			waves = append(waves, nil)
+		}
+		waves[n] = append(waves[n], event)
+	}
+	return waves
 }
 
 // KafkaEventPublisher implements EventPublisher using Kafka
@@ -74,20 +149,177 @@ type KafkaEventPublisher struct {
 	topic    string
 	metrics  MetricsRecorder
 	logger   Logger
+
+	// transactional is set when the producer has a transactional.id and
+	// InitTransactions succeeded
+	transactional bool
+	// txMu serializes transactions, the producer allows only one at a time
+	txMu sync.Mutex
 }
 
 func (p *KafkaEventPublisher) Publish(ctx context.Context, event Event) error {
+	err := p.PublishBatch(ctx, []Event{event}, BestEffort)
+	var batchErr *BatchPublishError
+	if errors.As(err, &batchErr) {
+		return batchErr.Failed[0].Err
+	}
+	return err
+}
+
+// PublishBatch publishes events keyed by aggregate ID and waits for their
+// delivery reports. On failure it returns a *BatchPublishError listing the
+// events that were not delivered.
+func (p *KafkaEventPublisher) PublishBatch(ctx context.Context, events []Event, mode BatchMode) error {
+	if len(events) == 0 {
+		return nil
+	}
+
 	start := time.Now()
 	defer func() {
-		p.metrics.ObserveLatency("event_publish", time.Since(start))
+		p.metrics.ObserveLatency("event_publish_batch", time.Since(start))
 	}()
 
+	var failed []EventFailure
+	switch mode {
+	case AllOrNothing:
+		if !p.transactional {
+			return ErrTransactionsDisabled
+		}
+		failed = p.publishTransaction(ctx, events)
+	default:
+		failed = p.publishWaves(ctx, events)
+	}
+
+	for range failed {
+		p.metrics.IncCounter("event_publish_errors")
+	}
+	for i := len(failed); i < len(events); i++ {
+		p.metrics.IncCounter("events_published")
+	}
+	if len(failed) > 0 {
+		return &BatchPublishError{Total: len(events), Failed: failed}
+	}
+	return nil
+}
+
+func (p *KafkaEventPublisher) publishWaves(ctx context.Context, events []Event) []EventFailure {
+	var failed []EventFailure
+	broken := make(map[string]bool)
+
+	for _, wave := range orderedWaves(events) {
+		var send []Event
+		for _, event := range wave {
+			if broken[event.AggregateID] {
+				failed = append(failed, EventFailure{Event: event, Err: ErrSkipped})
+				continue
+			}
+			send = append(send, event)
+		}
+
+		for _, f := range p.produceAndWait(ctx, send) {
+			broken[f.Event.AggregateID] = true
+			failed = append(failed, f)
+		}
+	}
+	return failed
+}
+
+// abortTimeout bounds how long aborting a failed transaction may take
+const abortTimeout = 10 * time.Second
+
+// publishTransaction sends the batch in one Kafka transaction, so consumers
+// reading with isolation.level=read_committed see all events or none
+func (p *KafkaEventPublisher) publishTransaction(ctx context.Context, events []Event) []EventFailure {
+	p.txMu.Lock()
+	defer p.txMu.Unlock()
+
+	rollback := func(cause []EventFailure) []EventFailure {
+		// ctx may be the reason we are aborting, and a canceled abort
+		// leaves the producer stuck in a half-finished transaction
+		abortCtx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+		defer cancel()
+		if err := p.producer.AbortTransaction(abortCtx); err != nil {
+			p.logger.Error("aborting transaction: %v", err)
+		}
+		p.metrics.IncCounter("event_batch_rollbacks")
+		return rolledBack(events, cause)
+	}
+
+	if err := p.producer.BeginTransaction(); err != nil {
+		return failAll(events, fmt.Errorf("beginning transaction: %w", err))
+	}
+
+	// A single partition keeps its order inside a transaction, so there
+	// is no need to send in waves
+	if failed := p.produceAndWait(ctx, events); len(failed) > 0 {
+		return rollback(failed)
+	}
+
+	if err := p.producer.CommitTransaction(ctx); err != nil {
+		var kafkaErr kafka.Error
+		if errors.As(err, &kafkaErr) && kafkaErr.TxnRequiresAbort() {
+			return rollback(failAll(events, fmt.Errorf("committing transaction: %w", err)))
+		}
+		// The outcome is unknown, so report every event as failed and let
+		// the caller retry, consumers may then see duplicates
+		return failAll(events, fmt.Errorf("committing transaction: %w", err))
+	}
+	return nil
+}
+
+// produceAndWait sends events and collects their delivery reports
+func (p *KafkaEventPublisher) produceAndWait(ctx context.Context, events []Event) []EventFailure {
+	var failed []EventFailure
+	deliveries := make(chan kafka.Event, len(events))
+	pending := make(map[int]Event)
+
+	for i, event := range events {
+		msg, err := p.message(event)
+		if err == nil {
+			msg.Opaque = i
+			err = p.producer.Produce(msg, deliveries)
+		}
+		if err != nil {
+			failed = append(failed, EventFailure{Event: event, Err: fmt.Errorf("producing event: %w", err)})
+			continue
+		}
+		pending[i] = event
+	}
+
+	for len(pending) > 0 {
+		select {
+		case <-ctx.Done():
+			// The messages may still be delivered, but the caller has to
+			// treat them as failed
+			for _, event := range pending {
+				failed = append(failed, EventFailure{Event: event, Err: ctx.Err()})
+			}
+			return failed
+		case e := <-deliveries:
+			msg, ok := e.(*kafka.Message)
+			if !ok {
+				continue
+			}
+			i := msg.Opaque.(int)
+			if msg.TopicPartition.Error != nil {
+				failed = append(failed, EventFailure{
+					Event: pending[i],
+					Err:   fmt.Errorf("delivering event: %w", msg.TopicPartition.Error),
+				})
+			}
+			delete(pending, i)
+		}
+	}
+	return failed
+}
+
+func (p *KafkaEventPublisher) message(event Event) (*kafka.Message, error) {
 	data, err := json.Marshal(event)
 	if err != nil {
-		return fmt.Errorf("marshaling event: %w", err)
+		return nil, fmt.Errorf("marshaling event: %w", err)
 	}
 
-	msg := kafka.Message{
+	return &kafka.Message{
 		Key:   []byte(event.AggregateID),
 		Value: data,
 		Headers: []kafka.Header{
@@ -95,25 +327,33 @@ func (p *KafkaEventPublisher) Publish(ctx context.Context, event Event) error {
 			{Key: "event_version", Value: []byte(strconv.Itoa(event.Version))},
 		},
 		TopicPartition: kafka.TopicPartition{Topic: &p.topic, Partition: kafka.PartitionAny},
-	}
+	}, nil
+}
 
-	if err := p.producer.Produce(&msg, nil); err != nil {
-		p.metrics.IncCounter("event_publish_errors")
-		return fmt.Errorf("producing event: %w", err)
+func failAll(events []Event, err error) []EventFailure {
+	failed := make([]EventFailure, len(events))
+	for i, event := range events {
+		failed[i] = EventFailure{Event: event, Err: err}
 	}
-
-	p.metrics.IncCounter("events_published")
-	return nil
+	return failed
 }
 
-// Implementation of PublishBatch to fulfill the EventPublisher interface
-func (p *KafkaEventPublisher) PublishBatch(ctx context.Context, events []Event) error {
-	for _, event := range events {
-		if err := p.Publish(ctx, event); err != nil {
-			return err
+// rolledBack reports the events that failed with their own error and the
+// rest of the batch as rolled back
+func rolledBack(events []Event, failed []EventFailure) []EventFailure {
+	causes := make(map[string]error)
+	for _, f := range failed {
+		causes[f.Event.ID] = f.Err
+	}
+	result := make([]EventFailure, len(events))
+	for i, event := range events {
+		err, ok := causes[event.ID]
+		if !ok {
+			err = ErrRolledBack
 		}
+		result[i] = EventFailure{Event: event, Err: err}
 	}
-	return nil
+	return result
 }
 
 // NewKafkaEventPublisher creates a new KafkaEventPublisher
@@ -126,10 +366,133 @@ func NewKafkaEventPublisher(producer *kafka.Producer, topic string, metrics Metr
 	}
 }
 
+// NewTransactionalKafkaEventPublisher creates a publisher that supports
+// AllOrNothing batches. The producer must be configured with a
+// transactional.id.
+func NewTransactionalKafkaEventPublisher(ctx context.Context, producer *kafka.Producer, topic string, metrics MetricsRecorder, logger Logger) (*KafkaEventPublisher, error) {
+	if err := producer.InitTransactions(ctx); err != nil {
+		return nil, fmt.Errorf("initializing transactions: %w", err)
+	}
+	p := NewKafkaEventPublisher(producer, topic, metrics, logger)
+	p.transactional = true
+	return p, nil
+}
+
+// InMemoryEventPublisher implements EventPublisher with the same ordering
+// and failure semantics as KafkaEventPublisher, for tests
+type InMemoryEventPublisher struct {
+	mu        sync.Mutex
+	published []Event
+	// FailWith, when set, decides whether delivering an event fails
+	FailWith func(event Event) error
+}
+
+func NewInMemoryEventPublisher() *InMemoryEventPublisher {
+	return &InMemoryEventPublisher{}
+}
+
+func (p *InMemoryEventPublisher) Publish(ctx context.Context, event Event) error {
+	err := p.PublishBatch(ctx, []Event{event}, BestEffort)
+	var batchErr *BatchPublishError
+	if errors.As(err, &batchErr) {
+		return batchErr.Failed[0].Err
+	}
+	return err
+}
+
+func (p *InMemoryEventPublisher) PublishBatch(ctx context.Context, events []Event, mode BatchMode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var failed []EventFailure
+	var delivered []Event
+	broken := make(map[string]bool)
+	for _, wave := range orderedWaves(events) {
+		for _, event := range wave {
+			if broken[event.AggregateID] && mode == BestEffort {
+				failed = append(failed, EventFailure{Event: event, Err: ErrSkipped})
+				continue
+			}
+			if p.FailWith != nil {
+				if err := p.FailWith(event); err != nil {
+					broken[event.AggregateID] = true
+					failed = append(failed, EventFailure{Event: event, Err: err})
+					continue
+				}
+			}
+			delivered = append(delivered, event)
+		}
+	}
+
+	if len(failed) > 0 && mode == AllOrNothing {
+		return &BatchPublishError{Total: len(events), Failed: rolledBack(events, failed)}
+	}
+	p.published = append(p.published, delivered...)
+	if len(failed) > 0 {
+		return &BatchPublishError{Total: len(events), Failed: failed}
+	}
+	return nil
+}
+
+// Published returns the delivered events of an aggregate in delivery order
+func (p *InMemoryEventPublisher) Published(aggregateID string) []Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var events []Event
+	for _, event := range p.published {
+		if event.AggregateID == aggregateID {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// runInMemoryDemo shows partial failures in both batch modes without a broker
+func runInMemoryDemo() {
+	publisher := NewInMemoryEventPublisher()
+	publisher.FailWith = func(event Event) error {
+		if event.ID == "evt-2" {
+			return errors.New("broker rejected message")
+		}
+		return nil
+	}
+
+	batch := []Event{
+		{ID: "evt-1", Type: "order.created", AggregateID: "order-1", Version: 1},
+		{ID: "evt-2", Type: "order.paid", AggregateID: "order-1", Version: 2},
+		{ID: "evt-3", Type: "order.shipped", AggregateID: "order-1", Version: 3},
+		{ID: "evt-4", Type: "order.created", AggregateID: "order-2", Version: 1},
+	}
+
+	for _, mode := range []BatchMode{BestEffort, AllOrNothing} {
+		err := publisher.PublishBatch(context.Background(), batch, mode)
+		var batchErr *BatchPublishError
+		if errors.As(err, &batchErr) {
+			for _, f := range batchErr.Failed {
+				fmt.Printf("mode %d: %s not published: %v\n", mode, f.Event.ID, f.Err)
+			}
+		}
+	}
+	fmt.Printf("order-1 events published: %d, order-2 events published: %d\n",
+		len(publisher.Published("order-1")), len(publisher.Published("order-2")))
+}
+
 func main() {
-	// Create a Kafka producer configuration
+	if os.Getenv("PUBLISHER") == "memory" {
+		runInMemoryDemo()
+		return
+	}
+
+	// Create a Kafka producer configuration. Idempotence keeps retried
+	// messages in order and free of duplicates.
 	config := &kafka.ConfigMap{
-		"bootstrap.servers": "localhost:9092",
+		"bootstrap.servers":  "localhost:9092",
+		"enable.idempotence": true,
 	}
 
 	// Create a producer instance
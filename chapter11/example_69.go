@@ -2,14 +2,26 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
 	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
 )
 
 // Event represents a domain event
@@ -29,10 +41,58 @@ type Aggregate interface {
 	ApplyEvent(event Event) error
 }
 
-// EventStore interface defines methods for storing and loading events
+// EventStore interface defines methods for storing and loading events.
+// Save appends events to the stream of aggregateID only if the stream is
+// still at expectedVersion (0 for a new stream).
 type EventStore interface {
-	Save(ctx context.Context, events []Event) error
+	Save(ctx context.Context, aggregateID string, expectedVersion int, events []Event) error
 	Load(ctx context.Context, aggregateID string) ([]Event, error)
+	LoadFrom(ctx context.Context, aggregateID string, afterVersion int) ([]Event, error)
+	// LoadAsOf returns the events recorded at or before the given time
+	LoadAsOf(ctx context.Context, aggregateID string, at time.Time) ([]Event, error)
+	// LoadUntilVersion returns the events up to and including version
+	LoadUntilVersion(ctx context.Context, aggregateID string, version int) ([]Event, error)
+}
+
+// ErrConcurrencyConflict is returned by Save when another writer appended to
+// the stream after the caller loaded it
+var ErrConcurrencyConflict = errors.New("concurrency conflict")
+
+// ConcurrencyConflictError describes a rejected append. It matches
+// ErrConcurrencyConflict with errors.Is.
+type ConcurrencyConflictError struct {
+	AggregateID     string
+	ExpectedVersion int
+	ActualVersion   int
+}
+
+func (e *ConcurrencyConflictError) Error() string {
+	if e.ActualVersion < 0 {
+		return fmt.Sprintf("concurrency conflict on aggregate %s: expected version %d", e.AggregateID, e.ExpectedVersion)
+	}
+	return fmt.Sprintf("concurrency conflict on aggregate %s: expected version %d, stream is at %d",
+		e.AggregateID, e.ExpectedVersion, e.ActualVersion)
+}
+
+func (e *ConcurrencyConflictError) Is(target error) bool {
+	return target == ErrConcurrencyConflict
+}
+
+// validateAppend checks that events belong to aggregateID and continue the
+// stream right after expectedVersion without gaps
+func validateAppend(aggregateID string, expectedVersion int, events []Event) error {
+	if expectedVersion < 0 {
+		return fmt.Errorf("invalid expected version %d", expectedVersion)
+	}
+	for i, event := range events {
+		if event.AggregateID != aggregateID {
+			return fmt.Errorf("event %s belongs to aggregate %s, not %s", event.ID, event.AggregateID, aggregateID)
+		}
+		if want := expectedVersion + i + 1; event.Version != want {
+			return fmt.Errorf("event %s has version %d, expected %d", event.ID, event.Version, want)
+		}
+	}
+	return nil
 }
 
 // Logger is a simple interface for logging
@@ -47,111 +107,1145 @@ type MetricsRecorder interface {
 	RecordEventLoaded(eventType string)
 }
 
-// SimpleLogger implements the Logger interface
-type SimpleLogger struct{}
-
-func (l *SimpleLogger) Info(msg string, args ...interface{}) {
-	log.Printf("[INFO] "+msg, args...)
+// SimpleLogger implements the Logger interface
+type SimpleLogger struct{}
+
+func (l *SimpleLogger) Info(msg string, args ...interface{}) {
+	log.Printf("[INFO] "+msg, args...)
+}
+
+func (l *SimpleLogger) Error(msg string, args ...interface{}) {
+	log.Printf("[ERROR] "+msg, args...)
+}
+
+// SimpleMetricsRecorder implements the MetricsRecorder interface
+type SimpleMetricsRecorder struct{}
+
+func (m *SimpleMetricsRecorder) RecordEventSaved(eventType string) {
+	log.Printf("Metric: Event saved: %s", eventType)
+}
+
+func (m *SimpleMetricsRecorder) RecordEventLoaded(eventType string) {
+	log.Printf("Metric: Event loaded: %s", eventType)
+}
+
+// PostgresEventStore implements the EventStore interface
+type PostgresEventStore struct {
+	db      *sql.DB
+	metrics MetricsRecorder
+	logger  Logger
+}
+
+// NewPostgresEventStore creates a new PostgresEventStore
+func NewPostgresEventStore(db *sql.DB, metrics MetricsRecorder, logger Logger) *PostgresEventStore {
+	return &PostgresEventStore{
+		db:      db,
+		metrics: metrics,
+		logger:  logger,
+	}
+}
+
+// saveEvent saves a single event to the database
+func (s *PostgresEventStore) saveEvent(ctx context.Context, tx *sql.Tx, event Event) error {
+	query := `
+		INSERT INTO events (id, aggregate_id, type, version, data, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	_, err := tx.ExecContext(ctx, query, event.ID, event.AggregateID, event.Type, event.Version, event.Data, event.CreatedAt)
+	if err != nil {
+		// The UNIQUE(aggregate_id, version) constraint catches writers that
+		// passed the version check concurrently with us
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return &ConcurrencyConflictError{
+				AggregateID:     event.AggregateID,
+				ExpectedVersion: event.Version - 1,
+				ActualVersion:   -1,
+			}
+		}
+		return fmt.Errorf("inserting event: %w", err)
+	}
+
+	s.metrics.RecordEventSaved(event.Type)
+	s.logger.Info("Event saved", "type", event.Type, "aggregateID", event.AggregateID)
+	return nil
+}
+
+// Save appends events to an aggregate stream in a single transaction,
+// rejecting the append if the stream is no longer at expectedVersion
+func (s *PostgresEventStore) Save(ctx context.Context, aggregateID string, expectedVersion int, events []Event) error {
+	if err := validateAppend(aggregateID, expectedVersion, events); err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Archived events are no longer in the events table, but still count
+	var current int
+	err = tx.QueryRowContext(ctx, `
+		SELECT GREATEST(
+			(SELECT COALESCE(MAX(version), 0) FROM events WHERE aggregate_id = $1),
+			(SELECT COALESCE(MAX(last_version), 0) FROM archived_streams WHERE aggregate_id = $1))
+	`, aggregateID).Scan(&current)
+	if err != nil {
+		return fmt.Errorf("reading stream version: %w", err)
+	}
+	if current != expectedVersion {
+		return &ConcurrencyConflictError{
+			AggregateID:     aggregateID,
+			ExpectedVersion: expectedVersion,
+			ActualVersion:   current,
+		}
+	}
+
+	for _, event := range events {
+		if err := s.saveEvent(ctx, tx, event); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+
+	return nil
+}
+
+// Load retrieves all events for an aggregate
+func (s *PostgresEventStore) Load(ctx context.Context, aggregateID string) ([]Event, error) {
+	return s.LoadFrom(ctx, aggregateID, 0)
+}
+
+// LoadFrom retrieves the events of an aggregate with a version greater than afterVersion
+func (s *PostgresEventStore) LoadFrom(ctx context.Context, aggregateID string, afterVersion int) ([]Event, error) {
+	query := `
+		SELECT id, aggregate_id, type, version, data, created_at
+		FROM events
+		WHERE aggregate_id = $1 AND version > $2
+		ORDER BY version ASC
+	`
+	rows, err := s.db.QueryContext(ctx, query, aggregateID, afterVersion)
+	if err != nil {
+		return nil, fmt.Errorf("querying events: %w", err)
+	}
+	defer rows.Close()
+
+	events, err := scanEvents(rows, s.metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("Events loaded", "aggregateID", aggregateID, "afterVersion", afterVersion, "count", len(events))
+	return events, nil
+}
+
+// LoadAsOf retrieves the events of an aggregate up to the last version
+// recorded at or before at. Cutting by version rather than by created_at
+// keeps the stream gap-free when clocks of different writers disagree.
+func (s *PostgresEventStore) LoadAsOf(ctx context.Context, aggregateID string, at time.Time) ([]Event, error) {
+	return s.query(ctx, `
+		SELECT id, aggregate_id, type, version, data, created_at
+		FROM events
+		WHERE aggregate_id = $1 AND version <= (
+			SELECT COALESCE(MAX(version), 0) FROM events
+			WHERE aggregate_id = $1 AND created_at <= $2)
+		ORDER BY version ASC
+	`, aggregateID, at)
+}
+
+// LoadUntilVersion retrieves the events of an aggregate up to and including version
+func (s *PostgresEventStore) LoadUntilVersion(ctx context.Context, aggregateID string, version int) ([]Event, error) {
+	return s.query(ctx, `
+		SELECT id, aggregate_id, type, version, data, created_at
+		FROM events
+		WHERE aggregate_id = $1 AND version <= $2
+		ORDER BY version ASC
+	`, aggregateID, version)
+}
+
+func (s *PostgresEventStore) query(ctx context.Context, query string, args ...interface{}) ([]Event, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying events: %w", err)
+	}
+	defer rows.Close()
+	return scanEvents(rows, s.metrics)
+}
+
+// scanEvents reads event rows selected as
+// id, aggregate_id, type, version, data, created_at
+func scanEvents(rows *sql.Rows, metrics MetricsRecorder) ([]Event, error) {
+	var events []Event
+	for rows.Next() {
+		var event Event
+		if err := rows.Scan(&event.ID, &event.AggregateID, &event.Type, &event.Version, &event.Data, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scanning event: %w", err)
+		}
+		events = append(events, event)
+		metrics.RecordEventLoaded(event.Type)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating over events: %w", err)
+	}
+	return events, nil
+}
+
+// SQLiteEventStore implements the EventStore interface on SQLite so the
+// store can be exercised locally without a PostgreSQL server. Open the
+// database with _txlock=immediate: a deferred BEGIN lets concurrent saves
+// fail with "database is locked" instead of ErrConcurrencyConflict.
+type SQLiteEventStore struct {
+	db      *sql.DB
+	metrics MetricsRecorder
+	logger  Logger
+}
+
+// NewSQLiteEventStore creates a new SQLiteEventStore
+func NewSQLiteEventStore(db *sql.DB, metrics MetricsRecorder, logger Logger) *SQLiteEventStore {
+	return &SQLiteEventStore{
+		db:      db,
+		metrics: metrics,
+		logger:  logger,
+	}
+}
+
+// Save appends events to an aggregate stream in a single transaction,
+// rejecting the append if the stream is no longer at expectedVersion
+func (s *SQLiteEventStore) Save(ctx context.Context, aggregateID string, expectedVersion int, events []Event) error {
+	if err := validateAppend(aggregateID, expectedVersion, events); err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Archived events are no longer in the events table, but still count
+	var current int
+	err = tx.QueryRowContext(ctx, `
+		SELECT MAX(
+			(SELECT COALESCE(MAX(version), 0) FROM events WHERE aggregate_id = ?1),
+			(SELECT COALESCE(MAX(last_version), 0) FROM archived_streams WHERE aggregate_id = ?1))
+	`, aggregateID).Scan(&current)
+	if err != nil {
+		return fmt.Errorf("reading stream version: %w", err)
+	}
+	if current != expectedVersion {
+		return &ConcurrencyConflictError{
+			AggregateID:     aggregateID,
+			ExpectedVersion: expectedVersion,
+			ActualVersion:   current,
+		}
+	}
+
+	for _, event := range events {
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO events (id, aggregate_id, type, version, data, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+			event.ID, event.AggregateID, event.Type, event.Version, []byte(event.Data), event.CreatedAt.UTC())
+		if err != nil {
+			var sqliteErr sqlite3.Error
+			if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+				return &ConcurrencyConflictError{
+					AggregateID:     aggregateID,
+					ExpectedVersion: expectedVersion,
+					ActualVersion:   -1,
+				}
+			}
+			return fmt.Errorf("inserting event: %w", err)
+		}
+		s.metrics.RecordEventSaved(event.Type)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+
+	s.logger.Info("Events saved", "aggregateID", aggregateID, "count", len(events))
+	return nil
+}
+
+// Load retrieves all events for an aggregate
+func (s *SQLiteEventStore) Load(ctx context.Context, aggregateID string) ([]Event, error) {
+	return s.LoadFrom(ctx, aggregateID, 0)
+}
+
+// LoadFrom retrieves the events of an aggregate with a version greater than afterVersion
+func (s *SQLiteEventStore) LoadFrom(ctx context.Context, aggregateID string, afterVersion int) ([]Event, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, aggregate_id, type, version, data, created_at FROM events WHERE aggregate_id = ? AND version > ? ORDER BY version ASC",
+		aggregateID, afterVersion)
+	if err != nil {
+		return nil, fmt.Errorf("querying events: %w", err)
+	}
+	defer rows.Close()
+
+	events, err := scanEvents(rows, s.metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("Events loaded", "aggregateID", aggregateID, "afterVersion", afterVersion, "count", len(events))
+	return events, nil
+}
+
+// LoadAsOf retrieves the events of an aggregate up to the last version
+// recorded at or before at. Times are stored in UTC so they compare
+// correctly as text.
+func (s *SQLiteEventStore) LoadAsOf(ctx context.Context, aggregateID string, at time.Time) ([]Event, error) {
+	return s.query(ctx, `
+		SELECT id, aggregate_id, type, version, data, created_at FROM events
+		WHERE aggregate_id = ?1 AND version <= (
+			SELECT COALESCE(MAX(version), 0) FROM events
+			WHERE aggregate_id = ?1 AND created_at <= ?2)
+		ORDER BY version ASC`,
+		aggregateID, at.UTC())
+}
+
+// LoadUntilVersion retrieves the events of an aggregate up to and including version
+func (s *SQLiteEventStore) LoadUntilVersion(ctx context.Context, aggregateID string, version int) ([]Event, error) {
+	return s.query(ctx,
+		"SELECT id, aggregate_id, type, version, data, created_at FROM events WHERE aggregate_id = ? AND version <= ? ORDER BY version ASC",
+		aggregateID, version)
+}
+
+func (s *SQLiteEventStore) query(ctx context.Context, query string, args ...interface{}) ([]Event, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying events: %w", err)
+	}
+	defer rows.Close()
+	return scanEvents(rows, s.metrics)
+}
+
+// SegmentStorage is where archived segments are kept, such as a directory
+// or an object store bucket
+type SegmentStorage interface {
+	Put(ctx context.Context, name string, data []byte) error
+	Get(ctx context.Context, name string) ([]byte, error)
+	Delete(ctx context.Context, name string) error
+	List(ctx context.Context) ([]string, error)
+}
+
+// FileSegmentStorage keeps segments as files in a directory
+type FileSegmentStorage struct {
+	dir string
+}
+
+// NewFileSegmentStorage creates the directory if needed
+func NewFileSegmentStorage(dir string) (*FileSegmentStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating segment directory: %w", err)
+	}
+	return &FileSegmentStorage{dir: dir}, nil
+}
+
+// Put writes to a temporary file first, so a crash never leaves a
+// truncated segment under its final name
+func (s *FileSegmentStorage) Put(ctx context.Context, name string, data []byte) error {
+	tmp, err := os.CreateTemp(s.dir, name+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("creating segment file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing segment %s: %w", name, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("syncing segment %s: %w", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing segment %s: %w", name, err)
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, name))
+}
+
+func (s *FileSegmentStorage) Get(ctx context.Context, name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("reading segment %s: %w", name, err)
+	}
+	return data, nil
+}
+
+func (s *FileSegmentStorage) Delete(ctx context.Context, name string) error {
+	err := os.Remove(filepath.Join(s.dir, name))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("deleting segment %s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *FileSegmentStorage) List(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("listing segments: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), segmentSuffix) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+const (
+	segmentSuffix = ".jsonl.gz"
+	segmentFormat = 1
+)
+
+// ErrSegmentCorrupt is returned when a segment does not match its checksum
+// or cannot be decoded
+var ErrSegmentCorrupt = errors.New("segment corrupt")
+
+// segmentHeader is the first line of a segment
+type segmentHeader struct {
+	Format  int    `json:"format"`
+	Segment string `json:"segment"`
+	Events  int    `json:"events"`
+}
+
+// encodeSegment writes a gzip-compressed header line followed by one JSON
+// event per line
+func encodeSegment(name string, events []Event) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	if err := enc.Encode(segmentHeader{Format: segmentFormat, Segment: name, Events: len(events)}); err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		if err := enc.Encode(event); err != nil {
+			return nil, fmt.Errorf("encoding event %s: %w", event.ID, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeSegment checks data against checksum and returns its events
+func decodeSegment(data []byte, checksum string) ([]Event, error) {
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrSegmentCorrupt)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSegmentCorrupt, err)
+	}
+	defer zr.Close()
+
+	dec := json.NewDecoder(zr)
+	var header segmentHeader
+	if err := dec.Decode(&header); err != nil || header.Format != segmentFormat {
+		return nil, fmt.Errorf("%w: bad header", ErrSegmentCorrupt)
+	}
+
+	events := make([]Event, 0, header.Events)
+	for dec.More() {
+		var event Event
+		if err := dec.Decode(&event); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrSegmentCorrupt, err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != header.Events {
+		return nil, fmt.Errorf("%w: header says %d events, found %d", ErrSegmentCorrupt, header.Events, len(events))
+	}
+	return events, nil
+}
+
+// ArchivePolicy selects the aggregates to move out of the events table
+type ArchivePolicy struct {
+	// IdleFor archives aggregates without events for this long
+	IdleFor time.Duration
+	// ClosedTypes are event types that end an aggregate's life, such as
+	// OrderCanceled. Closed aggregates are archived after ClosedFor.
+	ClosedTypes []string
+	ClosedFor   time.Duration
+	// MaxAggregates limits the size of one segment
+	MaxAggregates int
+}
+
+// SegmentInfo describes an archived segment as recorded in the index
+type SegmentInfo struct {
+	Name       string
+	Checksum   string
+	Events     int
+	Aggregates int
+	CreatedAt  time.Time
+}
+
+// SegmentProblem is something Verify found wrong with a segment
+type SegmentProblem struct {
+	Segment string
+	Problem string
+}
+
+// Archiver moves the streams of old or closed aggregates into compressed,
+// checksummed segments. The archive_segments and archived_streams tables
+// index which segment holds which versions of an aggregate. The segment is
+// stored before the events are deleted, so a crash in between leaves at
+// worst an unindexed segment, which Verify reports.
+type Archiver struct {
+	db      *sql.DB
+	live    EventStore
+	storage SegmentStorage
+	logger  Logger
+}
+
+// NewArchiver creates an Archiver. live must be the database store itself,
+// not a TieredEventStore.
+func NewArchiver(db *sql.DB, live EventStore, storage SegmentStorage, logger Logger) *Archiver {
+	return &Archiver{
+		db:      db,
+		live:    live,
+		storage: storage,
+		logger:  logger,
+	}
+}
+
+// archiveCandidate is an aggregate and the last version being archived
+type archiveCandidate struct {
+	aggregateID string
+	version     int
+}
+
+// Archive writes one segment with the aggregates selected by policy and
+// removes their events from the events table. It returns nil when there is
+// nothing to archive.
+func (a *Archiver) Archive(ctx context.Context, policy ArchivePolicy) (*SegmentInfo, error) {
+	candidates, err := a.candidates(ctx, policy)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	var events []Event
+	for _, c := range candidates {
+		stream, err := a.live.LoadUntilVersion(ctx, c.aggregateID, c.version)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %w", c.aggregateID, err)
+		}
+		events = append(events, stream...)
+	}
+
+	now := time.Now().UTC()
+	info := &SegmentInfo{
+		Name:       fmt.Sprintf("segment-%s%s", now.Format("20060102T150405.000000000"), segmentSuffix),
+		Events:     len(events),
+		Aggregates: len(candidates),
+		CreatedAt:  now,
+	}
+	data, err := encodeSegment(info.Name, events)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	info.Checksum = hex.EncodeToString(sum[:])
+
+	if err := a.storage.Put(ctx, info.Name, data); err != nil {
+		return nil, err
+	}
+
+	// Read the segment back before deleting anything from the database
+	stored, err := a.storage.Get(ctx, info.Name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decodeSegment(stored, info.Checksum); err != nil {
+		return nil, fmt.Errorf("verifying segment %s: %w", info.Name, err)
+	}
+
+	if err := a.commitSegment(ctx, info, candidates, events); err != nil {
+		return nil, err
+	}
+
+	a.logger.Info("Segment archived", "segment", info.Name, "aggregates", info.Aggregates, "events", info.Events)
+	return info, nil
+}
+
+func (a *Archiver) candidates(ctx context.Context, policy ArchivePolicy) ([]archiveCandidate, error) {
+	now := time.Now().UTC()
+	args := []interface{}{now.Add(-policy.IdleFor), now.Add(-policy.ClosedFor)}
+	closed := "0"
+	if len(policy.ClosedTypes) > 0 {
+		placeholders := make([]string, len(policy.ClosedTypes))
+		for i, t := range policy.ClosedTypes {
+			args = append(args, t)
+			placeholders[i] = fmt.Sprintf("$%d", len(args))
+		}
+		closed = "SUM(CASE WHEN type IN (" + strings.Join(placeholders, ", ") + ") THEN 1 ELSE 0 END)"
+	}
+	args = append(args, policy.MaxAggregates)
+
+	// Placeholders are written as $n, which SQLite accepts as well
+	rows, err := a.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT aggregate_id, MAX(version)
+		FROM events
+		GROUP BY aggregate_id
+		HAVING MAX(created_at) < $1 OR (MAX(created_at) < $2 AND %s > 0)
+		ORDER BY aggregate_id
+		LIMIT $%d
+	`, closed, len(args)), args...)
+	if err != nil {
+		return nil, fmt.Errorf("selecting aggregates to archive: %w", err)
+	}
+	defer rows.Close()
+
+	var candidates []archiveCandidate
+	for rows.Next() {
+		var c archiveCandidate
+		if err := rows.Scan(&c.aggregateID, &c.version); err != nil {
+			return nil, fmt.Errorf("scanning aggregate: %w", err)
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, rows.Err()
+}
+
+// commitSegment indexes the segment and deletes the archived events in
+// one transaction
+func (a *Archiver) commitSegment(ctx context.Context, info *SegmentInfo, candidates []archiveCandidate, events []Event) error {
+	first := make(map[string]int)
+	for _, event := range events {
+		if _, ok := first[event.AggregateID]; !ok {
+			first[event.AggregateID] = event.Version
+		}
+	}
+
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO archive_segments (name, checksum, event_count, aggregate_count, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, info.Name, info.Checksum, info.Events, info.Aggregates, info.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("indexing segment: %w", err)
+	}
+
+	deleted := 0
+	for _, c := range candidates {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO archived_streams (aggregate_id, segment, first_version, last_version)
+			VALUES ($1, $2, $3, $4)
+		`, c.aggregateID, info.Name, first[c.aggregateID], c.version)
+		if err != nil {
+			return fmt.Errorf("indexing stream %s: %w", c.aggregateID, err)
+		}
+
+		result, err := tx.ExecContext(ctx,
+			"DELETE FROM events WHERE aggregate_id = $1 AND version <= $2",
+			c.aggregateID, c.version)
+		if err != nil {
+			return fmt.Errorf("deleting archived events of %s: %w", c.aggregateID, err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		deleted += int(n)
+	}
+
+	// Another archiver or a restore got in between; the segment stays
+	// unindexed and Verify reports it
+	if deleted != len(events) {
+		return fmt.Errorf("archiving %s: expected to delete %d events, deleted %d", info.Name, len(events), deleted)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+	return nil
+}
+
+// Segments returns the index of archived segments
+func (a *Archiver) Segments(ctx context.Context) ([]SegmentInfo, error) {
+	rows, err := a.db.QueryContext(ctx, `
+		SELECT name, checksum, event_count, aggregate_count, created_at
+		FROM archive_segments
+		ORDER BY name
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("querying segments: %w", err)
+	}
+	defer rows.Close()
+
+	var segments []SegmentInfo
+	for rows.Next() {
+		var s SegmentInfo
+		if err := rows.Scan(&s.Name, &s.Checksum, &s.Events, &s.Aggregates, &s.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scanning segment: %w", err)
+		}
+		segments = append(segments, s)
+	}
+	return segments, rows.Err()
+}
+
+// Verify checks every indexed segment against its checksum and the stream
+// index, and reports stored segments that are not indexed
+func (a *Archiver) Verify(ctx context.Context) ([]SegmentProblem, error) {
+	segments, err := a.Segments(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []SegmentProblem
+	indexed := make(map[string]bool)
+	for _, segment := range segments {
+		indexed[segment.Name] = true
+		problem, err := a.verifySegment(ctx, segment)
+		if err != nil {
+			return nil, err
+		}
+		if problem != "" {
+			problems = append(problems, SegmentProblem{Segment: segment.Name, Problem: problem})
+		}
+	}
+
+	stored, err := a.storage.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range stored {
+		if !indexed[name] {
+			problems = append(problems, SegmentProblem{Segment: name, Problem: "not in the index"})
+		}
+	}
+	return problems, nil
+}
+
+func (a *Archiver) verifySegment(ctx context.Context, segment SegmentInfo) (string, error) {
+	data, err := a.storage.Get(ctx, segment.Name)
+	if err != nil {
+		return err.Error(), nil
+	}
+	events, err := decodeSegment(data, segment.Checksum)
+	if err != nil {
+		return err.Error(), nil
+	}
+	if len(events) != segment.Events {
+		return fmt.Sprintf("index says %d events, segment has %d", segment.Events, len(events)), nil
+	}
+
+	streams, err := a.segmentStreams(ctx, segment.Name)
+	if err != nil {
+		return "", err
+	}
+	found := make(map[string][2]int)
+	for _, event := range events {
+		r, ok := found[event.AggregateID]
+		if !ok {
+			r[0] = event.Version
+		}
+		r[1] = event.Version
+		found[event.AggregateID] = r
+	}
+	if len(found) != len(streams) {
+		return fmt.Sprintf("index lists %d streams, segment has %d", len(streams), len(found)), nil
+	}
+	for id, want := range streams {
+		if found[id] != want {
+			return fmt.Sprintf("stream %s: index says versions %d-%d, segment has %d-%d", id, want[0], want[1], found[id][0], found[id][1]), nil
+		}
+	}
+	return "", nil
+}
+
+// segmentStreams returns the first and last version of each stream the
+// index places in segment
+func (a *Archiver) segmentStreams(ctx context.Context, segment string) (map[string][2]int, error) {
+	rows, err := a.db.QueryContext(ctx,
+		"SELECT aggregate_id, first_version, last_version FROM archived_streams WHERE segment = $1",
+		segment)
+	if err != nil {
+		return nil, fmt.Errorf("querying archived streams: %w", err)
+	}
+	defer rows.Close()
+
+	streams := make(map[string][2]int)
+	for rows.Next() {
+		var id string
+		var r [2]int
+		if err := rows.Scan(&id, &r[0], &r[1]); err != nil {
+			return nil, fmt.Errorf("scanning archived stream: %w", err)
+		}
+		streams[id] = r
+	}
+	return streams, rows.Err()
+}
+
+// Restore moves the events of a segment back into the events table and
+// drops the segment from the index and the storage
+func (a *Archiver) Restore(ctx context.Context, name string) (int, error) {
+	var checksum string
+	err := a.db.QueryRowContext(ctx,
+		"SELECT checksum FROM archive_segments WHERE name = $1", name).Scan(&checksum)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("segment %s is not in the index", name)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("loading segment %s: %w", name, err)
+	}
+
+	data, err := a.storage.Get(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	events, err := decodeSegment(data, checksum)
+	if err != nil {
+		return 0, fmt.Errorf("restoring %s: %w", name, err)
+	}
+
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, event := range events {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO events (id, aggregate_id, type, version, data, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (id) DO NOTHING
+		`, event.ID, event.AggregateID, event.Type, event.Version, []byte(event.Data), event.CreatedAt.UTC())
+		if err != nil {
+			return 0, fmt.Errorf("restoring event %s: %w", event.ID, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM archived_streams WHERE segment = $1", name); err != nil {
+		return 0, fmt.Errorf("removing stream index: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM archive_segments WHERE name = $1", name); err != nil {
+		return 0, fmt.Errorf("removing segment index: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("committing transaction: %w", err)
+	}
+
+	// A failure here leaves an unindexed segment, which Verify reports
+	if err := a.storage.Delete(ctx, name); err != nil {
+		return len(events), err
+	}
+
+	a.logger.Info("Segment restored", "segment", name, "events", len(events))
+	return len(events), nil
+}
+
+// TieredEventStore serves archived streams from their segments and the
+// rest from the live store, so callers of Load and friends never notice
+// that part of a stream was archived. Save goes to the live store, whose
+// version check takes the archived versions into account.
+type TieredEventStore struct {
+	EventStore
+	db      *sql.DB
+	storage SegmentStorage
+}
+
+func NewTieredEventStore(live EventStore, db *sql.DB, storage SegmentStorage) *TieredEventStore {
+	return &TieredEventStore{EventStore: live, db: db, storage: storage}
+}
+
+// loadArchived returns the archived events of an aggregate and the last
+// archived version, 0 if nothing is archived
+func (s *TieredEventStore) loadArchived(ctx context.Context, aggregateID string) ([]Event, int, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT st.segment, seg.checksum, st.last_version
+		FROM archived_streams st
+		JOIN archive_segments seg ON seg.name = st.segment
+		WHERE st.aggregate_id = $1
+		ORDER BY st.first_version
+	`, aggregateID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("querying archive index: %w", err)
+	}
+	type location struct {
+		segment, checksum string
+		lastVersion       int
+	}
+	var locations []location
+	for rows.Next() {
+		var l location
+		if err := rows.Scan(&l.segment, &l.checksum, &l.lastVersion); err != nil {
+			rows.Close()
+			return nil, 0, fmt.Errorf("scanning archive index: %w", err)
+		}
+		locations = append(locations, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("iterating over archive index: %w", err)
+	}
+
+	var events []Event
+	last := 0
+	for _, l := range locations {
+		data, err := s.storage.Get(ctx, l.segment)
+		if err != nil {
+			return nil, 0, err
+		}
+		all, err := decodeSegment(data, l.checksum)
+		if err != nil {
+			return nil, 0, fmt.Errorf("reading segment %s: %w", l.segment, err)
+		}
+		for _, event := range all {
+			if event.AggregateID == aggregateID {
+				events = append(events, event)
+			}
+		}
+		last = l.lastVersion
+	}
+	return events, last, nil
+}
+
+// Load retrieves all events for an aggregate, archived or not
+func (s *TieredEventStore) Load(ctx context.Context, aggregateID string) ([]Event, error) {
+	return s.LoadFrom(ctx, aggregateID, 0)
+}
+
+func (s *TieredEventStore) LoadFrom(ctx context.Context, aggregateID string, afterVersion int) ([]Event, error) {
+	archived, last, err := s.loadArchived(ctx, aggregateID)
+	if err != nil {
+		return nil, err
+	}
+	events := filterEvents(archived, func(e Event) bool { return e.Version > afterVersion })
+	if afterVersion > last {
+		last = afterVersion
+	}
+	live, err := s.EventStore.LoadFrom(ctx, aggregateID, last)
+	if err != nil {
+		return nil, err
+	}
+	return append(events, live...), nil
+}
+
+func (s *TieredEventStore) LoadAsOf(ctx context.Context, aggregateID string, at time.Time) ([]Event, error) {
+	archived, _, err := s.loadArchived(ctx, aggregateID)
+	if err != nil {
+		return nil, err
+	}
+	live, err := s.EventStore.LoadAsOf(ctx, aggregateID, at)
+	if err != nil {
+		return nil, err
+	}
+	if len(live) > 0 {
+		// Live events follow every archived one
+		return append(archived, live...), nil
+	}
+
+	// Cut by version, like the live store, so skewed clocks leave no gaps
+	cutoff := 0
+	for _, e := range archived {
+		if !e.CreatedAt.After(at) && e.Version > cutoff {
+			cutoff = e.Version
+		}
+	}
+	return filterEvents(archived, func(e Event) bool { return e.Version <= cutoff }), nil
+}
+
+func (s *TieredEventStore) LoadUntilVersion(ctx context.Context, aggregateID string, version int) ([]Event, error) {
+	archived, last, err := s.loadArchived(ctx, aggregateID)
+	if err != nil {
+		return nil, err
+	}
+	events := filterEvents(archived, func(e Event) bool { return e.Version <= version })
+	if version <= last {
+		return events, nil
+	}
+	live, err := s.EventStore.LoadUntilVersion(ctx, aggregateID, version)
+	if err != nil {
+		return nil, err
+	}
+	return append(events, live...), nil
+}
+
+func filterEvents(events []Event, keep func(Event) bool) []Event {
+	var kept []Event
+	for _, event := range events {
+		if keep(event) {
+			kept = append(kept, event)
+		}
+	}
+	return kept
 }
 
-func (l *SimpleLogger) Error(msg string, args ...interface{}) {
-	log.Printf("[ERROR] "+msg, args...)
+// Snapshot is the serialized state of an aggregate at a given stream version
+type Snapshot struct {
+	AggregateID   string
+	AggregateType string
+	Version       int
+	SchemaVersion int
+	Data          json.RawMessage
+	CreatedAt     time.Time
 }
 
-// SimpleMetricsRecorder implements the MetricsRecorder interface
-type SimpleMetricsRecorder struct{}
-
-func (m *SimpleMetricsRecorder) RecordEventSaved(eventType string) {
-	log.Printf("Metric: Event saved: %s", eventType)
+// SnapshotStore keeps the latest snapshot of each aggregate
+type SnapshotStore interface {
+	// LoadSnapshot returns nil when the aggregate has no snapshot
+	LoadSnapshot(ctx context.Context, aggregateID string) (*Snapshot, error)
+	SaveSnapshot(ctx context.Context, snapshot Snapshot) error
+	DeleteSnapshot(ctx context.Context, aggregateID string) error
 }
 
-func (m *SimpleMetricsRecorder) RecordEventLoaded(eventType string) {
-	log.Printf("Metric: Event loaded: %s", eventType)
+// SQLSnapshotStore implements SnapshotStore. Its queries run unchanged on
+// both PostgreSQL and SQLite.
+type SQLSnapshotStore struct {
+	db *sql.DB
 }
 
-// PostgresEventStore implements the EventStore interface
-type PostgresEventStore struct {
-	db      *sql.DB
-	metrics MetricsRecorder
-	logger  Logger
+// NewSQLSnapshotStore creates a new SQLSnapshotStore
+func NewSQLSnapshotStore(db *sql.DB) *SQLSnapshotStore {
+	return &SQLSnapshotStore{db: db}
 }
 
-// NewPostgresEventStore creates a new PostgresEventStore
-func NewPostgresEventStore(db *sql.DB, metrics MetricsRecorder, logger Logger) *PostgresEventStore {
-	return &PostgresEventStore{
-		db:      db,
-		metrics: metrics,
-		logger:  logger,
+func (s *SQLSnapshotStore) LoadSnapshot(ctx context.Context, aggregateID string) (*Snapshot, error) {
+	query := `
+		SELECT aggregate_id, aggregate_type, version, schema_version, data, created_at
+		FROM snapshots
+		WHERE aggregate_id = $1
+	`
+	var snapshot Snapshot
+	err := s.db.QueryRowContext(ctx, query, aggregateID).Scan(
+		&snapshot.AggregateID, &snapshot.AggregateType, &snapshot.Version,
+		&snapshot.SchemaVersion, &snapshot.Data, &snapshot.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
 	}
+	if err != nil {
+		return nil, fmt.Errorf("querying snapshot: %w", err)
+	}
+	return &snapshot, nil
 }
 
-// saveEvent saves a single event to the database
-func (s *PostgresEventStore) saveEvent(ctx context.Context, tx *sql.Tx, event Event) error {
+// SaveSnapshot replaces the stored snapshot unless it is already newer
+func (s *SQLSnapshotStore) SaveSnapshot(ctx context.Context, snapshot Snapshot) error {
 	query := `
-		INSERT INTO events (id, aggregate_id, type, version, data, created_at)
+		INSERT INTO snapshots (aggregate_id, aggregate_type, version, schema_version, data, created_at)
 		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (aggregate_id) DO UPDATE SET
+			aggregate_type = excluded.aggregate_type,
+			version = excluded.version,
+			schema_version = excluded.schema_version,
+			data = excluded.data,
+			created_at = excluded.created_at
+		WHERE snapshots.version < excluded.version
+			OR snapshots.schema_version <> excluded.schema_version
 	`
-	_, err := tx.ExecContext(ctx, query, event.ID, event.AggregateID, event.Type, event.Version, event.Data, event.CreatedAt)
+	_, err := s.db.ExecContext(ctx, query,
+		snapshot.AggregateID, snapshot.AggregateType, snapshot.Version,
+		snapshot.SchemaVersion, []byte(snapshot.Data), snapshot.CreatedAt)
 	if err != nil {
-		return fmt.Errorf("inserting event: %w", err)
+		return fmt.Errorf("saving snapshot: %w", err)
 	}
-
-	s.metrics.RecordEventSaved(event.Type)
-	s.logger.Info("Event saved", "type", event.Type, "aggregateID", event.AggregateID)
 	return nil
 }
 
-// Save stores multiple events in a single transaction
-func (s *PostgresEventStore) Save(ctx context.Context, events []Event) error {
-	tx, err := s.db.BeginTx(ctx, nil)
+func (s *SQLSnapshotStore) DeleteSnapshot(ctx context.Context, aggregateID string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM snapshots WHERE aggregate_id = $1", aggregateID)
 	if err != nil {
-		return fmt.Errorf("beginning transaction: %w", err)
+		return fmt.Errorf("deleting snapshot: %w", err)
 	}
-	defer tx.Rollback()
+	return nil
+}
 
-	for _, event := range events {
-		if err := s.saveEvent(ctx, tx, event); err != nil {
-			return err
-		}
+// SnapshotPolicy maps an aggregate type to the number of events after which
+// a new snapshot is taken. Types without an entry are never snapshotted.
+type SnapshotPolicy map[string]int
+
+// Snapshotter restores aggregate state from snapshots and takes new ones
+// according to its policy
+type Snapshotter struct {
+	store  SnapshotStore
+	policy SnapshotPolicy
+	logger Logger
+}
+
+// NewSnapshotter creates a new Snapshotter
+func NewSnapshotter(store SnapshotStore, policy SnapshotPolicy, logger Logger) *Snapshotter {
+	return &Snapshotter{
+		store:  store,
+		policy: policy,
+		logger: logger,
 	}
+}
 
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("committing transaction: %w", err)
+// Restore decodes the latest snapshot of aggregateID into state and returns
+// the version it was taken at, or 0 if there is no usable snapshot.
+// Snapshots written with a different schema version, or that no longer
+// decode into state, are deleted and state is left untouched.
+func (s *Snapshotter) Restore(ctx context.Context, aggregateID string, schemaVersion int, state interface{}) (int, error) {
+	snapshot, err := s.store.LoadSnapshot(ctx, aggregateID)
+	if err != nil {
+		return 0, err
+	}
+	if snapshot == nil {
+		return 0, nil
 	}
 
-	return nil
+	if snapshot.SchemaVersion != schemaVersion {
+		s.logger.Info("Discarding stale snapshot", "aggregateID", aggregateID,
+			"schemaVersion", snapshot.SchemaVersion, "expected", schemaVersion)
+		return 0, s.store.DeleteSnapshot(ctx, aggregateID)
+	}
+
+	// Decode into a fresh value so a snapshot that fails halfway does not
+	// leave state partially filled
+	target := reflect.ValueOf(state).Elem()
+	decoded := reflect.New(target.Type())
+	if err := json.Unmarshal(snapshot.Data, decoded.Interface()); err != nil {
+		s.logger.Info("Discarding undecodable snapshot", "aggregateID", aggregateID, "error", err)
+		return 0, s.store.DeleteSnapshot(ctx, aggregateID)
+	}
+	target.Set(decoded.Elem())
+	return snapshot.Version, nil
 }
 
-// Load retrieves all events for an aggregate
-func (s *PostgresEventStore) Load(ctx context.Context, aggregateID string) ([]Event, error) {
-	query := `
-		SELECT id, aggregate_id, type, version, data, created_at
-		FROM events
-		WHERE aggregate_id = $1
-		ORDER BY version ASC
-	`
-	rows, err := s.db.QueryContext(ctx, query, aggregateID)
-	if err != nil {
-		return nil, fmt.Errorf("querying events: %w", err)
+// MaybeSave stores a snapshot of state when at least the configured number
+// of events have been applied since the previous snapshot
+func (s *Snapshotter) MaybeSave(ctx context.Context, aggregateType, aggregateID string, version, eventsSinceSnapshot, schemaVersion int, state interface{}) error {
+	every, ok := s.policy[aggregateType]
+	if !ok || every <= 0 || eventsSinceSnapshot < every {
+		return nil
 	}
-	defer rows.Close()
 
-	var events []Event
-	for rows.Next() {
-		var event Event
-		if err := rows.Scan(&event.ID, &event.AggregateID, &event.Type, &event.Version, &event.Data, &event.CreatedAt); err != nil {
-			return nil, fmt.Errorf("scanning event: %w", err)
-		}
-		events = append(events, event)
-		s.metrics.RecordEventLoaded(event.Type)
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("encoding snapshot: %w", err)
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("iterating over events: %w", err)
+	snapshot := Snapshot{
+		AggregateID:   aggregateID,
+		AggregateType: aggregateType,
+		Version:       version,
+		SchemaVersion: schemaVersion,
+		Data:          data,
+		CreatedAt:     time.Now(),
+	}
+	if err := s.store.SaveSnapshot(ctx, snapshot); err != nil {
+		return err
 	}
 
-	s.logger.Info("Events loaded", "aggregateID", aggregateID, "count", len(events))
-	return events, nil
+	s.logger.Info("Snapshot saved", "aggregateID", aggregateID, "version", version)
+	return nil
 }
 
 // Example Order aggregate
@@ -165,6 +1259,14 @@ type Order struct {
 	version      int
 }
 
+const (
+	orderAggregateType = "Order"
+
+	// orderSnapshotSchemaVersion must be bumped whenever the serialized
+	// fields of Order change, so old snapshots are rebuilt from events
+	orderSnapshotSchemaVersion = 1
+)
+
 // ID returns the aggregate ID
 func (o *Order) ID() string {
 	return o.OrderID
@@ -219,25 +1321,162 @@ func (o *Order) ApplyEvent(event Event) error {
 	return nil
 }
 
-// LoadOrder loads an order from its event stream
-func LoadOrder(ctx context.Context, orderID string, store EventStore) (*Order, error) {
-	events, err := store.Load(ctx, orderID)
+// LoadOrder loads an order from its event stream. When snapshots is not
+// nil, loading starts from the latest snapshot and replays only the events
+// recorded after it.
+func LoadOrder(ctx context.Context, orderID string, store EventStore, snapshots *Snapshotter) (*Order, error) {
+	order := &Order{}
+	fromVersion := 0
+	if snapshots != nil {
+		version, err := snapshots.Restore(ctx, orderID, orderSnapshotSchemaVersion, order)
+		if err != nil {
+			return nil, fmt.Errorf("restoring snapshot: %w", err)
+		}
+		order.version = version
+		fromVersion = version
+	}
+
+	events, err := store.LoadFrom(ctx, orderID, fromVersion)
 	if err != nil {
 		return nil, fmt.Errorf("loading events: %w", err)
 	}
 
-	if len(events) == 0 {
+	if fromVersion == 0 && len(events) == 0 {
 		return nil, fmt.Errorf("order not found: %s", orderID)
 	}
 
+	if err := order.replay(events); err != nil {
+		return nil, err
+	}
+
+	if snapshots != nil {
+		// A failed snapshot only costs a longer replay next time
+		err := snapshots.MaybeSave(ctx, orderAggregateType, orderID, order.Version(),
+			len(events), orderSnapshotSchemaVersion, order)
+		if err != nil {
+			log.Printf("Warning: saving snapshot for %s: %v", orderID, err)
+		}
+	}
+
+	return order, nil
+}
+
+func (o *Order) replay(events []Event) error {
+	for _, event := range events {
+		if err := o.ApplyEvent(event); err != nil {
+			return fmt.Errorf("applying event: %w", err)
+		}
+	}
+	return nil
+}
+
+// OrderAsOf rebuilds an order as it was at the given time
+func OrderAsOf(ctx context.Context, store EventStore, orderID string, at time.Time) (*Order, error) {
+	events, err := store.LoadAsOf(ctx, orderID, at)
+	if err != nil {
+		return nil, fmt.Errorf("loading events: %w", err)
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("order %s did not exist at %s", orderID, at.Format(time.RFC3339))
+	}
+
+	order := &Order{}
+	if err := order.replay(events); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// OrderAtVersion rebuilds an order as it was right after the given version
+func OrderAtVersion(ctx context.Context, store EventStore, orderID string, version int) (*Order, error) {
+	events, err := store.LoadUntilVersion(ctx, orderID, version)
+	if err != nil {
+		return nil, fmt.Errorf("loading events: %w", err)
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("order %s has no version %d", orderID, version)
+	}
+
 	order := &Order{}
+	if err := order.replay(events); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// FieldChange is a single field that differs between two order states
+type FieldChange struct {
+	Field string
+	From  interface{}
+	To    interface{}
+}
+
+// OrderDiff lists what happened to an order between two points in time
+type OrderDiff struct {
+	From    time.Time
+	To      time.Time
+	Events  []Event
+	Changes []FieldChange
+}
+
+// DiffOrder returns the events recorded after from and up to to, and the
+// fields they changed. An order that did not exist yet at from is compared
+// against an empty order. Both ends are cut by version like LoadAsOf, so
+// clock skew between writers cannot split the stream out of order.
+func DiffOrder(ctx context.Context, store EventStore, orderID string, from, to time.Time) (*OrderDiff, error) {
+	if to.Before(from) {
+		return nil, fmt.Errorf("diff end %s is before start %s", to.Format(time.RFC3339), from.Format(time.RFC3339))
+	}
+
+	earlier, err := store.LoadAsOf(ctx, orderID, from)
+	if err != nil {
+		return nil, fmt.Errorf("loading events: %w", err)
+	}
+	cutoff := 0
+	if len(earlier) > 0 {
+		cutoff = earlier[len(earlier)-1].Version
+	}
+
+	events, err := store.LoadAsOf(ctx, orderID, to)
+	if err != nil {
+		return nil, fmt.Errorf("loading events: %w", err)
+	}
+
+	before, after := &Order{}, &Order{}
+	diff := &OrderDiff{From: from, To: to}
 	for _, event := range events {
-		if err := order.ApplyEvent(event); err != nil {
+		if event.Version <= cutoff {
+			if err := before.ApplyEvent(event); err != nil {
+				return nil, fmt.Errorf("applying event: %w", err)
+			}
+		} else {
+			diff.Events = append(diff.Events, event)
+		}
+		if err := after.ApplyEvent(event); err != nil {
 			return nil, fmt.Errorf("applying event: %w", err)
 		}
 	}
 
-	return order, nil
+	diff.Changes = diffOrders(before, after)
+	return diff, nil
+}
+
+func diffOrders(before, after *Order) []FieldChange {
+	var changes []FieldChange
+	add := func(field string, from, to interface{}, changed bool) {
+		if changed {
+			changes = append(changes, FieldChange{Field: field, From: from, To: to})
+		}
+	}
+
+	add("order_id", before.OrderID, after.OrderID, before.OrderID != after.OrderID)
+	add("customer_id", before.CustomerID, after.CustomerID, before.CustomerID != after.CustomerID)
+	add("status", before.Status, after.Status, before.Status != after.Status)
+	add("total_amount", before.TotalAmount, after.TotalAmount, before.TotalAmount != after.TotalAmount)
+	add("created_at", before.CreatedAt, after.CreatedAt, !before.CreatedAt.Equal(after.CreatedAt))
+	add("last_modified", before.LastModified, after.LastModified, !before.LastModified.Equal(after.LastModified))
+	add("version", before.version, after.version, before.version != after.version)
+	return changes
 }
 
 // CreateOrder creates a new order and saves the event
@@ -261,7 +1500,7 @@ func CreateOrder(ctx context.Context, store EventStore, orderID, customerID stri
 		CreatedAt:   now,
 	}
 
-	if err := store.Save(ctx, []Event{event}); err != nil {
+	if err := store.Save(ctx, orderID, 0, []Event{event}); err != nil {
 		return nil, fmt.Errorf("saving event: %w", err)
 	}
 
@@ -293,7 +1532,7 @@ func UpdateOrder(ctx context.Context, store EventStore, order *Order, totalAmoun
 		CreatedAt:   now,
 	}
 
-	if err := store.Save(ctx, []Event{event}); err != nil {
+	if err := store.Save(ctx, order.ID(), order.Version(), []Event{event}); err != nil {
 		return fmt.Errorf("saving event: %w", err)
 	}
 
@@ -323,7 +1562,7 @@ func CancelOrder(ctx context.Context, store EventStore, order *Order) error {
 		CreatedAt:   now,
 	}
 
-	if err := store.Save(ctx, []Event{event}); err != nil {
+	if err := store.Save(ctx, order.ID(), order.Version(), []Event{event}); err != nil {
 		return fmt.Errorf("saving event: %w", err)
 	}
 
@@ -335,7 +1574,8 @@ func CancelOrder(ctx context.Context, store EventStore, order *Order) error {
 }
 
 func setupDatabase(db *sql.DB) error {
-	// Create events table if not exists
+	// Create events table if not exists. UNIQUE(aggregate_id, version)
+	// is what makes concurrent appends to the same stream fail.
 	_, err := db.Exec(`
 		CREATE TABLE IF NOT EXISTS events (
 			id TEXT PRIMARY KEY,
@@ -347,26 +1587,219 @@ func setupDatabase(db *sql.DB) error {
 			UNIQUE(aggregate_id, version)
 		)
 	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS snapshots (
+			aggregate_id TEXT PRIMARY KEY,
+			aggregate_type TEXT NOT NULL,
+			version INTEGER NOT NULL,
+			schema_version INTEGER NOT NULL,
+			data JSONB NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS archive_segments (
+			name TEXT PRIMARY KEY,
+			checksum TEXT NOT NULL,
+			event_count INTEGER NOT NULL,
+			aggregate_count INTEGER NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS archived_streams (
+			aggregate_id TEXT NOT NULL,
+			segment TEXT NOT NULL REFERENCES archive_segments (name),
+			first_version INTEGER NOT NULL,
+			last_version INTEGER NOT NULL,
+			PRIMARY KEY (aggregate_id, segment)
+		)
+	`)
 	return err
 }
 
-func main() {
-	// Connect to PostgreSQL
-	db, err := sql.Open("postgres", "postgresql://pg:pg@localhost:5432/eventsourcing?sslmode=disable")
+func setupSQLiteDatabase(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS events (
+			id TEXT PRIMARY KEY,
+			aggregate_id TEXT NOT NULL,
+			type TEXT NOT NULL,
+			version INTEGER NOT NULL,
+			data BLOB NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			UNIQUE(aggregate_id, version)
+		)
+	`)
 	if err != nil {
-		log.Fatalf("Error connecting to database: %v", err)
+		return err
 	}
-	defer db.Close()
 
-	// Setup the database
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS snapshots (
+			aggregate_id TEXT PRIMARY KEY,
+			aggregate_type TEXT NOT NULL,
+			version INTEGER NOT NULL,
+			schema_version INTEGER NOT NULL,
+			data BLOB NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS archive_segments (
+			name TEXT PRIMARY KEY,
+			checksum TEXT NOT NULL,
+			event_count INTEGER NOT NULL,
+			aggregate_count INTEGER NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS archived_streams (
+			aggregate_id TEXT NOT NULL,
+			segment TEXT NOT NULL REFERENCES archive_segments (name),
+			first_version INTEGER NOT NULL,
+			last_version INTEGER NOT NULL,
+			PRIMARY KEY (aggregate_id, segment)
+		)
+	`)
+	return err
+}
+
+// openEventStore picks the store from the EVENT_STORE environment variable:
+// "sqlite" uses a local file, anything else uses PostgreSQL
+func openEventStore(logger Logger, metrics MetricsRecorder) (EventStore, *sql.DB, error) {
+	if os.Getenv("EVENT_STORE") == "sqlite" {
+		db, err := sql.Open("sqlite3", "./eventsourcing.db?_txlock=immediate&_busy_timeout=5000")
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening sqlite database: %w", err)
+		}
+		if err := setupSQLiteDatabase(db); err != nil {
+			db.Close()
+			return nil, nil, fmt.Errorf("setting up sqlite database: %w", err)
+		}
+		return NewSQLiteEventStore(db, metrics, logger), db, nil
+	}
+
+	db, err := sql.Open("postgres", "postgresql://pg:pg@localhost:5432/eventsourcing?sslmode=disable")
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting to database: %w", err)
+	}
 	if err := setupDatabase(db); err != nil {
-		log.Fatalf("Error setting up database: %v", err)
+		db.Close()
+		return nil, nil, fmt.Errorf("setting up database: %w", err)
+	}
+	return NewPostgresEventStore(db, metrics, logger), db, nil
+}
+
+// runArchiveCommand implements the archive, verify and restore commands:
+//
+//	go run example_69.go archive -idle-for 2160h -closed-for 720h
+//	go run example_69.go verify
+//	go run example_69.go restore segment-20240101T000000.000000000.jsonl.gz
+func runArchiveCommand(ctx context.Context, archiver *Archiver, args []string) error {
+	switch args[0] {
+	case "archive":
+		flags := flag.NewFlagSet("archive", flag.ExitOnError)
+		idleFor := flags.Duration("idle-for", 90*24*time.Hour, "archive aggregates without events for this long")
+		closedFor := flags.Duration("closed-for", 30*24*time.Hour, "archive canceled orders after this long")
+		maxAggregates := flags.Int("max-aggregates", 1000, "aggregates per segment")
+		flags.Parse(args[1:])
+
+		policy := ArchivePolicy{
+			IdleFor:       *idleFor,
+			ClosedTypes:   []string{"OrderCanceled"},
+			ClosedFor:     *closedFor,
+			MaxAggregates: *maxAggregates,
+		}
+		for {
+			info, err := archiver.Archive(ctx, policy)
+			if err != nil {
+				return err
+			}
+			if info == nil {
+				return nil
+			}
+			fmt.Printf("%s: %d aggregates, %d events, sha256 %s\n", info.Name, info.Aggregates, info.Events, info.Checksum)
+		}
+	case "verify":
+		problems, err := archiver.Verify(ctx)
+		if err != nil {
+			return err
+		}
+		for _, p := range problems {
+			fmt.Printf("%s: %s\n", p.Segment, p.Problem)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("%d segment problem(s) found", len(problems))
+		}
+		fmt.Println("all segments ok")
+		return nil
+	case "restore":
+		if len(args) != 2 {
+			return errors.New("usage: restore <segment>")
+		}
+		n, err := archiver.Restore(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("restored %d events from %s\n", n, args[1])
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q, expected archive, verify or restore", args[0])
 	}
+}
 
-	// Create event store
+func main() {
+	// Create event store. Reads go through the tiered store so archived
+	// streams load like any other.
 	logger := &SimpleLogger{}
 	metrics := &SimpleMetricsRecorder{}
-	store := NewPostgresEventStore(db, metrics, logger)
+	live, db, err := openEventStore(logger, metrics)
+	if err != nil {
+		log.Fatalf("Error opening event store: %v", err)
+	}
+	defer db.Close()
+
+	dir := os.Getenv("ARCHIVE_DIR")
+	if dir == "" {
+		dir = "./archive"
+	}
+	storage, err := NewFileSegmentStorage(dir)
+	if err != nil {
+		log.Fatalf("Error opening segment storage: %v", err)
+	}
+	archiver := NewArchiver(db, live, storage, logger)
+	store := NewTieredEventStore(live, db, storage)
+
+	if len(os.Args) > 1 {
+		if err := runArchiveCommand(context.Background(), archiver, os.Args[1:]); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+
+	// Snapshot orders every 2 events so the demo exercises both paths
+	snapshots := NewSnapshotter(NewSQLSnapshotStore(db), SnapshotPolicy{orderAggregateType: 2}, logger)
 
 	// Create a new order
 	ctx := context.Background()
@@ -377,14 +1810,27 @@ func main() {
 	}
 	log.Printf("Order created: %+v", order)
 
+	// Keep a copy that will go stale once the order is updated
+	staleOrder := *order
+
 	// Update the order
 	if err := UpdateOrder(ctx, store, order, 150.75); err != nil {
 		log.Fatalf("Error updating order: %v", err)
 	}
 	log.Printf("Order updated: %+v", order)
 
+	// A writer holding the old version is rejected instead of
+	// interleaving its event with ours
+	err = UpdateOrder(ctx, store, &staleOrder, 99.99)
+	if !errors.Is(err, ErrConcurrencyConflict) {
+		log.Fatalf("Expected concurrency conflict, got: %v", err)
+	}
+	log.Printf("Stale update rejected: %v", err)
+
+	updatedAt := time.Now()
+
 	// Load the order from events
-	loadedOrder, err := LoadOrder(ctx, orderID, store)
+	loadedOrder, err := LoadOrder(ctx, orderID, store, snapshots)
 	if err != nil {
 		log.Fatalf("Error loading order: %v", err)
 	}
@@ -397,9 +1843,51 @@ func main() {
 	log.Printf("Order canceled: %+v", order)
 
 	// Load the order again to see the final state
-	finalOrder, err := LoadOrder(ctx, orderID, store)
+	finalOrder, err := LoadOrder(ctx, orderID, store, snapshots)
 	if err != nil {
 		log.Fatalf("Error loading final order: %v", err)
 	}
 	log.Printf("Final order state: %+v", finalOrder)
+
+	// Look at the order as it was before it was canceled
+	pastOrder, err := OrderAsOf(ctx, store, orderID, updatedAt)
+	if err != nil {
+		log.Fatalf("Error loading past order: %v", err)
+	}
+	log.Printf("Order as of %s: %+v", updatedAt.Format(time.RFC3339Nano), pastOrder)
+
+	firstVersion, err := OrderAtVersion(ctx, store, orderID, 1)
+	if err != nil {
+		log.Fatalf("Error loading order version 1: %v", err)
+	}
+	log.Printf("Order at version 1: %+v", firstVersion)
+
+	diff, err := DiffOrder(ctx, store, orderID, updatedAt, time.Now())
+	if err != nil {
+		log.Fatalf("Error diffing order: %v", err)
+	}
+	for _, event := range diff.Events {
+		log.Printf("Since %s: event %s (version %d)", updatedAt.Format(time.RFC3339Nano), event.Type, event.Version)
+	}
+	for _, change := range diff.Changes {
+		log.Printf("Since %s: %s changed from %v to %v", updatedAt.Format(time.RFC3339Nano), change.Field, change.From, change.To)
+	}
+
+	// Archive the canceled order and load it again, now from its segment
+	info, err := archiver.Archive(ctx, ArchivePolicy{
+		IdleFor:       90 * 24 * time.Hour,
+		ClosedTypes:   []string{"OrderCanceled"},
+		MaxAggregates: 1000,
+	})
+	if err != nil {
+		log.Fatalf("Error archiving orders: %v", err)
+	}
+	if info != nil {
+		log.Printf("Archived %d orders into %s", info.Aggregates, info.Name)
+	}
+	archivedOrder, err := LoadOrder(ctx, orderID, store, nil)
+	if err != nil {
+		log.Fatalf("Error loading archived order: %v", err)
+	}
+	log.Printf("Archived order state: %+v", archivedOrder)
 }
\ No newline at end of file
@@ -3,35 +3,40 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"reflect"
+	"sync"
+	"testing"
 	"time"
+
+	_ "github.com/lib/pq"
 )
 
-// Command and Query interfaces
+// Command interface
 type Command interface {
 	ToEvents() ([]Event, error)
 }
 
-type Query interface {
-	// Query interface marker
-}
-
 // Handler interfaces
-type CommandHandler interface {
-	Handle(ctx context.Context, cmd Command) error
+type CommandHandler[C any] interface {
+	Handle(ctx context.Context, cmd C) error
 }
 
-type QueryHandler interface {
-	Handle(ctx context.Context, query Query) (interface{}, error)
+type QueryHandler[Q any, R any] interface {
+	Handle(ctx context.Context, query Q) (R, error)
 }
 
 // Event related types
 type Event struct {
-	ID        string
-	Type      string
-	Data      interface{}
-	Timestamp time.Time
+	ID          string
+	AggregateID string
+	Type        string
+	Data        interface{}
+	Timestamp   time.Time
 }
 
 type EventStore interface {
@@ -44,7 +49,7 @@ type EventPublisher interface {
 
 // Support types
 type Validator interface {
-	Validate(cmd Command) error
+	Validate(msg interface{}) error
 }
 
 type MetricsRecorder interface {
@@ -53,66 +58,529 @@ type MetricsRecorder interface {
 }
 
 type Logger interface {
+	Info(msg string, args ...interface{})
 	Error(msg string, args ...interface{})
 }
 
-// Implementation of UserCommandHandler
-type UserCommandHandler struct {
-	eventStore EventStore
-	publisher  EventPublisher
-	validator  Validator
-	metrics    MetricsRecorder
-	logger     Logger
+// Tracer starts a span for each dispatch
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
 }
 
-func (h *UserCommandHandler) Handle(ctx context.Context, cmd Command) error {
-	start := time.Now()
-	defer func() {
-		h.metrics.ObserveLatency("command_processing", time.Since(start))
-	}()
+type Span interface {
+	SetError(err error)
+	End()
+}
+
+// Authorizer decides whether the caller in ctx may dispatch msg
+type Authorizer interface {
+	Authorize(ctx context.Context, msg Message) error
+}
+
+var (
+	// ErrHandlerExists is returned when a second handler is registered for
+	// the same command or query type or name
+	ErrHandlerExists = errors.New("handler already registered")
+	// ErrNoHandler is returned when dispatching a type without a handler
+	ErrNoHandler = errors.New("no handler registered")
+	// ErrResultType is returned when a query is asked for a different result
+	// type than its handler returns
+	ErrResultType = errors.New("unexpected result type")
+	// ErrUnauthorized is returned by authorizers to reject a dispatch
+	ErrUnauthorized = errors.New("unauthorized")
+)
+
+// MessageKind tells commands and queries apart in middleware
+type MessageKind string
+
+const (
+	KindCommand MessageKind = "command"
+	KindQuery   MessageKind = "query"
+)
+
+// Message is what middleware sees of a dispatch. Name is the name the
+// handler was registered with, for example "users.create", so policies and
+// metrics keyed by it survive moving or renaming the Go type.
+type Message struct {
+	Kind    MessageKind
+	Name    string
+	Payload interface{}
+}
+
+// DispatchFunc handles a message, returning nil as result for commands
+type DispatchFunc func(ctx context.Context, msg Message) (interface{}, error)
+
+// Middleware wraps every dispatch on a Bus
+type Middleware func(next DispatchFunc) DispatchFunc
+
+// Bus routes commands and queries to the single handler registered for
+// their type. Go methods cannot have type parameters, so the typed API is
+// the RegisterCommand, RegisterQuery, Send and Ask functions.
+type Bus struct {
+	mu         sync.RWMutex
+	handlers   map[reflect.Type]registration
+	middleware []Middleware
+}
+
+type registration struct {
+	kind       MessageKind
+	name       string
+	resultType reflect.Type
+	dispatch   DispatchFunc
+}
+
+func NewBus(middleware ...Middleware) *Bus {
+	return &Bus{
+		handlers:   make(map[reflect.Type]registration),
+		middleware: middleware,
+	}
+}
+
+func (b *Bus) register(kind MessageKind, name string, msgType, resultType reflect.Type, dispatch DispatchFunc) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if name == "" {
+		return fmt.Errorf("registering %s %s: empty name", kind, msgType)
+	}
+	for existingType, existing := range b.handlers {
+		if existingType == msgType || existing.name == name {
+			return fmt.Errorf("registering %s %s as %q: %w (%s %s as %q)",
+				kind, msgType, name, ErrHandlerExists, existing.kind, existingType, existing.name)
+		}
+	}
 
-	// Validate command
-	if err := h.validator.Validate(cmd); err != nil {
-		return fmt.Errorf("invalid command: %w", err)
+	// The chain is built once, the first middleware being the outermost
+	for i := len(b.middleware) - 1; i >= 0; i-- {
+		dispatch = b.middleware[i](dispatch)
 	}
+	b.handlers[msgType] = registration{kind: kind, name: name, resultType: resultType, dispatch: dispatch}
+	return nil
+}
+
+func (b *Bus) lookup(kind MessageKind, msgType reflect.Type) (registration, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	reg, ok := b.handlers[msgType]
+	if !ok || reg.kind != kind {
+		return registration{}, fmt.Errorf("dispatching %s %s: %w", kind, msgType, ErrNoHandler)
+	}
+	return reg, nil
+}
+
+// RegisterCommand registers the handler for commands of type C under name
+func RegisterCommand[C any](bus *Bus, name string, handler CommandHandler[C]) error {
+	msgType := reflect.TypeOf((*C)(nil)).Elem()
+	return bus.register(KindCommand, name, msgType, nil, func(ctx context.Context, msg Message) (interface{}, error) {
+		return nil, handler.Handle(ctx, msg.Payload.(C))
+	})
+}
 
+// RegisterQuery registers the handler for queries of type Q under name
+func RegisterQuery[Q any, R any](bus *Bus, name string, handler QueryHandler[Q, R]) error {
+	msgType := reflect.TypeOf((*Q)(nil)).Elem()
+	resultType := reflect.TypeOf((*R)(nil)).Elem()
+	return bus.register(KindQuery, name, msgType, resultType, func(ctx context.Context, msg Message) (interface{}, error) {
+		return handler.Handle(ctx, msg.Payload.(Q))
+	})
+}
+
+// Send dispatches a command through the middleware chain
+func Send[C any](ctx context.Context, bus *Bus, cmd C) error {
+	msgType := reflect.TypeOf((*C)(nil)).Elem()
+	reg, err := bus.lookup(KindCommand, msgType)
+	if err != nil {
+		return err
+	}
+	_, err = reg.dispatch(ctx, Message{Kind: KindCommand, Name: reg.name, Payload: cmd})
+	return err
+}
+
+// Ask dispatches a query through the middleware chain and returns its
+// typed result. R comes first so callers can write Ask[*UserView](ctx, bus, q).
+func Ask[R any, Q any](ctx context.Context, bus *Bus, query Q) (R, error) {
+	var zero R
+	msgType := reflect.TypeOf((*Q)(nil)).Elem()
+	reg, err := bus.lookup(KindQuery, msgType)
+	if err != nil {
+		return zero, err
+	}
+	if want := reflect.TypeOf((*R)(nil)).Elem(); want != reg.resultType {
+		return zero, fmt.Errorf("asking %s for %s, handler returns %s: %w", msgType, want, reg.resultType, ErrResultType)
+	}
+
+	result, err := reg.dispatch(ctx, Message{Kind: KindQuery, Name: reg.name, Payload: query})
+	if err != nil {
+		return zero, err
+	}
+	if result == nil {
+		return zero, nil
+	}
+	return result.(R), nil
+}
+
+// CommandHandlerFunc adapts a function to CommandHandler
+type CommandHandlerFunc[C any] func(ctx context.Context, cmd C) error
+
+func (f CommandHandlerFunc[C]) Handle(ctx context.Context, cmd C) error {
+	return f(ctx, cmd)
+}
+
+// QueryHandlerFunc adapts a function to QueryHandler
+type QueryHandlerFunc[Q any, R any] func(ctx context.Context, query Q) (R, error)
+
+func (f QueryHandlerFunc[Q, R]) Handle(ctx context.Context, query Q) (R, error) {
+	return f(ctx, query)
+}
+
+// ValidationMiddleware rejects messages the validator refuses
+func ValidationMiddleware(validator Validator) Middleware {
+	return func(next DispatchFunc) DispatchFunc {
+		return func(ctx context.Context, msg Message) (interface{}, error) {
+			if err := validator.Validate(msg.Payload); err != nil {
+				return nil, fmt.Errorf("invalid %s %s: %w", msg.Kind, msg.Name, err)
+			}
+			return next(ctx, msg)
+		}
+	}
+}
+
+// MetricsMiddleware records latency and errors per message type
+func MetricsMiddleware(metrics MetricsRecorder) Middleware {
+	return func(next DispatchFunc) DispatchFunc {
+		return func(ctx context.Context, msg Message) (interface{}, error) {
+			start := time.Now()
+			result, err := next(ctx, msg)
+			metrics.ObserveLatency(string(msg.Kind)+"_processing:"+msg.Name, time.Since(start))
+			if err != nil {
+				metrics.IncCounter(string(msg.Kind) + "_errors:" + msg.Name)
+			}
+			return result, err
+		}
+	}
+}
+
+// LoggingMiddleware logs the outcome of every dispatch
+func LoggingMiddleware(logger Logger) Middleware {
+	return func(next DispatchFunc) DispatchFunc {
+		return func(ctx context.Context, msg Message) (interface{}, error) {
+			start := time.Now()
+			result, err := next(ctx, msg)
+			if err != nil {
+				logger.Error("%s %s failed after %v: %v", msg.Kind, msg.Name, time.Since(start), err)
+			} else {
+				logger.Info("%s %s handled in %v", msg.Kind, msg.Name, time.Since(start))
+			}
+			return result, err
+		}
+	}
+}
+
+// TracingMiddleware runs every dispatch in its own span
+func TracingMiddleware(tracer Tracer) Middleware {
+	return func(next DispatchFunc) DispatchFunc {
+		return func(ctx context.Context, msg Message) (interface{}, error) {
+			ctx, span := tracer.Start(ctx, string(msg.Kind)+" "+msg.Name)
+			defer span.End()
+			result, err := next(ctx, msg)
+			if err != nil {
+				span.SetError(err)
+			}
+			return result, err
+		}
+	}
+}
+
+// AuthorizationMiddleware asks the authorizer before handling a message
+func AuthorizationMiddleware(authorizer Authorizer) Middleware {
+	return func(next DispatchFunc) DispatchFunc {
+		return func(ctx context.Context, msg Message) (interface{}, error) {
+			if err := authorizer.Authorize(ctx, msg); err != nil {
+				return nil, fmt.Errorf("%s %s: %w", msg.Kind, msg.Name, err)
+			}
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Implementation of UserCommandHandler. Publishing is left to the
+// OutboxRelay: the event store records every event in the outbox in the
+// same transaction that saves it. Validation and metrics are bus middleware.
+type UserCommandHandler struct {
+	eventStore EventStore
+}
+
+func (h *UserCommandHandler) Handle(ctx context.Context, cmd *CreateUserCommand) error {
 	// Generate events
 	events, err := cmd.ToEvents()
 	if err != nil {
 		return fmt.Errorf("generating events: %w", err)
 	}
 
-	// Store events
+	// Store events together with their outbox rows
 	if err := h.eventStore.Save(ctx, events); err != nil {
 		return fmt.Errorf("saving events: %w", err)
 	}
 
-	// Publish events
+	return nil
+}
+
+// PostgresEventStore saves events and their outbox rows atomically
+type PostgresEventStore struct {
+	db *sql.DB
+}
+
+func NewPostgresEventStore(db *sql.DB) *PostgresEventStore {
+	return &PostgresEventStore{db: db}
+}
+
+func (s *PostgresEventStore) Save(ctx context.Context, events []Event) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
 	for _, event := range events {
-		if err := h.publisher.Publish(ctx, event); err != nil {
-			h.metrics.IncCounter("event_publish_errors")
-			h.logger.Error("failed to publish event",
-				"error", err,
-				"event_id", event.ID)
+		data, err := json.Marshal(event.Data)
+		if err != nil {
+			return fmt.Errorf("marshaling event %s: %w", event.ID, err)
+		}
+
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO events (id, aggregate_id, type, data, timestamp) VALUES ($1, $2, $3, $4, $5)",
+			event.ID, event.AggregateID, event.Type, data, event.Timestamp)
+		if err != nil {
+			return fmt.Errorf("inserting event %s: %w", event.ID, err)
+		}
+
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO outbox (event_id, aggregate_id, type, data, timestamp) VALUES ($1, $2, $3, $4, $5)",
+			event.ID, event.AggregateID, event.Type, data, event.Timestamp)
+		if err != nil {
+			return fmt.Errorf("inserting outbox row for %s: %w", event.ID, err)
 		}
 	}
 
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
 	return nil
 }
 
-// Simple implementations for demonstration purposes
-type SimpleValidator struct{}
+// RelayConfig controls polling, retries and cleanup of the outbox relay
+type RelayConfig struct {
+	BatchSize     int
+	PollInterval  time.Duration
+	BaseBackoff   time.Duration
+	MaxBackoff    time.Duration
+	SentRetention time.Duration
+	CleanupEvery  time.Duration
+}
+
+// OutboxRelay publishes outbox rows through the EventPublisher and marks
+// them as sent. Rows of one aggregate are published strictly in the order
+// they were written: a failing row holds back the rows behind it.
+type OutboxRelay struct {
+	db        *sql.DB
+	publisher EventPublisher
+	config    RelayConfig
+	metrics   MetricsRecorder
+	logger    Logger
+}
+
+func NewOutboxRelay(db *sql.DB, publisher EventPublisher, config RelayConfig, metrics MetricsRecorder, logger Logger) *OutboxRelay {
+	return &OutboxRelay{
+		db:        db,
+		publisher: publisher,
+		config:    config,
+		metrics:   metrics,
+		logger:    logger,
+	}
+}
+
+// outboxRelayLockID is the advisory lock that lets only one relay instance
+// work the outbox at a time, which per-aggregate ordering depends on. It is
+// a session lock held on a dedicated connection, so no transaction stays
+// open while the relay waits on the broker.
+const outboxRelayLockID = 70
 
-func (v *SimpleValidator) Validate(cmd Command) error {
-	// Basic validation logic would go here
+type outboxRow struct {
+	id       int64
+	event    Event
+	attempts int
+}
+
+// Run polls the outbox until ctx is canceled
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.config.PollInterval)
+	defer ticker.Stop()
+
+	lastCleanup := time.Now()
+	for {
+		if err := r.relayBatch(ctx); err != nil {
+			r.metrics.IncCounter("outbox_relay_errors")
+			r.logger.Error("Relaying outbox batch failed: %v", err)
+		}
+
+		if time.Since(lastCleanup) >= r.config.CleanupEvery {
+			if err := r.cleanup(ctx); err != nil {
+				r.logger.Error("Cleaning up outbox failed: %v", err)
+			}
+			lastCleanup = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *OutboxRelay) relayBatch(ctx context.Context) error {
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("acquiring connection: %w", err)
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", outboxRelayLockID).Scan(&locked); err != nil {
+		return fmt.Errorf("acquiring relay lock: %w", err)
+	}
+	if !locked {
+		return nil // another relay instance is working the outbox
+	}
+	defer func() {
+		// ctx may already be canceled; the lock must still be released
+		// before the connection goes back to the pool
+		unlockCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := conn.ExecContext(unlockCtx, "SELECT pg_advisory_unlock($1)", outboxRelayLockID); err != nil {
+			r.logger.Error("Releasing relay lock failed: %v", err)
+		}
+	}()
+
+	rows, err := r.loadPending(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	// loadPending leaves out aggregates that are backing off; an aggregate
+	// whose row fails in this batch is held back for the rest of it
+	blocked := make(map[string]bool)
+	for _, row := range rows {
+		if blocked[row.event.AggregateID] {
+			continue
+		}
+
+		if err := r.publisher.Publish(ctx, row.event); err != nil {
+			blocked[row.event.AggregateID] = true
+			r.metrics.IncCounter("event_publish_errors")
+			r.logger.Error("Publishing event %s failed on attempt %d: %v", row.event.ID, row.attempts+1, err)
+			if err := r.markFailed(ctx, conn, row, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := conn.ExecContext(ctx, "UPDATE outbox SET sent_at = NOW() WHERE id = $1", row.id); err != nil {
+			return fmt.Errorf("marking outbox row %d as sent: %w", row.id, err)
+		}
+		r.metrics.IncCounter("events_published")
+	}
 	return nil
 }
 
-type SimpleEventStore struct{}
+// loadPending returns unsent rows in write order, skipping every row that
+// sits behind one that is still backing off, so a stuck aggregate cannot
+// fill the batch and starve the others
+func (r *OutboxRelay) loadPending(ctx context.Context, conn *sql.Conn) ([]outboxRow, error) {
+	rows, err := conn.QueryContext(ctx, `
+		SELECT o.id, o.event_id, o.aggregate_id, o.type, o.data, o.timestamp, o.attempts
+		FROM outbox o
+		WHERE o.sent_at IS NULL
+		  AND NOT EXISTS (
+			SELECT 1 FROM outbox b
+			WHERE b.aggregate_id = o.aggregate_id
+			  AND b.sent_at IS NULL
+			  AND b.id <= o.id
+			  AND b.next_attempt_at > NOW()
+		  )
+		ORDER BY o.id ASC
+		LIMIT $1`, r.config.BatchSize)
+	if err != nil {
+		return nil, fmt.Errorf("querying outbox: %w", err)
+	}
+	defer rows.Close()
+
+	var pending []outboxRow
+	for rows.Next() {
+		var row outboxRow
+		var data json.RawMessage
+		if err := rows.Scan(&row.id, &row.event.ID, &row.event.AggregateID, &row.event.Type,
+			&data, &row.event.Timestamp, &row.attempts); err != nil {
+			return nil, fmt.Errorf("scanning outbox row: %w", err)
+		}
+		row.event.Data = data
+		pending = append(pending, row)
+	}
 
-func (s *SimpleEventStore) Save(ctx context.Context, events []Event) error {
-	for _, event := range events {
-		fmt.Printf("Saving event: %s\n", event.ID)
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating over outbox: %w", err)
+	}
+	return pending, nil
+}
+
+// markFailed schedules the next attempt on the database clock, which is
+// the one loadPending compares next_attempt_at against
+func (r *OutboxRelay) markFailed(ctx context.Context, conn *sql.Conn, row outboxRow, publishErr error) error {
+	attempts := row.attempts + 1
+	_, err := conn.ExecContext(ctx,
+		"UPDATE outbox SET attempts = $2, next_attempt_at = NOW() + make_interval(secs => $3), last_error = $4 WHERE id = $1",
+		row.id, attempts, r.backoff(attempts).Seconds(), publishErr.Error())
+	if err != nil {
+		return fmt.Errorf("recording failed attempt for outbox row %d: %w", row.id, err)
+	}
+	return nil
+}
+
+// backoff doubles the delay with every attempt, up to MaxBackoff
+func (r *OutboxRelay) backoff(attempts int) time.Duration {
+	delay := r.config.BaseBackoff
+	for i := 1; i < attempts && delay < r.config.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > r.config.MaxBackoff {
+		delay = r.config.MaxBackoff
+	}
+	return delay
+}
+
+// cleanup deletes rows that were sent longer ago than SentRetention
+func (r *OutboxRelay) cleanup(ctx context.Context) error {
+	result, err := r.db.ExecContext(ctx,
+		"DELETE FROM outbox WHERE sent_at IS NOT NULL AND sent_at < NOW() - make_interval(secs => $1)",
+		r.config.SentRetention.Seconds())
+	if err != nil {
+		return fmt.Errorf("deleting sent outbox rows: %w", err)
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n > 0 {
+		r.metrics.IncCounter("outbox_rows_cleaned")
+	}
+	return nil
+}
+
+// Simple implementations for demonstration purposes
+type SimpleValidator struct{}
+
+// Validate calls Validate on messages that have one
+func (v *SimpleValidator) Validate(msg interface{}) error {
+	if validatable, ok := msg.(interface{ Validate() error }); ok {
+		return validatable.Validate()
 	}
 	return nil
 }
@@ -136,10 +604,64 @@ func (m *SimpleMetricsRecorder) IncCounter(metric string) {
 
 type SimpleLogger struct{}
 
+func (l *SimpleLogger) Info(msg string, args ...interface{}) {
+	log.Printf("INFO: "+msg, args...)
+}
+
 func (l *SimpleLogger) Error(msg string, args ...interface{}) {
 	log.Printf("ERROR: "+msg, args...)
 }
 
+// SimpleTracer logs span durations
+type SimpleTracer struct{}
+
+func (t *SimpleTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, &simpleSpan{name: name, start: time.Now()}
+}
+
+type simpleSpan struct {
+	name  string
+	start time.Time
+	err   error
+}
+
+func (s *simpleSpan) SetError(err error) { s.err = err }
+
+func (s *simpleSpan) End() {
+	log.Printf("TRACE: %s took %v (error: %v)", s.name, time.Since(s.start), s.err)
+}
+
+type principalKey struct{}
+
+// WithPrincipal attaches the calling user to ctx
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// RoleAuthorizer allows a message only to the principals listed for its
+// registered name. Messages that are not listed are open to any
+// authenticated caller.
+type RoleAuthorizer struct {
+	Allowed map[string][]string
+}
+
+func (a *RoleAuthorizer) Authorize(ctx context.Context, msg Message) error {
+	principal, _ := ctx.Value(principalKey{}).(string)
+	if principal == "" {
+		return fmt.Errorf("%w: no principal", ErrUnauthorized)
+	}
+	allowed, ok := a.Allowed[msg.Name]
+	if !ok {
+		return nil
+	}
+	for _, p := range allowed {
+		if p == principal {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s may not dispatch %s", ErrUnauthorized, principal, msg.Name)
+}
+
 // Example command
 type CreateUserCommand struct {
 	UserID    string
@@ -148,39 +670,282 @@ type CreateUserCommand struct {
 	LastName  string
 }
 
+func (c *CreateUserCommand) Validate() error {
+	if c.UserID == "" || c.Email == "" {
+		return errors.New("user ID and email are required")
+	}
+	return nil
+}
+
 func (c *CreateUserCommand) ToEvents() ([]Event, error) {
 	return []Event{
 		{
-			ID:        "evt-" + c.UserID,
-			Type:      "UserCreated",
-			Data:      c,
-			Timestamp: time.Now(),
+			ID:          "evt-" + c.UserID,
+			AggregateID: c.UserID,
+			Type:        "UserCreated",
+			Data:        c,
+			Timestamp:   time.Now(),
 		},
 	}, nil
 }
 
+// Example query
+type GetUserQuery struct {
+	UserID string
+}
+
+type UserView struct {
+	UserID    string
+	Email     string
+	FirstName string
+	LastName  string
+}
+
+// GetUserHandler answers GetUserQuery from the stored UserCreated event
+type GetUserHandler struct {
+	db *sql.DB
+}
+
+func (h *GetUserHandler) Handle(ctx context.Context, query GetUserQuery) (*UserView, error) {
+	var data []byte
+	err := h.db.QueryRowContext(ctx,
+		"SELECT data FROM events WHERE aggregate_id = $1 AND type = 'UserCreated'",
+		query.UserID).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading user %s: %w", query.UserID, err)
+	}
+
+	var view UserView
+	if err := json.Unmarshal(data, &view); err != nil {
+		return nil, fmt.Errorf("unmarshaling user %s: %w", query.UserID, err)
+	}
+	return &view, nil
+}
+
+func setupDatabase(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS events (
+			id TEXT PRIMARY KEY,
+			aggregate_id TEXT NOT NULL,
+			type TEXT NOT NULL,
+			data JSONB NOT NULL,
+			timestamp TIMESTAMP NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS outbox (
+			id BIGSERIAL PRIMARY KEY,
+			event_id TEXT NOT NULL UNIQUE,
+			aggregate_id TEXT NOT NULL,
+			type TEXT NOT NULL,
+			data JSONB NOT NULL,
+			timestamp TIMESTAMP NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			last_error TEXT,
+			sent_at TIMESTAMPTZ
+		);
+		CREATE INDEX IF NOT EXISTS outbox_unsent_idx ON outbox (id) WHERE sent_at IS NULL;
+		CREATE INDEX IF NOT EXISTS outbox_unsent_aggregate_idx ON outbox (aggregate_id, id) WHERE sent_at IS NULL
+	`)
+	return err
+}
+
+func TestBus(t *testing.T) {
+	ctx := WithPrincipal(context.Background(), "admin")
+	createUser := CommandHandlerFunc[*CreateUserCommand](func(ctx context.Context, cmd *CreateUserCommand) error {
+		return nil
+	})
+	getUser := QueryHandlerFunc[GetUserQuery, *UserView](func(ctx context.Context, query GetUserQuery) (*UserView, error) {
+		return &UserView{UserID: query.UserID}, nil
+	})
+
+	t.Run("rejects a second handler for a type or name", func(t *testing.T) {
+		bus := NewBus()
+		if err := RegisterCommand[*CreateUserCommand](bus, "users.create", createUser); err != nil {
+			t.Fatalf("RegisterCommand() error = %v", err)
+		}
+		if err := RegisterCommand[*CreateUserCommand](bus, "users.add", createUser); !errors.Is(err, ErrHandlerExists) {
+			t.Errorf("registering the type again: error = %v, want ErrHandlerExists", err)
+		}
+		if err := RegisterQuery[GetUserQuery, *UserView](bus, "users.create", getUser); !errors.Is(err, ErrHandlerExists) {
+			t.Errorf("registering the name again: error = %v, want ErrHandlerExists", err)
+		}
+	})
+
+	t.Run("reports messages without a handler", func(t *testing.T) {
+		bus := NewBus()
+		if err := RegisterCommand[*CreateUserCommand](bus, "users.create", createUser); err != nil {
+			t.Fatalf("RegisterCommand() error = %v", err)
+		}
+		if _, err := Ask[*UserView](ctx, bus, GetUserQuery{UserID: "u1"}); !errors.Is(err, ErrNoHandler) {
+			t.Errorf("Ask() error = %v, want ErrNoHandler", err)
+		}
+		// The value type is not the registered pointer type
+		if err := Send(ctx, bus, CreateUserCommand{UserID: "u1", Email: "a@example.com"}); !errors.Is(err, ErrNoHandler) {
+			t.Errorf("Send() error = %v, want ErrNoHandler", err)
+		}
+	})
+
+	t.Run("checks the result type of queries", func(t *testing.T) {
+		bus := NewBus()
+		if err := RegisterQuery[GetUserQuery, *UserView](bus, "users.get", getUser); err != nil {
+			t.Fatalf("RegisterQuery() error = %v", err)
+		}
+		if _, err := Ask[UserView](ctx, bus, GetUserQuery{UserID: "u1"}); !errors.Is(err, ErrResultType) {
+			t.Errorf("Ask[UserView]() error = %v, want ErrResultType", err)
+		}
+		user, err := Ask[*UserView](ctx, bus, GetUserQuery{UserID: "u1"})
+		if err != nil || user.UserID != "u1" {
+			t.Errorf("Ask[*UserView]() = %v, %v, want user u1", user, err)
+		}
+	})
+
+	t.Run("runs middleware in order, the first outermost", func(t *testing.T) {
+		var calls []string
+		record := func(name string) Middleware {
+			return func(next DispatchFunc) DispatchFunc {
+				return func(ctx context.Context, msg Message) (interface{}, error) {
+					calls = append(calls, name+" "+msg.Name)
+					return next(ctx, msg)
+				}
+			}
+		}
+		bus := NewBus(record("outer"), record("inner"))
+		err := RegisterCommand[*CreateUserCommand](bus, "users.create", CommandHandlerFunc[*CreateUserCommand](
+			func(ctx context.Context, cmd *CreateUserCommand) error {
+				calls = append(calls, "handler")
+				return nil
+			}))
+		if err != nil {
+			t.Fatalf("RegisterCommand() error = %v", err)
+		}
+
+		if err := Send(ctx, bus, &CreateUserCommand{UserID: "u1", Email: "a@example.com"}); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+		if want := "[outer users.create inner users.create handler]"; fmt.Sprint(calls) != want {
+			t.Errorf("calls = %v, want %s", calls, want)
+		}
+	})
+
+	t.Run("authorizes and validates before the handler runs", func(t *testing.T) {
+		handled := 0
+		bus := NewBus(
+			AuthorizationMiddleware(&RoleAuthorizer{Allowed: map[string][]string{"users.create": {"admin"}}}),
+			ValidationMiddleware(&SimpleValidator{}),
+		)
+		err := RegisterCommand[*CreateUserCommand](bus, "users.create", CommandHandlerFunc[*CreateUserCommand](
+			func(ctx context.Context, cmd *CreateUserCommand) error {
+				handled++
+				return nil
+			}))
+		if err != nil {
+			t.Fatalf("RegisterCommand() error = %v", err)
+		}
+
+		valid := &CreateUserCommand{UserID: "u1", Email: "a@example.com"}
+		tests := []struct {
+			name    string
+			ctx     context.Context
+			cmd     *CreateUserCommand
+			wantOK  bool
+			wantErr error
+		}{
+			{"admin", ctx, valid, true, nil},
+			{"other principal", WithPrincipal(context.Background(), "support"), valid, false, ErrUnauthorized},
+			{"no principal", context.Background(), valid, false, ErrUnauthorized},
+			{"invalid command", ctx, &CreateUserCommand{UserID: "u1"}, false, nil},
+		}
+		for _, tt := range tests {
+			err := Send(tt.ctx, bus, tt.cmd)
+			switch {
+			case tt.wantOK && err != nil:
+				t.Errorf("%s: Send() error = %v", tt.name, err)
+			case !tt.wantOK && err == nil:
+				t.Errorf("%s: Send() succeeded, want error", tt.name)
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Errorf("%s: Send() error = %v, want %v", tt.name, err, tt.wantErr)
+			}
+		}
+		if handled != 1 {
+			t.Errorf("handler ran %d times, want 1", handled)
+		}
+	})
+}
+
 func main() {
-	// Set up the command handler with dependencies
-	handler := &UserCommandHandler{
-		eventStore: &SimpleEventStore{},
-		publisher:  &SimpleEventPublisher{},
-		validator:  &SimpleValidator{},
-		metrics:    &SimpleMetricsRecorder{},
-		logger:     &SimpleLogger{},
+	db, err := sql.Open("postgres", "postgres://pg:pg@localhost:5432/cqrs?sslmode=disable")
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	if err := setupDatabase(db); err != nil {
+		log.Fatalf("Failed to set up database: %v", err)
 	}
 
+	metrics := &SimpleMetricsRecorder{}
+	logger := &SimpleLogger{}
+
+	// Set up the bus; the first middleware is the outermost
+	bus := NewBus(
+		TracingMiddleware(&SimpleTracer{}),
+		LoggingMiddleware(logger),
+		MetricsMiddleware(metrics),
+		AuthorizationMiddleware(&RoleAuthorizer{Allowed: map[string][]string{
+			"users.create": {"admin"},
+		}}),
+		ValidationMiddleware(&SimpleValidator{}),
+	)
+
+	if err := RegisterCommand[*CreateUserCommand](bus, "users.create", &UserCommandHandler{eventStore: NewPostgresEventStore(db)}); err != nil {
+		log.Fatalf("Failed to register command handler: %v", err)
+	}
+	if err := RegisterQuery[GetUserQuery, *UserView](bus, "users.get", &GetUserHandler{db: db}); err != nil {
+		log.Fatalf("Failed to register query handler: %v", err)
+	}
+
+	// The relay delivers whatever the handler committed, even across restarts
+	relay := NewOutboxRelay(db, &SimpleEventPublisher{}, RelayConfig{
+		BatchSize:     100,
+		PollInterval:  500 * time.Millisecond,
+		BaseBackoff:   time.Second,
+		MaxBackoff:    time.Minute,
+		SentRetention: 24 * time.Hour,
+		CleanupEvery:  time.Hour,
+	}, metrics, logger)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	go relay.Run(ctx)
+
 	// Create and handle a command
 	cmd := &CreateUserCommand{
-		UserID:    "user-123",
+		UserID:    fmt.Sprintf("user-%d", time.Now().UnixNano()),
 		Email:     "example@example.com",
 		FirstName: "John",
 		LastName:  "Doe",
 	}
 
-	ctx := context.Background()
-	if err := handler.Handle(ctx, cmd); err != nil {
+	if err := Send(WithPrincipal(ctx, "admin"), bus, cmd); err != nil {
 		log.Fatalf("Error handling command: %v", err)
 	}
 
 	fmt.Println("Command processed successfully!")
+
+	user, err := Ask[*UserView](WithPrincipal(ctx, "support"), bus, GetUserQuery{UserID: cmd.UserID})
+	if err != nil {
+		log.Fatalf("Error handling query: %v", err)
+	}
+	fmt.Printf("Loaded user %s <%s>\n", user.UserID, user.Email)
+
+	// Callers other than admin may not create users
+	if err := Send(WithPrincipal(ctx, "support"), bus, cmd); errors.Is(err, ErrUnauthorized) {
+		fmt.Printf("Rejected as expected: %v\n", err)
+	}
+
+	// Give the relay a moment to publish the event
+	<-ctx.Done()
 }
\ No newline at end of file
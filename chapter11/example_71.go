@@ -3,35 +3,56 @@ package main
 
 import (
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"reflect"
+	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
 )
 
-// Event represents a domain event
+// Event represents a domain event. Position is its place in the global,
+// gap-tolerant ordering of all events and is assigned by the store.
 type Event struct {
 	ID        string
 	Type      string
 	Data      json.RawMessage
 	Timestamp time.Time
+	Position  int64
 }
 
-// Projector interface for projecting events
+// Projector interface for projecting events. Run is the only writer of
+// the live projection, so every change to it advances the checkpoint that
+// rebuilds catch up to.
 type Projector interface {
-	Project(ctx context.Context, event Event) error
+	Name() string
+	Run(ctx context.Context, subscription *CatchUpSubscription) error
 	Rebuild(ctx context.Context) error
 }
 
 // EventStore interface for loading events
 type EventStore interface {
-	LoadAll(ctx context.Context) ([]Event, error)
+	// LoadAfter returns up to limit events with a position greater than
+	// position, in position order
+	LoadAfter(ctx context.Context, position int64, limit int) ([]Event, error)
 	Append(ctx context.Context, event Event) error
 }
 
+// CheckpointStore keeps the last position each projector has processed
+type CheckpointStore interface {
+	Load(ctx context.Context, projector string) (int64, error)
+	SaveTx(ctx context.Context, tx *sql.Tx, projector string, position int64) error
+}
+
 // MetricsRecorder interface for recording metrics
 type MetricsRecorder interface {
 	RecordProjection(eventType string, duration time.Duration)
@@ -52,8 +73,10 @@ func NewPostgresEventStore(db *sql.DB) *PostgresEventStore {
 	return &PostgresEventStore{db: db}
 }
 
-func (s *PostgresEventStore) LoadAll(ctx context.Context) ([]Event, error) {
-	rows, err := s.db.QueryContext(ctx, "SELECT id, type, data, timestamp FROM events ORDER BY timestamp ASC")
+func (s *PostgresEventStore) LoadAfter(ctx context.Context, position int64, limit int) ([]Event, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, type, data, timestamp, position FROM events WHERE position > $1 ORDER BY position ASC LIMIT $2",
+		position, limit)
 	if err != nil {
 		return nil, fmt.Errorf("querying events: %w", err)
 	}
@@ -62,26 +85,527 @@ func (s *PostgresEventStore) LoadAll(ctx context.Context) ([]Event, error) {
 	var events []Event
 	for rows.Next() {
 		var e Event
-		if err := rows.Scan(&e.ID, &e.Type, &e.Data, &e.Timestamp); err != nil {
+		if err := rows.Scan(&e.ID, &e.Type, &e.Data, &e.Timestamp, &e.Position); err != nil {
 			return nil, fmt.Errorf("scanning event: %w", err)
 		}
 		events = append(events, e)
 	}
 
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating over events: %w", err)
+	}
 	return events, nil
 }
 
 func (s *PostgresEventStore) Append(ctx context.Context, event Event) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Serialize appends so positions become visible in the order they are
+	// assigned; otherwise a subscriber could read position 11 before a slower
+	// transaction commits position 10 and skip it forever
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", eventsAppendLockID); err != nil {
+		return fmt.Errorf("acquiring append lock: %w", err)
+	}
+
 	//Important: In a real-world application, a secure migration tool would parse and execute these operations, below is a simplified example and should not be used in production and is not secure
-	_, err := s.db.ExecContext(ctx,
+	_, err = tx.ExecContext(ctx,
 		"INSERT INTO events (id, type, data, timestamp) VALUES ($1, $2, $3, $4)",
 		event.ID, event.Type, event.Data, event.Timestamp)
 	if err != nil {
 		return fmt.Errorf("inserting event: %w", err)
 	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+	return nil
+}
+
+// eventsAppendLockID is the advisory lock key guarding event appends
+const eventsAppendLockID = 71
+
+// PostgresCheckpointStore implements CheckpointStore using PostgreSQL
+type PostgresCheckpointStore struct {
+	db *sql.DB
+}
+
+func NewPostgresCheckpointStore(db *sql.DB) *PostgresCheckpointStore {
+	return &PostgresCheckpointStore{db: db}
+}
+
+// Load returns 0 for a projector that has never stored a checkpoint
+func (s *PostgresCheckpointStore) Load(ctx context.Context, projector string) (int64, error) {
+	var position int64
+	err := s.db.QueryRowContext(ctx,
+		"SELECT position FROM projection_checkpoints WHERE projector = $1",
+		projector).Scan(&position)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("loading checkpoint: %w", err)
+	}
+	return position, nil
+}
+
+// SaveTx stores the checkpoint in the same transaction as the projection
+// changes, so a crash can never leave the two out of step
+func (s *PostgresCheckpointStore) SaveTx(ctx context.Context, tx *sql.Tx, projector string, position int64) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO projection_checkpoints (projector, position, updated_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (projector) DO UPDATE SET position = $2, updated_at = NOW()`,
+		projector, position)
+	if err != nil {
+		return fmt.Errorf("saving checkpoint: %w", err)
+	}
+	return nil
+}
+
+var (
+	// ErrKeyNotFound is returned for a subject that never had a data key
+	ErrKeyNotFound = errors.New("data key not found")
+	// ErrKeyShredded is returned for a subject whose data key was deleted
+	ErrKeyShredded = errors.New("data key shredded")
+)
+
+// RedactedValue replaces encrypted fields whose key has been shredded
+const RedactedValue = "[redacted]"
+
+// KeyStore holds one data key per subject, usually a user. Shredding a
+// subject deletes its key, which makes every field encrypted with it
+// unreadable while the events themselves stay in the stream untouched.
+type KeyStore interface {
+	// DataKey returns the subject's key, creating it on first use
+	DataKey(ctx context.Context, subject string) ([]byte, error)
+	// Key returns the subject's existing key
+	Key(ctx context.Context, subject string) ([]byte, error)
+	Shred(ctx context.Context, subject string) error
+}
+
+// PostgresKeyStore implements KeyStore using PostgreSQL. A shredded key
+// leaves a row with a NULL key behind, so it cannot be recreated by a late
+// writer. In production the keys would be wrapped by a KMS master key.
+type PostgresKeyStore struct {
+	db *sql.DB
+}
+
+func NewPostgresKeyStore(db *sql.DB) *PostgresKeyStore {
+	return &PostgresKeyStore{db: db}
+}
+
+func (s *PostgresKeyStore) DataKey(ctx context.Context, subject string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generating data key: %w", err)
+	}
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO subject_keys (subject, key, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (subject) DO NOTHING`,
+		subject, key, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("storing data key: %w", err)
+	}
+	return s.Key(ctx, subject)
+}
+
+func (s *PostgresKeyStore) Key(ctx context.Context, subject string) ([]byte, error) {
+	var key []byte
+	err := s.db.QueryRowContext(ctx,
+		"SELECT key FROM subject_keys WHERE subject = $1",
+		subject).Scan(&key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("subject %s: %w", subject, ErrKeyNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading data key: %w", err)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("subject %s: %w", subject, ErrKeyShredded)
+	}
+	return key, nil
+}
+
+func (s *PostgresKeyStore) Shred(ctx context.Context, subject string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO subject_keys (subject, key, created_at, shredded_at)
+		VALUES ($1, NULL, $2, $2)
+		ON CONFLICT (subject) DO UPDATE SET key = NULL, shredded_at = EXCLUDED.shredded_at`,
+		subject, time.Now())
+	if err != nil {
+		return fmt.Errorf("shredding data key: %w", err)
+	}
 	return nil
 }
 
+// InMemoryKeyStore implements KeyStore for tests
+type InMemoryKeyStore struct {
+	mu   sync.Mutex
+	keys map[string][]byte // nil value means shredded
+}
+
+func NewInMemoryKeyStore() *InMemoryKeyStore {
+	return &InMemoryKeyStore{keys: make(map[string][]byte)}
+}
+
+func (s *InMemoryKeyStore) DataKey(ctx context.Context, subject string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[subject]
+	if !ok {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("generating data key: %w", err)
+		}
+		s.keys[subject] = key
+	}
+	if key == nil {
+		return nil, fmt.Errorf("subject %s: %w", subject, ErrKeyShredded)
+	}
+	return key, nil
+}
+
+func (s *InMemoryKeyStore) Key(ctx context.Context, subject string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[subject]
+	if !ok {
+		return nil, fmt.Errorf("subject %s: %w", subject, ErrKeyNotFound)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("subject %s: %w", subject, ErrKeyShredded)
+	}
+	return key, nil
+}
+
+func (s *InMemoryKeyStore) Shred(ctx context.Context, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[subject] = nil
+	return nil
+}
+
+// piiEnvelope replaces an encrypted field in event data. It carries
+// everything needed to decrypt it, so readers don't need the payload type.
+type piiEnvelope struct {
+	Version int    `json:"pii_v"`
+	Subject string `json:"subject"`
+	Data    string `json:"data"`
+}
+
+// PIICipher encrypts tagged fields of event payloads with the data key of
+// the payload's subject. Payload structs tag the field identifying the
+// subject with pii:"subject" and each field to protect with pii:"encrypt":
+//
+//	type UserData struct {
+//		ID    string `json:"id" pii:"subject"`
+//		Email string `json:"email" pii:"encrypt"`
+//	}
+type PIICipher struct {
+	keys KeyStore
+}
+
+func NewPIICipher(keys KeyStore) *PIICipher {
+	return &PIICipher{keys: keys}
+}
+
+// Marshal encodes v as JSON with its tagged fields encrypted
+func (c *PIICipher) Marshal(ctx context.Context, v interface{}) (json.RawMessage, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("marshaling %T: PII payloads must be structs", v)
+	}
+
+	var subject string
+	var encrypted []string
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+		switch field.Tag.Get("pii") {
+		case "subject":
+			subject = fmt.Sprint(rv.Field(i).Interface())
+		case "encrypt":
+			encrypted = append(encrypted, name)
+		}
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted) == 0 {
+		return data, nil
+	}
+	if subject == "" {
+		return nil, fmt.Errorf("marshaling %T: PII fields without a subject", v)
+	}
+
+	key, err := c.keys.DataKey(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for _, name := range encrypted {
+		envelope, err := encryptField(key, subject, fields[name])
+		if err != nil {
+			return nil, fmt.Errorf("encrypting %s: %w", name, err)
+		}
+		fields[name] = envelope
+	}
+	return json.Marshal(fields)
+}
+
+// Reveal decrypts every encrypted field in data. Fields of shredded
+// subjects become RedactedValue instead of failing, so old events stay
+// readable for projections and aggregates.
+func (c *PIICipher) Reveal(ctx context.Context, data json.RawMessage) (json.RawMessage, error) {
+	trimmed := strings.TrimSpace(string(data))
+	if !strings.Contains(trimmed, `"pii_v"`) {
+		return data, nil
+	}
+
+	switch trimmed[0] {
+	case '{':
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return nil, err
+		}
+		if _, ok := fields["pii_v"]; ok {
+			return c.decryptField(ctx, data)
+		}
+		for name, value := range fields {
+			revealed, err := c.Reveal(ctx, value)
+			if err != nil {
+				return nil, fmt.Errorf("revealing %s: %w", name, err)
+			}
+			fields[name] = revealed
+		}
+		return json.Marshal(fields)
+	case '[':
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, err
+		}
+		for i, item := range items {
+			revealed, err := c.Reveal(ctx, item)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = revealed
+		}
+		return json.Marshal(items)
+	default:
+		return data, nil
+	}
+}
+
+func (c *PIICipher) decryptField(ctx context.Context, data json.RawMessage) (json.RawMessage, error) {
+	var envelope piiEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("decoding PII envelope: %w", err)
+	}
+
+	key, err := c.keys.Key(ctx, envelope.Subject)
+	if errors.Is(err, ErrKeyShredded) {
+		return json.Marshal(RedactedValue)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(envelope.Data)
+	if err != nil {
+		return nil, fmt.Errorf("decoding PII ciphertext: %w", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("PII ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, []byte(envelope.Subject))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting PII field: %w", err)
+	}
+	return plaintext, nil
+}
+
+func encryptField(key []byte, subject string, value json.RawMessage) (json.RawMessage, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	// The subject is authenticated, so a field can't be moved to another user
+	sealed := gcm.Seal(nonce, nonce, value, []byte(subject))
+	return json.Marshal(piiEnvelope{
+		Version: 1,
+		Subject: subject,
+		Data:    base64.StdEncoding.EncodeToString(sealed),
+	})
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("creating cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// DecryptingEventStore reveals encrypted fields of the events it loads,
+// so projectors never see ciphertext
+type DecryptingEventStore struct {
+	EventStore
+	cipher *PIICipher
+}
+
+func NewDecryptingEventStore(store EventStore, cipher *PIICipher) *DecryptingEventStore {
+	return &DecryptingEventStore{EventStore: store, cipher: cipher}
+}
+
+func (s *DecryptingEventStore) LoadAfter(ctx context.Context, position int64, limit int) ([]Event, error) {
+	events, err := s.EventStore.LoadAfter(ctx, position, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range events {
+		data, err := s.cipher.Reveal(ctx, events[i].Data)
+		if err != nil {
+			return nil, fmt.Errorf("revealing event %s: %w", events[i].ID, err)
+		}
+		events[i].Data = data
+	}
+	return events, nil
+}
+
+// UserData is the payload of UserCreated and UserUpdated events
+type UserData struct {
+	ID    string `json:"id" pii:"subject"`
+	Name  string `json:"name" pii:"encrypt"`
+	Email string `json:"email" pii:"encrypt"`
+}
+
+// User is the state of a user rebuilt from its events
+type User struct {
+	ID      string
+	Name    string
+	Email   string
+	Deleted bool
+}
+
+// ApplyEvent applies an event with revealed data to the user
+func (u *User) ApplyEvent(event Event) error {
+	switch event.Type {
+	case "UserCreated", "UserUpdated":
+		var data UserData
+		if err := json.Unmarshal(event.Data, &data); err != nil {
+			return fmt.Errorf("unmarshaling user data: %w", err)
+		}
+		u.ID, u.Name, u.Email = data.ID, data.Name, data.Email
+	case "UserDeleted":
+		u.Deleted = true
+	default:
+		return fmt.Errorf("unknown event type: %s", event.Type)
+	}
+	return nil
+}
+
+// EraseUser handles an erasure request. The UserDeleted event removes the
+// user from projections, then shredding the key redacts the user's data in
+// every earlier event, including the ones a rebuild would replay.
+func EraseUser(ctx context.Context, store EventStore, keys KeyStore, userID string) error {
+	data, err := json.Marshal(struct {
+		ID string `json:"id"`
+	}{ID: userID})
+	if err != nil {
+		return err
+	}
+
+	err = store.Append(ctx, Event{
+		ID:        fmt.Sprintf("evt-%d", time.Now().UnixNano()),
+		Type:      "UserDeleted",
+		Data:      data,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("recording erasure of %s: %w", userID, err)
+	}
+	return keys.Shred(ctx, userID)
+}
+
+// CatchUpSubscription streams events in pages starting after a checkpoint,
+// and keeps polling for new events once it has caught up with the store
+type CatchUpSubscription struct {
+	store        EventStore
+	pageSize     int
+	pollInterval time.Duration
+	logger       Logger
+}
+
+func NewCatchUpSubscription(store EventStore, pageSize int, pollInterval time.Duration, logger Logger) *CatchUpSubscription {
+	return &CatchUpSubscription{
+		store:        store,
+		pageSize:     pageSize,
+		pollInterval: pollInterval,
+		logger:       logger,
+	}
+}
+
+// Run delivers pages of events after position to handle until ctx is
+// canceled or handle fails. A page is only considered done once handle
+// returns nil, so handle should persist the checkpoint itself.
+func (s *CatchUpSubscription) Run(ctx context.Context, position int64, handle func(ctx context.Context, events []Event) error) error {
+	live := false
+	for {
+		events, err := s.store.LoadAfter(ctx, position, s.pageSize)
+		if err != nil {
+			return fmt.Errorf("loading events after %d: %w", position, err)
+		}
+
+		if len(events) > 0 {
+			if err := handle(ctx, events); err != nil {
+				return err
+			}
+			position = events[len(events)-1].Position
+		}
+
+		// A full page means there is likely more history to catch up on
+		if len(events) == s.pageSize {
+			continue
+		}
+
+		if !live {
+			live = true
+			s.logger.Info("Subscription caught up at position %d, tailing live events", position)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.pollInterval):
+		}
+	}
+}
+
 // SimpleLogger implements Logger
 type SimpleLogger struct{}
 
@@ -102,163 +626,307 @@ func (m *SimpleMetrics) RecordProjection(eventType string, duration time.Duratio
 
 // UserProjector implements the Projector interface for User events
 type UserProjector struct {
-	db         *sql.DB
-	eventStore EventStore
-	metrics    MetricsRecorder
-	logger     Logger
+	db          *sql.DB
+	eventStore  EventStore
+	checkpoints CheckpointStore
+	metrics     MetricsRecorder
+	logger      Logger
 }
 
-func NewUserProjector(db *sql.DB, eventStore EventStore, metrics MetricsRecorder, logger Logger) *UserProjector {
+func NewUserProjector(db *sql.DB, eventStore EventStore, checkpoints CheckpointStore, metrics MetricsRecorder, logger Logger) *UserProjector {
 	return &UserProjector{
-		db:         db,
-		eventStore: eventStore,
-		metrics:    metrics,
-		logger:     logger,
+		db:          db,
+		eventStore:  eventStore,
+		checkpoints: checkpoints,
+		metrics:     metrics,
+		logger:      logger,
 	}
 }
 
-func (p *UserProjector) Project(ctx context.Context, event Event) error {
-	start := time.Now()
-	defer func() {
-		p.metrics.RecordProjection(event.Type, time.Since(start))
-	}()
+// Name identifies the projector's checkpoint
+func (p *UserProjector) Name() string {
+	return "user_projection"
+}
 
-	switch event.Type {
-	case "UserCreated":
-		return p.handleUserCreated(ctx, event)
-	case "UserUpdated":
-		return p.handleUserUpdated(ctx, event)
-	case "UserDeleted":
-		return p.handleUserDeleted(ctx, event)
-	default:
-		return fmt.Errorf("unknown event type: %s", event.Type)
+const (
+	// userProjectionTable is the table readers query
+	userProjectionTable = "user_projection"
+	// userShadowTable is where blue/green rebuilds write
+	userShadowTable = "user_projection_shadow"
+)
+
+// Run resumes the projection from its stored checkpoint and keeps it up to
+// date until ctx is canceled
+func (p *UserProjector) Run(ctx context.Context, subscription *CatchUpSubscription) error {
+	position, err := p.checkpoints.Load(ctx, p.Name())
+	if err != nil {
+		return err
 	}
+
+	p.logger.Info("Starting %s from position %d", p.Name(), position)
+	return subscription.Run(ctx, position, p.projectPage)
 }
 
-func (p *UserProjector) Rebuild(ctx context.Context) error {
-	// Start transaction
+// projectPage applies a page of events and advances the checkpoint atomically
+func (p *UserProjector) projectPage(ctx context.Context, events []Event) error {
 	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("beginning transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	// Clear existing projections
-	if err := p.clearProjections(ctx, tx); err != nil {
+	for _, event := range events {
+		start := time.Now()
+		if err := p.projectWithTx(ctx, tx, userProjectionTable, event); err != nil {
+			return fmt.Errorf("projecting event %s at position %d: %w", event.ID, event.Position, err)
+		}
+		p.metrics.RecordProjection(event.Type, time.Since(start))
+	}
+
+	if err := p.checkpoints.SaveTx(ctx, tx, p.Name(), events[len(events)-1].Position); err != nil {
 		return err
 	}
 
-	// Load all events
-	events, err := p.eventStore.LoadAll(ctx)
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+	return nil
+}
+
+// RebuildProgress reports how far a rebuild has come. Target is the live
+// projection's checkpoint, which the shadow table has to reach.
+type RebuildProgress struct {
+	ShadowTable string
+	Position    int64
+	Target      int64
+	Swapped     bool
+}
+
+// Rebuild replays the whole history without taking the live projection
+// offline. See RebuildWithProgress.
+func (p *UserProjector) Rebuild(ctx context.Context) error {
+	return p.RebuildWithProgress(ctx, func(progress RebuildProgress) {
+		p.logger.Info("Rebuild of %s at position %d of %d", progress.ShadowTable, progress.Position, progress.Target)
+	})
+}
+
+// RebuildWithProgress does a blue/green rebuild: history is replayed into a
+// shadow table while Run keeps the live table current. Once the shadow has
+// caught up with the live checkpoint the tables are swapped in a single
+// transaction. The rebuild position is stored after every page, so calling
+// it again after a crash resumes the unfinished rebuild.
+func (p *UserProjector) RebuildWithProgress(ctx context.Context, report func(RebuildProgress)) error {
+	position, err := p.startOrResumeRebuild(ctx)
 	if err != nil {
-		return fmt.Errorf("loading events: %w", err)
+		return err
 	}
 
-	// Project all events
-	for _, event := range events {
-		if err := p.projectWithTx(ctx, tx, event); err != nil {
+	for {
+		target, err := p.checkpoints.Load(ctx, p.Name())
+		if err != nil {
 			return err
 		}
-	}
 
-	// Commit transaction
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("committing transaction: %w", err)
-	}
+		events, err := p.eventStore.LoadAfter(ctx, position, rebuildPageSize)
+		if err != nil {
+			return fmt.Errorf("loading events: %w", err)
+		}
 
-	return nil
-}
+		// The shadow must never get ahead of the live checkpoint, or
+		// live projection would apply those events a second time after the swap
+		events = eventsUpTo(events, target)
+		if len(events) == 0 {
+			break
+		}
 
-// Helper method to clear projections
-func (p *UserProjector) clearProjections(ctx context.Context, tx *sql.Tx) error {
-	_, err := tx.ExecContext(ctx, "DELETE FROM user_projection")
+		if position, err = p.projectShadowPage(ctx, events); err != nil {
+			return err
+		}
+		report(RebuildProgress{ShadowTable: userShadowTable, Position: position, Target: target})
+	}
+
+	target, err := p.swapShadow(ctx, position)
 	if err != nil {
-		return fmt.Errorf("clearing user projection: %w", err)
+		return err
 	}
+	report(RebuildProgress{ShadowTable: userShadowTable, Position: target, Target: target, Swapped: true})
 	return nil
 }
 
-// Project with transaction
-func (p *UserProjector) projectWithTx(ctx context.Context, tx *sql.Tx, event Event) error {
-	switch event.Type {
-	case "UserCreated":
-		return p.handleUserCreatedTx(ctx, tx, event)
-	case "UserUpdated":
-		return p.handleUserUpdatedTx(ctx, tx, event)
-	case "UserDeleted":
-		return p.handleUserDeletedTx(ctx, tx, event)
-	default:
-		return nil // Skip unknown events during rebuild
+// startOrResumeRebuild returns the position of an unfinished rebuild, or
+// creates an empty shadow table and starts a new one at position 0
+func (p *UserProjector) startOrResumeRebuild(ctx context.Context) (int64, error) {
+	var position int64
+	err := p.db.QueryRowContext(ctx,
+		"SELECT position FROM projection_rebuilds WHERE projector = $1 AND status = 'building'",
+		p.Name()).Scan(&position)
+	if err == nil {
+		p.logger.Info("Resuming rebuild of %s at position %d", p.Name(), position)
+		return position, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("loading rebuild state: %w", err)
 	}
-}
 
-// Event handlers
-func (p *UserProjector) handleUserCreated(ctx context.Context, event Event) error {
-	var userData struct {
-		ID    string `json:"id"`
-		Name  string `json:"name"`
-		Email string `json:"email"`
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("beginning transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	if err := json.Unmarshal(event.Data, &userData); err != nil {
-		return fmt.Errorf("unmarshaling user data: %w", err)
+	statements := []string{
+		"DROP TABLE IF EXISTS " + userShadowTable,
+		fmt.Sprintf("CREATE TABLE %s (LIKE %s INCLUDING ALL)", userShadowTable, userProjectionTable),
 	}
-	//Important: In a real-world application, a secure migration tool would parse and execute these operations, below is a simplified example and should not be used in production and is not secure
-	_, err := p.db.ExecContext(ctx,
-		"INSERT INTO user_projection (id, name, email) VALUES ($1, $2, $3)",
-		userData.ID, userData.Name, userData.Email)
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return 0, fmt.Errorf("creating shadow table: %w", err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO projection_rebuilds (projector, shadow_table, position, status, started_at, updated_at)
+		VALUES ($1, $2, 0, 'building', NOW(), NOW())
+		ON CONFLICT (projector) DO UPDATE
+		SET shadow_table = $2, position = 0, status = 'building', started_at = NOW(), updated_at = NOW()`,
+		p.Name(), userShadowTable)
 	if err != nil {
-		return fmt.Errorf("inserting user: %w", err)
+		return 0, fmt.Errorf("saving rebuild state: %w", err)
 	}
 
-	p.logger.Info("Projected UserCreated for user %s", userData.ID)
-	return nil
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("committing transaction: %w", err)
+	}
+	return 0, nil
 }
 
-func (p *UserProjector) handleUserUpdated(ctx context.Context, event Event) error {
-	var userData struct {
-		ID    string `json:"id"`
-		Name  string `json:"name"`
-		Email string `json:"email"`
+// projectShadowPage applies events to the shadow table and advances the
+// rebuild position in the same transaction
+func (p *UserProjector) projectShadowPage(ctx context.Context, events []Event) (int64, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("beginning transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	if err := json.Unmarshal(event.Data, &userData); err != nil {
-		return fmt.Errorf("unmarshaling user data: %w", err)
+	for _, event := range events {
+		if err := p.projectWithTx(ctx, tx, userShadowTable, event); err != nil {
+			return 0, err
+		}
 	}
-	//Important: In a real-world application, a secure migration tool would parse and execute these operations, below is a simplified example and should not be used in production and is not secure
-	_, err := p.db.ExecContext(ctx,
-		"UPDATE user_projection SET name = $2, email = $3 WHERE id = $1",
-		userData.ID, userData.Name, userData.Email)
-	if err != nil {
-		return fmt.Errorf("updating user: %w", err)
+
+	position := events[len(events)-1].Position
+	if err := p.saveRebuildPosition(ctx, tx, position, "building"); err != nil {
+		return 0, err
 	}
 
-	p.logger.Info("Projected UserUpdated for user %s", userData.ID)
-	return nil
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("committing transaction: %w", err)
+	}
+	return position, nil
 }
 
-func (p *UserProjector) handleUserDeleted(ctx context.Context, event Event) error {
-	var userData struct {
-		ID string `json:"id"`
+// swapShadow pauses live projection, applies the last events the shadow is
+// missing and swaps the tables. It returns the position both are at.
+func (p *UserProjector) swapShadow(ctx context.Context, position int64) (int64, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("beginning transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	if err := json.Unmarshal(event.Data, &userData); err != nil {
-		return fmt.Errorf("unmarshaling user data: %w", err)
+	// Lock the live table first: a live page that already wrote to it
+	// finishes before we continue, and later ones wait for the swap
+	if _, err := tx.ExecContext(ctx, "LOCK TABLE "+userProjectionTable+" IN ACCESS EXCLUSIVE MODE"); err != nil {
+		return 0, fmt.Errorf("locking live projection: %w", err)
 	}
-	//Important: In a real-world application, a secure migration tool would parse and execute these operations, below is a simplified example and should not be used in production and is not secure
-	_, err := p.db.ExecContext(ctx,
-		"DELETE FROM user_projection WHERE id = $1",
-		userData.ID)
-	if err != nil {
-		return fmt.Errorf("deleting user: %w", err)
+
+	var target int64
+	err = tx.QueryRowContext(ctx,
+		"SELECT position FROM projection_checkpoints WHERE projector = $1 FOR UPDATE",
+		p.Name()).Scan(&target)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("loading live checkpoint: %w", err)
 	}
 
-	p.logger.Info("Projected UserDeleted for user %s", userData.ID)
+	for position < target {
+		events, err := p.eventStore.LoadAfter(ctx, position, rebuildPageSize)
+		if err != nil {
+			return 0, fmt.Errorf("loading events: %w", err)
+		}
+		events = eventsUpTo(events, target)
+		if len(events) == 0 {
+			break
+		}
+		for _, event := range events {
+			if err := p.projectWithTx(ctx, tx, userShadowTable, event); err != nil {
+				return 0, err
+			}
+		}
+		position = events[len(events)-1].Position
+	}
+
+	statements := []string{
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s_old", userProjectionTable, userProjectionTable),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", userShadowTable, userProjectionTable),
+		fmt.Sprintf("DROP TABLE %s_old", userProjectionTable),
+	}
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return 0, fmt.Errorf("swapping projection tables: %w", err)
+		}
+	}
+
+	if err := p.saveRebuildPosition(ctx, tx, position, "done"); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("committing transaction: %w", err)
+	}
+
+	p.logger.Info("Swapped rebuilt %s into place at position %d", userProjectionTable, position)
+	return position, nil
+}
+
+func (p *UserProjector) saveRebuildPosition(ctx context.Context, tx *sql.Tx, position int64, status string) error {
+	_, err := tx.ExecContext(ctx,
+		"UPDATE projection_rebuilds SET position = $2, status = $3, updated_at = NOW() WHERE projector = $1",
+		p.Name(), position, status)
+	if err != nil {
+		return fmt.Errorf("saving rebuild state: %w", err)
+	}
 	return nil
 }
 
-// Transaction-based handlers for rebuild
-func (p *UserProjector) handleUserCreatedTx(ctx context.Context, tx *sql.Tx, event Event) error {
+// eventsUpTo drops the events after position
+func eventsUpTo(events []Event, position int64) []Event {
+	for i, event := range events {
+		if event.Position > position {
+			return events[:i]
+		}
+	}
+	return events
+}
+
+const rebuildPageSize = 500
+
+// Project with transaction into the given table
+func (p *UserProjector) projectWithTx(ctx context.Context, tx *sql.Tx, table string, event Event) error {
+	switch event.Type {
+	case "UserCreated":
+		return p.handleUserCreatedTx(ctx, tx, table, event)
+	case "UserUpdated":
+		return p.handleUserUpdatedTx(ctx, tx, table, event)
+	case "UserDeleted":
+		return p.handleUserDeletedTx(ctx, tx, table, event)
+	default:
+		return nil // Skip unknown events during rebuild
+	}
+}
+
+// Transaction-based handlers; table is the live or the shadow projection table
+func (p *UserProjector) handleUserCreatedTx(ctx context.Context, tx *sql.Tx, table string, event Event) error {
 	var userData struct {
 		ID    string `json:"id"`
 		Name  string `json:"name"`
@@ -270,7 +938,7 @@ func (p *UserProjector) handleUserCreatedTx(ctx context.Context, tx *sql.Tx, eve
 	}
 
 	_, err := tx.ExecContext(ctx,
-		"INSERT INTO user_projection (id, name, email) VALUES ($1, $2, $3)",
+		"INSERT INTO "+table+" (id, name, email) VALUES ($1, $2, $3)",
 		userData.ID, userData.Name, userData.Email)
 	if err != nil {
 		return fmt.Errorf("inserting user: %w", err)
@@ -279,7 +947,7 @@ func (p *UserProjector) handleUserCreatedTx(ctx context.Context, tx *sql.Tx, eve
 	return nil
 }
 
-func (p *UserProjector) handleUserUpdatedTx(ctx context.Context, tx *sql.Tx, event Event) error {
+func (p *UserProjector) handleUserUpdatedTx(ctx context.Context, tx *sql.Tx, table string, event Event) error {
 	var userData struct {
 		ID    string `json:"id"`
 		Name  string `json:"name"`
@@ -291,7 +959,7 @@ func (p *UserProjector) handleUserUpdatedTx(ctx context.Context, tx *sql.Tx, eve
 	}
 
 	_, err := tx.ExecContext(ctx,
-		"UPDATE user_projection SET name = $2, email = $3 WHERE id = $1",
+		"UPDATE "+table+" SET name = $2, email = $3 WHERE id = $1",
 		userData.ID, userData.Name, userData.Email)
 	if err != nil {
 		return fmt.Errorf("updating user: %w", err)
@@ -300,7 +968,7 @@ func (p *UserProjector) handleUserUpdatedTx(ctx context.Context, tx *sql.Tx, eve
 	return nil
 }
 
-func (p *UserProjector) handleUserDeletedTx(ctx context.Context, tx *sql.Tx, event Event) error {
+func (p *UserProjector) handleUserDeletedTx(ctx context.Context, tx *sql.Tx, table string, event Event) error {
 	var userData struct {
 		ID string `json:"id"`
 	}
@@ -310,7 +978,7 @@ func (p *UserProjector) handleUserDeletedTx(ctx context.Context, tx *sql.Tx, eve
 	}
 
 	_, err := tx.ExecContext(ctx,
-		"DELETE FROM user_projection WHERE id = $1",
+		"DELETE FROM "+table+" WHERE id = $1",
 		userData.ID)
 	if err != nil {
 		return fmt.Errorf("deleting user: %w", err)
@@ -319,6 +987,43 @@ func (p *UserProjector) handleUserDeletedTx(ctx context.Context, tx *sql.Tx, eve
 	return nil
 }
 
+func setupDatabase(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS events (
+			position BIGSERIAL PRIMARY KEY,
+			id TEXT NOT NULL UNIQUE,
+			type TEXT NOT NULL,
+			data JSONB NOT NULL,
+			timestamp TIMESTAMP NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS user_projection (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			email TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS projection_checkpoints (
+			projector TEXT PRIMARY KEY,
+			position BIGINT NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS projection_rebuilds (
+			projector TEXT PRIMARY KEY,
+			shadow_table TEXT NOT NULL,
+			position BIGINT NOT NULL,
+			status TEXT NOT NULL,
+			started_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS subject_keys (
+			subject TEXT PRIMARY KEY,
+			key BYTEA,
+			created_at TIMESTAMP NOT NULL,
+			shredded_at TIMESTAMP
+		)
+	`)
+	return err
+}
+
 func main() {
 	ctx := context.Background()
 
@@ -329,25 +1034,33 @@ func main() {
 	}
 	defer db.Close()
 
-	// Create dependencies
+	if err := setupDatabase(db); err != nil {
+		log.Fatalf("Failed to set up database: %v", err)
+	}
+
+	// Create dependencies. Projections read through the decrypting store.
+	keys := NewPostgresKeyStore(db)
+	piiCipher := NewPIICipher(keys)
 	eventStore := NewPostgresEventStore(db)
+	readStore := NewDecryptingEventStore(eventStore, piiCipher)
+	checkpoints := NewPostgresCheckpointStore(db)
 	logger := &SimpleLogger{}
 	metrics := &SimpleMetrics{}
 
 	// Create projector
-	projector := NewUserProjector(db, eventStore, metrics, logger)
+	projector := NewUserProjector(db, readStore, checkpoints, metrics, logger)
 
-	// Example: rebuild projection
-	if err := projector.Rebuild(ctx); err != nil {
-		log.Fatalf("Failed to rebuild projection: %v", err)
+	// Example: append a new event with its PII encrypted; the subscription
+	// below picks it up
+	userID := fmt.Sprintf("user-%d", time.Now().UnixNano())
+	data, err := piiCipher.Marshal(ctx, UserData{ID: userID, Name: "John Doe", Email: "john@example.com"})
+	if err != nil {
+		log.Fatalf("Failed to encrypt user data: %v", err)
 	}
-	logger.Info("Projection rebuilt successfully")
-
-	// Example: handle a new event
 	newEvent := Event{
-		ID:        "evt-123",
+		ID:        fmt.Sprintf("evt-%d", time.Now().UnixNano()),
 		Type:      "UserCreated",
-		Data:      json.RawMessage(`{"id":"user-123","name":"John Doe","email":"john@example.com"}`),
+		Data:      data,
 		Timestamp: time.Now(),
 	}
 
@@ -355,9 +1068,40 @@ func main() {
 		log.Fatalf("Failed to append event: %v", err)
 	}
 
-	if err := projector.Project(ctx, newEvent); err != nil {
-		log.Fatalf("Failed to project event: %v", err)
+	// Example: catch up from the checkpoint, then tail live events.
+	// Restarting the program resumes from the stored checkpoint.
+	runCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	subscription := NewCatchUpSubscription(readStore, 100, 500*time.Millisecond, logger)
+	done := make(chan error, 1)
+	go func() {
+		done <- projector.Run(runCtx, subscription)
+	}()
+
+	// Example: rebuild the projection while live projection keeps running
+	if err := projector.Rebuild(ctx); err != nil {
+		log.Fatalf("Failed to rebuild projection: %v", err)
+	}
+	logger.Info("Projection rebuilt successfully")
+
+	if err := <-done; err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		log.Fatalf("Projection stopped: %v", err)
 	}
 
 	logger.Info("New event projected successfully")
+
+	// Example: erase the user, after which the original event is redacted
+	if err := EraseUser(ctx, eventStore, keys, userID); err != nil {
+		log.Fatalf("Failed to erase user: %v", err)
+	}
+	revealed, err := piiCipher.Reveal(ctx, newEvent.Data)
+	if err != nil {
+		log.Fatalf("Failed to reveal event: %v", err)
+	}
+	var user User
+	if err := user.ApplyEvent(Event{Type: newEvent.Type, Data: revealed}); err != nil {
+		log.Fatalf("Failed to apply event: %v", err)
+	}
+	logger.Info("After erasure user %s has name %q and email %q", user.ID, user.Name, user.Email)
 }
\ No newline at end of file
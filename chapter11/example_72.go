@@ -3,15 +3,21 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"os"
 	"os/signal"
+	"sort"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
+	_ "github.com/lib/pq"
 )
 
 // Event represents a domain event to be processed
@@ -65,38 +71,263 @@ func (m *SimpleMetricsRecorder) ObserveLatency(name string, duration time.Durati
 	fmt.Printf("Observed latency for %s: %v\n", name, duration)
 }
 
-// Kafka Message wrapper to match the original code
+// Kafka Message wrapper to match the original code. Partition and Offset
+// identify the message for commits.
 type Message struct {
-	ID    string
-	Value []byte
+	ID        string
+	Value     []byte
+	Partition int32
+	Offset    int64
 }
 
-// Consumer interface for Kafka
+// PartitionOffset is the next offset to read from a partition, which is
+// what gets committed once every earlier message has been processed
+type PartitionOffset struct {
+	Partition int32
+	Offset    int64
+}
+
+// RebalanceListener is told when the consumer gains or loses partitions.
+// OnRevoked runs before the partitions are handed to another consumer, so
+// it is the last chance to commit their offsets.
+type RebalanceListener interface {
+	OnAssigned(partitions []int32)
+	OnRevoked(partitions []int32)
+}
+
+// Consumer interface for Kafka. Offsets are only committed through Commit,
+// never automatically.
 type Consumer interface {
 	ReadMessage(ctx context.Context) (Message, error)
+	Commit(ctx context.Context, offsets []PartitionOffset) error
+	SetRebalanceListener(listener RebalanceListener)
+}
+
+// InMemoryPartitionedConsumer implements Consumer over in-memory partition
+// logs, so commit and rebalance behavior can be tested without a broker
+type InMemoryPartitionedConsumer struct {
+	mu         sync.Mutex
+	partitions [][]Message
+	assigned   []int32
+	position   map[int32]int64
+	committed  map[int32]int64
+	pending    []int32
+	rebalance  bool
+	next       int
+	listener   RebalanceListener
+	notify     chan struct{}
+}
+
+func NewInMemoryPartitionedConsumer(partitions int) *InMemoryPartitionedConsumer {
+	c := &InMemoryPartitionedConsumer{
+		partitions: make([][]Message, partitions),
+		position:   make(map[int32]int64),
+		committed:  make(map[int32]int64),
+		notify:     make(chan struct{}, 1),
+	}
+	for p := 0; p < partitions; p++ {
+		c.assigned = append(c.assigned, int32(p))
+	}
+	return c
+}
+
+// Produce appends a message to the partition chosen by hashing key
+func (c *InMemoryPartitionedConsumer) Produce(key string, value []byte) {
+	c.mu.Lock()
+	var h uint32 = 2166136261
+	for i := 0; i < len(key); i++ {
+		h = (h ^ uint32(key[i])) * 16777619
+	}
+	partition := int32(h % uint32(len(c.partitions)))
+	offset := int64(len(c.partitions[partition]))
+	c.partitions[partition] = append(c.partitions[partition], Message{
+		ID:        key,
+		Value:     value,
+		Partition: partition,
+		Offset:    offset,
+	})
+	c.mu.Unlock()
+	c.wake()
+}
+
+// Rebalance changes the assigned partitions. Like Kafka, the listener is
+// called from the next ReadMessage, and newly assigned partitions restart
+// at their committed offset, so uncommitted messages are delivered again.
+func (c *InMemoryPartitionedConsumer) Rebalance(assigned []int32) {
+	c.mu.Lock()
+	c.pending = assigned
+	c.rebalance = true
+	c.mu.Unlock()
+	c.wake()
+}
+
+// Committed returns the committed offset of a partition
+func (c *InMemoryPartitionedConsumer) Committed(partition int32) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.committed[partition]
+}
+
+func (c *InMemoryPartitionedConsumer) SetRebalanceListener(listener RebalanceListener) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listener = listener
+}
+
+func (c *InMemoryPartitionedConsumer) Commit(ctx context.Context, offsets []PartitionOffset) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, o := range offsets {
+		if o.Offset > c.committed[o.Partition] {
+			c.committed[o.Partition] = o.Offset
+		}
+	}
+	return nil
+}
+
+func (c *InMemoryPartitionedConsumer) ReadMessage(ctx context.Context) (Message, error) {
+	for {
+		c.applyRebalance()
+		if msg, ok := c.poll(); ok {
+			return msg, nil
+		}
+		select {
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		case <-c.notify:
+		}
+	}
+}
+
+func (c *InMemoryPartitionedConsumer) applyRebalance() {
+	c.mu.Lock()
+	if !c.rebalance {
+		c.mu.Unlock()
+		return
+	}
+	revoked, assigned, listener := c.assigned, c.pending, c.listener
+	c.rebalance = false
+	c.mu.Unlock()
+
+	// Callbacks run without the lock so they can call Commit
+	if listener != nil {
+		listener.OnRevoked(revoked)
+	}
+
+	c.mu.Lock()
+	c.assigned = assigned
+	for _, p := range assigned {
+		c.position[p] = c.committed[p]
+	}
+	c.mu.Unlock()
+
+	if listener != nil {
+		listener.OnAssigned(assigned)
+	}
+}
+
+// poll returns the next message, taking partitions in turn
+func (c *InMemoryPartitionedConsumer) poll() (Message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := 0; i < len(c.assigned); i++ {
+		p := c.assigned[(c.next+i)%len(c.assigned)]
+		if pos := c.position[p]; pos < int64(len(c.partitions[p])) {
+			c.position[p] = pos + 1
+			c.next = (c.next + i + 1) % len(c.assigned)
+			return c.partitions[p][pos], true
+		}
+	}
+	return Message{}, false
+}
+
+func (c *InMemoryPartitionedConsumer) wake() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
 }
 
-// Kafka consumer implementation
+// Kafka consumer implementation with auto-commit disabled
 type KafkaConsumer struct {
 	consumer *kafka.Consumer
+	topic    string
+
+	mu       sync.Mutex
+	listener RebalanceListener
 }
 
 func NewKafkaConsumer(brokers, group, topic string) (*KafkaConsumer, error) {
 	c, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers": brokers,
-		"group.id":          group,
-		"auto.offset.reset": "earliest",
+		"bootstrap.servers":  brokers,
+		"group.id":           group,
+		"auto.offset.reset":  "earliest",
+		"enable.auto.commit": false,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	err = c.SubscribeTopics([]string{topic}, nil)
+	kc := &KafkaConsumer{consumer: c, topic: topic}
+	err = c.SubscribeTopics([]string{topic}, kc.onRebalance)
 	if err != nil {
 		return nil, err
 	}
 
-	return &KafkaConsumer{consumer: c}, nil
+	return kc, nil
+}
+
+func (c *KafkaConsumer) SetRebalanceListener(listener RebalanceListener) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listener = listener
+}
+
+// onRebalance is called by the Kafka client from inside ReadMessage
+func (c *KafkaConsumer) onRebalance(consumer *kafka.Consumer, event kafka.Event) error {
+	c.mu.Lock()
+	listener := c.listener
+	c.mu.Unlock()
+
+	switch e := event.(type) {
+	case kafka.AssignedPartitions:
+		if err := consumer.Assign(e.Partitions); err != nil {
+			return err
+		}
+		if listener != nil {
+			listener.OnAssigned(partitionIDs(e.Partitions))
+		}
+	case kafka.RevokedPartitions:
+		// Flush commits before the partitions move to another consumer
+		if listener != nil {
+			listener.OnRevoked(partitionIDs(e.Partitions))
+		}
+		return consumer.Unassign()
+	}
+	return nil
+}
+
+func partitionIDs(partitions []kafka.TopicPartition) []int32 {
+	ids := make([]int32, len(partitions))
+	for i, p := range partitions {
+		ids[i] = p.Partition
+	}
+	return ids
+}
+
+func (c *KafkaConsumer) Commit(ctx context.Context, offsets []PartitionOffset) error {
+	partitions := make([]kafka.TopicPartition, len(offsets))
+	for i, o := range offsets {
+		partitions[i] = kafka.TopicPartition{
+			Topic:     &c.topic,
+			Partition: o.Partition,
+			Offset:    kafka.Offset(o.Offset),
+		}
+	}
+	if _, err := c.consumer.CommitOffsets(partitions); err != nil {
+		return fmt.Errorf("committing offsets: %w", err)
+	}
+	return nil
 }
 
 func (c *KafkaConsumer) ReadMessage(ctx context.Context) (Message, error) {
@@ -119,49 +350,556 @@ func (c *KafkaConsumer) ReadMessage(ctx context.Context) (Message, error) {
 
 	// Convert to our Message type
 	return Message{
-		ID:    string(msg.Key),
-		Value: msg.Value,
+		ID:        string(msg.Key),
+		Value:     msg.Value,
+		Partition: msg.TopicPartition.Partition,
+		Offset:    int64(msg.TopicPartition.Offset),
 	}, nil
 }
 
+// OffsetTracker records which messages of each partition are in flight
+// and which are done. Only the offset below which every message is done
+// may be committed, so a slow message holds back the commits of faster
+// ones read after it from the same partition.
+type OffsetTracker struct {
+	mu         sync.Mutex
+	partitions map[int32]*partitionOffsets
+}
+
+type partitionOffsets struct {
+	inFlight  []int64 // in read order, which is offset order
+	done      map[int64]bool
+	next      int64 // next offset to commit, -1 until something finished
+	committed int64
+}
+
+func NewOffsetTracker() *OffsetTracker {
+	return &OffsetTracker{partitions: make(map[int32]*partitionOffsets)}
+}
+
+// Track registers a message that was read and is about to be processed
+func (t *OffsetTracker) Track(partition int32, offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	po, ok := t.partitions[partition]
+	if !ok {
+		po = &partitionOffsets{done: make(map[int64]bool), next: -1, committed: -1}
+		t.partitions[partition] = po
+	}
+	po.inFlight = append(po.inFlight, offset)
+}
+
+// Done marks a message as processed. Messages of partitions that were
+// revoked meanwhile are ignored.
+func (t *OffsetTracker) Done(partition int32, offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	po, ok := t.partitions[partition]
+	if !ok {
+		return
+	}
+	po.done[offset] = true
+	for len(po.inFlight) > 0 && po.done[po.inFlight[0]] {
+		delete(po.done, po.inFlight[0])
+		po.next = po.inFlight[0] + 1
+		po.inFlight = po.inFlight[1:]
+	}
+}
+
+// Committable returns the offsets that advanced since the last commit,
+// limited to the given partitions if any are passed
+func (t *OffsetTracker) Committable(only ...int32) []PartitionOffset {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var offsets []PartitionOffset
+	for partition, po := range t.partitions {
+		if len(only) > 0 && !containsPartition(only, partition) {
+			continue
+		}
+		if po.next > po.committed {
+			offsets = append(offsets, PartitionOffset{Partition: partition, Offset: po.next})
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i].Partition < offsets[j].Partition })
+	return offsets
+}
+
+// MarkCommitted records offsets the broker accepted
+func (t *OffsetTracker) MarkCommitted(offsets []PartitionOffset) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, o := range offsets {
+		if po, ok := t.partitions[o.Partition]; ok && o.Offset > po.committed {
+			po.committed = o.Offset
+		}
+	}
+}
+
+// InFlight returns the number of unfinished messages in the given partitions
+func (t *OffsetTracker) InFlight(partitions []int32) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, p := range partitions {
+		if po, ok := t.partitions[p]; ok {
+			n += len(po.inFlight)
+		}
+	}
+	return n
+}
+
+// Forget drops the state of partitions this consumer no longer owns
+func (t *OffsetTracker) Forget(partitions []int32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, p := range partitions {
+		delete(t.partitions, p)
+	}
+}
+
+func containsPartition(partitions []int32, partition int32) bool {
+	for _, p := range partitions {
+		if p == partition {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryPolicy controls how often a failing event is retried before it is
+// dead-lettered, and how long to wait in between
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// delay doubles BaseDelay for every attempt already made, up to MaxDelay
+func (r RetryPolicy) delay(attempt int) time.Duration {
+	d := r.BaseDelay
+	for i := 1; i < attempt && d < r.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > r.MaxDelay {
+		d = r.MaxDelay
+	}
+	return d
+}
+
+// IdempotencyStore remembers which events were processed successfully, so
+// redelivered events can be skipped
+type IdempotencyStore interface {
+	Seen(ctx context.Context, eventID string) (bool, error)
+	MarkProcessed(ctx context.Context, eventID string) error
+}
+
+// InMemoryIdempotencyStore implements IdempotencyStore with a map
+type InMemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	processed map[string]time.Time
+}
+
+func NewInMemoryIdempotencyStore() *InMemoryIdempotencyStore {
+	return &InMemoryIdempotencyStore{processed: make(map[string]time.Time)}
+}
+
+func (s *InMemoryIdempotencyStore) Seen(ctx context.Context, eventID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.processed[eventID]
+	return ok, nil
+}
+
+func (s *InMemoryIdempotencyStore) MarkProcessed(ctx context.Context, eventID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.processed[eventID] = time.Now()
+	return nil
+}
+
+// DeadLetter is a message that could not be processed
+type DeadLetter struct {
+	ID       string
+	Message  Message
+	Error    string
+	Attempts int
+	FailedAt time.Time
+}
+
+// DeadLetterSink stores dead letters until they are replayed
+type DeadLetterSink interface {
+	Add(ctx context.Context, letter DeadLetter) error
+	List(ctx context.Context) ([]DeadLetter, error)
+	Get(ctx context.Context, id string) (DeadLetter, error)
+	Remove(ctx context.Context, id string) error
+}
+
+// ErrDeadLetterNotFound is returned for unknown dead letter IDs
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// InMemoryDeadLetterSink implements DeadLetterSink with a map. Its letters
+// are gone after a restart, so it only suits tests and the in-memory demo.
+type InMemoryDeadLetterSink struct {
+	mu      sync.Mutex
+	seq     int
+	letters map[string]DeadLetter
+}
+
+func NewInMemoryDeadLetterSink() *InMemoryDeadLetterSink {
+	return &InMemoryDeadLetterSink{letters: make(map[string]DeadLetter)}
+}
+
+func (s *InMemoryDeadLetterSink) Add(ctx context.Context, letter DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if letter.ID == "" {
+		s.seq++
+		letter.ID = fmt.Sprintf("dlq-%d", s.seq)
+	}
+	s.letters[letter.ID] = letter
+	return nil
+}
+
+// List returns dead letters oldest first
+func (s *InMemoryDeadLetterSink) List(ctx context.Context) ([]DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	letters := make([]DeadLetter, 0, len(s.letters))
+	for _, letter := range s.letters {
+		letters = append(letters, letter)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].FailedAt.Before(letters[j].FailedAt) })
+	return letters, nil
+}
+
+func (s *InMemoryDeadLetterSink) Get(ctx context.Context, id string) (DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	letter, ok := s.letters[id]
+	if !ok {
+		return DeadLetter{}, ErrDeadLetterNotFound
+	}
+	return letter, nil
+}
+
+func (s *InMemoryDeadLetterSink) Remove(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.letters, id)
+	return nil
+}
+
+// PostgresDeadLetterSink implements DeadLetterSink with a table, so dead
+// letters survive a restart of the processor. Letters are keyed by
+// partition and offset: a message that is dead-lettered again after a
+// redelivery overwrites its first copy instead of being stored twice.
+type PostgresDeadLetterSink struct {
+	db *sql.DB
+}
+
+func NewPostgresDeadLetterSink(db *sql.DB) *PostgresDeadLetterSink {
+	return &PostgresDeadLetterSink{db: db}
+}
+
+func (s *PostgresDeadLetterSink) Add(ctx context.Context, letter DeadLetter) error {
+	if letter.ID == "" {
+		letter.ID = fmt.Sprintf("%d-%d", letter.Message.Partition, letter.Message.Offset)
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO dead_letters (id, message_id, value, kafka_partition, kafka_offset, error, attempts, failed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET error = $6, attempts = $7, failed_at = $8`,
+		letter.ID, letter.Message.ID, letter.Message.Value, letter.Message.Partition,
+		letter.Message.Offset, letter.Error, letter.Attempts, letter.FailedAt)
+	if err != nil {
+		return fmt.Errorf("storing dead letter: %w", err)
+	}
+	return nil
+}
+
+// List returns dead letters oldest first
+func (s *PostgresDeadLetterSink) List(ctx context.Context) ([]DeadLetter, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, message_id, value, kafka_partition, kafka_offset, error, attempts, failed_at
+		FROM dead_letters
+		ORDER BY failed_at ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("querying dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	var letters []DeadLetter
+	for rows.Next() {
+		letter, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating over dead letters: %w", err)
+	}
+	return letters, nil
+}
+
+func (s *PostgresDeadLetterSink) Get(ctx context.Context, id string) (DeadLetter, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT id, message_id, value, kafka_partition, kafka_offset, error, attempts, failed_at
+		FROM dead_letters
+		WHERE id = $1`, id)
+	letter, err := scanDeadLetter(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DeadLetter{}, ErrDeadLetterNotFound
+	}
+	return letter, err
+}
+
+func (s *PostgresDeadLetterSink) Remove(ctx context.Context, id string) error {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM dead_letters WHERE id = $1", id); err != nil {
+		return fmt.Errorf("removing dead letter %s: %w", id, err)
+	}
+	return nil
+}
+
+func scanDeadLetter(row interface {
+	Scan(dest ...interface{}) error
+}) (DeadLetter, error) {
+	var letter DeadLetter
+	err := row.Scan(&letter.ID, &letter.Message.ID, &letter.Message.Value, &letter.Message.Partition,
+		&letter.Message.Offset, &letter.Error, &letter.Attempts, &letter.FailedAt)
+	if err != nil {
+		return DeadLetter{}, fmt.Errorf("scanning dead letter: %w", err)
+	}
+	return letter, nil
+}
+
+func setupDatabase(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS dead_letters (
+			id TEXT PRIMARY KEY,
+			message_id TEXT NOT NULL,
+			value BYTEA NOT NULL,
+			kafka_partition INTEGER NOT NULL,
+			kafka_offset BIGINT NOT NULL,
+			error TEXT NOT NULL,
+			attempts INTEGER NOT NULL,
+			failed_at TIMESTAMPTZ NOT NULL
+		)
+	`)
+	return err
+}
+
+// permanentError marks failures that retrying cannot fix, such as a
+// message that is not valid JSON
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
 // EventProcessor from the original example
 type EventProcessor struct {
-	consumer   Consumer
-	handler    EventHandler
-	metrics    MetricsRecorder
-	logger     Logger
-	errorsChan chan error
+	consumer    Consumer
+	handler     EventHandler
+	metrics     MetricsRecorder
+	logger      Logger
+	errorsChan  chan error
+	retry       RetryPolicy
+	idempotency IdempotencyStore
+	deadLetters DeadLetterSink
+
+	// concurrency is the number of messages handled at the same time
+	concurrency int
+	// commitInterval is how often finished offsets are committed
+	commitInterval time.Duration
+	// revokeTimeout bounds how long a rebalance waits for in-flight
+	// messages of revoked partitions
+	revokeTimeout time.Duration
+	offsets       *OffsetTracker
 }
 
+// Start reads messages and hands them to concurrent workers. Messages
+// with the same key always go to the same worker, which handles them one
+// at a time in partition order; that keeps Kafka's per-key ordering and
+// keeps two deliveries of one event from racing past the idempotency
+// check. An offset is committed only after its message and every earlier
+// message of the same partition were processed or dead-lettered, so with
+// a durable dead-letter sink a crash can cause redelivery but never loses
+// a message. On cancellation Start stops reading, lets the workers finish
+// and commits what they completed.
 func (p *EventProcessor) Start(ctx context.Context) error {
+	p.offsets = NewOffsetTracker()
+	p.consumer.SetRebalanceListener(p)
+	if p.concurrency < 1 {
+		p.concurrency = 1
+	}
+
+	work := make([]chan Message, p.concurrency)
+	var workers sync.WaitGroup
+	for i := range work {
+		work[i] = make(chan Message, workerQueueSize)
+		workers.Add(1)
+		go func(queue <-chan Message) {
+			defer workers.Done()
+			for msg := range queue {
+				if p.handleMessage(ctx, msg) {
+					p.offsets.Done(msg.Partition, msg.Offset)
+				}
+			}
+		}(work[i])
+	}
+
+	committerDone := make(chan struct{})
+	go func() {
+		defer close(committerDone)
+		ticker := time.NewTicker(p.commitInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.commit(ctx)
+			}
+		}
+	}()
+
+	err := p.readLoop(ctx, work)
+
+	for _, queue := range work {
+		close(queue)
+	}
+	workers.Wait()
+	<-committerDone
+
+	// ctx is already canceled, so the final commit needs its own deadline
+	commitCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p.commit(commitCtx)
+	return err
+}
+
+// workerQueueSize is how many messages can wait for a busy worker before
+// reading blocks
+const workerQueueSize = 16
+
+func (p *EventProcessor) readLoop(ctx context.Context, work []chan Message) error {
 	for {
+		msg, err := p.consumer.ReadMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// Only increment counter and log if it's not a context cancellation
+			p.metrics.IncCounter("message_read_errors")
+			p.logger.Error("failed to read message", "error", err)
+			continue
+		}
+
+		// Successfully read a message
+		fmt.Printf("Successfully read message with ID: %s\n", msg.ID)
+
+		p.offsets.Track(msg.Partition, msg.Offset)
 		select {
+		case work[workerFor(msg, len(work))] <- msg:
 		case <-ctx.Done():
 			return ctx.Err()
-		default:
-			msg, err := p.consumer.ReadMessage(ctx)
-			if err != nil {
-				// Only increment counter and log if it's not a context cancellation
-				if err != context.Canceled {
-					p.metrics.IncCounter("message_read_errors")
-					p.logger.Error("failed to read message", "error", err)
-				}
-				continue
-			}
+		}
+	}
+}
 
-			// Successfully read a message
-			fmt.Printf("Successfully read message with ID: %s\n", msg.ID)
-
-			if err := p.processMessage(ctx, msg); err != nil {
-				p.metrics.IncCounter("message_processing_errors")
-				p.logger.Error("failed to process message",
-					"error", err,
-					"message_id", msg.ID)
-				p.errorsChan <- err
-			} else {
-				p.metrics.IncCounter("message_processed_success")
-				fmt.Printf("Successfully processed message with ID: %s\n", msg.ID)
-			}
+// workerFor picks the worker of msg by hashing its key
+func workerFor(msg Message, workers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(msg.ID))
+	return int(h.Sum32() % uint32(workers))
+}
+
+// handleMessage processes msg with retries and dead-letters it if that
+// fails. It reports false only when processing was interrupted by
+// cancellation, in which case the offset must not be committed.
+func (p *EventProcessor) handleMessage(ctx context.Context, msg Message) bool {
+	attempts, err := p.processWithRetry(ctx, msg)
+	if err == nil {
+		p.metrics.IncCounter("message_processed_success")
+		fmt.Printf("Successfully processed message with ID: %s\n", msg.ID)
+		return true
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+
+	p.metrics.IncCounter("message_processing_errors")
+	p.logger.Error("failed to process message",
+		"error", err,
+		"message_id", msg.ID,
+		"attempts", attempts)
+	if !p.deadLetter(ctx, msg, err, attempts) {
+		// Canceled before the letter was stored, so leave the offset
+		// uncommitted
+		return false
+	}
+	select {
+	case p.errorsChan <- err:
+	default:
+	}
+	return true
+}
+
+func (p *EventProcessor) commit(ctx context.Context, partitions ...int32) {
+	offsets := p.offsets.Committable(partitions...)
+	if len(offsets) == 0 {
+		return
+	}
+	if err := p.consumer.Commit(ctx, offsets); err != nil {
+		p.metrics.IncCounter("offset_commit_errors")
+		p.logger.Error("failed to commit offsets", "error", err)
+		return
+	}
+	p.offsets.MarkCommitted(offsets)
+}
+
+// OnAssigned implements RebalanceListener
+func (p *EventProcessor) OnAssigned(partitions []int32) {}
+
+// OnRevoked implements RebalanceListener. It gives in-flight messages of
+// the revoked partitions a chance to finish, commits them and forgets the
+// partitions, since their new owner resumes from the committed offsets.
+func (p *EventProcessor) OnRevoked(partitions []int32) {
+	deadline := time.Now().Add(p.revokeTimeout)
+	for p.offsets.InFlight(partitions) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p.commit(ctx, partitions...)
+	p.offsets.Forget(partitions)
+}
+
+// processWithRetry processes msg until it succeeds, fails permanently or
+// runs out of attempts, and returns the number of attempts made
+func (p *EventProcessor) processWithRetry(ctx context.Context, msg Message) (int, error) {
+	attempt := 0
+	for {
+		attempt++
+		err := p.processMessage(ctx, msg)
+		if err == nil {
+			return attempt, nil
+		}
+
+		var permanent *permanentError
+		if errors.As(err, &permanent) || attempt >= p.retry.MaxAttempts {
+			return attempt, err
+		}
+
+		p.metrics.IncCounter("message_retries")
+		select {
+		case <-ctx.Done():
+			return attempt, ctx.Err()
+		case <-time.After(p.retry.delay(attempt)):
 		}
 	}
 }
@@ -174,13 +912,220 @@ func (p *EventProcessor) processMessage(ctx context.Context, msg Message) error
 
 	var event Event
 	if err := json.Unmarshal(msg.Value, &event); err != nil {
-		return fmt.Errorf("unmarshaling event: %w", err)
+		return &permanentError{err: fmt.Errorf("unmarshaling event: %w", err)}
+	}
+
+	seen, err := p.idempotency.Seen(ctx, event.ID)
+	if err != nil {
+		return fmt.Errorf("checking idempotency store: %w", err)
+	}
+	if seen {
+		p.metrics.IncCounter("message_duplicates_skipped")
+		return nil
+	}
+
+	if err := p.handler.HandleEvent(ctx, event); err != nil {
+		return err
+	}
+
+	// A crash before this line means the event is handled again on
+	// redelivery, so handlers must still tolerate the odd duplicate
+	if err := p.idempotency.MarkProcessed(ctx, event.ID); err != nil {
+		return fmt.Errorf("recording processed event: %w", err)
+	}
+	return nil
+}
+
+// deadLetter stores msg in the dead-letter sink, retrying with the retry
+// policy's backoff until the sink accepts it: skipping the message would
+// lose it, and leaving its offset in flight would stall the commits of its
+// partition. It reports false only when ctx is canceled first.
+func (p *EventProcessor) deadLetter(ctx context.Context, msg Message, cause error, attempts int) bool {
+	letter := DeadLetter{
+		Message:  msg,
+		Error:    cause.Error(),
+		Attempts: attempts,
+		FailedAt: time.Now(),
+	}
+	for attempt := 1; ; attempt++ {
+		err := p.deadLetters.Add(ctx, letter)
+		if err == nil {
+			p.metrics.IncCounter("messages_dead_lettered")
+			return true
+		}
+
+		p.metrics.IncCounter("dead_letter_errors")
+		p.logger.Error("failed to dead-letter message", "error", err, "message_id", msg.ID, "attempt", attempt)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(p.retry.delay(attempt)):
+		}
+	}
+}
+
+// ListDeadLetters returns the messages waiting in the dead-letter sink
+func (p *EventProcessor) ListDeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	return p.deadLetters.List(ctx)
+}
+
+// ReplayDeadLetter processes a dead letter again with the normal retry
+// policy. It is removed from the sink on success and updated on failure.
+func (p *EventProcessor) ReplayDeadLetter(ctx context.Context, id string) error {
+	letter, err := p.deadLetters.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	attempts, err := p.processWithRetry(ctx, letter.Message)
+	if err != nil {
+		letter.Error = err.Error()
+		letter.Attempts += attempts
+		letter.FailedAt = time.Now()
+		if addErr := p.deadLetters.Add(ctx, letter); addErr != nil {
+			return fmt.Errorf("updating dead letter %s: %w", id, addErr)
+		}
+		return fmt.Errorf("replaying dead letter %s: %w", id, err)
+	}
+
+	p.metrics.IncCounter("dead_letters_replayed")
+	return p.deadLetters.Remove(ctx, id)
+}
+
+// FlakyEventHandler fails every event of the configured type until
+// Recover is called, to demonstrate retries and replays
+type FlakyEventHandler struct {
+	mu        sync.Mutex
+	failType  string
+	recovered bool
+}
+
+func (h *FlakyEventHandler) HandleEvent(ctx context.Context, event Event) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if event.Type == h.failType && !h.recovered {
+		return fmt.Errorf("downstream unavailable for %s", event.ID)
+	}
+	fmt.Printf("Processing event: %s of type: %s\n", event.ID, event.Type)
+	return nil
+}
+
+func (h *FlakyEventHandler) Recover() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.recovered = true
+}
+
+// SlowEventHandler takes longer for some event types, so messages finish
+// out of order
+type SlowEventHandler struct {
+	delays map[string]time.Duration
+}
+
+func (h *SlowEventHandler) HandleEvent(ctx context.Context, event Event) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(h.delays[event.Type]):
+	}
+	fmt.Printf("Processing event: %s of type: %s\n", event.ID, event.Type)
+	return nil
+}
+
+func newInMemoryProcessor(consumer Consumer, handler EventHandler) *EventProcessor {
+	return &EventProcessor{
+		consumer:       consumer,
+		handler:        handler,
+		metrics:        &SimpleMetricsRecorder{},
+		logger:         &SimpleLogger{},
+		errorsChan:     make(chan error, 100),
+		retry:          RetryPolicy{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond, MaxDelay: 100 * time.Millisecond},
+		idempotency:    NewInMemoryIdempotencyStore(),
+		deadLetters:    NewInMemoryDeadLetterSink(),
+		concurrency:    4,
+		commitInterval: 50 * time.Millisecond,
+		revokeTimeout:  time.Second,
+	}
+}
+
+func encodeEvent(id, eventType string) []byte {
+	data, _ := json.Marshal(Event{ID: id, Type: eventType, Timestamp: time.Now()})
+	return data
+}
+
+// runInMemoryDemo exercises retries, deduplication, dead-lettering and
+// replay without a Kafka broker
+func runInMemoryDemo() {
+	consumer := NewInMemoryPartitionedConsumer(1)
+	handler := &FlakyEventHandler{failType: "payment.captured"}
+	processor := newInMemoryProcessor(consumer, handler)
+
+	consumer.Produce("evt-1", encodeEvent("evt-1", "order.created"))
+	consumer.Produce("evt-1", encodeEvent("evt-1", "order.created")) // redelivery, skipped
+	consumer.Produce("evt-2", encodeEvent("evt-2", "payment.captured"))
+	consumer.Produce("evt-3", []byte("not json"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	processor.Start(ctx)
+
+	letters, _ := processor.ListDeadLetters(context.Background())
+	for _, letter := range letters {
+		log.Printf("Dead letter %s: message %s after %d attempts: %s", letter.ID, letter.Message.ID, letter.Attempts, letter.Error)
+	}
+
+	handler.Recover()
+	for _, letter := range letters {
+		if err := processor.ReplayDeadLetter(context.Background(), letter.ID); err != nil {
+			log.Printf("Replay failed: %v", err)
+		}
 	}
 
-	return p.handler.HandleEvent(ctx, event)
+	letters, _ = processor.ListDeadLetters(context.Background())
+	log.Printf("%d dead letter(s) left after replay", len(letters))
+}
+
+// runOffsetDemo shows that a slow message holds back the commit of faster
+// messages behind it, and that a rebalance flushes finished offsets
+func runOffsetDemo() {
+	consumer := NewInMemoryPartitionedConsumer(1)
+	processor := newInMemoryProcessor(consumer, &SlowEventHandler{
+		delays: map[string]time.Duration{"report.generated": 300 * time.Millisecond},
+	})
+
+	consumer.Produce("evt-a", encodeEvent("evt-a", "report.generated"))
+	for i := 0; i < 3; i++ {
+		id := fmt.Sprintf("evt-%d", i)
+		consumer.Produce(id, encodeEvent(id, "order.created"))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		processor.Start(ctx)
+		close(done)
+	}()
+
+	time.Sleep(150 * time.Millisecond)
+	log.Printf("While evt-a is running, committed offset is %d", consumer.Committed(0))
+
+	consumer.Rebalance([]int32{0})
+	consumer.Produce("evt-b", encodeEvent("evt-b", "order.created")) // triggers the rebalance
+	time.Sleep(200 * time.Millisecond)
+	log.Printf("After the rebalance, committed offset is %d", consumer.Committed(0))
+
+	cancel()
+	<-done
+	log.Printf("After shutdown, committed offset is %d", consumer.Committed(0))
 }
 
 func main() {
+	if getEnv("CONSUMER", "kafka") == "memory" {
+		runInMemoryDemo()
+		runOffsetDemo()
+		return
+	}
+
 	// Get Kafka configuration from environment variables or use defaults
 	kafkaBrokers := getEnv("KAFKA_BROKERS", "localhost:9092")
 	kafkaTopic := getEnv("KAFKA_TOPIC", "events")
@@ -190,6 +1135,17 @@ func main() {
 		kafkaBrokers, kafkaTopic, kafkaGroup)
 	log.Printf("Make sure Kafka is running, or you'll see timeout errors")
 
+	// Dead letters must outlive the process: their offsets are committed
+	// once they are stored
+	db, err := sql.Open("postgres", getEnv("DEAD_LETTER_DSN", "postgres://pg:pg@localhost:5432/events?sslmode=disable"))
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+	if err := setupDatabase(db); err != nil {
+		log.Fatalf("Failed to set up database: %v", err)
+	}
+
 	// Create Kafka consumer
 	consumer, err := NewKafkaConsumer(kafkaBrokers, kafkaGroup, kafkaTopic)
 	if err != nil {
@@ -198,11 +1154,18 @@ func main() {
 
 	// Create event processor
 	processor := &EventProcessor{
-		consumer:   consumer,
-		handler:    &SimpleEventHandler{},
-		metrics:    &SimpleMetricsRecorder{},
-		logger:     &SimpleLogger{},
-		errorsChan: make(chan error, 100), // Buffer for errors
+		consumer:    consumer,
+		handler:     &SimpleEventHandler{},
+		metrics:     &SimpleMetricsRecorder{},
+		logger:      &SimpleLogger{},
+		errorsChan:  make(chan error, 100), // Buffer for errors
+		retry:       RetryPolicy{MaxAttempts: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: 5 * time.Second},
+		idempotency: NewInMemoryIdempotencyStore(),
+		deadLetters: NewPostgresDeadLetterSink(db),
+
+		concurrency:    8,
+		commitInterval: time.Second,
+		revokeTimeout:  10 * time.Second,
 	}
 
 	// Setup context with cancellation
@@ -216,8 +1179,9 @@ func main() {
 	// Start error handling goroutine
 	go func() {
 		for err := range processor.errorsChan {
+			// Failed messages are already in the dead-letter sink and can
+			// be replayed with processor.ReplayDeadLetter
 			log.Printf("Error channel received: %v", err)
-			// Here you could implement retry logic or dead-letter queue
 		}
 	}()
 
@@ -1,8 +1,19 @@
 // Example 73
-package eventstore_test
+// Conformance suite for the event stores of example 69. It belongs to that
+// program's package: save it as example_69_test.go next to example_69.go
+// and run go test, so the suite checks the stores themselves.
+package main
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -10,24 +21,15 @@ import (
 	"github.com/stretchr/testify/suite"
 )
 
-// Event represents a domain event
-type Event struct {
-	ID          string
-	Type        string
-	AggregateID string
-	Version     int
-	Data        []byte
-	Timestamp   time.Time
-}
-
-// EventStore interface defines methods for event persistence
-type EventStore interface {
-	Save(ctx context.Context, events []Event) error
+// conformanceStore is the part of EventStore the suite verifies
+type conformanceStore interface {
+	Save(ctx context.Context, aggregateID string, expectedVersion int, events []Event) error
 	Load(ctx context.Context, aggregateID string) ([]Event, error)
 }
 
-// Implementation of EventStore for testing
+// InMemoryEventStore is the smallest store that passes the suite
 type InMemoryEventStore struct {
+	mu     sync.Mutex
 	events map[string][]Event
 }
 
@@ -37,17 +39,55 @@ func NewInMemoryEventStore() *InMemoryEventStore {
 	}
 }
 
-func (s *InMemoryEventStore) Save(ctx context.Context, events []Event) error {
+func (s *InMemoryEventStore) Save(ctx context.Context, aggregateID string, expectedVersion int, events []Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := validateAppend(aggregateID, expectedVersion, events); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := len(s.events[aggregateID])
+	if current != expectedVersion {
+		return &ConcurrencyConflictError{
+			AggregateID:     aggregateID,
+			ExpectedVersion: expectedVersion,
+			ActualVersion:   current,
+		}
+	}
+
 	for _, event := range events {
-		s.events[event.AggregateID] = append(s.events[event.AggregateID], event)
+		event.Data = append(json.RawMessage(nil), event.Data...)
+		s.events[aggregateID] = append(s.events[aggregateID], event)
 	}
 	return nil
 }
 
 func (s *InMemoryEventStore) Load(ctx context.Context, aggregateID string) ([]Event, error) {
-	return s.events[aggregateID], nil
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Event(nil), s.events[aggregateID]...), nil
 }
 
+// quietLogger and quietMetrics keep the stores from logging every event
+type quietLogger struct{}
+
+func (quietLogger) Info(msg string, args ...interface{})  {}
+func (quietLogger) Error(msg string, args ...interface{}) {}
+
+type quietMetrics struct{}
+
+func (quietMetrics) RecordEventSaved(eventType string)  {}
+func (quietMetrics) RecordEventLoaded(eventType string) {}
+
 // Helper function to generate test events
 func generateTestEvents(aggregateID string, count int) []Event {
 	events := make([]Event, count)
@@ -57,33 +97,55 @@ func generateTestEvents(aggregateID string, count int) []Event {
 			Type:        "TestEvent",
 			AggregateID: aggregateID,
 			Version:     i + 1,
-			Data:        []byte(`{"test":"data"}`),
-			Timestamp:   time.Now(),
+			Data:        json.RawMessage(`{"test":"data"}`),
+			CreatedAt:   time.Now().UTC(),
 		}
 	}
 	return events
 }
 
-// EventStoreTestSuite is the original test suite
-type EventStoreTestSuite struct {
+// EventStoreConformanceSuite verifies the EventStore contract. Any
+// implementation can run it by providing a NewStore function that returns
+// an empty store:
+//
+//	suite.Run(t, &EventStoreConformanceSuite{NewStore: func(t *testing.T) conformanceStore { ... }})
+type EventStoreConformanceSuite struct {
 	suite.Suite
-	store  EventStore
-	events []Event
-	ctx    context.Context
+	// NewStore returns an empty store for each test
+	NewStore func(t *testing.T) conformanceStore
+
+	store conformanceStore
+	ctx   context.Context
 }
 
-func (s *EventStoreTestSuite) SetupTest() {
-	s.store = NewInMemoryEventStore()
+func (s *EventStoreConformanceSuite) SetupTest() {
+	s.store = s.NewStore(s.T())
 	s.ctx = context.Background()
 }
 
-func (s *EventStoreTestSuite) TestSaveAndLoadEvents() {
+// requireStream asserts that the stored stream equals want
+func (s *EventStoreConformanceSuite) requireStream(aggregateID string, want []Event) {
+	loaded, err := s.store.Load(s.ctx, aggregateID)
+	s.Require().NoError(err)
+	s.Require().Len(loaded, len(want))
+	for i, event := range want {
+		s.Equal(event.ID, loaded[i].ID)
+		s.Equal(event.Type, loaded[i].Type)
+		s.Equal(event.AggregateID, loaded[i].AggregateID)
+		s.Equal(event.Version, loaded[i].Version)
+		// PostgreSQL stores payloads as JSONB, which normalizes whitespace
+		s.JSONEq(string(event.Data), string(loaded[i].Data))
+		s.WithinDuration(event.CreatedAt, loaded[i].CreatedAt, time.Millisecond)
+	}
+}
+
+func (s *EventStoreConformanceSuite) TestSaveAndLoadEvents() {
 	// Arrange
 	aggregateID := uuid.New().String()
 	events := generateTestEvents(aggregateID, 5)
 
 	// Act
-	err := s.store.Save(s.ctx, events)
+	err := s.store.Save(s.ctx, aggregateID, 0, events)
 	s.Require().NoError(err)
 
 	loaded, err := s.store.Load(s.ctx, aggregateID)
@@ -98,7 +160,251 @@ func (s *EventStoreTestSuite) TestSaveAndLoadEvents() {
 	}
 }
 
-// Run the test suite
+func (s *EventStoreConformanceSuite) TestSaveRejectsStaleExpectedVersion() {
+	// Arrange
+	aggregateID := uuid.New().String()
+	events := generateTestEvents(aggregateID, 3)
+	s.Require().NoError(s.store.Save(s.ctx, aggregateID, 0, events[:2]))
+
+	// Act: a second writer still believes the stream is empty
+	err := s.store.Save(s.ctx, aggregateID, 0, events[:1])
+
+	// Assert
+	s.Require().ErrorIs(err, ErrConcurrencyConflict)
+	var conflict *ConcurrencyConflictError
+	s.Require().ErrorAs(err, &conflict)
+	s.Equal(2, conflict.ActualVersion)
+
+	s.Require().NoError(s.store.Save(s.ctx, aggregateID, 2, events[2:]))
+	loaded, err := s.store.Load(s.ctx, aggregateID)
+	s.Require().NoError(err)
+	s.Len(loaded, 3)
+}
+
+func (s *EventStoreConformanceSuite) TestLoadKeepsVersionOrderAcrossAppends() {
+	aggregateID := uuid.New().String()
+	events := generateTestEvents(aggregateID, 6)
+
+	// Append in several batches, interleaved with another stream
+	other := uuid.New().String()
+	s.Require().NoError(s.store.Save(s.ctx, aggregateID, 0, events[:1]))
+	s.Require().NoError(s.store.Save(s.ctx, other, 0, generateTestEvents(other, 2)))
+	s.Require().NoError(s.store.Save(s.ctx, aggregateID, 1, events[1:4]))
+	s.Require().NoError(s.store.Save(s.ctx, aggregateID, 4, events[4:]))
+
+	s.requireStream(aggregateID, events)
+}
+
+func (s *EventStoreConformanceSuite) TestSaveRejectsVersionGaps() {
+	aggregateID := uuid.New().String()
+	events := generateTestEvents(aggregateID, 4)
+
+	// Versions 1, 2, 4: the batch itself has a gap
+	gapped := []Event{events[0], events[1], events[3]}
+	s.Error(s.store.Save(s.ctx, aggregateID, 0, gapped))
+	s.requireStream(aggregateID, nil)
+
+	// Version 3 cannot follow an empty stream
+	s.Error(s.store.Save(s.ctx, aggregateID, 0, events[2:3]))
+
+	// Expected version ahead of the stream
+	s.Require().NoError(s.store.Save(s.ctx, aggregateID, 0, events[:1]))
+	err := s.store.Save(s.ctx, aggregateID, 2, events[2:3])
+	s.ErrorIs(err, ErrConcurrencyConflict)
+
+	s.requireStream(aggregateID, events[:1])
+}
+
+func (s *EventStoreConformanceSuite) TestSaveRejectsEventsOfAnotherAggregate() {
+	aggregateID := uuid.New().String()
+	foreign := generateTestEvents(uuid.New().String(), 1)
+
+	s.Error(s.store.Save(s.ctx, aggregateID, 0, foreign))
+	s.requireStream(aggregateID, nil)
+}
+
+func (s *EventStoreConformanceSuite) TestConcurrentAppendsHaveOneWinner() {
+	aggregateID := uuid.New().String()
+	s.Require().NoError(s.store.Save(s.ctx, aggregateID, 0, generateTestEvents(aggregateID, 1)))
+
+	const writers = 8
+	var wg sync.WaitGroup
+	errs := make([]error, writers)
+	appended := make([][]Event, writers)
+	for i := 0; i < writers; i++ {
+		appended[i] = generateTestEvents(aggregateID, 3)[1:]
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.store.Save(s.ctx, aggregateID, 1, appended[i])
+		}(i)
+	}
+	wg.Wait()
+
+	winner := -1
+	for i, err := range errs {
+		if err == nil {
+			s.Equal(-1, winner, "more than one concurrent append succeeded")
+			winner = i
+			continue
+		}
+		s.ErrorIs(err, ErrConcurrencyConflict)
+	}
+	s.Require().NotEqual(-1, winner, "no concurrent append succeeded")
+
+	loaded, err := s.store.Load(s.ctx, aggregateID)
+	s.Require().NoError(err)
+	s.Require().Len(loaded, 3)
+	s.Equal(appended[winner][0].ID, loaded[1].ID)
+	s.Equal(appended[winner][1].ID, loaded[2].ID)
+}
+
+func (s *EventStoreConformanceSuite) TestEmptyStreams() {
+	aggregateID := uuid.New().String()
+
+	loaded, err := s.store.Load(s.ctx, aggregateID)
+	s.Require().NoError(err)
+	s.Empty(loaded)
+
+	// Saving no events is a no-op, but still checks the expected version
+	s.NoError(s.store.Save(s.ctx, aggregateID, 0, nil))
+	s.ErrorIs(s.store.Save(s.ctx, aggregateID, 3, nil), ErrConcurrencyConflict)
+	s.requireStream(aggregateID, nil)
+}
+
+func (s *EventStoreConformanceSuite) TestLargePayloads() {
+	aggregateID := uuid.New().String()
+	events := generateTestEvents(aggregateID, 2)
+
+	payload := make([]byte, 4<<20)
+	rand.New(rand.NewSource(73)).Read(payload)
+	events[1].Data = json.RawMessage(fmt.Sprintf(`{"blob":%q}`, fmt.Sprintf("%x", payload[:1<<20])))
+	events[0].Data = json.RawMessage(`{"pad":"` + strings.Repeat("x", len(payload)) + `"}`)
+
+	s.Require().NoError(s.store.Save(s.ctx, aggregateID, 0, events))
+	s.requireStream(aggregateID, events)
+}
+
+func (s *EventStoreConformanceSuite) TestContextCancellation() {
+	aggregateID := uuid.New().String()
+	events := generateTestEvents(aggregateID, 2)
+	s.Require().NoError(s.store.Save(s.ctx, aggregateID, 0, events[:1]))
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	cancel()
+
+	s.ErrorIs(s.store.Save(ctx, aggregateID, 1, events[1:]), context.Canceled)
+	_, err := s.store.Load(ctx, aggregateID)
+	s.ErrorIs(err, context.Canceled)
+
+	// The canceled append must not have been applied
+	s.requireStream(aggregateID, events[:1])
+}
+
+// TestMatchesReferenceModel runs random sequences of appends, including
+// stale and future expected versions, against the store and a plain map,
+// then checks both agree. Set EVENTSTORE_SEED to replay a failing run.
+func (s *EventStoreConformanceSuite) TestMatchesReferenceModel() {
+	seed := time.Now().UnixNano()
+	if v := os.Getenv("EVENTSTORE_SEED"); v != "" {
+		fmt.Sscan(v, &seed)
+	}
+	s.T().Logf("seed %d", seed)
+	rng := rand.New(rand.NewSource(seed))
+
+	aggregates := []string{uuid.New().String(), uuid.New().String(), uuid.New().String()}
+	model := make(map[string][]Event)
+
+	for op := 0; op < 200; op++ {
+		aggregateID := aggregates[rng.Intn(len(aggregates))]
+		current := len(model[aggregateID])
+
+		expected := current
+		switch rng.Intn(5) {
+		case 0:
+			expected = rng.Intn(current + 1) // possibly stale
+		case 1:
+			expected = current + 1 + rng.Intn(3) // ahead of the stream
+		}
+
+		batch := make([]Event, 1+rng.Intn(3))
+		for i := range batch {
+			data := make([]byte, rng.Intn(64))
+			rng.Read(data)
+			batch[i] = Event{
+				ID:          uuid.New().String(),
+				Type:        fmt.Sprintf("Type%d", rng.Intn(3)),
+				AggregateID: aggregateID,
+				Version:     expected + i + 1,
+				Data:        json.RawMessage(fmt.Sprintf(`{"n":%d,"raw":"%x"}`, op, data)),
+				CreatedAt:   time.Now().UTC(),
+			}
+		}
+
+		err := s.store.Save(s.ctx, aggregateID, expected, batch)
+		if expected == current {
+			s.Require().NoError(err, "op %d seed %d", op, seed)
+			model[aggregateID] = append(model[aggregateID], batch...)
+		} else {
+			s.Require().ErrorIs(err, ErrConcurrencyConflict, "op %d seed %d", op, seed)
+		}
+	}
+
+	for _, aggregateID := range aggregates {
+		s.requireStream(aggregateID, model[aggregateID])
+	}
+}
+
+// Run the conformance suite against every store of example 69
+
 func TestEventStore(t *testing.T) {
-	suite.Run(t, new(EventStoreTestSuite))
+	suite.Run(t, &EventStoreConformanceSuite{
+		NewStore: func(t *testing.T) conformanceStore { return NewInMemoryEventStore() },
+	})
+}
+
+func TestSQLiteEventStore(t *testing.T) {
+	suite.Run(t, &EventStoreConformanceSuite{
+		NewStore: func(t *testing.T) conformanceStore {
+			// Same options as openEventStore
+			dsn := "file:" + filepath.Join(t.TempDir(), "events.db") + "?_txlock=immediate&_busy_timeout=5000"
+			db, err := sql.Open("sqlite3", dsn)
+			if err != nil {
+				t.Fatalf("opening sqlite: %v", err)
+			}
+			t.Cleanup(func() { db.Close() })
+
+			if err := setupSQLiteDatabase(db); err != nil {
+				t.Fatalf("setting up sqlite database: %v", err)
+			}
+			return NewSQLiteEventStore(db, quietMetrics{}, quietLogger{})
+		},
+	})
+}
+
+// TestPostgresEventStore runs when EVENTSTORE_POSTGRES_DSN points at a
+// scratch database; its events table is truncated before every test
+func TestPostgresEventStore(t *testing.T) {
+	dsn := os.Getenv("EVENTSTORE_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("EVENTSTORE_POSTGRES_DSN not set")
+	}
+
+	suite.Run(t, &EventStoreConformanceSuite{
+		NewStore: func(t *testing.T) conformanceStore {
+			db, err := sql.Open("postgres", dsn)
+			if err != nil {
+				t.Fatalf("opening postgres: %v", err)
+			}
+			t.Cleanup(func() { db.Close() })
+
+			if err := setupDatabase(db); err != nil {
+				t.Fatalf("setting up database: %v", err)
+			}
+			if _, err := db.Exec("TRUNCATE events"); err != nil {
+				t.Fatalf("truncating events: %v", err)
+			}
+			return NewPostgresEventStore(db, quietMetrics{}, quietLogger{})
+		},
+	})
 }
\ No newline at end of file
@@ -3,9 +3,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"sync"
+	"testing"
 	"time"
 )
 
@@ -43,69 +45,409 @@ func (m *SimpleMetricsRecorder) ObserveLatency(name string, duration time.Durati
 	fmt.Printf("[METRIC] Observed latency for %s: %v with labels %v\n", name, duration, labels)
 }
 
-// CircuitBreaker for preventing cascading failures
-type CircuitBreaker struct {
-	name             string
-	failureCount     int
-	failureThreshold int
-	state            string
-	lastFailure      time.Time
-	resetTimeout     time.Duration
-	mutex            sync.Mutex
-	logger           Logger
+// State represents the state of the circuit breaker
+type State int
+
+const (
+	StateClosed   State = iota // Calls are allowed and recorded in the window
+	StateOpen                  // Calls are rejected until OpenTimeout has passed
+	StateHalfOpen              // A limited number of probe calls are allowed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// WindowType chooses between a call-count and a time-based window
+type WindowType int
+
+const (
+	// CountWindow covers a fixed number of calls, WindowSize
+	CountWindow WindowType = iota
+	// TimeWindow covers the calls made during the last WindowDuration
+	TimeWindow
+)
+
+// BreakerConfig configures a CircuitBreaker. Both thresholds are fractions
+// between 0 and 1. Slow call detection stays off unless SlowCallDuration
+// and SlowCallRateThreshold are both set.
+type BreakerConfig[T any] struct {
+	Name           string
+	WindowType     WindowType
+	WindowSize     int
+	WindowDuration time.Duration
+	// MinimumCalls is how many calls the window needs before its rates
+	// count, so two failures out of three calls at night don't trip the
+	// breaker. A count window can't hold more than WindowSize calls, so
+	// it is lowered to that.
+	MinimumCalls          int
+	FailureRateThreshold  float64
+	SlowCallDuration      time.Duration
+	SlowCallRateThreshold float64
+	// OpenTimeout is the pause between opening and the first probe
+	OpenTimeout time.Duration
+	// HalfOpenProbes calls are let through after OpenTimeout. Once all of
+	// them returned, their rates close the breaker or open it again.
+	HalfOpenProbes int
+	// HalfOpenMaxWait bounds how long probes may take. A probe stuck on a
+	// hung connection would otherwise leave the breaker half-open, with
+	// every other call rejected. Defaults to OpenTimeout.
+	HalfOpenMaxWait time.Duration
+	// IsFailure classifies a result, for instance a 5xx response without
+	// an error; when nil, only errors count as failures
+	IsFailure func(result T, err error) bool
+	// OnStateChange runs while the breaker holds its lock and must not
+	// call back into it
+	OnStateChange func(name string, from, to State)
+}
+
+// CircuitBreaker rejects calls while the recent failure rate or slow call
+// rate of an operation is above its threshold. The type parameter is the
+// operation's result, *http.Response for the ServiceClient.
+type CircuitBreaker[T any] struct {
+	config BreakerConfig[T]
+
+	mu        sync.Mutex
+	state     State
+	changedAt time.Time
+	window    slidingWindow
+	// generation is bumped on each transition; afterCall ignores calls
+	// that began under an earlier one
+	generation uint64
+	probes     int
+	probeStats WindowStats
+}
+
+func NewCircuitBreaker[T any](config BreakerConfig[T]) *CircuitBreaker[T] {
+	if config.WindowSize <= 0 {
+		config.WindowSize = 100
+	}
+	if config.WindowDuration <= 0 {
+		config.WindowDuration = time.Minute
+	}
+	if config.MinimumCalls <= 0 {
+		config.MinimumCalls = 10
+	}
+	if config.WindowType == CountWindow && config.MinimumCalls > config.WindowSize {
+		config.MinimumCalls = config.WindowSize
+	}
+	if config.FailureRateThreshold <= 0 {
+		config.FailureRateThreshold = 0.5
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = 30 * time.Second
+	}
+	if config.HalfOpenProbes <= 0 {
+		config.HalfOpenProbes = 1
+	}
+	if config.HalfOpenMaxWait <= 0 {
+		config.HalfOpenMaxWait = config.OpenTimeout
+	}
+	if config.IsFailure == nil {
+		config.IsFailure = func(_ T, err error) bool { return err != nil }
+	}
+
+	cb := &CircuitBreaker[T]{config: config}
+	if config.WindowType == TimeWindow {
+		cb.window = newTimeWindow(config.WindowDuration)
+	} else {
+		cb.window = newCountWindow(config.WindowSize)
+	}
+	return cb
+}
+
+// Execute calls operation unless the breaker rejects it, then records the
+// outcome and duration of the call
+func (cb *CircuitBreaker[T]) Execute(operation func() (T, error)) (T, error) {
+	generation, err := cb.beforeCall()
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+
+	start := time.Now()
+	completed := false
+	defer func() {
+		// operation panicked; count that against it before unwinding
+		if !completed {
+			cb.afterCall(generation, true, time.Since(start))
+		}
+	}()
+
+	result, err := operation()
+	completed = true
+	cb.afterCall(generation, cb.config.IsFailure(result, err), time.Since(start))
+	return result, err
+}
+
+// Run wraps an operation that only returns an error
+func (cb *CircuitBreaker[T]) Run(operation func() error) error {
+	_, err := cb.Execute(func() (T, error) {
+		var zero T
+		return zero, operation()
+	})
+	return err
+}
+
+func (cb *CircuitBreaker[T]) State() State {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.currentState(time.Now())
+}
+
+// Stats returns the totals of the calls the window holds right now
+func (cb *CircuitBreaker[T]) Stats() WindowStats {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.window.stats(time.Now())
 }
 
-func NewCircuitBreaker(name string) *CircuitBreaker {
-	return &CircuitBreaker{
-		name:             name,
-		failureThreshold: 3,
-		state:            "CLOSED", // CLOSED = healthy, OPEN = tripping
-		resetTimeout:     5 * time.Second,
-		logger:           &SimpleLogger{},
+// currentState applies the transitions that are due to time alone: open
+// to half-open after OpenTimeout, and half-open back to open when probes
+// are still running after HalfOpenMaxWait. Callers hold cb.mu.
+func (cb *CircuitBreaker[T]) currentState(now time.Time) State {
+	elapsed := now.Sub(cb.changedAt)
+	switch {
+	case cb.state == StateOpen && elapsed >= cb.config.OpenTimeout:
+		cb.setState(StateHalfOpen, now)
+	case cb.state == StateHalfOpen && elapsed >= cb.config.HalfOpenMaxWait &&
+		cb.probes > cb.probeStats.Calls:
+		cb.setState(StateOpen, now)
 	}
+	return cb.state
 }
 
-func (cb *CircuitBreaker) Execute(fn func() error) error {
-	cb.mutex.Lock()
-	if cb.state == "OPEN" {
-		if time.Since(cb.lastFailure) > cb.resetTimeout {
-			fmt.Printf("[CIRCUIT] %s: Half-open, allowing test request\n", cb.name)
-			cb.state = "HALF-OPEN"
+func (cb *CircuitBreaker[T]) beforeCall() (uint64, error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.currentState(time.Now()) {
+	case StateOpen:
+		return 0, fmt.Errorf("%s: %w", cb.config.Name, ErrCircuitOpen)
+	case StateHalfOpen:
+		if cb.probes >= cb.config.HalfOpenProbes {
+			return 0, fmt.Errorf("%s: %w", cb.config.Name, ErrCircuitOpen)
+		}
+		cb.probes++
+	}
+	return cb.generation, nil
+}
+
+func (cb *CircuitBreaker[T]) afterCall(generation uint64, failed bool, duration time.Duration) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if generation != cb.generation {
+		return
+	}
+	now := time.Now()
+	slow := cb.config.SlowCallDuration > 0 && duration >= cb.config.SlowCallDuration
+
+	switch cb.state {
+	case StateClosed:
+		cb.window.record(now, failed, slow)
+		if stats := cb.window.stats(now); stats.Calls >= cb.config.MinimumCalls && cb.exceeded(stats) {
+			cb.setState(StateOpen, now)
+		}
+	case StateHalfOpen:
+		cb.probeStats.add(failed, slow)
+		if cb.probeStats.Calls < cb.config.HalfOpenProbes {
+			return
+		}
+		if cb.exceeded(cb.probeStats) {
+			cb.setState(StateOpen, now)
 		} else {
-			cb.mutex.Unlock()
-			fmt.Printf("[CIRCUIT] %s: Open (tripped), fast-failing request\n", cb.name)
-			return fmt.Errorf("circuit breaker open")
+			cb.setState(StateClosed, now)
 		}
-	} else {
-		fmt.Printf("[CIRCUIT] %s: Closed, executing request\n", cb.name)
 	}
-	cb.mutex.Unlock()
+}
 
-	err := fn()
+func (cb *CircuitBreaker[T]) exceeded(stats WindowStats) bool {
+	if stats.FailureRate() >= cb.config.FailureRateThreshold {
+		return true
+	}
+	return cb.config.SlowCallRateThreshold > 0 && cb.config.SlowCallDuration > 0 &&
+		stats.SlowCallRate() >= cb.config.SlowCallRateThreshold
+}
 
-	cb.mutex.Lock()
-	defer cb.mutex.Unlock()
+// setState clears the window and the probes on every transition. Callers
+// hold cb.mu.
+func (cb *CircuitBreaker[T]) setState(state State, now time.Time) {
+	from := cb.state
+	cb.state = state
+	cb.changedAt = now
+	cb.generation++
+	cb.probes = 0
+	cb.probeStats = WindowStats{}
+	cb.window.reset()
+	if cb.config.OnStateChange != nil {
+		cb.config.OnStateChange(cb.config.Name, from, state)
+	}
+}
 
-	if err != nil {
-		cb.failureCount++
-		fmt.Printf("[CIRCUIT] %s: Request failed, failure count: %d/%d\n",
-			cb.name, cb.failureCount, cb.failureThreshold)
-
-		if cb.failureCount >= cb.failureThreshold || cb.state == "HALF-OPEN" {
-			cb.state = "OPEN"
-			cb.lastFailure = time.Now()
-			fmt.Printf("[CIRCUIT] %s: Circuit tripped open\n", cb.name)
+// WindowStats counts calls and how many of them failed or were slow
+type WindowStats struct {
+	Calls     int
+	Failures  int
+	SlowCalls int
+}
+
+func (s *WindowStats) add(failed, slow bool) {
+	s.Calls++
+	if failed {
+		s.Failures++
+	}
+	if slow {
+		s.SlowCalls++
+	}
+}
+
+func (s WindowStats) FailureRate() float64 {
+	if s.Calls == 0 {
+		return 0
+	}
+	return float64(s.Failures) / float64(s.Calls)
+}
+
+func (s WindowStats) SlowCallRate() float64 {
+	if s.Calls == 0 {
+		return 0
+	}
+	return float64(s.SlowCalls) / float64(s.Calls)
+}
+
+type slidingWindow interface {
+	record(now time.Time, failed, slow bool)
+	stats(now time.Time) WindowStats
+	reset()
+}
+
+type callOutcome struct {
+	failed bool
+	slow   bool
+}
+
+// countWindow keeps the last len(outcomes) outcomes in a ring, with
+// running totals so stats is O(1)
+type countWindow struct {
+	outcomes []callOutcome
+	next     int
+	filled   bool
+	totals   WindowStats
+}
+
+func newCountWindow(size int) *countWindow {
+	return &countWindow{outcomes: make([]callOutcome, size)}
+}
+
+func (w *countWindow) record(_ time.Time, failed, slow bool) {
+	if w.filled {
+		// The slot about to be overwritten leaves the totals
+		old := w.outcomes[w.next]
+		w.totals.Calls--
+		if old.failed {
+			w.totals.Failures--
+		}
+		if old.slow {
+			w.totals.SlowCalls--
 		}
-		return err
 	}
+	w.outcomes[w.next] = callOutcome{failed: failed, slow: slow}
+	w.totals.add(failed, slow)
+	w.next = (w.next + 1) % len(w.outcomes)
+	if w.next == 0 {
+		w.filled = true
+	}
+}
+
+func (w *countWindow) stats(time.Time) WindowStats {
+	return w.totals
+}
+
+func (w *countWindow) reset() {
+	w.next, w.filled, w.totals = 0, false, WindowStats{}
+}
+
+// timeWindow splits its duration into timeWindowBuckets buckets and sums
+// those that are recent enough, however many calls they hold
+type timeWindow struct {
+	width   time.Duration
+	buckets []timeBucket
+}
+
+type timeBucket struct {
+	epoch int64 // now / width when the bucket was started
+	stats WindowStats
+}
+
+const timeWindowBuckets = 10
+
+func newTimeWindow(duration time.Duration) *timeWindow {
+	width := duration / timeWindowBuckets
+	if width <= 0 {
+		width = 1
+	}
+	return &timeWindow{width: width, buckets: make([]timeBucket, timeWindowBuckets)}
+}
+
+func (w *timeWindow) record(now time.Time, failed, slow bool) {
+	epoch := now.UnixNano() / int64(w.width)
+	bucket := &w.buckets[epoch%int64(len(w.buckets))]
+	if bucket.epoch != epoch {
+		*bucket = timeBucket{epoch: epoch}
+	}
+	bucket.stats.add(failed, slow)
+}
 
-	if cb.state == "HALF-OPEN" {
-		fmt.Printf("[CIRCUIT] %s: Success in half-open state, resetting circuit\n", cb.name)
-		cb.state = "CLOSED"
+func (w *timeWindow) stats(now time.Time) WindowStats {
+	epoch := now.UnixNano() / int64(w.width)
+	var total WindowStats
+	for _, bucket := range w.buckets {
+		if epoch-bucket.epoch < int64(len(w.buckets)) {
+			total.Calls += bucket.stats.Calls
+			total.Failures += bucket.stats.Failures
+			total.SlowCalls += bucket.stats.SlowCalls
+		}
 	}
+	return total
+}
 
-	cb.failureCount = 0
-	return nil
+func (w *timeWindow) reset() {
+	for i := range w.buckets {
+		w.buckets[i] = timeBucket{}
+	}
+}
+
+// NewHTTPCircuitBreaker returns a breaker for HTTP calls that counts 5xx
+// responses as failures. It trips when half of the last ten calls failed,
+// once there were at least three of them.
+func NewHTTPCircuitBreaker(name string) *CircuitBreaker[*http.Response] {
+	return NewCircuitBreaker(BreakerConfig[*http.Response]{
+		Name:                 name,
+		WindowSize:           10,
+		MinimumCalls:         3,
+		FailureRateThreshold: 0.5,
+		OpenTimeout:          5 * time.Second,
+		HalfOpenProbes:       2,
+		HalfOpenMaxWait:      10 * time.Second,
+		IsFailure: func(resp *http.Response, err error) bool {
+			return err != nil || resp.StatusCode >= 500
+		},
+		OnStateChange: func(name string, from, to State) {
+			fmt.Printf("[CIRCUIT] %s: %s -> %s\n", name, from, to)
+		},
+	})
 }
 
 // Retrier for automatic retry on failures
@@ -167,7 +509,7 @@ func WithRetrier(retrier Retrier) Option {
 }
 
 // WithCircuitBreaker configures the circuit breaker
-func WithCircuitBreaker(cb *CircuitBreaker) Option {
+func WithCircuitBreaker(cb *CircuitBreaker[*http.Response]) Option {
 	return func(client *ServiceClient) {
 		client.circuitBreaker = cb
 	}
@@ -209,7 +551,7 @@ type ServiceClient struct {
 	baseURL        string
 	httpClient     *http.Client
 	retrier        Retrier
-	circuitBreaker *CircuitBreaker
+	circuitBreaker *CircuitBreaker[*http.Response]
 	metrics        MetricsRecorder
 	logger         Logger
 }
@@ -239,7 +581,7 @@ func NewServiceClient(baseURL string, opts ...Option) *ServiceClient {
 	}
 
 	if client.circuitBreaker == nil {
-		client.circuitBreaker = NewCircuitBreaker("default")
+		client.circuitBreaker = NewHTTPCircuitBreaker("default")
 	}
 
 	return client
@@ -259,15 +601,12 @@ func (c *ServiceClient) DoRequest(ctx context.Context, req *http.Request) (*http
 	req.Header.Set("X-Trace-ID", traceID)
 
 	// Execute with circuit breaker and retry
-	var resp *http.Response
-	err := c.circuitBreaker.Execute(func() error {
-		var err error
-		resp, err = c.retrier.Do(ctx, func() (*http.Response, error) {
+	resp, err := c.circuitBreaker.Execute(func() (*http.Response, error) {
+		return c.retrier.Do(ctx, func() (*http.Response, error) {
 			// Clone the request to prevent reuse of a closed request
 			reqClone := req.Clone(req.Context())
 			return c.httpClient.Do(reqClone)
 		})
-		return err
 	})
 
 	if err != nil {
@@ -342,6 +681,199 @@ func startTestServer() *http.Server {
 	return server
 }
 
+// TestCircuitBreaker drives breakers through sequences of calls. A call
+// that hangs stays in flight until the test ends, like a probe stuck on a
+// dead connection.
+func TestCircuitBreaker(t *testing.T) {
+	type call struct {
+		wait time.Duration // pause before the call
+		fail bool
+		slow bool
+		hang bool
+	}
+	ok := call{}
+	fail := call{fail: true}
+	slow := call{slow: true}
+	hang := call{hang: true}
+	after := func(wait time.Duration, c call) call {
+		c.wait = wait
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		config BreakerConfig[struct{}]
+		calls  []call
+		// settle is waited out before the final state is checked
+		settle       time.Duration
+		want         State
+		wantRejected int
+	}{
+		{
+			name:   "failure rate below threshold",
+			config: BreakerConfig[struct{}]{WindowSize: 10, MinimumCalls: 4},
+			calls:  []call{ok, fail, ok, ok, fail, ok},
+			want:   StateClosed,
+		},
+		{
+			name:   "failure rate at threshold",
+			config: BreakerConfig[struct{}]{WindowSize: 10, MinimumCalls: 4},
+			calls:  []call{ok, fail, ok, fail},
+			want:   StateOpen,
+		},
+		{
+			name:   "custom failure rate threshold",
+			config: BreakerConfig[struct{}]{WindowSize: 10, MinimumCalls: 4, FailureRateThreshold: 0.75},
+			calls:  []call{fail, fail, ok, ok, fail},
+			want:   StateClosed,
+		},
+		{
+			name:   "failures dropped out of the count window",
+			config: BreakerConfig[struct{}]{WindowSize: 4, MinimumCalls: 4},
+			calls:  []call{fail, ok, ok, ok, ok, fail},
+			want:   StateClosed,
+		},
+		{
+			name:   "below MinimumCalls",
+			config: BreakerConfig[struct{}]{MinimumCalls: 5},
+			calls:  []call{fail, fail, fail, fail},
+			want:   StateClosed,
+		},
+		{
+			name:         "MinimumCalls reached",
+			config:       BreakerConfig[struct{}]{MinimumCalls: 5},
+			calls:        []call{fail, fail, fail, fail, fail, ok},
+			want:         StateOpen,
+			wantRejected: 1,
+		},
+		{
+			name:   "MinimumCalls capped at WindowSize",
+			config: BreakerConfig[struct{}]{WindowSize: 3, MinimumCalls: 10},
+			calls:  []call{fail, fail, fail},
+			want:   StateOpen,
+		},
+		{
+			name: "failures expired from the time window",
+			config: BreakerConfig[struct{}]{
+				WindowType: TimeWindow, WindowDuration: 50 * time.Millisecond, MinimumCalls: 3,
+			},
+			calls: []call{fail, fail, after(80*time.Millisecond, fail)},
+			want:  StateClosed,
+		},
+		{
+			name: "slow call rate",
+			config: BreakerConfig[struct{}]{
+				MinimumCalls: 4, SlowCallDuration: 5 * time.Millisecond, SlowCallRateThreshold: 0.5,
+			},
+			calls: []call{ok, slow, ok, slow},
+			want:  StateOpen,
+		},
+		{
+			name:   "slow calls without a slow call threshold",
+			config: BreakerConfig[struct{}]{MinimumCalls: 4, SlowCallDuration: 5 * time.Millisecond},
+			calls:  []call{slow, slow, slow, slow},
+			want:   StateClosed,
+		},
+		{
+			name:   "open until OpenTimeout",
+			config: BreakerConfig[struct{}]{MinimumCalls: 1, OpenTimeout: 20 * time.Millisecond},
+			calls:  []call{fail},
+			settle: 30 * time.Millisecond,
+			want:   StateHalfOpen,
+		},
+		{
+			name:         "half-open admits HalfOpenProbes calls",
+			config:       BreakerConfig[struct{}]{MinimumCalls: 1, OpenTimeout: 10 * time.Millisecond, HalfOpenProbes: 2},
+			calls:        []call{fail, after(20*time.Millisecond, hang), hang, ok},
+			want:         StateHalfOpen,
+			wantRejected: 1,
+		},
+		{
+			name:   "passing probes close",
+			config: BreakerConfig[struct{}]{MinimumCalls: 1, OpenTimeout: 10 * time.Millisecond, HalfOpenProbes: 2},
+			calls:  []call{fail, after(20*time.Millisecond, ok), ok},
+			want:   StateClosed,
+		},
+		{
+			name:   "failing probes reopen",
+			config: BreakerConfig[struct{}]{MinimumCalls: 1, OpenTimeout: 10 * time.Millisecond, HalfOpenProbes: 2},
+			calls:  []call{fail, after(20*time.Millisecond, ok), fail},
+			want:   StateOpen,
+		},
+		{
+			name: "hung probe reopens after HalfOpenMaxWait",
+			config: BreakerConfig[struct{}]{
+				MinimumCalls: 1, OpenTimeout: 10 * time.Millisecond, HalfOpenMaxWait: 30 * time.Millisecond,
+			},
+			calls:  []call{fail, after(20*time.Millisecond, hang)},
+			settle: 40 * time.Millisecond,
+			want:   StateOpen,
+		},
+		{
+			name: "hung probe within HalfOpenMaxWait",
+			config: BreakerConfig[struct{}]{
+				MinimumCalls: 1, OpenTimeout: 10 * time.Millisecond, HalfOpenMaxWait: time.Minute,
+			},
+			calls:  []call{fail, after(20*time.Millisecond, hang)},
+			settle: 40 * time.Millisecond,
+			want:   StateHalfOpen,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			defer close(release)
+
+			cb := NewCircuitBreaker(tt.config)
+			rejected := 0
+			for _, c := range tt.calls {
+				time.Sleep(c.wait)
+
+				started := make(chan struct{})
+				result := make(chan error, 1)
+				go func(c call) {
+					result <- cb.Run(func() error {
+						close(started)
+						switch {
+						case c.hang:
+							<-release
+						case c.slow:
+							time.Sleep(tt.config.SlowCallDuration + time.Millisecond)
+						case c.fail:
+							return errors.New("call failed")
+						}
+						return nil
+					})
+				}(c)
+
+				var err error
+				if c.hang {
+					// Wait until the call is in flight, unless it was rejected
+					select {
+					case <-started:
+						continue
+					case err = <-result:
+					}
+				} else {
+					err = <-result
+				}
+				if errors.Is(err, ErrCircuitOpen) {
+					rejected++
+				}
+			}
+			time.Sleep(tt.settle)
+
+			if got := cb.State(); got != tt.want {
+				t.Errorf("State() = %s, want %s", got, tt.want)
+			}
+			if rejected != tt.wantRejected {
+				t.Errorf("rejected %d calls, want %d", rejected, tt.wantRejected)
+			}
+		})
+	}
+}
+
 func main() {
 	// Start a test server
 	server := startTestServer()
@@ -353,7 +885,7 @@ func main() {
 
 	// Create service client with options
 	fmt.Println("\n=== BASIC REQUEST WITH TRACING AND METRICS ===")
-	cb := NewCircuitBreaker("test-circuit")
+	cb := NewHTTPCircuitBreaker("test-circuit")
 	retrier := NewRetrier(3, logger)
 	client := NewServiceClient("http://localhost:8080",
 		WithLogger(logger),
@@ -378,7 +910,7 @@ func main() {
 		WithLogger(logger),
 		WithMetrics(metrics),
 		WithRetrier(retrier),
-		WithCircuitBreaker(NewCircuitBreaker("retry-circuit")),
+		WithCircuitBreaker(NewHTTPCircuitBreaker("retry-circuit")),
 	)
 
 	resp, err = retrierClient.Get(ctx, "/retry-test")
@@ -391,7 +923,7 @@ func main() {
 
 	// Test circuit breaker
 	fmt.Println("\n=== TESTING CIRCUIT BREAKER ===")
-	cbCircuit := NewCircuitBreaker("test-breaker")
+	cbCircuit := NewHTTPCircuitBreaker("test-breaker")
 	cbClient := NewServiceClient("http://localhost:8080",
 		WithLogger(logger),
 		WithMetrics(metrics),
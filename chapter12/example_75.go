@@ -3,19 +3,37 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"net"
+	"os"
+	"sort"
+	"sync"
+	"testing"
 	"time"
 
 	"github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// Message represents a message to be published
+// Message represents a message to be published. ID is also the partition
+// key. Headers are filled in on delivery.
 type Message struct {
-	ID   string
-	Data []byte
+	ID      string
+	Data    []byte
+	Headers map[string]string
 }
 
 // MessageHandler is a function that processes messages
@@ -55,26 +73,70 @@ func (m *SimpleMetrics) IncCounter(name string, labels ...string) {
 	log.Printf("COUNTER: %s incremented with labels %v", name, labels)
 }
 
-// Trace context implementation
-type trace struct {
-	spanContext traceSpanContext
+// tracePropagator carries W3C trace context and baggage in message
+// headers, the same way the RabbitMQ client does, so traces continue across
+// both brokers
+var tracePropagator = propagation.NewCompositeTextMapPropagator(
+	propagation.TraceContext{},
+	propagation.Baggage{},
+)
+
+// withTraceContext copies headers and replaces their trace context with
+// that of ctx
+func withTraceContext(ctx context.Context, headers map[string]string) map[string]string {
+	traced := make(map[string]string, len(headers)+3)
+	for key, value := range headers {
+		traced[key] = value
+	}
+	for _, key := range tracePropagator.Fields() {
+		delete(traced, key)
+	}
+	tracePropagator.Inject(ctx, propagation.MapCarrier(traced))
+	return traced
 }
 
-type traceSpanContext struct {
-	TraceID uuid.UUID
+// extractTraceContext returns ctx carrying the remote span context and
+// baggage found in headers. Malformed headers are ignored.
+func extractTraceContext(ctx context.Context, headers map[string]string) context.Context {
+	return tracePropagator.Extract(ctx, propagation.MapCarrier(headers))
+}
+
+// startConsumerSpan continues the producer's trace from a message's
+// headers. The consumer span is a child of the producer span and links to
+// it, so the relation stays visible to backends that start a new trace per
+// consumer.
+func startConsumerSpan(ctx context.Context, tracer trace.Tracer, system, topic string, headers map[string]string) (context.Context, trace.Span) {
+	ctx = extractTraceContext(ctx, headers)
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", system),
+			attribute.String("messaging.destination.name", topic),
+		),
+	}
+	if producer := trace.SpanContextFromContext(ctx); producer.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: producer}))
+	}
+	return tracer.Start(ctx, "process "+topic, opts...)
 }
 
-func (t *trace) SpanContext() traceSpanContext {
-	return t.spanContext
+func startProducerSpan(ctx context.Context, tracer trace.Tracer, system, topic string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "publish "+topic,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", system),
+			attribute.String("messaging.destination.name", topic),
+		),
+	)
 }
 
-// FromContext extracts trace from context
-func FromContext(ctx context.Context) *trace {
-	val := ctx.Value("trace")
-	if val == nil {
-		return &trace{spanContext: traceSpanContext{TraceID: uuid.New()}}
+// endSpan records the outcome of the span's work and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 	}
-	return val.(*trace)
+	span.End()
 }
 
 // MessageBroker interface
@@ -83,43 +145,80 @@ type MessageBroker interface {
 	Subscribe(ctx context.Context, topic string, handler MessageHandler) error
 }
 
+// TopicDeleter is implemented by brokers that can drop topics, such as the
+// private reply topics of a Requester
+type TopicDeleter interface {
+	DeleteTopic(topic string) error
+}
+
+// TopicCreator is implemented by brokers that can create a topic before
+// anyone subscribes to it
+type TopicCreator interface {
+	CreateTopic(topic string, partitions int) error
+}
+
+// GroupBroker is implemented by brokers whose subscribers can join a
+// consumer group other than the configured one
+type GroupBroker interface {
+	Group(groupID string) MessageBroker
+}
+
 // KafkaBroker struct
 type KafkaBroker struct {
 	producer *kafka.Writer
-	consumer *kafka.Reader
+	groupID  string
 	metrics  MetricsRecorder
 	logger   Logger
+	tracer   trace.Tracer
 }
 
 func NewKafkaBroker(kafkaURL string) *KafkaBroker {
+	// Hash keeps all messages with the same ID on one partition, in order
 	producer := &kafka.Writer{
 		Addr:     kafka.TCP(kafkaURL),
-		Balancer: &kafka.LeastBytes{},
+		Balancer: &kafka.Hash{},
 	}
 
 	return &KafkaBroker{
 		producer: producer,
+		groupID:  "example-consumer-group",
 		metrics:  &SimpleMetrics{},
 		logger:   &SimpleLogger{},
+		tracer:   otel.Tracer("messaging/kafka"),
 	}
 }
 
-// CreateTopic creates a Kafka topic if it doesn't exist
-func CreateTopic(kafkaURL, topic string, partitions int) error {
+// SetTracer replaces the tracer of the global TracerProvider
+func (b *KafkaBroker) SetTracer(tracer trace.Tracer) {
+	b.tracer = tracer
+}
+
+// dialController connects to the cluster's controller, which handles
+// topic creation and deletion
+func dialController(kafkaURL string) (*kafka.Conn, error) {
 	conn, err := kafka.Dial("tcp", kafkaURL)
 	if err != nil {
-		return fmt.Errorf("dial failed: %w", err)
+		return nil, fmt.Errorf("dial failed: %w", err)
 	}
 	defer conn.Close()
 
 	controller, err := conn.Controller()
 	if err != nil {
-		return fmt.Errorf("get controller failed: %w", err)
+		return nil, fmt.Errorf("get controller failed: %w", err)
 	}
 
 	controllerConn, err := kafka.Dial("tcp", net.JoinHostPort(controller.Host, fmt.Sprintf("%d", controller.Port)))
 	if err != nil {
-		return fmt.Errorf("connect to controller failed: %w", err)
+		return nil, fmt.Errorf("connect to controller failed: %w", err)
+	}
+	return controllerConn, nil
+}
+
+// CreateTopic creates a Kafka topic if it doesn't exist
+func CreateTopic(kafkaURL, topic string, partitions int) error {
+	controllerConn, err := dialController(kafkaURL)
+	if err != nil {
+		return err
 	}
 	defer controllerConn.Close()
 
@@ -139,6 +238,25 @@ func CreateTopic(kafkaURL, topic string, partitions int) error {
 	return nil
 }
 
+// CreateTopic creates a topic on the broker's cluster
+func (b *KafkaBroker) CreateTopic(topic string, partitions int) error {
+	return CreateTopic(b.producer.Addr.String(), topic, partitions)
+}
+
+// DeleteTopic deletes a topic and the messages in it
+func (b *KafkaBroker) DeleteTopic(topic string) error {
+	controllerConn, err := dialController(b.producer.Addr.String())
+	if err != nil {
+		return err
+	}
+	defer controllerConn.Close()
+
+	if err := controllerConn.DeleteTopics(topic); err != nil {
+		return fmt.Errorf("delete topic failed: %w", err)
+	}
+	return nil
+}
+
 func (b *KafkaBroker) Publish(ctx context.Context, topic string, msg Message) error {
 	start := time.Now()
 	defer func() {
@@ -147,9 +265,12 @@ func (b *KafkaBroker) Publish(ctx context.Context, topic string, msg Message) er
 		)
 	}()
 
+	ctx, span := startProducerSpan(ctx, b.tracer, "kafka", topic)
+
 	// Add tracing context
-	headers := []kafka.Header{
-		{Key: "trace_id", Value: []byte(FromContext(ctx).SpanContext().TraceID.String())},
+	var headers []kafka.Header
+	for key, value := range withTraceContext(ctx, msg.Headers) {
+		headers = append(headers, kafka.Header{Key: key, Value: []byte(value)})
 	}
 
 	// Publish message
@@ -160,6 +281,8 @@ func (b *KafkaBroker) Publish(ctx context.Context, topic string, msg Message) er
 		Headers: headers,
 	})
 
+	endSpan(span, err)
+
 	if err != nil {
 		b.metrics.IncCounter("message_publish_errors", "topic", topic)
 		return fmt.Errorf("publishing message: %w", err)
@@ -169,40 +292,72 @@ func (b *KafkaBroker) Publish(ctx context.Context, topic string, msg Message) er
 	return nil
 }
 
+// Subscribe joins the broker's consumer group. Every subscription reads
+// with a reader of its own until ctx is canceled.
 func (b *KafkaBroker) Subscribe(ctx context.Context, topic string, handler MessageHandler) error {
-	// Implementation of Subscribe method
-	b.consumer = kafka.NewReader(kafka.ReaderConfig{
+	return b.subscribe(ctx, topic, b.groupID, handler)
+}
+
+// Group returns a MessageBroker whose subscribers join the given consumer
+// group instead of the broker's
+func (b *KafkaBroker) Group(groupID string) MessageBroker {
+	return &kafkaGroupBroker{broker: b, groupID: groupID}
+}
+
+type kafkaGroupBroker struct {
+	broker  *KafkaBroker
+	groupID string
+}
+
+func (g *kafkaGroupBroker) Publish(ctx context.Context, topic string, msg Message) error {
+	return g.broker.Publish(ctx, topic, msg)
+}
+
+func (g *kafkaGroupBroker) Subscribe(ctx context.Context, topic string, handler MessageHandler) error {
+	return g.broker.subscribe(ctx, topic, g.groupID, handler)
+}
+
+func (g *kafkaGroupBroker) DeleteTopic(topic string) error {
+	return g.broker.DeleteTopic(topic)
+}
+
+func (b *KafkaBroker) subscribe(ctx context.Context, topic, groupID string, handler MessageHandler) error {
+	reader := kafka.NewReader(kafka.ReaderConfig{
 		Brokers:  []string{b.producer.Addr.String()},
 		Topic:    topic,
-		GroupID:  "example-consumer-group",
+		GroupID:  groupID,
 		MinBytes: 10e3, // 10KB
 		MaxBytes: 10e6, // 10MB
 	})
 
 	go func() {
+		defer reader.Close()
 		for {
 			select {
 			case <-ctx.Done():
 				return
 			default:
-				m, err := b.consumer.ReadMessage(ctx)
+				m, err := reader.ReadMessage(ctx)
 				if err != nil {
 					b.logger.Error("Failed to read message: %v", err)
 					continue
 				}
 
 				msg := Message{
-					ID:   string(m.Key),
-					Data: m.Value,
+					ID:      string(m.Key),
+					Data:    m.Value,
+					Headers: make(map[string]string, len(m.Headers)),
+				}
+				for _, h := range m.Headers {
+					msg.Headers[h.Key] = string(h.Value)
 				}
 
-				traceCtx := context.WithValue(ctx, "trace", &trace{
-					spanContext: traceSpanContext{
-						TraceID: uuid.New(),
-					},
-				})
+				// Continue the publisher's trace
+				traceCtx, span := startConsumerSpan(ctx, b.tracer, "kafka", topic, msg.Headers)
 
-				if err := handler(traceCtx, msg); err != nil {
+				err = handler(traceCtx, msg)
+				endSpan(span, err)
+				if err != nil {
 					b.logger.Error("Failed to process message: %v", err)
 				}
 			}
@@ -212,7 +367,1240 @@ func (b *KafkaBroker) Subscribe(ctx context.Context, topic string, handler Messa
 	return nil
 }
 
+// InMemoryBrokerConfig configures an InMemoryBroker
+type InMemoryBrokerConfig struct {
+	// Partitions is the partition count of topics created on first use
+	Partitions int
+	// GroupID is the consumer group Subscribe joins, like KafkaBroker's
+	GroupID string
+	// MaxDeliveries is how often a message is handed to a failing handler
+	// before it is skipped; 0 redelivers forever
+	MaxDeliveries int
+	// RedeliveryDelay is the pause before a failed message is redelivered
+	RedeliveryDelay time.Duration
+}
+
+// InMemoryBroker implements MessageBroker in process, for tests of code
+// written against KafkaBroker. Messages are keyed to partitions with the
+// same hash as KafkaBroker's balancer. Every consumer group tracks its own
+// offsets, and the partitions of a topic are spread over the group's
+// subscribers in the order they joined. A message whose handler fails is
+// redelivered before anything later in its partition, and an offset is
+// committed only after its handler succeeded, so leaving subscribers hand
+// unfinished messages to the rest of the group.
+type InMemoryBroker struct {
+	mu     sync.Mutex
+	config InMemoryBrokerConfig
+	topics map[string]*memoryTopic
+	rr     int
+	logger Logger
+	metric MetricsRecorder
+	tracer trace.Tracer
+}
+
+type memoryTopic struct {
+	name       string
+	partitions [][]Message
+	groups     map[string]*memoryGroup
+}
+
+type memoryGroup struct {
+	committed []int64
+	members   []*memoryMember
+}
+
+type memoryMember struct {
+	partitions []int
+	cursor     int
+	wake       chan struct{}
+}
+
+func NewInMemoryBroker(config InMemoryBrokerConfig) *InMemoryBroker {
+	if config.Partitions <= 0 {
+		config.Partitions = 1
+	}
+	if config.GroupID == "" {
+		config.GroupID = "example-consumer-group"
+	}
+	return &InMemoryBroker{
+		config: config,
+		topics: make(map[string]*memoryTopic),
+		logger: &SimpleLogger{},
+		metric: &SimpleMetrics{},
+		tracer: otel.Tracer("messaging/memory"),
+	}
+}
+
+// SetTracer replaces the tracer of the global TracerProvider
+func (b *InMemoryBroker) SetTracer(tracer trace.Tracer) {
+	b.tracer = tracer
+}
+
+// CreateTopic creates a topic with its own partition count. It fails if
+// the topic already exists or partitions is not positive, like its Kafka
+// counterpart.
+func (b *InMemoryBroker) CreateTopic(topic string, partitions int) error {
+	if partitions <= 0 {
+		return fmt.Errorf("create topic failed: topic %s needs at least one partition, got %d", topic, partitions)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.topics[topic]; ok {
+		return fmt.Errorf("create topic failed: topic %s already exists", topic)
+	}
+	b.topics[topic] = newMemoryTopic(topic, partitions)
+	return nil
+}
+
+// DeleteTopic drops a topic with its messages and consumer groups.
+// Publishing to it again creates a new, empty topic.
+func (b *InMemoryBroker) DeleteTopic(topic string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.topics[topic]; !ok {
+		return fmt.Errorf("delete topic failed: topic %s does not exist", topic)
+	}
+	delete(b.topics, topic)
+	return nil
+}
+
+func newMemoryTopic(name string, partitions int) *memoryTopic {
+	return &memoryTopic{
+		name:       name,
+		partitions: make([][]Message, partitions),
+		groups:     make(map[string]*memoryGroup),
+	}
+}
+
+// topic returns the topic, creating it on first use. Callers hold b.mu.
+func (b *InMemoryBroker) topic(name string) *memoryTopic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = newMemoryTopic(name, b.config.Partitions)
+		b.topics[name] = t
+	}
+	return t
+}
+
+// Partition returns the partition a key is written to, using the same
+// FNV-1a hash as kafka.Hash
+func (b *InMemoryBroker) Partition(topic, key string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return hashPartition(key, len(b.topic(topic).partitions))
+}
+
+func hashPartition(key string, partitions int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	p := int32(h.Sum32()) % int32(partitions)
+	if p < 0 {
+		p = -p
+	}
+	return int(p)
+}
+
+func (b *InMemoryBroker) Publish(ctx context.Context, topic string, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		b.metric.IncCounter("message_publish_errors", "topic", topic)
+		return fmt.Errorf("publishing message: %w", err)
+	}
+
+	ctx, span := startProducerSpan(ctx, b.tracer, "memory", topic)
+	defer span.End()
+
+	headers := withTraceContext(ctx, msg.Headers)
+	data := append([]byte(nil), msg.Data...)
+
+	b.mu.Lock()
+	t := b.topic(topic)
+	var partition int
+	if msg.ID == "" {
+		partition = b.rr % len(t.partitions)
+		b.rr++
+	} else {
+		partition = hashPartition(msg.ID, len(t.partitions))
+	}
+	t.partitions[partition] = append(t.partitions[partition], Message{ID: msg.ID, Data: data, Headers: headers})
+	for _, g := range t.groups {
+		for _, m := range g.members {
+			m.notify()
+		}
+	}
+	b.mu.Unlock()
+
+	b.metric.IncCounter("messages_published", "topic", topic)
+	return nil
+}
+
+// Subscribe joins the configured consumer group. Delivery stops when ctx
+// is canceled.
+func (b *InMemoryBroker) Subscribe(ctx context.Context, topic string, handler MessageHandler) error {
+	return b.subscribe(ctx, topic, b.config.GroupID, handler)
+}
+
+// Group returns a MessageBroker whose subscribers join the given consumer
+// group instead of the configured one
+func (b *InMemoryBroker) Group(groupID string) MessageBroker {
+	return &inMemoryGroupBroker{broker: b, groupID: groupID}
+}
+
+type inMemoryGroupBroker struct {
+	broker  *InMemoryBroker
+	groupID string
+}
+
+func (g *inMemoryGroupBroker) Publish(ctx context.Context, topic string, msg Message) error {
+	return g.broker.Publish(ctx, topic, msg)
+}
+
+func (g *inMemoryGroupBroker) Subscribe(ctx context.Context, topic string, handler MessageHandler) error {
+	return g.broker.subscribe(ctx, topic, g.groupID, handler)
+}
+
+func (g *inMemoryGroupBroker) DeleteTopic(topic string) error {
+	return g.broker.DeleteTopic(topic)
+}
+
+func (b *InMemoryBroker) subscribe(ctx context.Context, topic, groupID string, handler MessageHandler) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	t := b.topic(topic)
+	g, ok := t.groups[groupID]
+	if !ok {
+		// A new group starts at the beginning, like auto.offset.reset=earliest
+		g = &memoryGroup{committed: make([]int64, len(t.partitions))}
+		t.groups[groupID] = g
+	}
+	m := &memoryMember{wake: make(chan struct{}, 1)}
+	g.members = append(g.members, m)
+	g.rebalance()
+	b.mu.Unlock()
+
+	go b.consume(ctx, t, g, m, handler)
+	return nil
+}
+
+// rebalance spreads partitions over members round-robin. Callers hold b.mu.
+func (g *memoryGroup) rebalance() {
+	for _, m := range g.members {
+		m.partitions = m.partitions[:0]
+		m.cursor = 0
+	}
+	if len(g.members) == 0 {
+		return
+	}
+	for p := range g.committed {
+		m := g.members[p%len(g.members)]
+		m.partitions = append(m.partitions, p)
+	}
+	for _, m := range g.members {
+		m.notify()
+	}
+}
+
+func (m *memoryMember) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *memoryMember) owns(partition int) bool {
+	for _, p := range m.partitions {
+		if p == partition {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *InMemoryBroker) consume(ctx context.Context, t *memoryTopic, g *memoryGroup, m *memoryMember, handler MessageHandler) {
+	defer b.leave(g, m)
+
+	for {
+		partition, offset, msg, ok := b.next(t, g, m)
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-m.wake:
+			}
+			continue
+		}
+
+		if !b.deliver(ctx, t.name, msg, handler) {
+			// Canceled mid-delivery: the offset stays uncommitted and
+			// the message goes to whoever owns the partition next
+			return
+		}
+
+		b.mu.Lock()
+		if m.owns(partition) && g.committed[partition] == offset {
+			g.committed[partition] = offset + 1
+		}
+		b.mu.Unlock()
+	}
+}
+
+// next picks the first uncommitted message of the member's partitions,
+// taking partitions in turn so none of them starves
+func (b *InMemoryBroker) next(t *memoryTopic, g *memoryGroup, m *memoryMember) (int, int64, Message, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i := 0; i < len(m.partitions); i++ {
+		p := m.partitions[(m.cursor+i)%len(m.partitions)]
+		offset := g.committed[p]
+		if offset < int64(len(t.partitions[p])) {
+			m.cursor = (m.cursor + i + 1) % len(m.partitions)
+			return p, offset, t.partitions[p][offset], true
+		}
+	}
+	return 0, 0, Message{}, false
+}
+
+// deliver hands msg to handler until it succeeds or MaxDeliveries is
+// reached. It returns false if ctx was canceled before that.
+func (b *InMemoryBroker) deliver(ctx context.Context, topic string, msg Message, handler MessageHandler) bool {
+	for attempt := 1; ; attempt++ {
+		if ctx.Err() != nil {
+			return false
+		}
+
+		delivered := Message{ID: msg.ID, Data: msg.Data, Headers: make(map[string]string, len(msg.Headers))}
+		for key, value := range msg.Headers {
+			delivered.Headers[key] = value
+		}
+
+		// Every delivery attempt gets its own consumer span
+		traceCtx, span := startConsumerSpan(ctx, b.tracer, "memory", topic, msg.Headers)
+		span.SetAttributes(attribute.Int("messaging.delivery.attempt", attempt))
+		err := handler(traceCtx, delivered)
+		endSpan(span, err)
+		if err == nil {
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+
+		b.logger.Error("Failed to process message: %v", err)
+		if b.config.MaxDeliveries > 0 && attempt >= b.config.MaxDeliveries {
+			b.metric.IncCounter("messages_skipped")
+			b.logger.Error("Skipping message %s after %d deliveries", msg.ID, attempt)
+			return true
+		}
+		b.metric.IncCounter("messages_redelivered")
+
+		if b.config.RedeliveryDelay > 0 {
+			select {
+			case <-ctx.Done():
+				return false
+			case <-time.After(b.config.RedeliveryDelay):
+			}
+		}
+	}
+}
+
+func (b *InMemoryBroker) leave(g *memoryGroup, m *memoryMember) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, member := range g.members {
+		if member == m {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	g.rebalance()
+}
+
+// Committed returns a group's next offset for a partition of topic
+func (b *InMemoryBroker) Committed(topic, groupID string, partition int) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	g, ok := b.topic(topic).groups[groupID]
+	if !ok {
+		return 0
+	}
+	return g.committed[partition]
+}
+
+// Messages returns what was published to a partition, in offset order
+func (b *InMemoryBroker) Messages(topic string, partition int) []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Message(nil), b.topic(topic).partitions[partition]...)
+}
+
+// WaitIdle blocks until every consumer group with subscribers has
+// committed everything published to its topic. Tests call it instead of
+// sleeping.
+func (b *InMemoryBroker) WaitIdle(ctx context.Context) error {
+	for !b.idle() {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for consumers: %w", ctx.Err())
+		case <-time.After(time.Millisecond):
+		}
+	}
+	return nil
+}
+
+func (b *InMemoryBroker) idle() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, t := range b.topics {
+		for _, g := range t.groups {
+			if len(g.members) == 0 {
+				continue
+			}
+			for p, log := range t.partitions {
+				if g.committed[p] < int64(len(log)) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// ScheduledMessage is a message held back until DeliverAt
+type ScheduledMessage struct {
+	ID        string
+	Topic     string
+	Message   Message
+	DeliverAt time.Time
+}
+
+var (
+	ErrScheduledMessageNotFound = errors.New("scheduled message not found")
+	// ErrScheduledMessageInFlight means a dispatcher claimed the message
+	// and may be publishing it, so it can no longer be canceled
+	ErrScheduledMessageInFlight = errors.New("scheduled message is being published")
+)
+
+// ScheduleStore keeps scheduled messages until a dispatcher releases them
+type ScheduleStore interface {
+	Add(ctx context.Context, msg ScheduledMessage) error
+	// Cancel removes a message no dispatcher has claimed
+	Cancel(ctx context.Context, id string) error
+	// Claim returns due messages and hides them from other dispatchers
+	// until the claim expires, so a dispatcher that dies mid-release does
+	// not lose them
+	Claim(ctx context.Context, now time.Time, claimFor time.Duration, limit int) ([]ScheduledMessage, error)
+	// Release removes a message after it was published
+	Release(ctx context.Context, id string) error
+	// NextDue returns the earliest time a message can be claimed, if any
+	NextDue(ctx context.Context) (time.Time, bool, error)
+}
+
+// SQLiteScheduleStore keeps scheduled messages in a SQLite table, so they
+// survive restarts
+type SQLiteScheduleStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteScheduleStore(ctx context.Context, db *sql.DB) (*SQLiteScheduleStore, error) {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS scheduled_messages (
+			id            TEXT PRIMARY KEY,
+			topic         TEXT NOT NULL,
+			message_id    TEXT NOT NULL,
+			data          BLOB NOT NULL,
+			headers       TEXT NOT NULL,
+			deliver_at    INTEGER NOT NULL,
+			claimed_until INTEGER NOT NULL DEFAULT 0
+		);
+		CREATE INDEX IF NOT EXISTS scheduled_messages_deliver_at ON scheduled_messages (deliver_at);`)
+	if err != nil {
+		return nil, fmt.Errorf("creating scheduled_messages table: %w", err)
+	}
+	return &SQLiteScheduleStore{db: db}, nil
+}
+
+func (s *SQLiteScheduleStore) Add(ctx context.Context, msg ScheduledMessage) error {
+	headers, err := json.Marshal(msg.Message.Headers)
+	if err != nil {
+		return fmt.Errorf("encoding headers: %w", err)
+	}
+	// A nil slice would be stored as NULL
+	data := msg.Message.Data
+	if data == nil {
+		data = []byte{}
+	}
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO scheduled_messages (id, topic, message_id, data, headers, deliver_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		msg.ID, msg.Topic, msg.Message.ID, data, string(headers), msg.DeliverAt.UnixNano())
+	if err != nil {
+		return fmt.Errorf("storing scheduled message: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteScheduleStore) Cancel(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx,
+		`DELETE FROM scheduled_messages WHERE id = ? AND claimed_until <= ?`, id, time.Now().UnixNano())
+	if err != nil {
+		return fmt.Errorf("canceling scheduled message: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("canceling scheduled message: %w", err)
+	} else if n > 0 {
+		return nil
+	}
+
+	var exists bool
+	err = s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM scheduled_messages WHERE id = ?)`, id).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("canceling scheduled message: %w", err)
+	}
+	if exists {
+		return fmt.Errorf("%w: %s", ErrScheduledMessageInFlight, id)
+	}
+	return fmt.Errorf("%w: %s", ErrScheduledMessageNotFound, id)
+}
+
+func (s *SQLiteScheduleStore) Claim(ctx context.Context, now time.Time, claimFor time.Duration, limit int) ([]ScheduledMessage, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE scheduled_messages SET claimed_until = ?1
+		WHERE id IN (
+			SELECT id FROM scheduled_messages
+			WHERE deliver_at <= ?2 AND claimed_until <= ?2
+			ORDER BY deliver_at
+			LIMIT ?3
+		)
+		RETURNING id, topic, message_id, data, headers, deliver_at`,
+		now.Add(claimFor).UnixNano(), now.UnixNano(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("claiming due messages: %w", err)
+	}
+	defer rows.Close()
+
+	var due []ScheduledMessage
+	for rows.Next() {
+		var msg ScheduledMessage
+		var headers string
+		var deliverAt int64
+		if err := rows.Scan(&msg.ID, &msg.Topic, &msg.Message.ID, &msg.Message.Data, &headers, &deliverAt); err != nil {
+			return nil, fmt.Errorf("scanning scheduled message: %w", err)
+		}
+		if err := json.Unmarshal([]byte(headers), &msg.Message.Headers); err != nil {
+			return nil, fmt.Errorf("decoding headers of %s: %w", msg.ID, err)
+		}
+		msg.DeliverAt = time.Unix(0, deliverAt)
+		due = append(due, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("claiming due messages: %w", err)
+	}
+
+	// RETURNING does not keep the subquery's order
+	sort.Slice(due, func(i, j int) bool { return due[i].DeliverAt.Before(due[j].DeliverAt) })
+	return due, nil
+}
+
+func (s *SQLiteScheduleStore) Release(ctx context.Context, id string) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM scheduled_messages WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("releasing scheduled message: %w", err)
+	}
+	return nil
+}
+
+// NextDue skips claimed messages until their claim expires, so a failed
+// publish does not make the dispatcher spin
+func (s *SQLiteScheduleStore) NextDue(ctx context.Context) (time.Time, bool, error) {
+	var next sql.NullInt64
+	err := s.db.QueryRowContext(ctx, `SELECT MIN(MAX(deliver_at, claimed_until)) FROM scheduled_messages`).Scan(&next)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("reading next delivery time: %w", err)
+	}
+	if !next.Valid {
+		return time.Time{}, false, nil
+	}
+	return time.Unix(0, next.Int64), true, nil
+}
+
+// SchedulerConfig configures a Scheduler
+type SchedulerConfig struct {
+	// PollInterval bounds how long messages scheduled by other processes
+	// wait past their delivery time
+	PollInterval time.Duration
+	// ClaimTimeout is how long a claimed message stays hidden; a failed
+	// publish is retried once it expires
+	ClaimTimeout time.Duration
+	BatchSize    int
+}
+
+// Scheduler publishes messages to a broker at a later time. Messages wait
+// in the store until Run's dispatcher releases them, so they are delivered
+// at least once even if the process restarts in between.
+type Scheduler struct {
+	store   ScheduleStore
+	broker  MessageBroker
+	config  SchedulerConfig
+	logger  Logger
+	metrics MetricsRecorder
+	wake    chan struct{}
+}
+
+func NewScheduler(store ScheduleStore, broker MessageBroker, config SchedulerConfig) *Scheduler {
+	if config.PollInterval <= 0 {
+		config.PollInterval = time.Second
+	}
+	if config.ClaimTimeout <= 0 {
+		config.ClaimTimeout = 30 * time.Second
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 100
+	}
+	return &Scheduler{
+		store:   store,
+		broker:  broker,
+		config:  config,
+		logger:  &SimpleLogger{},
+		metrics: &SimpleMetrics{},
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// PublishAt stores msg for delivery to topic at the given time and returns
+// the ID to cancel it with. The trace context of ctx is kept, so the
+// delivery continues the caller's trace.
+func (s *Scheduler) PublishAt(ctx context.Context, topic string, msg Message, at time.Time) (string, error) {
+	scheduled := ScheduledMessage{
+		ID:        uuid.New().String(),
+		Topic:     topic,
+		Message:   Message{ID: msg.ID, Data: msg.Data, Headers: withTraceContext(ctx, msg.Headers)},
+		DeliverAt: at,
+	}
+	if err := s.store.Add(ctx, scheduled); err != nil {
+		return "", fmt.Errorf("scheduling message: %w", err)
+	}
+	s.metrics.IncCounter("messages_scheduled", "topic", topic)
+
+	// The dispatcher may be sleeping until a later message is due
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return scheduled.ID, nil
+}
+
+func (s *Scheduler) PublishAfter(ctx context.Context, topic string, msg Message, delay time.Duration) (string, error) {
+	return s.PublishAt(ctx, topic, msg, time.Now().Add(delay))
+}
+
+// Cancel drops a scheduled message. It returns ErrScheduledMessageNotFound
+// once the message was published and ErrScheduledMessageInFlight while a
+// dispatcher is publishing it.
+func (s *Scheduler) Cancel(ctx context.Context, id string) error {
+	if err := s.store.Cancel(ctx, id); err != nil {
+		return err
+	}
+	s.metrics.IncCounter("scheduled_messages_canceled")
+	return nil
+}
+
+// Run releases due messages until ctx is canceled. Several dispatchers may
+// share a store; claims keep them from publishing the same message twice.
+func (s *Scheduler) Run(ctx context.Context) error {
+	for {
+		if err := s.dispatchDue(ctx); err != nil && ctx.Err() == nil {
+			s.logger.Error("Failed to dispatch scheduled messages: %v", err)
+		}
+
+		wait := s.config.PollInterval
+		if next, ok, err := s.store.NextDue(ctx); err == nil && ok {
+			if until := time.Until(next); until < wait {
+				wait = max(until, 0)
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-s.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func (s *Scheduler) dispatchDue(ctx context.Context) error {
+	for {
+		due, err := s.store.Claim(ctx, time.Now(), s.config.ClaimTimeout, s.config.BatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range due {
+			// Publish under the trace the message was scheduled in
+			publishCtx := extractTraceContext(ctx, msg.Message.Headers)
+			if err := s.broker.Publish(publishCtx, msg.Topic, msg.Message); err != nil {
+				// The claim expires and the message is retried
+				s.metrics.IncCounter("scheduled_message_publish_errors", "topic", msg.Topic)
+				s.logger.Error("Failed to publish scheduled message %s: %v", msg.ID, err)
+				continue
+			}
+			if err := s.store.Release(ctx, msg.ID); err != nil {
+				// Published but still stored: it goes out again after the claim
+				s.logger.Error("Failed to release scheduled message %s: %v", msg.ID, err)
+				continue
+			}
+			s.metrics.ObserveLatency("scheduled_message_delay", time.Since(msg.DeliverAt), "topic", msg.Topic)
+		}
+
+		if len(due) < s.config.BatchSize {
+			return nil
+		}
+	}
+}
+
+// Request-reply headers
+const (
+	correlationIDHeader = "correlation_id"
+	replyToHeader       = "reply_to"
+	deadlineHeader      = "deadline"
+	replyErrorHeader    = "reply_error"
+)
+
+// RemoteError is the error a request handler returned, passed back to
+// the caller
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote: " + e.Message
+}
+
+// Requester sends requests over a MessageBroker and waits for the replies.
+// Replies come back on a topic of its own, and are matched to waiting
+// callers by correlation ID. Replies that arrive after their caller gave
+// up are dropped.
+type Requester struct {
+	broker     MessageBroker
+	replyTopic string
+	logger     Logger
+	metrics    MetricsRecorder
+
+	mu      sync.Mutex
+	pending map[string]chan Message
+}
+
+// NewRequester subscribes to a new reply topic until ctx is canceled. The
+// topic is created first if the broker is a TopicCreator, so no reply
+// published before the subscription starts is lost, and deleted afterwards
+// if it is a TopicDeleter. A GroupBroker subscribes in a consumer group
+// named after the topic, so requesters never share a group.
+func NewRequester(ctx context.Context, broker MessageBroker) (*Requester, error) {
+	r := &Requester{
+		broker:     broker,
+		replyTopic: "replies." + uuid.New().String(),
+		logger:     &SimpleLogger{},
+		metrics:    &SimpleMetrics{},
+		pending:    make(map[string]chan Message),
+	}
+	if creator, ok := broker.(TopicCreator); ok {
+		if err := creator.CreateTopic(r.replyTopic, 1); err != nil {
+			return nil, fmt.Errorf("creating reply topic: %w", err)
+		}
+	}
+
+	subscriber := broker
+	if grouper, ok := broker.(GroupBroker); ok {
+		subscriber = grouper.Group(r.replyTopic)
+	}
+	if err := subscriber.Subscribe(ctx, r.replyTopic, r.handleReply); err != nil {
+		return nil, fmt.Errorf("subscribing to replies: %w", err)
+	}
+
+	if deleter, ok := broker.(TopicDeleter); ok {
+		go func() {
+			<-ctx.Done()
+			if err := deleter.DeleteTopic(r.replyTopic); err != nil {
+				r.logger.Error("Failed to delete reply topic %s: %v", r.replyTopic, err)
+			}
+		}()
+	}
+	return r, nil
+}
+
+// Request publishes msg to topic and returns the reply. The deadline of
+// ctx goes with the request, so handlers skip requests nobody waits for.
+func (r *Requester) Request(ctx context.Context, topic string, msg Message) (Message, error) {
+	correlationID := uuid.New().String()
+	reply := make(chan Message, 1)
+
+	r.mu.Lock()
+	r.pending[correlationID] = reply
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, correlationID)
+		r.mu.Unlock()
+	}()
+
+	headers := make(map[string]string, len(msg.Headers)+3)
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+	headers[correlationIDHeader] = correlationID
+	headers[replyToHeader] = r.replyTopic
+	if deadline, ok := ctx.Deadline(); ok {
+		headers[deadlineHeader] = deadline.Format(time.RFC3339Nano)
+	}
+
+	if err := r.broker.Publish(ctx, topic, Message{ID: msg.ID, Data: msg.Data, Headers: headers}); err != nil {
+		return Message{}, fmt.Errorf("sending request: %w", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		r.metrics.IncCounter("request_timeouts", "topic", topic)
+		return Message{}, fmt.Errorf("waiting for reply: %w", ctx.Err())
+	case msg := <-reply:
+		if remote, ok := msg.Headers[replyErrorHeader]; ok {
+			return msg, &RemoteError{Message: remote}
+		}
+		return msg, nil
+	}
+}
+
+func (r *Requester) handleReply(ctx context.Context, msg Message) error {
+	correlationID := msg.Headers[correlationIDHeader]
+
+	r.mu.Lock()
+	reply, ok := r.pending[correlationID]
+	delete(r.pending, correlationID)
+	r.mu.Unlock()
+
+	if !ok {
+		// The caller timed out, or this is a redelivered duplicate
+		r.metrics.IncCounter("late_replies", "topic", r.replyTopic)
+		r.logger.Info("Dropping reply %s nobody waits for", correlationID)
+		return nil
+	}
+	reply <- msg
+	return nil
+}
+
+// RequestHandler answers a request with the data of the reply
+type RequestHandler func(ctx context.Context, msg Message) ([]byte, error)
+
+// ServeRequests subscribes handler to topic and publishes its answers to
+// each request's reply topic. Handler errors are sent back as RemoteError;
+// requests past their deadline are skipped.
+func ServeRequests(ctx context.Context, broker MessageBroker, topic string, handler RequestHandler) error {
+	logger := &SimpleLogger{}
+	return broker.Subscribe(ctx, topic, func(ctx context.Context, msg Message) error {
+		replyTo := msg.Headers[replyToHeader]
+		correlationID := msg.Headers[correlationIDHeader]
+		if replyTo == "" || correlationID == "" {
+			logger.Error("Dropping request %s without reply topic or correlation ID", msg.ID)
+			return nil
+		}
+
+		handlerCtx := ctx
+		if value, ok := msg.Headers[deadlineHeader]; ok {
+			if deadline, err := time.Parse(time.RFC3339Nano, value); err == nil {
+				if time.Now().After(deadline) {
+					logger.Info("Skipping request %s past its deadline", correlationID)
+					return nil
+				}
+				var cancel context.CancelFunc
+				handlerCtx, cancel = context.WithDeadline(ctx, deadline)
+				defer cancel()
+			}
+		}
+
+		data, err := handler(handlerCtx, msg)
+		headers := map[string]string{correlationIDHeader: correlationID}
+		if err != nil {
+			headers[replyErrorHeader] = err.Error()
+		}
+
+		// An error here makes the broker redeliver the request
+		return broker.Publish(ctx, replyTo, Message{ID: correlationID, Data: data, Headers: headers})
+	})
+}
+
+// linkLogger is a span processor that logs which producer span each
+// consumer span links to
+type linkLogger struct{}
+
+func (linkLogger) OnStart(ctx context.Context, span sdktrace.ReadWriteSpan) {}
+
+func (linkLogger) OnEnd(span sdktrace.ReadOnlySpan) {
+	if span.SpanKind() == trace.SpanKindConsumer && len(span.Links()) > 0 {
+		log.Printf("span %q %s linked to producer span %s", span.Name(), span.SpanContext().SpanID(), span.Links()[0].SpanContext.SpanID())
+	}
+}
+
+func (linkLogger) Shutdown(ctx context.Context) error { return nil }
+
+func (linkLogger) ForceFlush(ctx context.Context) error { return nil }
+
+// runInMemoryDemo shows keyed partitioning, two consumer groups and
+// redelivery without a Kafka broker
+func runInMemoryDemo() {
+	broker := NewInMemoryBroker(InMemoryBrokerConfig{Partitions: 3, MaxDeliveries: 3})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(linkLogger{}))
+	defer provider.Shutdown(context.Background())
+	tracer := provider.Tracer("example")
+	broker.SetTracer(tracer)
+
+	var mu sync.Mutex
+	received := make(map[string][]string)
+	failedOnce := false
+	handler := func(group string) MessageHandler {
+		return func(ctx context.Context, msg Message) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if group == "audit" && !failedOnce {
+				failedOnce = true
+				return errors.New("temporary failure")
+			}
+			received[group] = append(received[group], string(msg.Data))
+			log.Printf("%s received %s (trace %s, tenant %s)", group, msg.Data,
+				trace.SpanContextFromContext(ctx).TraceID(), baggage.FromContext(ctx).Member("tenant").Value())
+			return nil
+		}
+	}
+
+	// Two members share the default group, the audit group gets everything too
+	broker.Subscribe(ctx, "orders", handler("billing"))
+	broker.Subscribe(ctx, "orders", handler("billing"))
+	broker.Group("audit").Subscribe(ctx, "orders", handler("audit"))
+
+	// Consumers see the trace and baggage of the code that published
+	tenant, _ := baggage.NewMember("tenant", "acme")
+	bag, _ := baggage.New(tenant)
+	publishCtx, span := tracer.Start(baggage.ContextWithBaggage(ctx, bag), "place orders")
+	for i := 0; i < 3; i++ {
+		for _, order := range []string{"order-1", "order-2"} {
+			msg := Message{ID: order, Data: []byte(fmt.Sprintf("%s event %d", order, i))}
+			if err := broker.Publish(publishCtx, "orders", msg); err != nil {
+				log.Fatalf("Failed to publish message: %v", err)
+			}
+		}
+	}
+	span.End()
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+	if err := broker.WaitIdle(waitCtx); err != nil {
+		log.Fatalf("Consumers did not catch up: %v", err)
+	}
+
+	groups := make([]string, 0, len(received))
+	for group := range received {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		log.Printf("%s got %d messages", group, len(received[group]))
+	}
+
+	runSchedulerDemo(ctx, broker)
+	runRequestReplyDemo(ctx, broker)
+}
+
+// runRequestReplyDemo asks a price service for quotes, once in time and
+// once with a deadline the service cannot meet
+func runRequestReplyDemo(ctx context.Context, broker MessageBroker) {
+	err := ServeRequests(ctx, broker, "prices", func(ctx context.Context, msg Message) ([]byte, error) {
+		if string(msg.Data) == "slow-item" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		if string(msg.Data) == "unknown-item" {
+			return nil, errors.New("no such item")
+		}
+		return []byte(fmt.Sprintf("%s costs 42", msg.Data)), nil
+	})
+	if err != nil {
+		log.Fatalf("Failed to serve requests: %v", err)
+	}
+
+	requester, err := NewRequester(ctx, broker)
+	if err != nil {
+		log.Fatalf("Failed to create requester: %v", err)
+	}
+
+	for _, item := range []string{"book", "unknown-item", "slow-item"} {
+		reqCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		reply, err := requester.Request(reqCtx, "prices", Message{ID: item, Data: []byte(item)})
+		cancel()
+
+		var remote *RemoteError
+		switch {
+		case errors.As(err, &remote):
+			log.Printf("Price request for %s failed remotely: %s", item, remote.Message)
+		case errors.Is(err, context.DeadlineExceeded):
+			log.Printf("Price request for %s timed out", item)
+		case err != nil:
+			log.Fatalf("Price request failed: %v", err)
+		default:
+			log.Printf("Price reply: %s", reply.Data)
+		}
+	}
+
+	// Let the late reply to the slow request arrive and be dropped
+	time.Sleep(200 * time.Millisecond)
+}
+
+// runSchedulerDemo delays one reminder and cancels another
+func runSchedulerDemo(ctx context.Context, broker MessageBroker) {
+	dir, err := os.MkdirTemp("", "scheduler")
+	if err != nil {
+		log.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := sql.Open("sqlite3", dir+"/scheduler.db?_busy_timeout=5000")
+	if err != nil {
+		log.Fatalf("Failed to open scheduler database: %v", err)
+	}
+	defer db.Close()
+
+	store, err := NewSQLiteScheduleStore(ctx, db)
+	if err != nil {
+		log.Fatalf("Failed to set up scheduler store: %v", err)
+	}
+	scheduler := NewScheduler(store, broker, SchedulerConfig{PollInterval: 100 * time.Millisecond})
+	runCtx, stop := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		scheduler.Run(runCtx)
+	}()
+	defer func() {
+		stop()
+		<-stopped
+	}()
+
+	reminders := make(chan string, 2)
+	broker.Subscribe(ctx, "reminders", func(ctx context.Context, msg Message) error {
+		reminders <- string(msg.Data)
+		return nil
+	})
+
+	start := time.Now()
+	if _, err := scheduler.PublishAfter(ctx, "reminders", Message{ID: "user-1", Data: []byte("your cart is waiting")}, 300*time.Millisecond); err != nil {
+		log.Fatalf("Failed to schedule reminder: %v", err)
+	}
+	canceled, err := scheduler.PublishAfter(ctx, "reminders", Message{ID: "user-2", Data: []byte("never sent")}, 100*time.Millisecond)
+	if err != nil {
+		log.Fatalf("Failed to schedule reminder: %v", err)
+	}
+	if err := scheduler.Cancel(ctx, canceled); err != nil {
+		log.Fatalf("Failed to cancel reminder: %v", err)
+	}
+
+	select {
+	case reminder := <-reminders:
+		log.Printf("Reminder %q delivered after %v", reminder, time.Since(start).Round(10*time.Millisecond))
+	case <-time.After(5 * time.Second):
+		log.Fatalf("Reminder was not delivered")
+	}
+}
+
+// Tests of the in-memory broker's partitioning, consumer groups and
+// redelivery
+func TestInMemoryBroker(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("rejects topics without partitions", func(t *testing.T) {
+		broker := NewInMemoryBroker(InMemoryBrokerConfig{})
+		for _, partitions := range []int{0, -1} {
+			if err := broker.CreateTopic("orders", partitions); err == nil {
+				t.Errorf("CreateTopic(%d) succeeded, want error", partitions)
+			}
+		}
+		if err := broker.CreateTopic("orders", 3); err != nil {
+			t.Fatalf("CreateTopic(3) error = %v", err)
+		}
+		if err := broker.CreateTopic("orders", 3); err == nil {
+			t.Error("creating an existing topic succeeded, want error")
+		}
+	})
+
+	t.Run("keys stick to their partition in order", func(t *testing.T) {
+		broker := NewInMemoryBroker(InMemoryBrokerConfig{Partitions: 4})
+		for i := 0; i < 3; i++ {
+			for _, key := range []string{"a", "b", "c"} {
+				msg := Message{ID: key, Data: []byte(fmt.Sprint(i))}
+				if err := broker.Publish(ctx, "orders", msg); err != nil {
+					t.Fatalf("Publish() error = %v", err)
+				}
+			}
+		}
+
+		for _, key := range []string{"a", "b", "c"} {
+			var got []string
+			for _, msg := range broker.Messages("orders", broker.Partition("orders", key)) {
+				if msg.ID == key {
+					got = append(got, string(msg.Data))
+				}
+			}
+			if fmt.Sprint(got) != "[0 1 2]" {
+				t.Errorf("messages of key %s = %v, want [0 1 2]", key, got)
+			}
+		}
+	})
+
+	t.Run("groups consume independently and members share partitions", func(t *testing.T) {
+		broker := NewInMemoryBroker(InMemoryBrokerConfig{Partitions: 2})
+		subCtx, stop := context.WithCancel(ctx)
+		defer stop()
+
+		var mu sync.Mutex
+		received := make(map[string]int)
+		count := func(name string) MessageHandler {
+			return func(ctx context.Context, msg Message) error {
+				mu.Lock()
+				defer mu.Unlock()
+				received[name]++
+				return nil
+			}
+		}
+		billing := broker.Group("billing")
+		for _, name := range []string{"billing-1", "billing-2"} {
+			if err := billing.Subscribe(subCtx, "orders", count(name)); err != nil {
+				t.Fatalf("Subscribe() error = %v", err)
+			}
+		}
+		if err := broker.Group("audit").Subscribe(subCtx, "orders", count("audit")); err != nil {
+			t.Fatalf("Subscribe() error = %v", err)
+		}
+
+		for i := 0; i < 20; i++ {
+			if err := broker.Publish(ctx, "orders", Message{ID: fmt.Sprintf("order-%d", i)}); err != nil {
+				t.Fatalf("Publish() error = %v", err)
+			}
+		}
+		if err := broker.WaitIdle(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if received["audit"] != 20 {
+			t.Errorf("audit received %d messages, want 20", received["audit"])
+		}
+		if received["billing-1"]+received["billing-2"] != 20 {
+			t.Errorf("billing received %d messages, want 20", received["billing-1"]+received["billing-2"])
+		}
+		for p := 0; p < 2; p++ {
+			if want := int64(len(broker.Messages("orders", p))); broker.Committed("orders", "billing", p) != want {
+				t.Errorf("billing committed %d on partition %d, want %d", broker.Committed("orders", "billing", p), p, want)
+			}
+		}
+	})
+
+	t.Run("failed messages are redelivered before later ones", func(t *testing.T) {
+		broker := NewInMemoryBroker(InMemoryBrokerConfig{MaxDeliveries: 3})
+		subCtx, stop := context.WithCancel(ctx)
+		defer stop()
+
+		var mu sync.Mutex
+		var seen []string
+		err := broker.Subscribe(subCtx, "orders", func(ctx context.Context, msg Message) error {
+			mu.Lock()
+			defer mu.Unlock()
+			seen = append(seen, msg.ID)
+			if msg.ID == "poison" || (msg.ID == "flaky" && len(seen) == 1) {
+				return errors.New("handler failed")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Subscribe() error = %v", err)
+		}
+
+		for _, id := range []string{"flaky", "poison", "last"} {
+			if err := broker.Publish(ctx, "orders", Message{ID: id}); err != nil {
+				t.Fatalf("Publish() error = %v", err)
+			}
+		}
+		if err := broker.WaitIdle(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		// flaky succeeds on its second try, poison is skipped after three
+		want := "[flaky flaky poison poison poison last]"
+		if fmt.Sprint(seen) != want {
+			t.Errorf("deliveries = %v, want %s", seen, want)
+		}
+	})
+
+	t.Run("requesters delete their reply topic when done", func(t *testing.T) {
+		broker := NewInMemoryBroker(InMemoryBrokerConfig{})
+		reqCtx, stop := context.WithCancel(ctx)
+		requester, err := NewRequester(reqCtx, broker)
+		if err != nil {
+			t.Fatalf("NewRequester() error = %v", err)
+		}
+		hasTopic := func() bool {
+			broker.mu.Lock()
+			defer broker.mu.Unlock()
+			_, ok := broker.topics[requester.replyTopic]
+			return ok
+		}
+		if !hasTopic() {
+			t.Fatal("reply topic missing while the requester is running")
+		}
+
+		stop()
+		for hasTopic() {
+			select {
+			case <-ctx.Done():
+				t.Fatal("reply topic not deleted after the requester stopped")
+			case <-time.After(time.Millisecond):
+			}
+		}
+	})
+
+	t.Run("requesters consume replies in a group of their own", func(t *testing.T) {
+		broker := NewInMemoryBroker(InMemoryBrokerConfig{})
+		first, err := NewRequester(ctx, broker)
+		if err != nil {
+			t.Fatalf("NewRequester() error = %v", err)
+		}
+		second, err := NewRequester(ctx, broker)
+		if err != nil {
+			t.Fatalf("NewRequester() error = %v", err)
+		}
+
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+		for _, requester := range []*Requester{first, second} {
+			topic := broker.topics[requester.replyTopic]
+			if _, ok := topic.groups[requester.replyTopic]; !ok || len(topic.groups) != 1 {
+				t.Errorf("groups of %s = %v, want only the topic's own", requester.replyTopic, topic.groups)
+			}
+		}
+	})
+}
+
 func main() {
+	if os.Getenv("BROKER") == "memory" {
+		runInMemoryDemo()
+		return
+	}
 	kafkaURL := "localhost:9092"
 	topicName := "example-topic"
 
@@ -226,11 +1614,7 @@ func main() {
 	broker := NewKafkaBroker(kafkaURL)
 
 	// Create a context with tracing
-	ctx := context.WithValue(context.Background(), "trace", &trace{
-		spanContext: traceSpanContext{
-			TraceID: uuid.New(),
-		},
-	})
+	ctx, span := broker.tracer.Start(context.Background(), "example")
 
 	// Example message
 	msg := Message{
@@ -242,6 +1626,7 @@ func main() {
 	if err := broker.Publish(ctx, topicName, msg); err != nil {
 		log.Fatalf("Failed to publish message: %v", err)
 	}
+	span.End()
 
 	// Subscribe example
 	if err := broker.Subscribe(ctx, topicName, func(ctx context.Context, msg Message) error {
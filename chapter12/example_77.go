@@ -9,20 +9,6 @@ import (
 	"time"
 )
 
-// State represents the state of the circuit breaker
-type State int
-
-const (
-	StateClosed   State = iota // Circuit is closed and requests are allowed
-	StateOpen                  // Circuit is open and requests are blocked
-	StateHalfOpen              // Circuit is half-open, allowing a test request
-)
-
-// Errors
-var (
-	ErrCircuitOpen = errors.New("circuit breaker is open")
-)
-
 // MetricsRecorder interface for recording metrics
 type MetricsRecorder interface {
 	IncCounter(name string, labels ...string)
@@ -49,98 +35,389 @@ func (sl *SimpleLogger) Warn(msg string, keyvals ...interface{}) {
 	fmt.Printf("WARNING: %s, %v\n", msg, keyvals)
 }
 
-// CircuitBreaker implementation
-type CircuitBreaker struct {
-	name         string
-	maxFailures  int
-	resetTimeout time.Duration
-	failureCount int64
-	lastFailure  time.Time
-	state        State
-	metrics      MetricsRecorder
-	mutex        sync.RWMutex
+// State represents the state of the circuit breaker
+type State int
+
+const (
+	StateClosed   State = iota // Calls are allowed and recorded in the window
+	StateOpen                  // Calls are rejected until OpenTimeout has passed
+	StateHalfOpen              // A limited number of probe calls are allowed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// WindowType is the kind of sliding window the failure rate is taken over
+type WindowType int
+
+const (
+	// CountWindow holds the outcomes of the last WindowSize calls
+	CountWindow WindowType = iota
+	// TimeWindow holds the outcomes of whatever calls were made in the
+	// last WindowDuration
+	TimeWindow
+)
+
+// BreakerConfig configures a CircuitBreaker. FailureRateThreshold and
+// SlowCallRateThreshold are fractions; leaving either SlowCallDuration or
+// SlowCallRateThreshold at zero ignores how long calls take.
+type BreakerConfig[T any] struct {
+	Name           string
+	WindowType     WindowType
+	WindowSize     int
+	WindowDuration time.Duration
+	// MinimumCalls is the least number of calls in the window for the
+	// rates to be trusted; with fewer, the breaker stays closed however
+	// many of them failed. For count windows it never exceeds WindowSize.
+	MinimumCalls          int
+	FailureRateThreshold  float64
+	SlowCallDuration      time.Duration
+	SlowCallRateThreshold float64
+	// OpenTimeout is how long calls are rejected before probing starts
+	OpenTimeout time.Duration
+	// HalfOpenProbes is the number of trial calls made while half-open.
+	// The breaker decides on closing only after every one has finished.
+	HalfOpenProbes int
+	// HalfOpenMaxWait reopens the breaker when the probes have not all
+	// finished by then; without it one probe that never returns would
+	// keep rejecting everything else. Zero means OpenTimeout.
+	HalfOpenMaxWait time.Duration
+	// IsFailure lets a result count as failed even without an error; the
+	// default looks at the error only
+	IsFailure func(result T, err error) bool
+	// OnStateChange must not use the breaker: it runs under the
+	// breaker's mutex
+	OnStateChange func(name string, from, to State)
 }
 
-// NewCircuitBreaker creates a new circuit breaker
-func NewCircuitBreaker(name string, maxFailures int, resetTimeout time.Duration, metrics MetricsRecorder) *CircuitBreaker {
-	return &CircuitBreaker{
-		name:         name,
-		maxFailures:  maxFailures,
-		resetTimeout: resetTimeout,
-		state:        StateClosed,
-		metrics:      metrics,
+// CircuitBreaker guards an operation by failing fast once too many recent
+// calls failed or were slow. T is whatever the operation returns besides
+// its error; Run covers operations that only return an error.
+type CircuitBreaker[T any] struct {
+	config BreakerConfig[T]
+
+	mu        sync.Mutex
+	state     State
+	changedAt time.Time
+	window    slidingWindow
+	// generation tells afterCall whether the state changed while a call
+	// was running, in which case its outcome is dropped
+	generation uint64
+	probes     int
+	probeStats WindowStats
+}
+
+func NewCircuitBreaker[T any](config BreakerConfig[T]) *CircuitBreaker[T] {
+	if config.WindowSize <= 0 {
+		config.WindowSize = 100
+	}
+	if config.WindowDuration <= 0 {
+		config.WindowDuration = time.Minute
 	}
+	if config.MinimumCalls <= 0 {
+		config.MinimumCalls = 10
+	}
+	if config.WindowType == CountWindow && config.MinimumCalls > config.WindowSize {
+		config.MinimumCalls = config.WindowSize
+	}
+	if config.FailureRateThreshold <= 0 {
+		config.FailureRateThreshold = 0.5
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = 30 * time.Second
+	}
+	if config.HalfOpenProbes <= 0 {
+		config.HalfOpenProbes = 1
+	}
+	if config.HalfOpenMaxWait <= 0 {
+		config.HalfOpenMaxWait = config.OpenTimeout
+	}
+	if config.IsFailure == nil {
+		config.IsFailure = func(_ T, err error) bool { return err != nil }
+	}
+
+	cb := &CircuitBreaker[T]{config: config}
+	if config.WindowType == TimeWindow {
+		cb.window = newTimeWindow(config.WindowDuration)
+	} else {
+		cb.window = newCountWindow(config.WindowSize)
+	}
+	return cb
 }
 
-func (cb *CircuitBreaker) allowRequest() bool {
-	cb.mutex.RLock()
-	defer cb.mutex.RUnlock()
+// Execute fails with ErrCircuitOpen while the breaker is open. Otherwise
+// it calls operation and feeds the outcome into the window.
+func (cb *CircuitBreaker[T]) Execute(operation func() (T, error)) (T, error) {
+	generation, err := cb.beforeCall()
+	if err != nil {
+		var zero T
+		return zero, err
+	}
 
-	if cb.state == StateClosed {
-		return true
+	start := time.Now()
+	completed := false
+	defer func() {
+		// Only a panic gets here without completed set; it counts as a
+		// failure
+		if !completed {
+			cb.afterCall(generation, true, time.Since(start))
+		}
+	}()
+
+	result, err := operation()
+	completed = true
+	cb.afterCall(generation, cb.config.IsFailure(result, err), time.Since(start))
+	return result, err
+}
+
+// Run is the Execute variant for func() error
+func (cb *CircuitBreaker[T]) Run(operation func() error) error {
+	_, err := cb.Execute(func() (T, error) {
+		var zero T
+		return zero, operation()
+	})
+	return err
+}
+
+func (cb *CircuitBreaker[T]) State() State {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.currentState(time.Now())
+}
+
+// Stats reports the calls, failures and slow calls in the window
+func (cb *CircuitBreaker[T]) Stats() WindowStats {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.window.stats(time.Now())
+}
+
+// currentState catches up on timeouts: OpenTimeout turns open into
+// half-open, and HalfOpenMaxWait turns half-open with unfinished probes
+// back into open. Callers hold cb.mu.
+func (cb *CircuitBreaker[T]) currentState(now time.Time) State {
+	elapsed := now.Sub(cb.changedAt)
+	switch {
+	case cb.state == StateOpen && elapsed >= cb.config.OpenTimeout:
+		cb.setState(StateHalfOpen, now)
+	case cb.state == StateHalfOpen && elapsed >= cb.config.HalfOpenMaxWait &&
+		cb.probes > cb.probeStats.Calls:
+		cb.setState(StateOpen, now)
 	}
+	return cb.state
+}
+
+func (cb *CircuitBreaker[T]) beforeCall() (uint64, error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
 
-	if cb.state == StateOpen {
-		// Check if reset timeout has elapsed
-		if time.Since(cb.lastFailure) > cb.resetTimeout {
-			// Transition to half-open state
-			cb.mutex.RUnlock()
-			cb.mutex.Lock()
-			cb.state = StateHalfOpen
-			cb.mutex.Unlock()
-			cb.mutex.RLock()
-			return true
+	switch cb.currentState(time.Now()) {
+	case StateOpen:
+		return 0, fmt.Errorf("%s: %w", cb.config.Name, ErrCircuitOpen)
+	case StateHalfOpen:
+		if cb.probes >= cb.config.HalfOpenProbes {
+			return 0, fmt.Errorf("%s: %w", cb.config.Name, ErrCircuitOpen)
 		}
-		return false
+		cb.probes++
 	}
+	return cb.generation, nil
+}
+
+func (cb *CircuitBreaker[T]) afterCall(generation uint64, failed bool, duration time.Duration) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if generation != cb.generation {
+		return
+	}
+	now := time.Now()
+	slow := cb.config.SlowCallDuration > 0 && duration >= cb.config.SlowCallDuration
+
+	switch cb.state {
+	case StateClosed:
+		cb.window.record(now, failed, slow)
+		if stats := cb.window.stats(now); stats.Calls >= cb.config.MinimumCalls && cb.exceeded(stats) {
+			cb.setState(StateOpen, now)
+		}
+	case StateHalfOpen:
+		cb.probeStats.add(failed, slow)
+		if cb.probeStats.Calls < cb.config.HalfOpenProbes {
+			return
+		}
+		if cb.exceeded(cb.probeStats) {
+			cb.setState(StateOpen, now)
+		} else {
+			cb.setState(StateClosed, now)
+		}
+	}
+}
+
+func (cb *CircuitBreaker[T]) exceeded(stats WindowStats) bool {
+	if stats.FailureRate() >= cb.config.FailureRateThreshold {
+		return true
+	}
+	return cb.config.SlowCallRateThreshold > 0 && cb.config.SlowCallDuration > 0 &&
+		stats.SlowCallRate() >= cb.config.SlowCallRateThreshold
+}
+
+// setState switches state and forgets everything recorded under the old
+// one. Callers hold cb.mu.
+func (cb *CircuitBreaker[T]) setState(state State, now time.Time) {
+	from := cb.state
+	cb.state = state
+	cb.changedAt = now
+	cb.generation++
+	cb.probes = 0
+	cb.probeStats = WindowStats{}
+	cb.window.reset()
+	if cb.config.OnStateChange != nil {
+		cb.config.OnStateChange(cb.config.Name, from, state)
+	}
+}
 
-	// State is half-open, allow one test request
-	return true
+// WindowStats sums up the calls in a window
+type WindowStats struct {
+	Calls     int
+	Failures  int
+	SlowCalls int
 }
 
-func (cb *CircuitBreaker) recordFailure() {
-	cb.mutex.Lock()
-	defer cb.mutex.Unlock()
+func (s *WindowStats) add(failed, slow bool) {
+	s.Calls++
+	if failed {
+		s.Failures++
+	}
+	if slow {
+		s.SlowCalls++
+	}
+}
 
-	cb.failureCount++
-	cb.lastFailure = time.Now()
+func (s WindowStats) FailureRate() float64 {
+	if s.Calls == 0 {
+		return 0
+	}
+	return float64(s.Failures) / float64(s.Calls)
+}
 
-	if cb.state == StateHalfOpen || cb.failureCount >= int64(cb.maxFailures) {
-		cb.state = StateOpen
-		fmt.Printf("Circuit breaker '%s' has opened after %d failures\n", cb.name, cb.failureCount)
+func (s WindowStats) SlowCallRate() float64 {
+	if s.Calls == 0 {
+		return 0
 	}
+	return float64(s.SlowCalls) / float64(s.Calls)
+}
+
+type slidingWindow interface {
+	record(now time.Time, failed, slow bool)
+	stats(now time.Time) WindowStats
+	reset()
 }
 
-func (cb *CircuitBreaker) recordSuccess() {
-	cb.mutex.Lock()
-	defer cb.mutex.Unlock()
+type callOutcome struct {
+	failed bool
+	slow   bool
+}
+
+// countWindow is a fixed-size ring of outcomes whose totals are kept up
+// to date as outcomes enter and leave
+type countWindow struct {
+	outcomes []callOutcome
+	next     int
+	filled   bool
+	totals   WindowStats
+}
 
-	if cb.state == StateHalfOpen {
-		cb.state = StateClosed
-		cb.failureCount = 0
-		fmt.Printf("Circuit breaker '%s' has closed after successful test request\n", cb.name)
-	} else if cb.state == StateClosed && cb.failureCount > 0 {
-		cb.failureCount--
+func newCountWindow(size int) *countWindow {
+	return &countWindow{outcomes: make([]callOutcome, size)}
+}
+
+func (w *countWindow) record(_ time.Time, failed, slow bool) {
+	if w.filled {
+		// Overwriting the oldest outcome removes it from the totals
+		old := w.outcomes[w.next]
+		w.totals.Calls--
+		if old.failed {
+			w.totals.Failures--
+		}
+		if old.slow {
+			w.totals.SlowCalls--
+		}
+	}
+	w.outcomes[w.next] = callOutcome{failed: failed, slow: slow}
+	w.totals.add(failed, slow)
+	w.next = (w.next + 1) % len(w.outcomes)
+	if w.next == 0 {
+		w.filled = true
 	}
 }
 
-// Execute applies the circuit breaker pattern to the given operation
-func (cb *CircuitBreaker) Execute(operation func() error) error {
-	if !cb.allowRequest() {
-		cb.metrics.IncCounter("circuit_breaker_rejections", "name", cb.name)
-		fmt.Printf("Circuit breaker '%s' is open, rejecting request\n", cb.name)
-		return ErrCircuitOpen
+func (w *countWindow) stats(time.Time) WindowStats {
+	return w.totals
+}
+
+func (w *countWindow) reset() {
+	w.next, w.filled, w.totals = 0, false, WindowStats{}
+}
+
+// timeWindow keeps per-bucket totals instead of single outcomes, so a
+// burst of calls costs no extra memory
+type timeWindow struct {
+	width   time.Duration
+	buckets []timeBucket
+}
+
+type timeBucket struct {
+	epoch int64 // which width-long interval the bucket counts
+	stats WindowStats
+}
+
+const timeWindowBuckets = 10
+
+func newTimeWindow(duration time.Duration) *timeWindow {
+	width := duration / timeWindowBuckets
+	if width <= 0 {
+		width = 1
 	}
+	return &timeWindow{width: width, buckets: make([]timeBucket, timeWindowBuckets)}
+}
 
-	err := operation()
+func (w *timeWindow) record(now time.Time, failed, slow bool) {
+	epoch := now.UnixNano() / int64(w.width)
+	bucket := &w.buckets[epoch%int64(len(w.buckets))]
+	if bucket.epoch != epoch {
+		*bucket = timeBucket{epoch: epoch}
+	}
+	bucket.stats.add(failed, slow)
+}
 
-	if err != nil {
-		cb.recordFailure()
-		return err
+func (w *timeWindow) stats(now time.Time) WindowStats {
+	epoch := now.UnixNano() / int64(w.width)
+	var total WindowStats
+	for _, bucket := range w.buckets {
+		if epoch-bucket.epoch < int64(len(w.buckets)) {
+			total.Calls += bucket.stats.Calls
+			total.Failures += bucket.stats.Failures
+			total.SlowCalls += bucket.stats.SlowCalls
+		}
 	}
+	return total
+}
 
-	cb.recordSuccess()
-	return nil
+func (w *timeWindow) reset() {
+	for i := range w.buckets {
+		w.buckets[i] = timeBucket{}
+	}
 }
 
 // Fallback implementation
@@ -179,8 +456,18 @@ func main() {
 	metrics := &SimpleMetrics{}
 	logger := &SimpleLogger{}
 
-	// Create a circuit breaker with low threshold to demonstrate opening
-	cb := NewCircuitBreaker("service-a", 3, 5*time.Second, metrics)
+	// Create a circuit breaker that trips when half of the last calls failed,
+	// once there were at least three of them
+	cb := NewCircuitBreaker(BreakerConfig[struct{}]{
+		Name:           "service-a",
+		WindowSize:     10,
+		MinimumCalls:   3,
+		OpenTimeout:    5 * time.Second,
+		HalfOpenProbes: 2,
+		OnStateChange: func(name string, from, to State) {
+			fmt.Printf("Circuit breaker '%s' changed from %s to %s\n", name, from, to)
+		},
+	})
 
 	// Print initial state
 	fmt.Println("Circuit breaker created in CLOSED state")
@@ -204,16 +491,18 @@ func main() {
 	fmt.Println("Starting simulation...")
 	for i := 0; i < 10; i++ {
 		fmt.Printf("\nRequest %d:\n", i+1)
-		fmt.Printf("Circuit state before request: %v, Failure count: %d\n", cb.state, cb.failureCount)
+		stats := cb.Stats()
+		fmt.Printf("Circuit state before request: %v, failure rate: %.0f%% of %d calls\n", cb.State(), stats.FailureRate()*100, stats.Calls)
 
 		// Execute primary operation with circuit breaker protection
-		err := cb.Execute(func() error {
+		err := cb.Run(func() error {
 			// This simulates the primary service call
 			return errors.New("service unavailable")
 		})
 
 		if err != nil {
 			if errors.Is(err, ErrCircuitOpen) {
+				metrics.IncCounter("circuit_breaker_rejections", "name", "service-a")
 				fmt.Println("Circuit is open, request rejected")
 			} else {
 				// If circuit allowed the request but primary failed, use fallback